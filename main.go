@@ -19,6 +19,7 @@ package main
 import (
 	"github.com/appscodelabs/gh-ci-webhook/pkg/cmds"
 	_ "github.com/appscodelabs/gh-ci-webhook/pkg/providers/registry"
+	"github.com/appscodelabs/gh-ci-webhook/pkg/secrets"
 
 	"gomodules.xyz/logs"
 )
@@ -30,6 +31,13 @@ func main() {
 }
 
 func realMain() error {
+	// redact secrets from stdout, stderr and logs
+	restore, err := secrets.RedirectOutput()
+	if err != nil {
+		return err
+	}
+	defer restore()
+
 	logs.InitLogs()
 	defer logs.FlushLogs()
 
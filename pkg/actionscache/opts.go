@@ -0,0 +1,103 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package actionscache
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/appscodelabs/gh-ci-webhook/pkg/netacl"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	StorageDisk = "disk"
+	StorageNATS = "nats"
+)
+
+type Options struct {
+	// Addr is the listen address of the actions cache service, disabled if empty
+	Addr string `json:"addr,omitempty"`
+	// Storage is where cache entries are stored, disk or nats (object store)
+	Storage string `json:"storage,omitempty"`
+	// Dir stores cache entries with disk storage and uploads in progress
+	Dir string `json:"dir,omitempty"`
+	// MaxSize bounds the size of all cache entries
+	MaxSize resource.QuantityValue `json:"maxSize,omitempty"`
+	// MaxRepoSize bounds the size of the cache entries of a repository
+	MaxRepoSize resource.QuantityValue `json:"maxRepoSize,omitempty"`
+	// MaxAge evicts cache entries not used for this long
+	MaxAge metav1.Duration `json:"maxAge,omitempty"`
+	// AllowedNetworks are the client networks allowed to use the cache,
+	// the networks of the VMs if empty
+	AllowedNetworks []string `json:"allowedNetworks,omitempty"`
+}
+
+func NewOptions() *Options {
+	return &Options{
+		Storage:     StorageDisk,
+		Dir:         "/var/lib/gh-ci/actions-cache",
+		MaxSize:     resource.QuantityValue{Quantity: resource.MustParse("100Gi")},
+		MaxRepoSize: resource.QuantityValue{Quantity: resource.MustParse("10Gi")},
+		MaxAge:      metav1.Duration{Duration: 7 * 24 * time.Hour},
+	}
+}
+
+func (opts *Options) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&opts.Addr, "actions-cache.addr", opts.Addr, "Listen address of the GitHub Actions cache service used by VMs, eg, :8081 (disabled if empty)")
+	fs.StringVar(&opts.Storage, "actions-cache.storage", opts.Storage, "Storage of cache entries (disk, nats)")
+	fs.StringVar(&opts.Dir, "actions-cache.dir", opts.Dir, "PATH to directory where actions cache stores entries and uploads")
+	fs.Var(&opts.MaxSize, "actions-cache.max-size", "Max size of all actions cache entries")
+	fs.Var(&opts.MaxRepoSize, "actions-cache.max-repo-size", "Max size of the actions cache entries of a repository")
+	fs.DurationVar(&opts.MaxAge.Duration, "actions-cache.max-age", opts.MaxAge.Duration, "Evict actions cache entries not used for this long")
+	fs.StringSliceVar(&opts.AllowedNetworks, "actions-cache.allowed-networks", opts.AllowedNetworks, "Client networks allowed to use the actions cache, defaults to the networks of the VMs")
+}
+
+// Port returns the port the cache service listens on.
+func (opts *Options) Port() (string, error) {
+	_, port, err := net.SplitHostPort(opts.Addr)
+	return port, err
+}
+
+func (opts *Options) Validate() error {
+	if opts.Addr == "" {
+		return nil
+	}
+	if _, err := opts.Port(); err != nil {
+		return fmt.Errorf("invalid actions cache address %q: %v", opts.Addr, err)
+	}
+	switch opts.Storage {
+	case StorageDisk, StorageNATS:
+	default:
+		return fmt.Errorf("unknown actions cache storage %q", opts.Storage)
+	}
+	if opts.Dir == "" {
+		return fmt.Errorf("missing actions cache dir")
+	}
+	if opts.MaxSize.Sign() <= 0 || opts.MaxRepoSize.Sign() <= 0 {
+		return fmt.Errorf("actions cache max sizes must be positive")
+	}
+	if _, err := netacl.Parse(opts.AllowedNetworks); err != nil {
+		return errors.Wrap(err, "invalid actions cache allowed networks")
+	}
+	return nil
+}
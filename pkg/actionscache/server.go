@@ -0,0 +1,548 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package actionscache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/appscodelabs/gh-ci-webhook/pkg/netacl"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// uploads not committed for this long are discarded
+	uploadTimeout = time.Hour
+	// last used time of entries is only stored with this resolution
+	touchInterval = time.Hour
+
+	maintenanceInterval = time.Minute
+)
+
+// Entry is a cache entry of a repository.
+type Entry struct {
+	Name     string    `json:"name"`
+	Repo     string    `json:"repo"`
+	Key      string    `json:"key"`
+	Version  string    `json:"version"`
+	Size     int64     `json:"size"`
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"lastUsed"`
+}
+
+func entryName(repo, key, version string) string {
+	sum := sha256.Sum256([]byte(repo + "\x00" + key + "\x00" + version))
+	return hex.EncodeToString(sum[:])
+}
+
+// ScopeFunc returns the repository of the job running on the client at
+// remoteAddr.
+type ScopeFunc func(remoteAddr string) (string, bool)
+
+type upload struct {
+	id      int64
+	entry   Entry
+	file    *os.File
+	started time.Time
+}
+
+// Server implements the GitHub Actions cache service API used by
+// actions/cache. Cache entries are scoped to the repository of the job
+// running on the client VM.
+type Server struct {
+	opts    *Options
+	acl     netacl.ACL
+	storage Storage
+	scope   ScopeFunc
+
+	mu      sync.Mutex
+	entries map[string]*Entry
+	uploads map[int64]*upload
+	nextID  int64
+}
+
+type Status struct {
+	Entries int              `json:"entries"`
+	Size    int64            `json:"size"`
+	Uploads int              `json:"uploads"`
+	Repos   map[string]int64 `json:"repos"`
+}
+
+type repoKey struct{}
+
+func New(ctx context.Context, opts *Options, nc *nats.Conn, scope ScopeFunc) (*Server, error) {
+	acl, err := netacl.Parse(opts.AllowedNetworks)
+	if err != nil {
+		return nil, err
+	}
+
+	var storage Storage
+	switch opts.Storage {
+	case StorageNATS:
+		storage, err = newNATSStorage(ctx, nc)
+	default:
+		storage, err = newDiskStorage(opts.Dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	uploadDir := filepath.Join(opts.Dir, "uploads")
+	if err := os.RemoveAll(uploadDir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(uploadDir, 0o755); err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		opts:    opts,
+		acl:     acl,
+		storage: storage,
+		scope:   scope,
+		entries: map[string]*Entry{},
+		uploads: map[int64]*upload{},
+	}
+	if err := s.refresh(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Server) Handler() http.Handler {
+	r := chi.NewRouter()
+	r.Use(s.authorize)
+	r.Get("/_apis/artifactcache/cache", s.lookup)
+	r.Post("/_apis/artifactcache/caches", s.reserve)
+	r.Patch("/_apis/artifactcache/caches/{id}", s.uploadChunk)
+	r.Post("/_apis/artifactcache/caches/{id}", s.commit)
+	r.Get("/download/{name}", s.download)
+	return r
+}
+
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	srv := &http.Server{
+		Addr:    s.opts.Addr,
+		Handler: s.Handler(),
+	}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+	go wait.UntilWithContext(ctx, s.maintain, maintenanceInterval)
+
+	klog.InfoS("starting actions cache", "addr", s.opts.Addr, "storage", s.opts.Storage)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (s *Server) Status() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := Status{
+		Entries: len(s.entries),
+		Uploads: len(s.uploads),
+		Repos:   map[string]int64{},
+	}
+	for _, e := range s.entries {
+		out.Size += e.Size
+		out.Repos[e.Repo] += e.Size
+	}
+	return out
+}
+
+func (s *Server) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.acl.Allowed(r.RemoteAddr) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		repo, found := s.scope(r.RemoteAddr)
+		if !found {
+			http.Error(w, "no job found for client", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), repoKey{}, repo)))
+	})
+}
+
+func repoFrom(r *http.Request) string {
+	return r.Context().Value(repoKey{}).(string)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) lookup(w http.ResponseWriter, r *http.Request) {
+	repo := repoFrom(r)
+	keys := strings.Split(r.URL.Query().Get("keys"), ",")
+	version := r.URL.Query().Get("version")
+
+	s.mu.Lock()
+	e := s.find(repo, keys, version)
+	var result Entry
+	if e != nil {
+		result = *e
+	}
+	s.mu.Unlock()
+
+	if e == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, map[string]any{
+		"scope":           repo,
+		"cacheKey":        result.Key,
+		"cacheVersion":    result.Version,
+		"creationTime":    result.Created,
+		"archiveLocation": "http://" + r.Host + "/download/" + result.Name,
+	})
+}
+
+// find returns the entry matching the first key, either exactly or as the
+// most recently created entry with the key as prefix, same as the GitHub
+// cache service. It must be called with s.mu held.
+func (s *Server) find(repo string, keys []string, version string) *Entry {
+	for _, key := range keys {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+		if e, found := s.entries[entryName(repo, key, version)]; found {
+			return e
+		}
+		var latest *Entry
+		for _, e := range s.entries {
+			if e.Repo == repo && e.Version == version && strings.HasPrefix(e.Key, key) &&
+				(latest == nil || e.Created.After(latest.Created)) {
+				latest = e
+			}
+		}
+		if latest != nil {
+			return latest
+		}
+	}
+	return nil
+}
+
+func (s *Server) reserve(w http.ResponseWriter, r *http.Request) {
+	repo := repoFrom(r)
+	var req struct {
+		Key       string `json:"key"`
+		Version   string `json:"version"`
+		CacheSize int64  `json:"cacheSize"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Key == "" || req.Version == "" {
+		http.Error(w, "missing key or version", http.StatusBadRequest)
+		return
+	}
+	if req.CacheSize > s.opts.MaxRepoSize.Value() {
+		http.Error(w, fmt.Sprintf("cache size of %d bytes exceeds the max repository size", req.CacheSize), http.StatusBadRequest)
+		return
+	}
+
+	name := entryName(repo, req.Key, req.Version)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, found := s.entries[name]; found {
+		http.Error(w, "cache entry already exists", http.StatusConflict)
+		return
+	}
+	for _, u := range s.uploads {
+		if u.entry.Name == name {
+			http.Error(w, "cache entry is being uploaded", http.StatusConflict)
+			return
+		}
+	}
+	f, err := os.CreateTemp(filepath.Join(s.opts.Dir, "uploads"), "upload-")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.nextID++
+	s.uploads[s.nextID] = &upload{
+		id: s.nextID,
+		entry: Entry{
+			Name:    name,
+			Repo:    repo,
+			Key:     req.Key,
+			Version: req.Version,
+		},
+		file:    f,
+		started: time.Now(),
+	}
+	writeJSON(w, map[string]int64{"cacheId": s.nextID})
+}
+
+func (s *Server) getUpload(r *http.Request) (*upload, bool) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, found := s.uploads[id]
+	if !found || u.entry.Repo != repoFrom(r) {
+		return nil, false
+	}
+	return u, true
+}
+
+func (s *Server) uploadChunk(w http.ResponseWriter, r *http.Request) {
+	u, found := s.getUpload(r)
+	if !found {
+		http.Error(w, "upload not found", http.StatusNotFound)
+		return
+	}
+
+	var start, end int64
+	if _, err := fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-%d/", &start, &end); err != nil || start < 0 || end < start {
+		http.Error(w, "invalid Content-Range", http.StatusBadRequest)
+		return
+	}
+	if end >= s.opts.MaxRepoSize.Value() {
+		http.Error(w, "cache entry exceeds the max repository size", http.StatusBadRequest)
+		return
+	}
+	n, err := io.Copy(io.NewOffsetWriter(u.file, start), io.LimitReader(r.Body, end-start+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n != end-start+1 {
+		http.Error(w, "chunk is shorter than Content-Range", http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) commit(w http.ResponseWriter, r *http.Request) {
+	u, found := s.getUpload(r)
+	if !found {
+		http.Error(w, "upload not found", http.StatusNotFound)
+		return
+	}
+	s.mu.Lock()
+	delete(s.uploads, u.id)
+	s.mu.Unlock()
+	defer u.discard()
+
+	var req struct {
+		Size int64 `json:"size"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fi, err := u.file.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if fi.Size() != req.Size {
+		http.Error(w, fmt.Sprintf("uploaded %d bytes, expected %d", fi.Size(), req.Size), http.StatusBadRequest)
+		return
+	}
+	if _, err := u.file.Seek(0, io.SeekStart); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	e := u.entry
+	e.Size = req.Size
+	e.Created = time.Now()
+	e.LastUsed = e.Created
+	if err := s.storage.Put(r.Context(), &e, u.file); err != nil {
+		klog.ErrorS(err, "failed to store actions cache entry", "repo", e.Repo, "key", e.Key)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.mu.Lock()
+	s.entries[e.Name] = &e
+	s.mu.Unlock()
+	klog.InfoS("stored actions cache entry", "repo", e.Repo, "key", e.Key, "size", e.Size)
+
+	s.evict(r.Context())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (u *upload) discard() {
+	_ = u.file.Close()
+	_ = os.Remove(u.file.Name())
+}
+
+func (s *Server) download(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	s.mu.Lock()
+	e, found := s.entries[name]
+	if !found || e.Repo != repoFrom(r) {
+		s.mu.Unlock()
+		http.NotFound(w, r)
+		return
+	}
+	var touched bool
+	if time.Since(e.LastUsed) > touchInterval {
+		e.LastUsed = time.Now()
+		touched = true
+	}
+	cur := *e
+	s.mu.Unlock()
+
+	if touched {
+		if err := s.storage.Update(r.Context(), &cur); err != nil {
+			klog.ErrorS(err, "failed to update actions cache entry", "repo", cur.Repo, "key", cur.Key)
+		}
+	}
+
+	rc, err := s.storage.Open(r.Context(), name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rc.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if f, ok := rc.(*os.File); ok {
+		http.ServeContent(w, r, name, time.Time{}, f)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(cur.Size, 10))
+	_, _ = io.Copy(w, rc)
+}
+
+// maintain discards stale uploads, picks up entries stored by other hosts
+// and evicts entries.
+func (s *Server) maintain(ctx context.Context) {
+	var stale []*upload
+	s.mu.Lock()
+	for id, u := range s.uploads {
+		if time.Since(u.started) > uploadTimeout {
+			stale = append(stale, u)
+			delete(s.uploads, id)
+		}
+	}
+	s.mu.Unlock()
+	for _, u := range stale {
+		u.discard()
+	}
+
+	if s.opts.Storage == StorageNATS {
+		if err := s.refresh(ctx); err != nil {
+			klog.ErrorS(err, "failed to list actions cache entries")
+		}
+	}
+	s.evict(ctx)
+}
+
+// refresh loads the entries from storage.
+func (s *Server) refresh(ctx context.Context) error {
+	entries, err := s.storage.List(ctx)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	latest := make(map[string]*Entry, len(entries))
+	for _, e := range entries {
+		if cur, found := s.entries[e.Name]; found && cur.LastUsed.After(e.LastUsed) {
+			e.LastUsed = cur.LastUsed
+		}
+		latest[e.Name] = e
+	}
+	s.entries = latest
+	return nil
+}
+
+// evict removes entries not used for max age, then the least recently used
+// entries of repositories over the max repository size and finally the
+// least recently used entries until all entries fit in max size.
+func (s *Server) evict(ctx context.Context) {
+	s.mu.Lock()
+	sorted := make([]*Entry, 0, len(s.entries))
+	for _, e := range s.entries {
+		sorted = append(sorted, e)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].LastUsed.Before(sorted[j].LastUsed)
+	})
+
+	var (
+		victims  []*Entry
+		kept     []*Entry
+		total    int64
+		repoSize = map[string]int64{}
+		now      = time.Now()
+	)
+	for _, e := range sorted {
+		if now.Sub(e.LastUsed) > s.opts.MaxAge.Duration {
+			victims = append(victims, e)
+			continue
+		}
+		kept = append(kept, e)
+		total += e.Size
+		repoSize[e.Repo] += e.Size
+	}
+	maxSize, maxRepoSize := s.opts.MaxSize.Value(), s.opts.MaxRepoSize.Value()
+	for _, e := range kept {
+		if total <= maxSize && repoSize[e.Repo] <= maxRepoSize {
+			continue
+		}
+		victims = append(victims, e)
+		total -= e.Size
+		repoSize[e.Repo] -= e.Size
+	}
+	for _, e := range victims {
+		delete(s.entries, e.Name)
+	}
+	s.mu.Unlock()
+
+	for _, e := range victims {
+		if err := s.storage.Delete(ctx, e.Name); err != nil {
+			klog.ErrorS(err, "failed to evict actions cache entry", "repo", e.Repo, "key", e.Key)
+			continue
+		}
+		klog.InfoS("evicted actions cache entry", "repo", e.Repo, "key", e.Key, "size", e.Size)
+	}
+}
@@ -0,0 +1,206 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package actionscache
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/pkg/errors"
+	"k8s.io/klog/v2"
+)
+
+// ObjectBucket is the NATS object store bucket used by the nats storage.
+const ObjectBucket = "gha_actions_cache"
+
+// Storage stores the data and metadata of cache entries.
+type Storage interface {
+	Put(ctx context.Context, e *Entry, r io.Reader) error
+	Open(ctx context.Context, name string) (io.ReadCloser, error)
+	// Update stores changed metadata of an entry
+	Update(ctx context.Context, e *Entry) error
+	Delete(ctx context.Context, name string) error
+	List(ctx context.Context) ([]*Entry, error)
+}
+
+// diskStorage stores every entry as a data file and a json metadata file.
+type diskStorage struct {
+	dir string
+}
+
+var _ Storage = diskStorage{}
+
+func newDiskStorage(dir string) (diskStorage, error) {
+	dir = filepath.Join(dir, "entries")
+	return diskStorage{dir: dir}, os.MkdirAll(dir, 0o755)
+}
+
+func (s diskStorage) Put(ctx context.Context, e *Entry, r io.Reader) error {
+	f, err := os.CreateTemp(s.dir, "put-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) //nolint:errcheck
+
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), filepath.Join(s.dir, e.Name)); err != nil {
+		return err
+	}
+	return s.Update(ctx, e)
+}
+
+func (s diskStorage) Open(_ context.Context, name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(s.dir, name))
+}
+
+func (s diskStorage) Update(_ context.Context, e *Entry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	filename := filepath.Join(s.dir, e.Name+".json")
+	if err := os.WriteFile(filename+".tmp", data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(filename+".tmp", filename)
+}
+
+func (s diskStorage) Delete(_ context.Context, name string) error {
+	for _, filename := range []string{name + ".json", name} {
+		if err := os.Remove(filepath.Join(s.dir, filename)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s diskStorage) List(_ context.Context) ([]*Entry, error) {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*Entry, 0, len(files))
+	for _, filename := range files {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		var e Entry
+		if err := json.Unmarshal(data, &e); err != nil {
+			klog.ErrorS(err, "skipping bad cache entry", "file", filename)
+			continue
+		}
+		entries = append(entries, &e)
+	}
+	return entries, nil
+}
+
+// natsStorage stores entries in a NATS object store, shared by all hosts.
+// Entry metadata is kept in the object metadata.
+type natsStorage struct {
+	os jetstream.ObjectStore
+}
+
+var _ Storage = natsStorage{}
+
+const metaEntry = "entry"
+
+func newNATSStorage(ctx context.Context, nc *nats.Conn) (natsStorage, error) {
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return natsStorage{}, err
+	}
+	store, err := js.CreateOrUpdateObjectStore(ctx, jetstream.ObjectStoreConfig{
+		Bucket:      ObjectBucket,
+		Description: "GitHub Actions cache",
+		Storage:     jetstream.FileStorage,
+	})
+	if err != nil {
+		return natsStorage{}, errors.Wrapf(err, "failed to create object store %s", ObjectBucket)
+	}
+	return natsStorage{os: store}, nil
+}
+
+func objectMeta(e *Entry) (jetstream.ObjectMeta, error) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return jetstream.ObjectMeta{}, err
+	}
+	return jetstream.ObjectMeta{
+		Name:     e.Name,
+		Metadata: map[string]string{metaEntry: string(data)},
+	}, nil
+}
+
+func (s natsStorage) Put(ctx context.Context, e *Entry, r io.Reader) error {
+	meta, err := objectMeta(e)
+	if err != nil {
+		return err
+	}
+	_, err = s.os.Put(ctx, meta, r)
+	return err
+}
+
+func (s natsStorage) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	return s.os.Get(ctx, name)
+}
+
+func (s natsStorage) Update(ctx context.Context, e *Entry) error {
+	meta, err := objectMeta(e)
+	if err != nil {
+		return err
+	}
+	return s.os.UpdateMeta(ctx, e.Name, meta)
+}
+
+func (s natsStorage) Delete(ctx context.Context, name string) error {
+	err := s.os.Delete(ctx, name)
+	if errors.Is(err, jetstream.ErrObjectNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (s natsStorage) List(ctx context.Context) ([]*Entry, error) {
+	infos, err := s.os.List(ctx)
+	if errors.Is(err, jetstream.ErrNoObjectsFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	entries := make([]*Entry, 0, len(infos))
+	for _, info := range infos {
+		var e Entry
+		if err := json.Unmarshal([]byte(info.Metadata[metaEntry]), &e); err != nil {
+			klog.ErrorS(err, "skipping bad cache entry", "object", info.Name)
+			continue
+		}
+		entries = append(entries, &e)
+	}
+	return entries, nil
+}
@@ -0,0 +1,295 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package alerts
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/appscodelabs/gh-ci-webhook/pkg/backend"
+	"github.com/appscodelabs/gh-ci-webhook/pkg/notifier"
+
+	"github.com/nats-io/nats.go"
+	passgen "gomodules.xyz/password-generator"
+	"k8s.io/klog/v2"
+)
+
+type Alert struct {
+	Rule     string    `json:"rule"`
+	Subject  string    `json:"subject"`
+	Message  string    `json:"message"`
+	Since    time.Time `json:"since"`
+	Silenced bool      `json:"silenced"`
+
+	notified time.Time
+}
+
+func (a Alert) key() string {
+	return a.Rule + "/" + a.Subject
+}
+
+// Silence suppresses notifications of alerts of a rule. An empty subject
+// matches every subject. A zero Until never expires.
+type Silence struct {
+	ID      string    `json:"id"`
+	Rule    string    `json:"rule"`
+	Subject string    `json:"subject,omitempty"`
+	Until   time.Time `json:"until,omitempty"`
+	Comment string    `json:"comment,omitempty"`
+}
+
+func (s Silence) expired(now time.Time) bool {
+	return !s.Until.IsZero() && now.After(s.Until)
+}
+
+func (s Silence) matches(a Alert) bool {
+	return s.Rule == a.Rule && (s.Subject == "" || s.Subject == a.Subject)
+}
+
+// Engine periodically evaluates alert rules. A firing alert is notified
+// once and then every repeat interval, and a resolve notification is sent
+// when its condition clears. Silenced alerts are tracked but not notified.
+type Engine struct {
+	nc *nats.Conn
+	sp *backend.StatusReporter
+
+	mu       sync.Mutex
+	opts     *Options
+	rules    []Rule
+	active   map[string]*Alert
+	silences []Silence
+	reloaded chan struct{}
+}
+
+func NewEngine(opts *Options, nc *nats.Conn, sp *backend.StatusReporter) (*Engine, error) {
+	rules, err := opts.rules(nc, sp)
+	if err != nil {
+		return nil, err
+	}
+	e := &Engine{
+		nc:       nc,
+		sp:       sp,
+		opts:     opts,
+		rules:    rules,
+		active:   map[string]*Alert{},
+		reloaded: make(chan struct{}, 1),
+	}
+	for _, s := range opts.Silences {
+		rule, subject, _ := strings.Cut(s, "/")
+		e.Silence(Silence{Rule: rule, Subject: subject, Comment: "configured at startup"})
+	}
+	return e, nil
+}
+
+func (e *Engine) Run(ctx context.Context) {
+	for e.runUntilReload(ctx) {
+	}
+}
+
+// runUntilReload evaluates the rules every eval interval until the engine
+// is reloaded. It returns false once ctx is done.
+func (e *Engine) runUntilReload(ctx context.Context) bool {
+	var tick <-chan time.Time
+	if interval := e.options().EvalInterval.Duration; interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-e.reloaded:
+			return true
+		case <-tick:
+			e.evaluate(ctx)
+		}
+	}
+}
+
+// Reload replaces the alert rules and thresholds. Active alerts and
+// silences are kept.
+func (e *Engine) Reload(opts *Options) error {
+	rules, err := opts.rules(e.nc, e.sp)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	e.opts = opts
+	e.rules = rules
+	e.mu.Unlock()
+
+	select {
+	case e.reloaded <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (e *Engine) options() *Options {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.opts
+}
+
+func (e *Engine) evaluate(ctx context.Context) {
+	e.mu.Lock()
+	rules := e.rules
+	e.mu.Unlock()
+
+	for _, rule := range rules {
+		findings, err := rule.Evaluate(ctx)
+		if err != nil {
+			klog.ErrorS(err, "failed to evaluate alert rule", "rule", rule.Name())
+			continue
+		}
+		e.update(rule.Name(), findings)
+	}
+}
+
+func (e *Engine) update(rule string, findings []Finding) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := time.Now()
+	e.expireSilences(now)
+
+	seen := map[string]bool{}
+	for _, f := range findings {
+		a := Alert{Rule: rule, Subject: f.Subject}
+		key := a.key()
+		seen[key] = true
+
+		cur, found := e.active[key]
+		if !found {
+			a.Since = now
+			cur = &a
+			e.active[key] = cur
+		}
+		cur.Message = f.Message
+		cur.Silenced = e.silenced(*cur)
+		if cur.Silenced {
+			continue
+		}
+		if cur.notified.IsZero() || now.Sub(cur.notified) >= e.opts.RepeatInterval.Duration {
+			cur.notified = now
+			notify(notifier.EventAlertFiring, *cur)
+		}
+	}
+
+	for key, a := range e.active {
+		if a.Rule != rule || seen[key] {
+			continue
+		}
+		delete(e.active, key)
+		if !a.notified.IsZero() && !e.silenced(*a) {
+			notify(notifier.EventAlertResolved, *a)
+		}
+	}
+}
+
+func notify(et notifier.EventType, a Alert) {
+	klog.InfoS("alert", "type", et, "rule", a.Rule, "subject", a.Subject, "message", a.Message)
+	notifier.Notify(notifier.Event{
+		Type:    et,
+		Message: a.Message,
+		Details: map[string]string{
+			"Rule":    a.Rule,
+			"Subject": a.Subject,
+			"Since":   a.Since.Format(time.RFC3339),
+		},
+	})
+}
+
+func (e *Engine) silenced(a Alert) bool {
+	for _, s := range e.silences {
+		if s.matches(a) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *Engine) expireSilences(now time.Time) {
+	silences := e.silences[:0]
+	for _, s := range e.silences {
+		if !s.expired(now) {
+			silences = append(silences, s)
+		}
+	}
+	e.silences = silences
+}
+
+// Silence adds a silence and returns its id.
+func (e *Engine) Silence(s Silence) string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if s.ID == "" {
+		s.ID = passgen.GenerateForCharset(8, passgen.AlphaNum)
+	}
+	e.silences = append(e.silences, s)
+	for _, a := range e.active {
+		a.Silenced = e.silenced(*a)
+	}
+	return s.ID
+}
+
+// Unsilence removes a silence and returns true if it was found.
+func (e *Engine) Unsilence(id string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for i, s := range e.silences {
+		if s.ID == id {
+			e.silences = append(e.silences[:i], e.silences[i+1:]...)
+			for _, a := range e.active {
+				a.Silenced = e.silenced(*a)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+type State struct {
+	Alerts   []Alert   `json:"alerts"`
+	Silences []Silence `json:"silences"`
+}
+
+func (e *Engine) State() State {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.expireSilences(time.Now())
+	result := State{
+		Alerts:   make([]Alert, 0, len(e.active)),
+		Silences: append([]Silence{}, e.silences...),
+	}
+	for _, a := range e.active {
+		result.Alerts = append(result.Alerts, *a)
+	}
+	sort.Slice(result.Alerts, func(i, j int) bool {
+		return result.Alerts[i].key() < result.Alerts[j].key()
+	})
+	return result
+}
@@ -0,0 +1,105 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package alerts
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type Options struct {
+	EvalInterval   metav1.Duration `json:"evalInterval,omitempty"`
+	RepeatInterval metav1.Duration `json:"repeatInterval,omitempty"`
+
+	// QueueAge alerts when the oldest queued job of a label is older than this.
+	QueueAge metav1.Duration `json:"queueAge,omitempty"`
+	// QueueAgeByLabel overrides QueueAge for individual labels
+	QueueAgeByLabel map[string]string `json:"queueAgeByLabel,omitempty"`
+
+	// HeartbeatTimeout alerts when a host controller has not sent a heartbeat for this long.
+	HeartbeatTimeout metav1.Duration `json:"heartbeatTimeout,omitempty"`
+	// HeartbeatExpiry forgets a host that has not sent a heartbeat for this
+	// long, eg, once it was decommissioned.
+	HeartbeatExpiry metav1.Duration `json:"heartbeatExpiry,omitempty"`
+
+	// StartFailureRate alerts when the fraction of failed VM starts within
+	// StartFailureWindow exceeds this rate.
+	StartFailureRate       float64         `json:"startFailureRate,omitempty"`
+	StartFailureWindow     metav1.Duration `json:"startFailureWindow,omitempty"`
+	StartFailureMinSamples int             `json:"startFailureMinSamples,omitempty"`
+
+	// StoppingTimeout alerts when a machine is stuck in stopping state for this long.
+	StoppingTimeout metav1.Duration `json:"stoppingTimeout,omitempty"`
+
+	// Silences are applied at startup, as <rule>[/<subject>]
+	Silences []string `json:"silences,omitempty"`
+}
+
+func NewOptions() *Options {
+	return &Options{
+		EvalInterval:           metav1.Duration{Duration: time.Minute},
+		RepeatInterval:         metav1.Duration{Duration: 4 * time.Hour},
+		QueueAge:               metav1.Duration{Duration: 30 * time.Minute},
+		HeartbeatTimeout:       metav1.Duration{Duration: 5 * time.Minute},
+		HeartbeatExpiry:        metav1.Duration{Duration: 24 * time.Hour},
+		StartFailureRate:       0.5,
+		StartFailureWindow:     metav1.Duration{Duration: time.Hour},
+		StartFailureMinSamples: 4,
+		StoppingTimeout:        metav1.Duration{Duration: 15 * time.Minute},
+	}
+}
+
+func (opts *Options) AddFlags(fs *pflag.FlagSet) {
+	fs.DurationVar(&opts.EvalInterval.Duration, "alerts.eval-interval", opts.EvalInterval.Duration, "Interval between alert rule evaluations (0 to disable alerting)")
+	fs.DurationVar(&opts.RepeatInterval.Duration, "alerts.repeat-interval", opts.RepeatInterval.Duration, "Interval before a firing alert is notified again")
+	fs.DurationVar(&opts.QueueAge.Duration, "alerts.queue-age", opts.QueueAge.Duration, "Alert when the oldest queued job of a label is older than this (0 to disable)")
+	fs.StringToStringVar(&opts.QueueAgeByLabel, "alerts.queue-age-by-label", opts.QueueAgeByLabel, "Per label queue age thresholds (eg, f0=10m)")
+	fs.DurationVar(&opts.HeartbeatTimeout.Duration, "alerts.heartbeat-timeout", opts.HeartbeatTimeout.Duration, "Alert when a host has not sent a heartbeat for this long (0 to disable)")
+	fs.DurationVar(&opts.HeartbeatExpiry.Duration, "alerts.heartbeat-expiry", opts.HeartbeatExpiry.Duration, "Forget a host that has not sent a heartbeat for this long (0 to never forget)")
+	fs.Float64Var(&opts.StartFailureRate, "alerts.start-failure-rate", opts.StartFailureRate, "Alert when the fraction of failed VM starts exceeds this rate (0 to disable)")
+	fs.DurationVar(&opts.StartFailureWindow.Duration, "alerts.start-failure-window", opts.StartFailureWindow.Duration, "Time window used to compute VM start failure rate")
+	fs.IntVar(&opts.StartFailureMinSamples, "alerts.start-failure-min-samples", opts.StartFailureMinSamples, "Min number of VM starts in window before failure rate is evaluated")
+	fs.DurationVar(&opts.StoppingTimeout.Duration, "alerts.stopping-timeout", opts.StoppingTimeout.Duration, "Alert when a machine is stuck in stopping state for this long (0 to disable)")
+	fs.StringArrayVar(&opts.Silences, "alerts.silence", opts.Silences, "Silence alerts, as <rule>[/<subject>] (eg, heartbeat/h-0)")
+}
+
+func (opts *Options) Validate() error {
+	if opts.RepeatInterval.Duration <= 0 {
+		return fmt.Errorf("alerts repeat interval %v must be positive", opts.RepeatInterval.Duration)
+	}
+	if opts.HeartbeatExpiry.Duration > 0 && opts.HeartbeatExpiry.Duration <= opts.HeartbeatTimeout.Duration {
+		return fmt.Errorf("alerts heartbeat expiry %v must be longer than the heartbeat timeout %v", opts.HeartbeatExpiry.Duration, opts.HeartbeatTimeout.Duration)
+	}
+	if opts.StartFailureRate < 0 || opts.StartFailureRate > 1 {
+		return fmt.Errorf("alerts start failure rate %v must be in range [0, 1]", opts.StartFailureRate)
+	}
+	for label, v := range opts.QueueAgeByLabel {
+		if _, err := time.ParseDuration(v); err != nil {
+			return fmt.Errorf("invalid queue age %q for label %s", v, label)
+		}
+	}
+	for _, s := range opts.Silences {
+		if rule, _, _ := strings.Cut(s, "/"); rule == "" {
+			return fmt.Errorf("invalid silence %q", s)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package alerts
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/appscodelabs/gh-ci-webhook/pkg/backend"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/util/duration"
+	"k8s.io/klog/v2"
+)
+
+const (
+	RuleQueueAge     = "queue-age"
+	RuleHeartbeat    = "heartbeat"
+	RuleStartFailure = "start-failure"
+	RuleStopping     = "stuck-stopping"
+)
+
+// Finding is a condition detected by a rule for a subject,
+// eg, a runner label, host or machine.
+type Finding struct {
+	Subject string
+	Message string
+}
+
+type Rule interface {
+	Name() string
+	Evaluate(ctx context.Context) ([]Finding, error)
+}
+
+type queueAgeRule struct {
+	nc        *nats.Conn
+	threshold time.Duration
+	byLabel   map[string]time.Duration
+}
+
+func (_ queueAgeRule) Name() string {
+	return RuleQueueAge
+}
+
+func (r queueAgeRule) Evaluate(ctx context.Context) ([]Finding, error) {
+	js, err := jetstream.New(r.nc)
+	if err != nil {
+		return nil, err
+	}
+	streamName := backend.StreamPrefix + "queued"
+	s, err := js.Stream(ctx, streamName)
+	if err != nil {
+		return nil, err
+	}
+	info, err := s.Info(ctx, jetstream.WithSubjectFilter(streamName+".*"))
+	if err != nil {
+		return nil, err
+	}
+
+	var result []Finding
+	for subj, n := range info.State.Subjects {
+		if n == 0 {
+			continue
+		}
+		label := strings.TrimPrefix(subj, streamName+".")
+		threshold, found := r.byLabel[label]
+		if !found {
+			threshold = r.threshold
+		}
+		if threshold <= 0 {
+			continue
+		}
+
+		msg, err := s.GetMsg(ctx, info.State.FirstSeq, jetstream.WithGetMsgSubject(subj))
+		if errors.Is(err, jetstream.ErrMsgNotFound) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if age := time.Since(msg.Time); age > threshold {
+			result = append(result, Finding{
+				Subject: label,
+				Message: fmt.Sprintf("%d jobs queued for label %s, oldest waiting for %s", n, label, duration.HumanDuration(age)),
+			})
+		}
+	}
+	return result, nil
+}
+
+type heartbeatRule struct {
+	sp      *backend.StatusReporter
+	timeout time.Duration
+	expiry  time.Duration
+}
+
+func (_ heartbeatRule) Name() string {
+	return RuleHeartbeat
+}
+
+func (r heartbeatRule) Evaluate(_ context.Context) ([]Finding, error) {
+	var result []Finding
+	for host, t := range r.sp.Heartbeats() {
+		age := time.Since(t)
+		if r.expiry > 0 && age > r.expiry {
+			klog.InfoS("forgetting host without heartbeat", "host", host, "age", age)
+			r.sp.ForgetHeartbeat(host)
+			continue
+		}
+		if age > r.timeout {
+			result = append(result, Finding{
+				Subject: host,
+				Message: fmt.Sprintf("host %s has not sent a heartbeat for %s", host, duration.HumanDuration(age)),
+			})
+		}
+	}
+	return result, nil
+}
+
+type startFailureRule struct {
+	sp         *backend.StatusReporter
+	rate       float64
+	window     time.Duration
+	minSamples int
+}
+
+func (_ startFailureRule) Name() string {
+	return RuleStartFailure
+}
+
+func (r startFailureRule) Evaluate(_ context.Context) ([]Finding, error) {
+	results := r.sp.StartResults(time.Now().Add(-r.window))
+	if len(results) == 0 || len(results) < r.minSamples {
+		return nil, nil
+	}
+
+	failed := 0
+	for _, sr := range results {
+		if sr.Failed {
+			failed++
+		}
+	}
+	if rate := float64(failed) / float64(len(results)); rate > r.rate {
+		return []Finding{
+			{
+				Subject: "vm",
+				Message: fmt.Sprintf("%d of %d VM starts failed in the last %s", failed, len(results), duration.HumanDuration(r.window)),
+			},
+		}, nil
+	}
+	return nil, nil
+}
+
+type stoppingRule struct {
+	sp      *backend.StatusReporter
+	timeout time.Duration
+}
+
+func (_ stoppingRule) Name() string {
+	return RuleStopping
+}
+
+func (r stoppingRule) Evaluate(_ context.Context) ([]Finding, error) {
+	var result []Finding
+	for _, ms := range r.sp.Machines() {
+		if ms.Status != backend.StatusStopping {
+			continue
+		}
+		if age := time.Since(ms.Timestamp); age > r.timeout {
+			result = append(result, Finding{
+				Subject: ms.Name,
+				Message: fmt.Sprintf("machine %s is stopping for %s (%s)", ms.Name, duration.HumanDuration(age), ms.Comment),
+			})
+		}
+	}
+	return result, nil
+}
+
+func (opts *Options) rules(nc *nats.Conn, sp *backend.StatusReporter) ([]Rule, error) {
+	var rules []Rule
+
+	byLabel := make(map[string]time.Duration, len(opts.QueueAgeByLabel))
+	for label, v := range opts.QueueAgeByLabel {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid queue age for label %s", label)
+		}
+		byLabel[label] = d
+	}
+	if opts.QueueAge.Duration > 0 || len(byLabel) > 0 {
+		rules = append(rules, queueAgeRule{nc: nc, threshold: opts.QueueAge.Duration, byLabel: byLabel})
+	}
+	if opts.HeartbeatTimeout.Duration > 0 {
+		rules = append(rules, heartbeatRule{sp: sp, timeout: opts.HeartbeatTimeout.Duration, expiry: opts.HeartbeatExpiry.Duration})
+	}
+	if opts.StartFailureRate > 0 {
+		rules = append(rules, startFailureRule{
+			sp:         sp,
+			rate:       opts.StartFailureRate,
+			window:     opts.StartFailureWindow.Duration,
+			minSamples: opts.StartFailureMinSamples,
+		})
+	}
+	if opts.StoppingTimeout.Duration > 0 {
+		rules = append(rules, stoppingRule{sp: sp, timeout: opts.StoppingTimeout.Duration})
+	}
+	return rules, nil
+}
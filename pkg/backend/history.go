@@ -0,0 +1,130 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/google/go-github/v70/github"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/pkg/errors"
+)
+
+const (
+	// JobHistoryBucket stores a record of every job run by a runner VM
+	JobHistoryBucket = StreamPrefix + "job_history"
+	// JobHistoryTTL is how long job records are kept
+	JobHistoryTTL = 30 * 24 * time.Hour
+)
+
+// JobRecord describes a completed job and the VM it ran on.
+type JobRecord struct {
+	JobID      int64     `json:"jobID"`
+	RunID      int64     `json:"runID"`
+	Repo       string    `json:"repo"`
+	Workflow   string    `json:"workflow,omitempty"`
+	Job        string    `json:"job"`
+	Labels     []string  `json:"labels,omitempty"`
+	Runner     string    `json:"runner"`
+	Conclusion string    `json:"conclusion"`
+	Started    time.Time `json:"started"`
+	Completed  time.Time `json:"completed"`
+
+	// Image and ImageVersion identify the OS image of the VM
+	Image        string `json:"image,omitempty"`
+	ImageVersion string `json:"imageVersion,omitempty"`
+	// Canary is true if the image was a canary under rollout
+	Canary bool `json:"canary,omitempty"`
+	// BootTime is the time from starting the VM until its runner was ready
+	BootTime string `json:"bootTime,omitempty"`
+	// Usage is the resources used by the VM that ran the job
+	Usage *ResourceUsage `json:"usage,omitempty"`
+}
+
+// ResourceUsage is the resources used by a VM, from the stats of its cgroup
+// and the counters of its network device.
+type ResourceUsage struct {
+	CPUSeconds      float64 `json:"cpuSeconds,omitempty"`
+	MemoryPeakBytes int64   `json:"memoryPeakBytes,omitempty"`
+	DiskReadBytes   int64   `json:"diskReadBytes,omitempty"`
+	DiskWriteBytes  int64   `json:"diskWriteBytes,omitempty"`
+	NetRxBytes      int64   `json:"netRxBytes,omitempty"`
+	NetTxBytes      int64   `json:"netTxBytes,omitempty"`
+}
+
+// NewJobRecord returns the record of a completed job.
+func NewJobRecord(e *github.WorkflowJobEvent) JobRecord {
+	job := e.GetWorkflowJob()
+	return JobRecord{
+		JobID:      job.GetID(),
+		RunID:      job.GetRunID(),
+		Repo:       e.GetRepo().GetFullName(),
+		Workflow:   job.GetWorkflowName(),
+		Job:        job.GetName(),
+		Labels:     job.Labels,
+		Runner:     job.GetRunnerName(),
+		Conclusion: job.GetConclusion(),
+		Started:    job.GetStartedAt().Time,
+		Completed:  job.GetCompletedAt().Time,
+	}
+}
+
+// JobHistory stores job records in a NATS KV bucket, keyed by job id.
+type JobHistory struct {
+	kv jetstream.KeyValue
+}
+
+func NewJobHistory(ctx context.Context, nc *nats.Conn) (*JobHistory, error) {
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return nil, err
+	}
+	kv, err := js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{
+		Bucket:      JobHistoryBucket,
+		Description: "gh-ci job history",
+		TTL:         JobHistoryTTL,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create job history bucket")
+	}
+	return &JobHistory{kv: kv}, nil
+}
+
+func (h *JobHistory) Put(ctx context.Context, rec JobRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = h.kv.Put(ctx, strconv.FormatInt(rec.JobID, 10), data)
+	return err
+}
+
+func (h *JobHistory) Get(ctx context.Context, jobID int64) (*JobRecord, error) {
+	entry, err := h.kv.Get(ctx, strconv.FormatInt(jobID, 10))
+	if err != nil {
+		return nil, err
+	}
+	var rec JobRecord
+	if err := json.Unmarshal(entry.Value(), &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
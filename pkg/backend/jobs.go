@@ -0,0 +1,121 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v70/github"
+	"github.com/nats-io/nats.go"
+	"k8s.io/klog/v2"
+)
+
+const subJobs = StreamPrefix + "jobs"
+
+// JobInfo is the job picked by a runner.
+type JobInfo struct {
+	Runner    string    `json:"runner"`
+	Repo      string    `json:"repo"`
+	JobID     int64     `json:"jobID"`
+	Labels    []string  `json:"labels,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// ReportJob tells the host controllers which job a runner picked.
+func ReportJob(nc *nats.Conn, runner string, e *github.WorkflowJobEvent) {
+	data, err := json.Marshal(JobInfo{
+		Runner:    runner,
+		Repo:      e.GetRepo().GetFullName(),
+		JobID:     e.GetWorkflowJob().GetID(),
+		Labels:    e.GetWorkflowJob().Labels,
+		Timestamp: time.Now(),
+	})
+	if err != nil {
+		klog.Errorln(err)
+		return
+	}
+	if err := nc.Publish(subJobs+"."+runner, data); err != nil {
+		klog.Errorln(err)
+	}
+}
+
+// SubscribeJobs calls fn for every job picked by a runner.
+func SubscribeJobs(nc *nats.Conn, fn func(job JobInfo)) error {
+	_, err := nc.Subscribe(subJobs+".>", func(msg *nats.Msg) {
+		var job JobInfo
+		if err := json.Unmarshal(msg.Data, &job); err != nil {
+			klog.ErrorS(err, "bad job report", "subject", msg.Subject)
+			return
+		}
+		fn(job)
+	})
+	return err
+}
+
+// SubscribeQueued calls fn for every job queued for self-hosted runners.
+// Unlike runners, it does not consume the queued jobs.
+func SubscribeQueued(nc *nats.Conn, fn func(e *github.WorkflowJobEvent)) error {
+	_, err := nc.Subscribe(StreamPrefix+"queued.*", func(msg *nats.Msg) {
+		eventType, payload, found := bytes.Cut(msg.Data, []byte(":"))
+		if !found {
+			return
+		}
+		event, err := github.ParseWebHook(string(eventType), payload)
+		if err != nil {
+			klog.ErrorS(err, "bad queued job", "subject", msg.Subject)
+			return
+		}
+		if e, ok := event.(*github.WorkflowJobEvent); ok {
+			fn(e)
+		}
+	})
+	return err
+}
+
+// JobTracker keeps the last job picked by each runner.
+type JobTracker struct {
+	mu   sync.Mutex
+	jobs map[string]JobInfo
+}
+
+func NewJobTracker(nc *nats.Conn) (*JobTracker, error) {
+	t := &JobTracker{
+		jobs: map[string]JobInfo{},
+	}
+	_, err := nc.Subscribe(subJobs+".>", func(msg *nats.Msg) {
+		var job JobInfo
+		if err := json.Unmarshal(msg.Data, &job); err != nil {
+			klog.ErrorS(err, "bad job report", "subject", msg.Subject)
+			return
+		}
+		t.mu.Lock()
+		t.jobs[job.Runner] = job
+		t.mu.Unlock()
+	})
+	return t, err
+}
+
+// Job returns the last job picked by runner.
+func (t *JobTracker) Job(runner string) (JobInfo, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	job, found := t.jobs[runner]
+	return job, found
+}
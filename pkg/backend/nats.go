@@ -35,7 +35,7 @@ const (
 )
 
 // NewConnection creates a new NATS connection
-func NewConnection(addr, credFile string) (nc *nats.Conn, err error) {
+func NewConnection(ncOpts *NATSOptions) (nc *nats.Conn, err error) {
 	hostname, _ := os.Hostname()
 	opts := []nats.Option{
 		nats.Name(fmt.Sprintf("ghactions.%s", hostname)),
@@ -46,23 +46,12 @@ func NewConnection(addr, credFile string) (nc *nats.Conn, err error) {
 		// nats.UseOldRequestStyle(),
 	}
 
-	if _, err := os.Stat(credFile); os.IsNotExist(err) {
-		var username, password string
-		if v, ok := os.LookupEnv("NATS_USERNAME"); ok {
-			username = v
-		} else {
-			username = os.Getenv("THIS_IS_NATS_USERNAME")
-		}
-		if v, ok := os.LookupEnv("NATS_PASSWORD"); ok {
-			password = v
-		} else {
-			password = os.Getenv("THIS_IS_NATS_PASSWORD")
-		}
-		if username != "" && password != "" {
-			opts = append(opts, nats.UserInfo(username, password))
+	if _, err := os.Stat(ncOpts.CredFile); os.IsNotExist(err) {
+		if ncOpts.Username != "" && ncOpts.Password != "" {
+			opts = append(opts, nats.UserInfo(ncOpts.Username, ncOpts.Password))
 		}
 	} else {
-		opts = append(opts, nats.UserCredentials(credFile))
+		opts = append(opts, nats.UserCredentials(ncOpts.CredFile))
 	}
 
 	//if os.Getenv("NATS_CERTIFICATE") != "" && os.Getenv("NATS_KEY") != "" {
@@ -81,7 +70,7 @@ func NewConnection(addr, credFile string) (nc *nats.Conn, err error) {
 	for {
 		select {
 		case <-ticker.C:
-			nc, err := nats.Connect(addr, opts...)
+			nc, err := nats.Connect(ncOpts.Addr, opts...)
 			if err == nil {
 				return nc, nil
 			}
@@ -17,36 +17,55 @@ limitations under the License.
 package backend
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"time"
 
+	"github.com/appscodelabs/gh-ci-webhook/pkg/secrets"
+
 	"github.com/spf13/pflag"
 )
 
 type NATSOptions struct {
-	Addr     string
-	CredFile string
+	Addr     string `json:"addr,omitempty"`
+	CredFile string `json:"credentialFile,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
 }
 
 func NewNATSOptions() *NATSOptions {
-	return &NATSOptions{
+	opts := &NATSOptions{
 		Addr: "this-is-nats.appscode.ninja:4222",
 	}
+	if v, ok := os.LookupEnv("NATS_USERNAME"); ok {
+		opts.Username = v
+	} else {
+		opts.Username = os.Getenv("THIS_IS_NATS_USERNAME")
+	}
+	if v, ok := os.LookupEnv("NATS_PASSWORD"); ok {
+		opts.Password = v
+	} else {
+		opts.Password = os.Getenv("THIS_IS_NATS_PASSWORD")
+	}
+	return opts
 }
 
 func (opts *NATSOptions) AddFlags(fs *pflag.FlagSet) {
 	fs.StringVar(&opts.Addr, "nats-addr", opts.Addr, "NATS serve address")
 	fs.StringVar(&opts.CredFile, "nats-credential-file", opts.CredFile, "PATH to NATS credential file")
+	fs.StringVar(&opts.Username, "nats-username", opts.Username, "NATS username, used when credential file is not found")
+	secrets.StringVar(fs, &opts.Password, "nats-password", "NATS password or secret reference (eg, systemd:nats-password)")
 }
 
 type Options struct {
-	AckWait time.Duration
+	AckWait time.Duration `json:"-"`
 
 	// hostname
-	Name       string
-	NumWorkers int
+	Name       string `json:"name,omitempty"`
+	NumWorkers int    `json:"-"`
 
-	Provider string
+	Provider string `json:"provider,omitempty"`
 }
 
 func (opts *Options) AddFlags(fs *pflag.FlagSet) {
@@ -62,3 +81,53 @@ func DefaultOptions() Options {
 		NumWorkers: 1, // MUST be 1
 	}
 }
+
+type WebhookOptions struct {
+	GitHubToken string   `json:"githubToken,omitempty"`
+	SecretToken string   `json:"secretToken,omitempty"`
+	CertDir     string   `json:"certDir,omitempty"`
+	Email       string   `json:"email,omitempty"`
+	Hosts       []string `json:"hosts,omitempty"`
+	Port        int      `json:"port,omitempty"`
+	EnableSSL   bool     `json:"ssl,omitempty"`
+}
+
+func NewWebhookOptions() *WebhookOptions {
+	return &WebhookOptions{
+		GitHubToken: os.Getenv("GITHUB_TOKEN"),
+		CertDir:     "certs",
+		Email:       "tamal@appscode.com",
+		Hosts:       []string{"this-is-nats.appscode.ninja"},
+		Port:        8080,
+	}
+}
+
+func (opts *WebhookOptions) AddFlags(fs *pflag.FlagSet) {
+	secrets.StringVar(fs, &opts.GitHubToken, "github-token", "GitHub Token or secret reference (eg, file:/etc/gh-ci/github-token)")
+	secrets.StringVar(fs, &opts.SecretToken, "secret-token", "Secret token to verify webhook payloads or secret reference")
+	fs.StringVar(&opts.CertDir, "cert-dir", opts.CertDir, "Directory where certs are stored")
+	fs.StringVar(&opts.Email, "email", opts.Email, "Email used by Let's Encrypt to notify about problems with issued certificates")
+	fs.StringSliceVar(&opts.Hosts, "hosts", opts.Hosts, "Hosts for which certificate will be issued")
+	fs.IntVar(&opts.Port, "port", opts.Port, "Port used when SSL is not enabled")
+	fs.BoolVar(&opts.EnableSSL, "ssl", opts.EnableSSL, "Set true to enable SSL via Let's Encrypt")
+}
+
+// ResolveSecrets replaces secret references with their values.
+func (opts *NATSOptions) ResolveSecrets() error {
+	return secrets.ResolveAll(&opts.Password)
+}
+
+// ResolveSecrets replaces secret references with their values.
+func (opts *WebhookOptions) ResolveSecrets() error {
+	return secrets.ResolveAll(&opts.GitHubToken, &opts.SecretToken)
+}
+
+func (opts *WebhookOptions) Validate() error {
+	if opts.Port < 1 || opts.Port > 65535 {
+		return fmt.Errorf("invalid webhook port %d", opts.Port)
+	}
+	if opts.EnableSSL && len(opts.Hosts) == 0 {
+		return errors.New("webhook hosts are required when ssl is enabled")
+	}
+	return nil
+}
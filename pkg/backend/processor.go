@@ -21,6 +21,7 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"regexp"
 	"strings"
 	"sync"
 	"time"
@@ -40,6 +41,8 @@ const (
 	RunnerHigh          = "f0"
 	RunnerTestrig       = "testrig"
 	RunnerLabelDetector = "label-detector"
+	// RunnerImagePrefix selects the OS image of firecracker VMs, eg, firecracker-noble
+	RunnerImagePrefix = RunnerRegular + "-"
 )
 
 var (
@@ -157,7 +160,18 @@ func RunsOnSelfHosted(e *github.WorkflowJobEvent) (string, bool) {
 		return "", false
 	}
 	label := e.GetWorkflowJob().Labels[0]
-	return label, label == RunnerHigh || label == RunnerRegular || label == RunnerTestrig
+	return label, label == RunnerHigh || label == RunnerRegular || label == RunnerTestrig || IsImageLabel(label)
+}
+
+// imageName is the rule of images.ValidateOS, that can not be imported here.
+var imageName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// IsImageLabel returns true for labels that select the OS image of the VM.
+// Labels are used as a single NATS subject token, so wildcards and dots are
+// not allowed.
+func IsImageLabel(label string) bool {
+	name, found := strings.CutPrefix(label, RunnerImagePrefix)
+	return found && imageName.MatchString(name)
 }
 
 func (mgr *Manager) ProcessCompletedMsg(payload []byte) (*github.WorkflowJobEvent, error) {
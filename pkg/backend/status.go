@@ -37,7 +37,13 @@ import (
 	"k8s.io/klog/v2"
 )
 
-const subStatus = StreamPrefix + "status"
+const (
+	subStatus    = StreamPrefix + "status"
+	subHeartbeat = StreamPrefix + "heartbeat"
+
+	// start results older than this are forgotten
+	startResultRetention = 24 * time.Hour
+)
 
 type Status string
 
@@ -48,12 +54,22 @@ const (
 	StatusPicked   Status = "picked"
 	StatusStopping Status = "stopping"
 	StatusStopped  Status = "stopped"
+	StatusFailed   Status = "failed"
 )
 
 type StatusReporter struct {
-	mu        sync.Mutex
-	inventory map[string]MachineStatus
-	nc        *nats.Conn
+	mu           sync.Mutex
+	inventory    map[string]MachineStatus
+	heartbeats   map[string]time.Time
+	startResults []StartResult
+	nc           *nats.Conn
+}
+
+// StartResult records whether a machine started successfully.
+type StartResult struct {
+	Name      string
+	Failed    bool
+	Timestamp time.Time
 }
 
 type MachineStatus struct {
@@ -74,21 +90,40 @@ func (ms MachineStatus) Strings() []string {
 
 func NewStatusReporter(nc *nats.Conn) (*StatusReporter, error) {
 	sp := &StatusReporter{
-		nc:        nc,
-		inventory: map[string]MachineStatus{},
+		nc:         nc,
+		inventory:  map[string]MachineStatus{},
+		heartbeats: map[string]time.Time{},
 	}
 	_, err := nc.Subscribe(subStatus, func(msg *nats.Msg) {
 		sp.setStatus(msg.Data)
 		_ = msg.Respond([]byte("OK"))
 	})
+	if err != nil {
+		return nil, err
+	}
+	_, err = nc.Subscribe(subHeartbeat, func(msg *nats.Msg) {
+		sp.mu.Lock()
+		sp.heartbeats[string(msg.Data)] = time.Now()
+		sp.mu.Unlock()
+	})
 	return sp, err
 }
 
-func (sp *StatusReporter) setStatus(msg []byte) {
+// SubscribeStatus calls fn for every machine status reported.
+func SubscribeStatus(nc *nats.Conn, fn func(ms MachineStatus)) error {
+	_, err := nc.Subscribe(subStatus, func(msg *nats.Msg) {
+		if cur, ok := parseStatus(msg.Data); ok {
+			fn(cur)
+		}
+	})
+	return err
+}
+
+func parseStatus(msg []byte) (MachineStatus, bool) {
 	fields := strings.SplitN(string(msg), ",", 3)
 	if len(fields) < 2 {
 		klog.Errorln("bad status report ", string(msg))
-		return
+		return MachineStatus{}, false
 	}
 	cur := MachineStatus{
 		Name:      fields[0],
@@ -99,11 +134,29 @@ func (sp *StatusReporter) setStatus(msg []byte) {
 	if len(fields) == 3 {
 		cur.Comment = fields[2]
 	}
+	return cur, true
+}
+
+func (sp *StatusReporter) setStatus(msg []byte) {
+	cur, ok := parseStatus(msg)
+	if !ok {
+		return
+	}
 
 	sp.mu.Lock()
 	defer sp.mu.Unlock()
 
 	sp.inventory[cur.Name] = cur
+	if cur.Status == StatusStarted || cur.Status == StatusFailed {
+		sp.startResults = append(sp.startResults, StartResult{
+			Name:      cur.Name,
+			Failed:    cur.Status == StatusFailed,
+			Timestamp: cur.Timestamp,
+		})
+		for len(sp.startResults) > 0 && time.Since(sp.startResults[0].Timestamp) > startResultRetention {
+			sp.startResults = sp.startResults[1:]
+		}
+	}
 	/*
 		last, found := sp.inventory[cur.Name]
 		if !found || last.Status != cur.Status {
@@ -118,6 +171,52 @@ func (sp *StatusReporter) setStatus(msg []byte) {
 	*/
 }
 
+// Machines returns the last reported status of every machine.
+func (sp *StatusReporter) Machines() []MachineStatus {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	result := make([]MachineStatus, 0, len(sp.inventory))
+	for _, s := range sp.inventory {
+		result = append(result, s)
+	}
+	return result
+}
+
+// Heartbeats returns the time of the last heartbeat received from each host.
+func (sp *StatusReporter) Heartbeats() map[string]time.Time {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	result := make(map[string]time.Time, len(sp.heartbeats))
+	for host, t := range sp.heartbeats {
+		result[host] = t
+	}
+	return result
+}
+
+// ForgetHeartbeat forgets a host, so that it is no longer expected to send
+// heartbeats.
+func (sp *StatusReporter) ForgetHeartbeat(host string) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	delete(sp.heartbeats, host)
+}
+
+// StartResults returns the machine start results reported since the given time.
+func (sp *StatusReporter) StartResults(since time.Time) []StartResult {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	var result []StartResult
+	for _, r := range sp.startResults {
+		if r.Timestamp.After(since) {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
 func (sp *StatusReporter) renderRunnerInfo() []byte {
 	sp.mu.Lock()
 	defer sp.mu.Unlock()
@@ -171,6 +270,13 @@ func ReportStatus(nc *nats.Conn, name string, s Status, comments ...string) {
 	}
 }
 
+// ReportHeartbeat tells the webhook server that the host controller is alive.
+func ReportHeartbeat(nc *nats.Conn, hostname string) {
+	if err := nc.Publish(subHeartbeat, []byte(hostname)); err != nil {
+		klog.Errorln(err)
+	}
+}
+
 func (sp *StatusReporter) GenerateMarkdownReport() ([]byte, error) {
 	var buf bytes.Buffer
 
@@ -26,9 +26,12 @@ import (
 	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nats.go/jetstream"
 	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/klog/v2"
 )
 
+const HeartbeatInterval = 30 * time.Second
+
 type Manager struct {
 	nc              *nats.Conn
 	streamQueued    jetstream.Stream
@@ -75,6 +78,43 @@ func (mgr *Manager) Start(ctx context.Context, jsOpts ...jetstream.JetStreamOpt)
 		return err
 	}
 
+	go wait.UntilWithContext(ctx, func(ctx context.Context) {
+		ReportHeartbeat(mgr.nc, mgr.name)
+	}, HeartbeatInterval)
+
+	mgr.RunVMs()
+	return nil
+}
+
+// reloadEvent is queued with the completed jobs of a host to reload its
+// provider.
+const reloadEvent = "reload"
+
+// Reload applies provider option changes and starts VMs for new slots. The
+// completed job worker must be the only one starting and stopping VMs, so
+// the reload is queued for it.
+func (mgr *Manager) Reload() error {
+	if mgr.Provider == nil {
+		return nil
+	}
+	js, err := jetstream.New(mgr.nc)
+	if err != nil {
+		return err
+	}
+	subj := fmt.Sprintf("%scompleted.%s", StreamPrefix, mgr.name)
+	if _, err := js.Publish(context.TODO(), subj, []byte(reloadEvent+":")); err != nil {
+		return errors.Wrap(err, "failed to queue reload")
+	}
+	return nil
+}
+
+// reload runs a reload queued by Reload.
+func (mgr *Manager) reload() error {
+	if r, ok := mgr.Provider.(api.Reloader); ok {
+		if err := r.Reload(); err != nil {
+			return errors.Wrap(err, "failed to reload provider")
+		}
+	}
 	mgr.RunVMs()
 	return nil
 }
@@ -191,6 +231,15 @@ func (mgr *Manager) ProcessCompletedJobs() error {
 					klog.ErrorS(err, "failed to parse completed job message")
 					return
 				}
+				if string(msg.Data()) == reloadEvent+":" {
+					if err := mgr.reload(); err != nil {
+						klog.ErrorS(err, "failed to reload host controller")
+					}
+					if err := msg.DoubleAck(context.TODO()); err != nil {
+						klog.Errorln(err)
+					}
+					return
+				}
 				// fmt.Printf("Processing msg: %s\n", string(msg.Data()))
 				_, err = mgr.ProcessCompletedMsg(msg.Data())
 				if err != nil {
@@ -0,0 +1,279 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmds
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/appscodelabs/gh-ci-webhook/pkg/backend"
+	"github.com/appscodelabs/gh-ci-webhook/pkg/config"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+func NewCmdConfig(cfg *config.Config) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:               "config",
+		Short:             "Config file sub commands",
+		DisableAutoGenTag: true,
+	}
+	cmd.AddCommand(NewCmdConfigValidate(cfg))
+	cmd.AddCommand(NewCmdConfigGet(cfg))
+	cmd.AddCommand(NewCmdConfigSet(cfg))
+	cmd.AddCommand(NewCmdConfigHistory(cfg))
+	cmd.AddCommand(NewCmdConfigDiff(cfg))
+	cmd.AddCommand(NewCmdConfigRollback(cfg))
+
+	return cmd
+}
+
+func NewCmdConfigValidate(cfg *config.Config) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:               "validate",
+		Short:             "Validate config file",
+		DisableAutoGenTag: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// config is loaded and validated by the root command
+			if cfg.Path() == "" {
+				return fmt.Errorf("missing config file, set --config or env %s", config.EnvConfigFile)
+			}
+			fmt.Printf("config file %s is valid\n", cfg.Path())
+			return nil
+		},
+	}
+	return cmd
+}
+
+func NewCmdConfigGet(cfg *config.Config) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:               "get <key>",
+		Short:             "Print config stored in NATS KV (global, pool.<pool> or host.<hostname>)",
+		Args:              cobra.ExactArgs(1),
+		DisableAutoGenTag: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return withConfigKV(cfg, args[0], func(ctx context.Context, kv jetstream.KeyValue) error {
+				entry, err := kv.Get(ctx, args[0])
+				if err != nil {
+					return err
+				}
+				fmt.Printf("# revision %d, %s\n", entry.Revision(), entry.Created().Format(time.RFC3339))
+				fmt.Print(string(entry.Value()))
+				return nil
+			})
+		},
+	}
+	cfg.NATS.AddFlags(cmd.Flags())
+	return cmd
+}
+
+func NewCmdConfigSet(cfg *config.Config) *cobra.Command {
+	var (
+		filename string
+		unset    []string
+	)
+	cmd := &cobra.Command{
+		Use:   "set <key> [<path>=<value>...]",
+		Short: "Set config stored in NATS KV",
+		Example: `  gh-ci config set pool.fc hostctl.firecracker.numInstances=4 hostctl.firecracker.os=jammy
+  gh-ci config set host.h-0 --unset hostctl.firecracker.numInstances
+  gh-ci config set global -f global.yaml`,
+		Args:              cobra.MinimumNArgs(1),
+		DisableAutoGenTag: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return withConfigKV(cfg, args[0], func(ctx context.Context, kv jetstream.KeyValue) error {
+				var data []byte
+				var revision uint64
+				entry, err := kv.Get(ctx, args[0])
+				if err == nil {
+					data, revision = entry.Value(), entry.Revision()
+				} else if !errors.Is(err, jetstream.ErrKeyNotFound) {
+					return err
+				}
+
+				if filename != "" {
+					data, err = os.ReadFile(filename)
+					if err != nil {
+						return err
+					}
+				}
+				for _, arg := range args[1:] {
+					path, value, found := strings.Cut(arg, "=")
+					if !found {
+						return fmt.Errorf("invalid argument %q, expected <path>=<value>", arg)
+					}
+					data, err = config.SetField(data, path, &value)
+					if err != nil {
+						return err
+					}
+				}
+				for _, path := range unset {
+					data, err = config.SetField(data, path, nil)
+					if err != nil {
+						return err
+					}
+				}
+				if err := config.CheckDocument(data); err != nil {
+					return errors.Wrap(err, "invalid config")
+				}
+
+				// fails if the key was changed by someone else in the meantime
+				if revision == 0 {
+					revision, err = kv.Create(ctx, args[0], data)
+				} else {
+					revision, err = kv.Update(ctx, args[0], data, revision)
+				}
+				if err != nil {
+					return err
+				}
+				fmt.Printf("%s updated to revision %d\n", args[0], revision)
+				return nil
+			})
+		},
+	}
+	cmd.Flags().StringVarP(&filename, "file", "f", filename, "PATH to yaml file replacing the stored config")
+	cmd.Flags().StringArrayVar(&unset, "unset", unset, "Remove a field, eg, hostctl.firecracker.numInstances")
+	cfg.NATS.AddFlags(cmd.Flags())
+	return cmd
+}
+
+func NewCmdConfigHistory(cfg *config.Config) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:               "history <key>",
+		Short:             "List revisions of config stored in NATS KV",
+		Args:              cobra.ExactArgs(1),
+		DisableAutoGenTag: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return withConfigKV(cfg, args[0], func(ctx context.Context, kv jetstream.KeyValue) error {
+				entries, err := kv.History(ctx, args[0])
+				if err != nil {
+					return err
+				}
+				for _, entry := range entries {
+					fmt.Printf("%d\t%s\t%s\n", entry.Revision(), entry.Created().Format(time.RFC3339), entry.Operation())
+				}
+				return nil
+			})
+		},
+	}
+	cfg.NATS.AddFlags(cmd.Flags())
+	return cmd
+}
+
+func NewCmdConfigDiff(cfg *config.Config) *cobra.Command {
+	var revision uint64
+	cmd := &cobra.Command{
+		Use:               "diff <key>",
+		Short:             "Show changes of config stored in NATS KV since a revision",
+		Args:              cobra.ExactArgs(1),
+		DisableAutoGenTag: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return withConfigKV(cfg, args[0], func(ctx context.Context, kv jetstream.KeyValue) error {
+				cur, prev, err := configRevisions(ctx, kv, args[0], revision)
+				if err != nil {
+					return err
+				}
+				fmt.Printf("--- revision %d\n+++ revision %d\n", prev.Revision(), cur.Revision())
+				fmt.Print(config.Diff(string(prev.Value()), string(cur.Value())))
+				return nil
+			})
+		},
+	}
+	cmd.Flags().Uint64Var(&revision, "revision", revision, "Revision to compare with (defaults to the previous revision)")
+	cfg.NATS.AddFlags(cmd.Flags())
+	return cmd
+}
+
+func NewCmdConfigRollback(cfg *config.Config) *cobra.Command {
+	var revision uint64
+	cmd := &cobra.Command{
+		Use:               "rollback <key>",
+		Short:             "Restore a previous revision of config stored in NATS KV",
+		Args:              cobra.ExactArgs(1),
+		DisableAutoGenTag: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return withConfigKV(cfg, args[0], func(ctx context.Context, kv jetstream.KeyValue) error {
+				cur, prev, err := configRevisions(ctx, kv, args[0], revision)
+				if err != nil {
+					return err
+				}
+				if prev.Operation() != jetstream.KeyValuePut {
+					return fmt.Errorf("revision %d of %s was deleted", prev.Revision(), args[0])
+				}
+				rev, err := kv.Update(ctx, args[0], prev.Value(), cur.Revision())
+				if err != nil {
+					return err
+				}
+				fmt.Printf("%s rolled back to revision %d as revision %d\n", args[0], prev.Revision(), rev)
+				return nil
+			})
+		},
+	}
+	cmd.Flags().Uint64Var(&revision, "revision", revision, "Revision to restore (defaults to the previous revision)")
+	cfg.NATS.AddFlags(cmd.Flags())
+	return cmd
+}
+
+// configRevisions returns the latest entry of key and the entry at revision,
+// or the one before the latest entry if revision is 0.
+func configRevisions(ctx context.Context, kv jetstream.KeyValue, key string, revision uint64) (jetstream.KeyValueEntry, jetstream.KeyValueEntry, error) {
+	entries, err := kv.History(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cur := entries[len(entries)-1]
+	if revision == 0 {
+		if len(entries) < 2 {
+			return nil, nil, fmt.Errorf("%s has no previous revision", key)
+		}
+		return cur, entries[len(entries)-2], nil
+	}
+	for _, entry := range entries {
+		if entry.Revision() == revision {
+			return cur, entry, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("revision %d of %s not found", revision, key)
+}
+
+func withConfigKV(cfg *config.Config, key string, fn func(ctx context.Context, kv jetstream.KeyValue) error) error {
+	if err := config.ValidateKey(key); err != nil {
+		return err
+	}
+	if err := cfg.NATS.ResolveSecrets(); err != nil {
+		return err
+	}
+	nc, err := backend.NewConnection(cfg.NATS)
+	if err != nil {
+		return err
+	}
+	defer nc.Drain() //nolint:errcheck
+
+	ctx, cancel := context.WithTimeout(context.Background(), backend.NatsRequestTimeout)
+	defer cancel()
+
+	kv, err := config.NewKV(ctx, nc)
+	if err != nil {
+		return err
+	}
+	return fn(ctx, kv)
+}
@@ -0,0 +1,42 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmds
+
+import (
+	"context"
+	"time"
+
+	"github.com/appscodelabs/gh-ci-webhook/pkg/providers/firecracker"
+
+	"github.com/spf13/cobra"
+)
+
+func NewCmdFirecrackerBakeSnapshot(ctx context.Context) *cobra.Command {
+	timeout := 30 * time.Minute
+	cmd := &cobra.Command{
+		Use:               "bake-snapshot",
+		Short:             "Bake the snapshot VMs of the OS image are restored from",
+		DisableAutoGenTag: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return firecracker.BakeSnapshot(ctx, timeout)
+		},
+	}
+	cmd.Flags().DurationVar(&timeout, "timeout", timeout, "Max time to provision the VM before it is snapshotted")
+	firecracker.DefaultOptions.AddFlags(cmd.Flags())
+
+	return cmd
+}
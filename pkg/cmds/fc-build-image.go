@@ -0,0 +1,44 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmds
+
+import (
+	"context"
+
+	"github.com/appscodelabs/gh-ci-webhook/pkg/images"
+
+	"github.com/spf13/cobra"
+)
+
+func NewCmdFirecrackerBuildImage(ctx context.Context) *cobra.Command {
+	opts := images.NewBuildOptions()
+	cmd := &cobra.Command{
+		Use:               "build-image",
+		Short:             "Build an OS image from a container image or Dockerfile",
+		DisableAutoGenTag: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := opts.Validate(); err != nil {
+				return err
+			}
+			_, err := images.Build(ctx, opts)
+			return err
+		},
+	}
+	opts.AddFlags(cmd.Flags())
+
+	return cmd
+}
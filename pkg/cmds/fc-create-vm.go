@@ -22,6 +22,7 @@ import (
 	"github.com/appscodelabs/gh-ci-webhook/pkg/backend"
 	"github.com/appscodelabs/gh-ci-webhook/pkg/providers/api"
 	"github.com/appscodelabs/gh-ci-webhook/pkg/providers/firecracker"
+	"github.com/appscodelabs/gh-ci-webhook/pkg/secrets"
 
 	"github.com/nats-io/nats.go"
 	"github.com/spf13/cobra"
@@ -40,10 +41,16 @@ func NewCmdFirecrackerCreateVM() *cobra.Command {
 		Short:             "Firecracker create VM",
 		DisableAutoGenTag: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := secrets.ResolveAll(&ghToken, &ncOpts.Password); err != nil {
+				return err
+			}
+			if err := firecracker.DefaultOptions.ResolveSecrets(); err != nil {
+				return err
+			}
 			firecracker.DefaultOptions.GitHubToken = ghToken
 
 			var err error
-			nc, err = backend.NewConnection(ncOpts.Addr, ncOpts.CredFile)
+			nc, err = backend.NewConnection(ncOpts)
 			if err != nil {
 				return err
 			}
@@ -65,7 +72,7 @@ func NewCmdFirecrackerCreateVM() *cobra.Command {
 			return p.StartRunner(slot)
 		},
 	}
-	cmd.Flags().StringVar(&ghToken, "github-token", ghToken, "GitHub Token")
+	secrets.StringVar(cmd.Flags(), &ghToken, "github-token", "GitHub Token or secret reference")
 	cmd.Flags().IntVar(&instanceID, "instance-id", instanceID, "Instance ID")
 	firecracker.DefaultOptions.AddFlags(cmd.Flags())
 	ncOpts.AddFlags(cmd.Flags())
@@ -0,0 +1,71 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmds
+
+import (
+	"os"
+
+	"github.com/appscodelabs/gh-ci-webhook/pkg/providers/firecracker"
+	"github.com/appscodelabs/gh-ci-webhook/pkg/secrets"
+
+	"github.com/spf13/cobra"
+)
+
+func NewCmdFirecrackerRenderUserData() *cobra.Command {
+	var (
+		ghToken    = os.Getenv("GITHUB_TOKEN")
+		instanceID = 0
+		image      string
+		canary     bool
+		snapshot   bool
+		restore    bool
+	)
+	cmd := &cobra.Command{
+		Use:               "render-user-data",
+		Short:             "Print the user-data of the VM of a slot without starting it",
+		DisableAutoGenTag: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := secrets.ResolveAll(&ghToken); err != nil {
+				return err
+			}
+			if err := firecracker.DefaultOptions.ResolveSecrets(); err != nil {
+				return err
+			}
+			if image == "" && canary {
+				image = firecracker.DefaultOptions.CanaryImage
+			}
+			if image == "" {
+				image = firecracker.DefaultOptions.OS
+			}
+			data, err := firecracker.DryRunUserData(ghToken, instanceID, image, canary, snapshot, restore)
+			if err != nil {
+				return err
+			}
+			_, err = os.Stdout.Write(data)
+			return err
+		},
+	}
+	secrets.StringVar(cmd.Flags(), &ghToken, "github-token", "GitHub Token or secret reference")
+	cmd.Flags().IntVar(&instanceID, "instance-id", instanceID, "Instance ID")
+	cmd.Flags().StringVar(&image, "image", image, "OS image booted by the VM (defaults to --firecracker.os)")
+	cmd.Flags().BoolVar(&canary, "canary", canary, "Render the user-data of a canary VM")
+	cmd.Flags().BoolVar(&snapshot, "snapshot", snapshot, "Render the user-data of the VM baked into a snapshot")
+	cmd.Flags().BoolVar(&restore, "restore", restore, "Render the script run by a VM restored from a snapshot")
+	firecracker.DefaultOptions.AddFlags(cmd.Flags())
+
+	return cmd
+}
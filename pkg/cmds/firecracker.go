@@ -17,10 +17,12 @@ limitations under the License.
 package cmds
 
 import (
+	"context"
+
 	"github.com/spf13/cobra"
 )
 
-func NewCmdFirecracker() *cobra.Command {
+func NewCmdFirecracker(ctx context.Context) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:               "firecracker",
 		Short:             "Firecracker sub commands",
@@ -29,6 +31,9 @@ func NewCmdFirecracker() *cobra.Command {
 	cmd.AddCommand(NewCmdFirecrackerCreateVM())
 	cmd.AddCommand(NewCmdFirecrackerCreateTAPDevice())
 	cmd.AddCommand(NewCmdFirecrackerDeleteTAPDevice())
+	cmd.AddCommand(NewCmdFirecrackerBakeSnapshot(ctx))
+	cmd.AddCommand(NewCmdFirecrackerBuildImage(ctx))
+	cmd.AddCommand(NewCmdFirecrackerRenderUserData())
 
 	return cmd
 }
@@ -18,28 +18,35 @@ package cmds
 
 import (
 	"context"
+	"encoding/json"
 	"net/http"
 	"os"
 
+	"github.com/appscodelabs/gh-ci-webhook/pkg/actionscache"
 	"github.com/appscodelabs/gh-ci-webhook/pkg/backend"
+	"github.com/appscodelabs/gh-ci-webhook/pkg/config"
+	"github.com/appscodelabs/gh-ci-webhook/pkg/gitmirror"
+	"github.com/appscodelabs/gh-ci-webhook/pkg/mirror"
+	"github.com/appscodelabs/gh-ci-webhook/pkg/netacl"
+	"github.com/appscodelabs/gh-ci-webhook/pkg/notifier"
 	"github.com/appscodelabs/gh-ci-webhook/pkg/providers/api"
 	"github.com/appscodelabs/gh-ci-webhook/pkg/providers/firecracker"
-	"github.com/appscodelabs/gh-ci-webhook/pkg/providers/linode"
+	"github.com/appscodelabs/gh-ci-webhook/pkg/proxy"
+	"github.com/appscodelabs/gh-ci-webhook/pkg/secrets"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/google/go-github/v70/github"
 	"github.com/nats-io/nats.go"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"k8s.io/klog/v2"
 )
 
-func NewCmdHostctl(ctx context.Context) *cobra.Command {
+func NewCmdHostctl(ctx context.Context, cfg *config.Config) *cobra.Command {
 	var (
-		ghToken = os.Getenv("GITHUB_TOKEN")
-		addr    = ":8080"
-
-		opts   = backend.DefaultOptions()
-		ncOpts = backend.NewNATSOptions()
+		opts   = cfg.Hostctl
+		ncOpts = cfg.NATS
 		nc     *nats.Conn
 	)
 	cmd := &cobra.Command{
@@ -47,58 +54,242 @@ func NewCmdHostctl(ctx context.Context) *cobra.Command {
 		Short:             "Run GitHub Actions runner host controller",
 		DisableAutoGenTag: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			linode.DefaultOptions.GitHubToken = ghToken
-			firecracker.DefaultOptions.GitHubToken = ghToken
+			if err := ncOpts.ResolveSecrets(); err != nil {
+				return err
+			}
+
+			var err error
+			nc, err = backend.NewConnection(ncOpts)
+			if err != nil {
+				return err
+			}
+			defer nc.Drain() //nolint:errcheck
+
+			// merge config distributed through NATS KV, before anything is started
+			kv, err := config.NewKV(ctx, nc)
+			if err != nil {
+				return err
+			}
+			cfg.UseKV(kv, config.KVKeys(opts.Pool, opts.Name)...)
+			latest, err := config.Reload(ctx, cfg, os.Args[1:], addHostctlFlags)
+			if err != nil {
+				return err
+			}
+			if err := resolveHostctlSecrets(latest); err != nil {
+				return err
+			}
+			applyHostctl(cfg, latest)
+
+			opts.Linode.GitHubToken = opts.GitHubToken
+			opts.Firecracker.GitHubToken = opts.GitHubToken
 
 			// For testing
 			// ncOpts.Addr = "192.168.0.233:4222"
 			// firecracker.DefaultOptions.NumInstances = 1
 
-			var natsUsername, natsPassword string
-			if v, ok := os.LookupEnv("NATS_USERNAME"); ok {
-				natsUsername = v
-			} else {
-				natsUsername = os.Getenv("THIS_IS_NATS_USERNAME")
+			opts.Firecracker.NatsURL = ncOpts.Addr
+			opts.Firecracker.NatsUsername = ncOpts.Username
+			opts.Firecracker.NatsPassword = ncOpts.Password
+
+			if err := notifier.Start(ctx, cfg.Notifier); err != nil {
+				return err
 			}
-			if v, ok := os.LookupEnv("NATS_PASSWORD"); ok {
-				natsPassword = v
-			} else {
-				natsPassword = os.Getenv("THIS_IS_NATS_PASSWORD")
+
+			if opts.Mirror.Addr != "" {
+				mirrorOpts := *opts.Mirror
+				mirrorOpts.AllowedNetworks = allowedNetworks("registry mirror", opts.Mirror.AllowedNetworks, opts.Firecracker, "127.0.0.0/8")
+				srv, err := mirror.New(&mirrorOpts)
+				if err != nil {
+					return err
+				}
+				opts.Firecracker.RegistryMirrorPort, _ = opts.Mirror.Port()
+				go func() {
+					if err := srv.ListenAndServe(ctx); err != nil {
+						klog.ErrorS(err, "registry mirror failed")
+					}
+				}()
 			}
-			firecracker.DefaultOptions.NatsURL = ncOpts.Addr
-			firecracker.DefaultOptions.NatsUsername = natsUsername
-			firecracker.DefaultOptions.NatsPassword = natsPassword
 
-			var err error
-			nc, err = backend.NewConnection(ncOpts.Addr, ncOpts.CredFile)
-			if err != nil {
-				return err
+			var cache *proxy.Server
+			if opts.CacheProxy.Addr != "" {
+				proxyOpts := *opts.CacheProxy
+				proxyOpts.AllowedNetworks = allowedNetworks("caching proxy", opts.CacheProxy.AllowedNetworks, opts.Firecracker, "127.0.0.0/8")
+				cache, err = proxy.New(&proxyOpts)
+				if err != nil {
+					return err
+				}
+				opts.Firecracker.CacheProxyPort, _ = opts.CacheProxy.Port()
+				go func() {
+					if err := cache.ListenAndServe(ctx); err != nil {
+						klog.ErrorS(err, "caching proxy failed")
+					}
+				}()
 			}
-			defer nc.Drain() //nolint:errcheck
 
-			mgr := backend.New(nc, opts)
+			var vmRepo func(remoteAddr string) (string, bool)
+			if opts.ActionsCache.Addr != "" || opts.GitMirror.Addr != "" {
+				jobs, err := backend.NewJobTracker(nc)
+				if err != nil {
+					return err
+				}
+				vmRepo = func(remoteAddr string) (string, bool) {
+					runner, found := firecracker.RunnerForAddr(remoteAddr)
+					if !found {
+						return "", false
+					}
+					job, found := jobs.Job(runner)
+					return job.Repo, found
+				}
+			}
+
+			var ac *actionscache.Server
+			if opts.ActionsCache.Addr != "" {
+				acOpts := *opts.ActionsCache
+				acOpts.AllowedNetworks = allowedNetworks("actions cache", opts.ActionsCache.AllowedNetworks, opts.Firecracker)
+				ac, err = actionscache.New(ctx, &acOpts, nc, vmRepo)
+				if err != nil {
+					return err
+				}
+				opts.Firecracker.ActionsCachePort, _ = opts.ActionsCache.Port()
+				go func() {
+					if err := ac.ListenAndServe(ctx); err != nil {
+						klog.ErrorS(err, "actions cache failed")
+					}
+				}()
+			}
+
+			if opts.GitMirror.Addr != "" {
+				opts.GitMirror.GitHubToken = opts.GitHubToken
+				gmOpts := *opts.GitMirror
+				gmOpts.AllowedNetworks = allowedNetworks("git mirror", opts.GitMirror.AllowedNetworks, opts.Firecracker)
+				gm, err := gitmirror.New(&gmOpts, vmRepo)
+				if err != nil {
+					return err
+				}
+				err = backend.SubscribeQueued(nc, func(e *github.WorkflowJobEvent) {
+					go gm.Refresh(e.GetRepo().GetFullName())
+				})
+				if err != nil {
+					return err
+				}
+				opts.Firecracker.GitMirrorPort, _ = opts.GitMirror.Port()
+				go func() {
+					if err := gm.ListenAndServe(ctx); err != nil {
+						klog.ErrorS(err, "git mirror failed")
+					}
+				}()
+			}
+
+			mgr := backend.New(nc, opts.Options)
 			if err := mgr.Start(ctx); err != nil {
 				return err
 			}
 
-			go runStatusServer(addr, mgr.Provider)
+			prev := cfg
+			go config.Watch(ctx, cfg, addHostctlFlags, func(latest *config.Config) {
+				if err := resolveHostctlSecrets(latest); err != nil {
+					klog.ErrorS(err, "failed to reload config")
+					return
+				}
+				reloadHostctl(ctx, cfg, prev, latest, mgr)
+				prev = latest
+			})
+
+			go runStatusServer(opts.StatusServerAddr, mgr.Provider, cache, ac)
 
 			<-ctx.Done()
 			return nil
 		},
 	}
 
-	cmd.Flags().StringVar(&ghToken, "github-token", ghToken, "GitHub Token")
-	cmd.Flags().StringVar(&addr, "status-server-addr", addr, "host:port of the status server")
-	linode.DefaultOptions.AddFlags(cmd.Flags())
-	firecracker.DefaultOptions.AddFlags(cmd.Flags())
-	opts.AddFlags(cmd.Flags())
-	ncOpts.AddFlags(cmd.Flags())
+	addHostctlFlags(cmd.Flags(), cfg)
 
 	return cmd
 }
 
-func runStatusServer(addr string, p api.Interface) {
+func addHostctlFlags(fs *pflag.FlagSet, cfg *config.Config) {
+	cfg.Hostctl.AddFlags(fs)
+	cfg.Notifier.AddFlags(fs)
+	cfg.NATS.AddFlags(fs)
+}
+
+func resolveHostctlSecrets(cfg *config.Config) error {
+	if err := cfg.NATS.ResolveSecrets(); err != nil {
+		return err
+	}
+	if err := cfg.Notifier.ResolveSecrets(); err != nil {
+		return err
+	}
+	if err := secrets.ResolveAll(&cfg.Hostctl.GitHubToken); err != nil {
+		return err
+	}
+	if err := cfg.Hostctl.Linode.ResolveSecrets(); err != nil {
+		return err
+	}
+	return cfg.Hostctl.Firecracker.ResolveSecrets()
+}
+
+// applyHostctl applies all host settings of the latest config. It is only
+// used before the host controller is started.
+func applyHostctl(cfg, latest *config.Config) {
+	cfg.Notifier = latest.Notifier
+	cfg.Hostctl.Options = latest.Hostctl.Options
+	cfg.Hostctl.GitHubToken = latest.Hostctl.GitHubToken
+	cfg.Hostctl.StatusServerAddr = latest.Hostctl.StatusServerAddr
+	*cfg.Hostctl.Firecracker = *latest.Hostctl.Firecracker
+	*cfg.Hostctl.Linode = *latest.Hostctl.Linode
+	*cfg.Hostctl.Mirror = *latest.Hostctl.Mirror
+	*cfg.Hostctl.CacheProxy = *latest.Hostctl.CacheProxy
+	*cfg.Hostctl.ActionsCache = *latest.Hostctl.ActionsCache
+	*cfg.Hostctl.GitMirror = *latest.Hostctl.GitMirror
+}
+
+// reloadHostctl applies the settings that are safe to change while VMs are
+// running. VM sizes and images are used for VMs started after the reload.
+// The other settings are reported once if changed since prev.
+// allowedNetworks returns the client networks of a host service: the
+// networks of the VMs and extra, unless networks are configured. Configured
+// networks that do not cover the networks of the VMs are warned about.
+func allowedNetworks(service string, networks []string, fc *firecracker.Options, extra ...string) []string {
+	if len(networks) == 0 {
+		return append(fc.VMNetworks(), extra...)
+	}
+	acl, _ := netacl.Parse(networks) // validated
+	for _, n := range fc.VMNetworks() {
+		if !acl.Covers(n) {
+			klog.Warningf("allowed networks of the %s do not cover the VM network %s, VMs outside them are refused", service, n)
+		}
+	}
+	return networks
+}
+
+func reloadHostctl(ctx context.Context, cfg, prev, latest *config.Config, mgr *backend.Manager) {
+	if err := notifier.Start(ctx, latest.Notifier); err != nil {
+		klog.ErrorS(err, "failed to restart notifier")
+	} else {
+		cfg.Notifier = latest.Notifier
+	}
+
+	// VMs read the options through firecracker.Current, so they are
+	// replaced as a whole instead of updated in place
+	cur, next := cfg.Hostctl.Firecracker, latest.Hostctl.Firecracker
+	cfg.Hostctl.Firecracker = firecracker.UpdateOptions(next)
+
+	if err := mgr.Reload(); err != nil {
+		klog.ErrorS(err, "failed to reload host controller")
+	}
+
+	// fields set at runtime are not part of the config file
+	next.GitHubToken, next.NatsURL, next.NatsUsername, next.NatsPassword = cur.GitHubToken, cur.NatsURL, cur.NatsUsername, cur.NatsPassword
+	next.RegistryMirrorPort, next.CacheProxyPort, next.ActionsCachePort, next.GitMirrorPort = cur.RegistryMirrorPort, cur.CacheProxyPort, cur.ActionsCachePort, cur.GitMirrorPort
+	latest.Hostctl.GitMirror.GitHubToken = cfg.Hostctl.GitMirror.GitHubToken
+	latest.Hostctl.Linode.GitHubToken = cfg.Hostctl.Linode.GitHubToken
+	latest.Hostctl.Linode.RootPassword = cfg.Hostctl.Linode.RootPassword
+	config.RestartRequired("nats", cfg.NATS, prev.NATS, latest.NATS)
+	config.RestartRequired("hostctl", cfg.Hostctl, prev.Hostctl, latest.Hostctl)
+}
+
+func runStatusServer(addr string, p api.Interface, cache *proxy.Server, ac *actionscache.Server) {
 	r := chi.NewRouter()
 	r.Use(middleware.RealIP)
 	r.Use(middleware.Logger)
@@ -107,12 +298,28 @@ func runStatusServer(addr string, p api.Interface) {
 		if p != nil {
 			data, err := p.Status()
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				http.Error(w, secrets.Redact(err.Error()), http.StatusInternalServerError)
 			} else {
-				_, _ = w.Write(data)
+				_, _ = w.Write([]byte(secrets.Redact(string(data))))
 			}
 		}
 	})
+	r.Get("/proxy/status", func(w http.ResponseWriter, r *http.Request) {
+		if cache == nil {
+			http.Error(w, "caching proxy is not running", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(cache.Status())
+	})
+	r.Get("/actions-cache/status", func(w http.ResponseWriter, r *http.Request) {
+		if ac == nil {
+			http.Error(w, "actions cache is not running", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(ac.Status())
+	})
 	klog.Infoln("starting status server", addr)
 	if err := http.ListenAndServe(addr, r); err != nil {
 		klog.Errorln(err)
@@ -0,0 +1,116 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmds
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/appscodelabs/gh-ci-webhook/pkg/backend"
+	"github.com/appscodelabs/gh-ci-webhook/pkg/config"
+	"github.com/appscodelabs/gh-ci-webhook/pkg/images"
+
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+)
+
+func NewCmdImage(ctx context.Context, cfg *config.Config) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:               "image",
+		Short:             "Distribute OS images to hosts through NATS",
+		DisableAutoGenTag: true,
+	}
+	cmd.AddCommand(NewCmdImagePush(ctx, cfg))
+	cmd.AddCommand(NewCmdImageList(ctx, cfg))
+
+	return cmd
+}
+
+func NewCmdImagePush(ctx context.Context, cfg *config.Config) *cobra.Command {
+	var (
+		activate = true
+		keep     = 3
+	)
+	cmd := &cobra.Command{
+		Use:               "push <dir>",
+		Short:             "Upload the image set in a directory to the image bucket",
+		Args:              cobra.ExactArgs(1),
+		DisableAutoGenTag: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return withImageStore(ctx, cfg, func(store *images.Store) error {
+				m, err := store.Push(ctx, args[0], activate)
+				if err != nil {
+					return err
+				}
+				fmt.Printf("pushed image %s version %s\n", m.OS, m.Version)
+				if keep > 0 {
+					return store.Prune(ctx, m.OS, keep)
+				}
+				return nil
+			})
+		},
+	}
+	cmd.Flags().BoolVar(&activate, "activate", activate, "Make hosts sync the pushed version")
+	cmd.Flags().IntVar(&keep, "keep", keep, "Number of versions of the image kept in the bucket (0 to keep all)")
+	cfg.NATS.AddFlags(cmd.Flags())
+	return cmd
+}
+
+func NewCmdImageList(ctx context.Context, cfg *config.Config) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:               "list",
+		Short:             "List the images in the image bucket",
+		DisableAutoGenTag: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return withImageStore(ctx, cfg, func(store *images.Store) error {
+				versions, err := store.Versions(ctx)
+				if err != nil {
+					return err
+				}
+				table := tablewriter.NewWriter(os.Stdout)
+				table.SetHeader([]string{"OS", "Version", "Created", "RootFS", "Latest"})
+				for _, m := range versions {
+					latest, _ := store.LatestVersion(ctx, m.OS)
+					table.Append([]string{m.OS, m.Version, m.Created.Format(time.RFC3339), m.RootFS.SHA256[:12], fmt.Sprint(latest == m.Version)})
+				}
+				table.Render()
+				return nil
+			})
+		},
+	}
+	cfg.NATS.AddFlags(cmd.Flags())
+	return cmd
+}
+
+func withImageStore(ctx context.Context, cfg *config.Config, fn func(store *images.Store) error) error {
+	if err := cfg.NATS.ResolveSecrets(); err != nil {
+		return err
+	}
+	nc, err := backend.NewConnection(cfg.NATS)
+	if err != nil {
+		return err
+	}
+	defer nc.Drain() //nolint:errcheck
+
+	store, err := images.NewStore(ctx, nc)
+	if err != nil {
+		return err
+	}
+	return fn(store)
+}
@@ -18,6 +18,9 @@ package cmds
 
 import (
 	"flag"
+	"os"
+
+	"github.com/appscodelabs/gh-ci-webhook/pkg/config"
 
 	"github.com/spf13/cobra"
 	"gomodules.xyz/signals"
@@ -25,21 +28,38 @@ import (
 )
 
 func NewRootCmd() *cobra.Command {
+	// The config file is loaded before the commands are created, so that
+	// its values are used as flag defaults and flags take precedence.
+	configFile := config.PathFromArgs(os.Args[1:])
+	cfg, loadErr := config.Load(configFile)
+	if loadErr != nil {
+		cfg = config.New()
+	}
+
 	rootCmd := &cobra.Command{
 		Use:               "gh-ci [command]",
 		Short:             `gh-ci by AppsCode - GitHub CI for private repos`,
 		DisableAutoGenTag: true,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if loadErr != nil {
+				return loadErr
+			}
+			return cfg.Validate()
+		},
 	}
 
 	flags := rootCmd.PersistentFlags()
 	flags.AddGoFlagSet(flag.CommandLine)
+	flags.StringVar(&configFile, "config", configFile, "PATH to config file (env "+config.EnvConfigFile+")")
 
 	ctx := signals.SetupSignalContext()
 
-	rootCmd.AddCommand(NewCmdRun())
-	rootCmd.AddCommand(NewCmdHostctl(ctx))
-	rootCmd.AddCommand(NewCmdWaitForJob())
-	rootCmd.AddCommand(NewCmdFirecracker())
+	rootCmd.AddCommand(NewCmdRun(ctx, cfg))
+	rootCmd.AddCommand(NewCmdHostctl(ctx, cfg))
+	rootCmd.AddCommand(NewCmdWaitForJob(cfg))
+	rootCmd.AddCommand(NewCmdConfig(cfg))
+	rootCmd.AddCommand(NewCmdFirecracker(ctx))
+	rootCmd.AddCommand(NewCmdImage(ctx, cfg))
 	rootCmd.AddCommand(v.NewCmdVersion())
 	return rootCmd
 }
@@ -22,24 +22,30 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/appscodelabs/gh-ci-webhook/pkg/backend"
+	"github.com/appscodelabs/gh-ci-webhook/pkg/config"
 	"github.com/appscodelabs/gh-ci-webhook/pkg/providers"
+	"github.com/appscodelabs/gh-ci-webhook/pkg/providers/firecracker"
 
 	"github.com/google/go-github/v70/github"
 	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nats.go/jetstream"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
+	"gomodules.xyz/go-sh"
 	"k8s.io/klog/v2"
 )
 
-func NewCmdWaitForJob() *cobra.Command {
+func NewCmdWaitForJob(cfg *config.Config) *cobra.Command {
 	var (
-		ncOpts  = backend.NewNATSOptions()
-		nc      *nats.Conn
-		testrig bool
+		ncOpts = cfg.NATS
+		opts   = cfg.WaitForJob
+		nc     *nats.Conn
 	)
 	cmd := &cobra.Command{
 		Use:               "wait-for-job",
@@ -50,8 +56,12 @@ func NewCmdWaitForJob() *cobra.Command {
 
 			hostname, _ := os.Hostname()
 
+			if err := ncOpts.ResolveSecrets(); err != nil {
+				return err
+			}
+
 			var err error
-			nc, err = backend.NewConnection(ncOpts.Addr, ncOpts.CredFile)
+			nc, err = backend.NewConnection(ncOpts)
 			if err != nil {
 				return err
 			}
@@ -59,7 +69,7 @@ func NewCmdWaitForJob() *cobra.Command {
 
 			var event *github.WorkflowJobEvent
 			for {
-				event, err = wait_until_job(nc, testrig)
+				event, err = wait_until_job(nc, opts.Testrig, opts.Labels, opts.Repos)
 				if err != nil {
 					klog.ErrorS(err, "error while waiting for next job")
 				}
@@ -77,6 +87,23 @@ func NewCmdWaitForJob() *cobra.Command {
 			}
 
 			backend.ReportStatus(nc, hostname, backend.StatusPicked, providers.EventKey(event))
+			backend.ReportJob(nc, hostname, event)
+
+			if opts.CacheVolume {
+				if err := useCacheVolume(nc, hostname, event.GetRepo().GetFullName()); err != nil {
+					klog.ErrorS(err, "failed to use cache volume")
+				}
+			}
+			if opts.SSHDebugKeys {
+				if err := useDebugKeys(nc, hostname); err != nil {
+					klog.ErrorS(err, "failed to authorize debug keys")
+				}
+			}
+			if opts.GitMirror != "" {
+				if err := useGitMirror(opts.GitMirror, event.GetRepo().GetFullName()); err != nil {
+					klog.ErrorS(err, "failed to configure git mirror")
+				}
+			}
 
 			// https://gist.github.com/tamalsaha/af2f99c80f84410253bd1e532bdfabc7
 			// export runner_scope=$(cat repo_owner.txt)
@@ -85,18 +112,153 @@ func NewCmdWaitForJob() *cobra.Command {
 			jobVars := fmt.Sprintf(`export runner_scope=%s/%s
 export labels=%s
 `, event.GetRepo().GetOwner().GetLogin(), event.GetRepo().GetName(), label)
-			return os.WriteFile("job_vars.txt", []byte(jobVars), 0o644)
+			if err := os.WriteFile("job_vars.txt", []byte(jobVars), 0o644); err != nil {
+				return err
+			}
+			if err := runJobHook(event, label); err != nil {
+				klog.ErrorS(err, "failed to run job hook")
+			}
+			return nil
 		},
 	}
 
 	ncOpts.AddFlags(cmd.Flags())
-	cmd.Flags().BoolVar(&testrig, "testrig", testrig, "Prefer testrig")
+	opts.AddFlags(cmd.Flags())
 
 	return cmd
 }
 
+// mountCacheVolume mounts the cache volume and bind mounts the cache
+// directories of docker, Go and npm from it.
+const mountCacheVolume = `set -e
+dev=/dev/vdb
+for i in $(seq 30); do
+  [ "$(blockdev --getsize64 $dev)" -gt 1048576 ] && break
+  sleep 1
+done
+blockdev --flushbufs $dev
+mkdir -p /cache
+mount $dev /cache
+systemctl stop docker docker.socket || true
+for dir in /var/lib/docker /home/runner/go/pkg/mod /home/runner/.npm /home/runner/.cache; do
+  mkdir -p /cache$dir $dir
+  mount --bind /cache$dir $dir
+done
+chown -R runner:runner /cache/home/runner /home/runner/go /home/runner/.npm /home/runner/.cache
+systemctl start docker
+`
+
+// useCacheVolume asks the host to attach the cache volume of a repository
+// to this VM and mounts it.
+func useCacheVolume(nc *nats.Conn, hostname, fullName string) error {
+	resp, err := nc.Request(firecracker.SubjectVolume+"."+hostname, []byte(fullName), 2*time.Minute)
+	if err != nil {
+		return err
+	}
+	if string(resp.Data) != "OK" {
+		return errors.New(string(resp.Data))
+	}
+	if out, err := sh.Command("/bin/bash", "-c", mountCacheVolume).CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "failed to mount cache volume: %s", out)
+	}
+	klog.InfoS("mounted cache volume", "repo", fullName)
+	return nil
+}
+
+// useDebugKeys authorizes the ssh keys of the debug users of the org of the
+// reported job, as given by the host, for the runner and root users.
+func useDebugKeys(nc *nats.Conn, hostname string) error {
+	resp, err := nc.Request(firecracker.SubjectSSHKeys+"."+hostname, nil, 30*time.Second)
+	if err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(resp.Data)) == 0 {
+		return nil
+	}
+	for _, home := range []string{"/root", "/home/runner"} {
+		dir := filepath.Join(home, ".ssh")
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(filepath.Join(dir, "authorized_keys"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(append(bytes.TrimSpace(resp.Data), '\n'))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if out, err := sh.Command("chown", "-R", "runner:runner", "/home/runner/.ssh").CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "failed to chown ssh dir: %s", out)
+	}
+	klog.InfoS("authorized debug keys")
+	return nil
+}
+
+// gitMirrorConfig is the git config file with the url rewrites of the git
+// mirror, included by the system git config.
+const gitMirrorConfig = "/etc/gh-ci-git-mirror.gitconfig"
+
+// repoNameChars are the characters allowed in GitHub repository names.
+const repoNameChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_."
+
+// useGitMirror makes git fetch the repository from the git mirror on the
+// host. Pushes still go to GitHub.
+//
+// insteadOf rewrites urls by prefix, so the urls of other repositories whose
+// name starts with the name of the repository, eg, owner/repo-foo for
+// owner/repo, are rewritten to themselves by longer prefixes, as the longest
+// matching prefix wins.
+func useGitMirror(mirror, fullName string) error {
+	upstream := "https://github.com/" + fullName
+	mirror = strings.TrimSuffix(mirror, "/") + "/" + fullName + ".git"
+
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "[url %q]\n\tinsteadOf = %s\n\tinsteadOf = %s.git\n", mirror, upstream, upstream)
+	fmt.Fprintf(&buf, "[url %q]\n\tpushInsteadOf = %s\n", upstream, upstream)
+	for _, prefix := range []string{upstream, upstream + ".git"} {
+		for _, c := range repoNameChars {
+			other := prefix + string(c)
+			fmt.Fprintf(&buf, "[url %q]\n\tinsteadOf = %s\n", other, other)
+		}
+	}
+	if err := os.WriteFile(gitMirrorConfig, []byte(buf.String()), 0o644); err != nil {
+		return err
+	}
+	args := []string{"config", "--system", "--add", "include.path", gitMirrorConfig}
+	if out, err := sh.Command("git", args).CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "git %s: %s", strings.Join(args, " "), out)
+	}
+	klog.InfoS("using git mirror", "repo", fullName, "mirror", mirror)
+	return nil
+}
+
+// runJobHook runs the job hook written by the user-data of the VM, if any.
+func runJobHook(event *github.WorkflowJobEvent, label string) error {
+	if _, err := os.Stat(firecracker.JobHookPath); os.IsNotExist(err) {
+		return nil
+	}
+	out, err := sh.NewSession().
+		SetEnv("GH_CI_JOB_ID", fmt.Sprintf("%d", event.GetWorkflowJob().GetID())).
+		SetEnv("GH_CI_JOB_SCOPE", event.GetRepo().GetFullName()).
+		SetEnv("GH_CI_JOB_WORKFLOW", event.GetWorkflowJob().GetWorkflowName()).
+		SetEnv("GH_CI_JOB_NAME", event.GetWorkflowJob().GetName()).
+		SetEnv("GH_CI_JOB_LABEL", label).
+		Command(firecracker.JobHookPath).
+		CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "%s: %s", firecracker.JobHookPath, out)
+	}
+	klog.InfoS("ran job hook", "output", string(out))
+	return nil
+}
+
 // https://natsbyexample.com/examples/jetstream/workqueue-stream/go
-func wait_until_job(nc *nats.Conn, testrig bool) (*github.WorkflowJobEvent, error) {
+func wait_until_job(nc *nats.Conn, testrig bool, labels, repos []string) (*github.WorkflowJobEvent, error) {
 	js, err := jetstream.New(nc)
 	if err != nil {
 		return nil, err
@@ -113,9 +275,12 @@ func wait_until_job(nc *nats.Conn, testrig bool) (*github.WorkflowJobEvent, erro
 
 	defer printStreamState(ctx, streamQueued)
 
-	subjects := []string{
-		streamName + "." + backend.RunnerHigh,
-		streamName + "." + backend.RunnerRegular,
+	if len(labels) == 0 {
+		labels = []string{backend.RunnerHigh, backend.RunnerRegular}
+	}
+	subjects := make([]string, 0, len(labels)+1)
+	for _, label := range labels {
+		subjects = append(subjects, streamName+"."+label)
 	}
 	if testrig {
 		subjects = append([]string{streamName + "." + backend.RunnerTestrig}, subjects...)
@@ -123,7 +288,7 @@ func wait_until_job(nc *nats.Conn, testrig bool) (*github.WorkflowJobEvent, erro
 
 	var payload []byte
 	for _, subj := range subjects {
-		payload, err = consumeMsg(ctx, streamQueued, subj)
+		payload, err = consumeMsg(ctx, streamQueued, subj, repos)
 		if err == nil && len(payload) > 0 {
 			break
 		}
@@ -146,7 +311,9 @@ func wait_until_job(nc *nats.Conn, testrig bool) (*github.WorkflowJobEvent, erro
 	return event.(*github.WorkflowJobEvent), nil
 }
 
-func consumeMsg(ctx context.Context, streamQueued jetstream.Stream, subj string) ([]byte, error) {
+// consumeMsg picks the oldest job queued for subj. If repos is set, only
+// the jobs of these repos are picked and the others are left in the queue.
+func consumeMsg(ctx context.Context, streamQueued jetstream.Stream, subj string, repos []string) ([]byte, error) {
 	cons, err := streamQueued.CreateOrUpdateConsumer(ctx, jetstream.ConsumerConfig{
 		FilterSubject: subj,
 		AckPolicy:     jetstream.AckExplicitPolicy,
@@ -167,16 +334,27 @@ func consumeMsg(ctx context.Context, streamQueued jetstream.Stream, subj string)
 		    wait for a response from the server on the reception and processing of the acknowledgement. This helps to
 		    avoid message duplication and guarantees that the message will not be re-delivered by the consumer.
 	*/
-	msgs, err := cons.FetchNoWait(1)
+	batch := 1
+	if len(repos) > 0 {
+		batch = 20
+	}
+	msgs, err := cons.FetchNoWait(batch)
 	if err != nil {
 		return nil, err
 	}
+	var payload []byte
 	for msg := range msgs.Messages() {
+		if payload != nil || !fromRepos(msg.Data(), repos) {
+			_ = msg.Nak()
+			continue
+		}
 		if err := msg.DoubleAck(ctx); err != nil {
 			return nil, err
-		} else {
-			return msg.Data(), nil // DONE
 		}
+		payload = msg.Data()
+	}
+	if payload != nil {
+		return payload, nil // DONE
 	}
 	if msgs.Error() != nil {
 		return nil, errors.Wrap(msgs.Error(), "error during Fetch()")
@@ -184,6 +362,24 @@ func consumeMsg(ctx context.Context, streamQueued jetstream.Stream, subj string)
 	return nil, nil
 }
 
+// fromRepos returns true if a queued job belongs to one of repos, or if
+// repos is empty.
+func fromRepos(data []byte, repos []string) bool {
+	if len(repos) == 0 {
+		return true
+	}
+	eventType, payload, found := bytes.Cut(data, []byte(":"))
+	if !found {
+		return false
+	}
+	event, err := github.ParseWebHook(string(eventType), payload)
+	if err != nil {
+		return false
+	}
+	e, ok := event.(*github.WorkflowJobEvent)
+	return ok && slices.Contains(repos, e.GetRepo().GetFullName())
+}
+
 func printStreamState(ctx context.Context, stream jetstream.Stream) {
 	info, _ := stream.Info(ctx)
 	if info != nil {
@@ -19,20 +19,26 @@ package cmds
 
 import (
 	"context"
+	"crypto/subtle"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"os"
+	"strings"
 	"time"
 
+	"github.com/appscodelabs/gh-ci-webhook/pkg/alerts"
 	"github.com/appscodelabs/gh-ci-webhook/pkg/backend"
+	"github.com/appscodelabs/gh-ci-webhook/pkg/config"
+	"github.com/appscodelabs/gh-ci-webhook/pkg/notifier"
+	"github.com/appscodelabs/gh-ci-webhook/pkg/secrets"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/google/go-github/v70/github"
 	"github.com/nats-io/nats.go"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"golang.org/x/crypto/acme/autocert"
 	"golang.org/x/oauth2"
 	shell "gomodules.xyz/go-sh"
@@ -40,19 +46,11 @@ import (
 	"k8s.io/klog/v2"
 )
 
-var (
-	secretToken = ""
-	certDir     = "certs"
-	email       = "tamal@appscode.com"
-	hosts       = []string{"this-is-nats.appscode.ninja"}
-	port        = 8080
-	enableSSL   bool
-)
-
-func NewCmdRun() *cobra.Command {
+func NewCmdRun(ctx context.Context, cfg *config.Config) *cobra.Command {
 	var (
-		ghToken = os.Getenv("GITHUB_TOKEN")
-		ncOpts  = backend.NewNATSOptions()
+		opts      = cfg.Webhook
+		ncOpts    = cfg.NATS
+		alertOpts = cfg.Alerts
 
 		nc *nats.Conn
 	)
@@ -61,8 +59,12 @@ func NewCmdRun() *cobra.Command {
 		Short:             "Run GitHub webhook server",
 		DisableAutoGenTag: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := resolveRunSecrets(cfg); err != nil {
+				return err
+			}
+
 			var err error
-			nc, err = backend.NewConnection(ncOpts.Addr, ncOpts.CredFile)
+			nc, err = backend.NewConnection(ncOpts)
 			if err != nil {
 				return err
 			}
@@ -73,41 +75,85 @@ func NewCmdRun() *cobra.Command {
 				return err
 			}
 
-			opts := backend.DefaultOptions()
-			mgr := backend.New(nc, opts)
+			if err := notifier.Start(ctx, cfg.Notifier); err != nil {
+				return err
+			}
+			ae, err := alerts.NewEngine(alertOpts, nc, sp)
+			if err != nil {
+				return err
+			}
+			go ae.Run(ctx)
+
+			mgr := backend.New(nc, backend.DefaultOptions())
 			if err = mgr.EnsureStreams(); err != nil {
 				return err
 			}
 
-			if secretToken == "" {
-				secretToken = passgen.GenerateForCharset(20, passgen.AlphaNum)
-				fmt.Printf("using secret token %s\n", secretToken)
+			if opts.SecretToken == "" {
+				opts.SecretToken = passgen.GenerateForCharset(20, passgen.AlphaNum)
+				// redacted from the logs, but printed once unredacted, so
+				// that it can be configured in GitHub
+				secrets.AddKnown(opts.SecretToken)
+				_, _ = fmt.Fprintf(secrets.Stdout, "using secret token %s\n", opts.SecretToken)
 			}
 
+			prev := cfg
+			go config.Watch(ctx, cfg, addRunFlags, func(latest *config.Config) {
+				if err := resolveRunSecrets(latest); err != nil {
+					klog.ErrorS(err, "failed to reload config")
+					return
+				}
+				if err := notifier.Start(ctx, latest.Notifier); err != nil {
+					klog.ErrorS(err, "failed to restart notifier")
+				} else {
+					cfg.Notifier = latest.Notifier
+				}
+				if err := ae.Reload(latest.Alerts); err != nil {
+					klog.ErrorS(err, "failed to reload alert rules")
+				} else {
+					cfg.Alerts = latest.Alerts
+				}
+
+				if latest.Webhook.SecretToken == "" {
+					latest.Webhook.SecretToken = opts.SecretToken
+				}
+				config.RestartRequired("nats", cfg.NATS, prev.NATS, latest.NATS)
+				config.RestartRequired("webhook", cfg.Webhook, prev.Webhook, latest.Webhook)
+				prev = latest
+			})
+
 			// github client
-			ctx := context.Background()
-			ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: ghToken})
-			tc := oauth2.NewClient(ctx, ts)
+			ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: opts.GitHubToken})
+			tc := oauth2.NewClient(context.Background(), ts)
 
 			gh := github.NewClient(tc)
 
-			return runServer(gh, nc, sp)
+			return runServer(gh, nc, sp, ae, opts)
 		},
 	}
 
-	cmd.Flags().StringVar(&ghToken, "github-token", ghToken, "GitHub Token")
-	cmd.Flags().StringVar(&secretToken, "secret-token", secretToken, "Secret token to verify webhook payloads")
-	cmd.Flags().StringVar(&certDir, "cert-dir", certDir, "Directory where certs are stored")
-	cmd.Flags().StringVar(&email, "email", email, "Email used by Let's Encrypt to notify about problems with issued certificates")
-	cmd.Flags().StringSliceVar(&hosts, "hosts", hosts, "Hosts for which certificate will be issued")
-	cmd.Flags().IntVar(&port, "port", port, "Port used when SSL is not enabled")
-	cmd.Flags().BoolVar(&enableSSL, "ssl", enableSSL, "Set true to enable SSL via Let's Encrypt")
-
-	ncOpts.AddFlags(cmd.Flags())
+	addRunFlags(cmd.Flags(), cfg)
 
 	return cmd
 }
 
+func resolveRunSecrets(cfg *config.Config) error {
+	if err := cfg.NATS.ResolveSecrets(); err != nil {
+		return err
+	}
+	if err := cfg.Webhook.ResolveSecrets(); err != nil {
+		return err
+	}
+	return cfg.Notifier.ResolveSecrets()
+}
+
+func addRunFlags(fs *pflag.FlagSet, cfg *config.Config) {
+	cfg.Webhook.AddFlags(fs)
+	cfg.NATS.AddFlags(fs)
+	cfg.Notifier.AddFlags(fs)
+	cfg.Alerts.AddFlags(fs)
+}
+
 type Response struct {
 	Type    string               `json:"type,omitempty"`
 	Host    string               `json:"host,omitempty"`
@@ -118,7 +164,14 @@ type Response struct {
 	TLS     *tls.ConnectionState `json:"tls,omitempty"`
 }
 
-func runServer(gh *github.Client, nc *nats.Conn, sp *backend.StatusReporter) error {
+type SilenceRequest struct {
+	Rule     string `json:"rule"`
+	Subject  string `json:"subject,omitempty"`
+	Duration string `json:"duration,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+func runServer(gh *github.Client, nc *nats.Conn, sp *backend.StatusReporter, ae *alerts.Engine, opts *backend.WebhookOptions) error {
 	sh := shell.NewSession()
 	sh.ShowCMD = true
 	sh.PipeFail = true
@@ -145,11 +198,51 @@ func runServer(gh *github.Client, nc *nats.Conn, sp *backend.StatusReporter) err
 	r.Get("/runner-status", func(w http.ResponseWriter, r *http.Request) {
 		data, err := sp.GenerateHTMLReport()
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, secrets.Redact(err.Error()), http.StatusInternalServerError)
 			return
 		}
 		w.Header().Set("Content-type", "text/html")
-		_, _ = w.Write([]byte(data))
+		_, _ = w.Write([]byte(secrets.Redact(data)))
+	})
+
+	r.Get("/alerts", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(ae.State())
+	})
+	r.Route("/alerts/silences", func(r chi.Router) {
+		r.Use(requireSecretToken(opts.SecretToken))
+		r.Post("/", func(w http.ResponseWriter, r *http.Request) {
+			var req SilenceRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if req.Rule == "" {
+				http.Error(w, "missing rule", http.StatusBadRequest)
+				return
+			}
+			s := alerts.Silence{
+				Rule:    req.Rule,
+				Subject: req.Subject,
+				Comment: req.Comment,
+			}
+			if req.Duration != "" {
+				d, err := time.ParseDuration(req.Duration)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				s.Until = time.Now().Add(d)
+			}
+			_, _ = w.Write([]byte(ae.Silence(s)))
+		})
+		r.Delete("/{id}", func(w http.ResponseWriter, r *http.Request) {
+			if !ae.Unsilence(chi.URLParam(r, "id")) {
+				http.Error(w, "silence not found", http.StatusNotFound)
+			}
+		})
 	})
 
 	r.Get("/*", func(w http.ResponseWriter, r *http.Request) {
@@ -161,12 +254,15 @@ func runServer(gh *github.Client, nc *nats.Conn, sp *backend.StatusReporter) err
 			Headers: r.Header,
 			TLS:     r.TLS,
 		}
-		enc := json.NewEncoder(w)
-		enc.SetIndent("", "  ")
-		_ = enc.Encode(resp)
+		data, err := json.MarshalIndent(resp, "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte(secrets.Redact(string(data)) + "\n"))
 	})
 	r.Post("/*", func(w http.ResponseWriter, r *http.Request) {
-		err := backend.SubmitPayload(gh, nc, r, []byte(secretToken))
+		err := backend.SubmitPayload(gh, nc, r, []byte(opts.SecretToken))
 		if err != nil {
 			klog.Errorln(err)
 			http.Error(w, err.Error(), http.StatusBadRequest)
@@ -174,8 +270,8 @@ func runServer(gh *github.Client, nc *nats.Conn, sp *backend.StatusReporter) err
 		}
 	})
 
-	if !enableSSL {
-		addr := fmt.Sprintf(":%d", port)
+	if !opts.EnableSSL {
+		addr := fmt.Sprintf(":%d", opts.Port)
 		fmt.Println("Listening to addr", addr)
 		return http.ListenAndServe(addr, r)
 	}
@@ -185,9 +281,9 @@ func runServer(gh *github.Client, nc *nats.Conn, sp *backend.StatusReporter) err
 	// - https://stackoverflow.com/a/40494806/244009
 	certManager := autocert.Manager{
 		Prompt:     autocert.AcceptTOS,
-		Cache:      autocert.DirCache(certDir),
-		HostPolicy: autocert.HostWhitelist(hosts...),
-		Email:      email,
+		Cache:      autocert.DirCache(opts.CertDir),
+		HostPolicy: autocert.HostWhitelist(opts.Hosts...),
+		Email:      opts.Email,
 	}
 	server := &http.Server{
 		Addr:         ":https",
@@ -211,3 +307,18 @@ func runServer(gh *github.Client, nc *nats.Conn, sp *backend.StatusReporter) err
 	fmt.Println("Listening to addr", server.Addr)
 	return server.ListenAndServeTLS("", "") // Key and cert are coming from Let's Encrypt
 }
+
+// requireSecretToken only allows requests carrying the webhook secret token
+// as a bearer token.
+func requireSecretToken(secretToken string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !found || subtle.ConstantTimeCompare([]byte(token), []byte(secretToken)) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,273 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/appscodelabs/gh-ci-webhook/pkg/actionscache"
+	"github.com/appscodelabs/gh-ci-webhook/pkg/alerts"
+	"github.com/appscodelabs/gh-ci-webhook/pkg/backend"
+	"github.com/appscodelabs/gh-ci-webhook/pkg/gitmirror"
+	"github.com/appscodelabs/gh-ci-webhook/pkg/mirror"
+	"github.com/appscodelabs/gh-ci-webhook/pkg/notifier"
+	"github.com/appscodelabs/gh-ci-webhook/pkg/providers/firecracker"
+	"github.com/appscodelabs/gh-ci-webhook/pkg/providers/linode"
+	"github.com/appscodelabs/gh-ci-webhook/pkg/proxy"
+	"github.com/appscodelabs/gh-ci-webhook/pkg/secrets"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	APIVersion = "gh-ci.appscode.com/v1alpha1"
+	Kind       = "Config"
+
+	// EnvConfigFile is used to find the config file when --config is not set.
+	EnvConfigFile = "GH_CI_CONFIG"
+)
+
+// Config is the configuration file shared by the run, hostctl and
+// wait-for-job commands. Settings are applied in order of defaults, config
+// file, environment overrides (see ApplyEnv) and command line flags.
+type Config struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+
+	NATS       *backend.NATSOptions    `json:"nats,omitempty"`
+	Webhook    *backend.WebhookOptions `json:"webhook,omitempty"`
+	Notifier   *notifier.Options       `json:"notifier,omitempty"`
+	Alerts     *alerts.Options         `json:"alerts,omitempty"`
+	Hostctl    *HostctlOptions         `json:"hostctl,omitempty"`
+	WaitForJob *WaitForJobOptions      `json:"waitForJob,omitempty"`
+
+	path   string
+	kv     jetstream.KeyValue
+	kvKeys []string
+}
+
+type HostctlOptions struct {
+	backend.Options `json:",inline"`
+
+	GitHubToken      string `json:"githubToken,omitempty"`
+	StatusServerAddr string `json:"statusServerAddr,omitempty"`
+	// Pool selects the pool.<pool> config key in NATS KV
+	Pool string `json:"pool,omitempty"`
+
+	Firecracker *firecracker.Options `json:"firecracker,omitempty"`
+	Linode      *linode.Options      `json:"linode,omitempty"`
+	Mirror      *mirror.Options      `json:"registryMirror,omitempty"`
+	CacheProxy  *proxy.Options       `json:"cacheProxy,omitempty"`
+	// ActionsCache implements the GitHub Actions cache service for VMs
+	ActionsCache *actionscache.Options `json:"actionsCache,omitempty"`
+	GitMirror    *gitmirror.Options    `json:"gitMirror,omitempty"`
+}
+
+func (opts *HostctlOptions) AddFlags(fs *pflag.FlagSet) {
+	secrets.StringVar(fs, &opts.GitHubToken, "github-token", "GitHub Token or secret reference (eg, systemd:github-token)")
+	fs.StringVar(&opts.StatusServerAddr, "status-server-addr", opts.StatusServerAddr, "host:port of the status server")
+	fs.StringVar(&opts.Pool, "pool", opts.Pool, "Name of the host pool used to select shared config in NATS KV")
+	opts.Options.AddFlags(fs)
+	opts.Linode.AddFlags(fs)
+	opts.Firecracker.AddFlags(fs)
+	opts.Mirror.AddFlags(fs)
+	opts.CacheProxy.AddFlags(fs)
+	opts.ActionsCache.AddFlags(fs)
+	opts.GitMirror.AddFlags(fs)
+}
+
+func (opts *HostctlOptions) Validate() error {
+	switch opts.Provider {
+	case "", "dummy", "linode":
+	case "firecracker":
+		if err := opts.Firecracker.Validate(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown provider %q", opts.Provider)
+	}
+	if err := opts.Mirror.Validate(); err != nil {
+		return err
+	}
+	if err := opts.CacheProxy.Validate(); err != nil {
+		return err
+	}
+	if err := opts.ActionsCache.Validate(); err != nil {
+		return err
+	}
+	return opts.GitMirror.Validate()
+}
+
+type WaitForJobOptions struct {
+	Testrig bool `json:"testrig,omitempty"`
+	// GitMirror is the URL of the git mirror on the host
+	GitMirror string `json:"gitMirror,omitempty"`
+	// CacheVolume requests the cache volume of the repository from the host
+	CacheVolume bool `json:"cacheVolume,omitempty"`
+	// Labels are the runner labels of the jobs picked, in priority order
+	Labels []string `json:"labels,omitempty"`
+	// Repos limits the jobs picked to these repos, if set
+	Repos []string `json:"repos,omitempty"`
+	// SSHDebugKeys authorizes the keys of the debug users of the org of the job
+	SSHDebugKeys bool `json:"sshDebugKeys,omitempty"`
+}
+
+func (opts *WaitForJobOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.BoolVar(&opts.Testrig, "testrig", opts.Testrig, "Prefer testrig")
+	fs.StringVar(&opts.GitMirror, "git-mirror", opts.GitMirror, "URL of the git mirror used to fetch the repository of the picked job")
+	fs.BoolVar(&opts.CacheVolume, "cache-volume", opts.CacheVolume, "Attach and mount the cache volume of the repository of the picked job")
+	fs.StringSliceVar(&opts.Labels, "labels", opts.Labels, "Runner labels of the jobs picked, in priority order (default f0,firecracker)")
+	fs.StringSliceVar(&opts.Repos, "repos", opts.Repos, "Repos whose jobs are picked (any repo if empty)")
+	fs.BoolVar(&opts.SSHDebugKeys, "ssh-debug-keys", opts.SSHDebugKeys, "Authorize the ssh keys of the debug users of the org of the picked job")
+}
+
+// New returns the default config. Provider and notifier sections point to
+// the package level DefaultOptions used by those packages.
+func New() *Config {
+	return &Config{
+		APIVersion: APIVersion,
+		Kind:       Kind,
+		NATS:       backend.NewNATSOptions(),
+		Webhook:    backend.NewWebhookOptions(),
+		Notifier:   notifier.DefaultOptions,
+		Alerts:     alerts.NewOptions(),
+		Hostctl: &HostctlOptions{
+			Options:          backend.DefaultOptions(),
+			GitHubToken:      os.Getenv("GITHUB_TOKEN"),
+			StatusServerAddr: ":8080",
+			Firecracker:      firecracker.DefaultOptions,
+			Linode:           linode.DefaultOptions,
+			Mirror:           mirror.NewOptions(),
+			CacheProxy:       proxy.NewOptions(),
+			ActionsCache:     actionscache.NewOptions(),
+			GitMirror:        gitmirror.NewOptions(),
+		},
+		WaitForJob: &WaitForJobOptions{},
+	}
+}
+
+// NewDefaults returns the default config without sharing any state with
+// the running process. It is used when the config file is reloaded.
+func NewDefaults() *Config {
+	cfg := New()
+	cfg.Notifier = notifier.NewOptions()
+	cfg.Hostctl.Firecracker = firecracker.NewOptions()
+	cfg.Hostctl.Linode = linode.NewOptions()
+	return cfg
+}
+
+// Load reads the config file at path on top of the defaults and applies
+// environment overrides. An empty path only applies environment overrides.
+func Load(path string) (*Config, error) {
+	return load(context.Background(), New(), path, nil, nil)
+}
+
+func load(ctx context.Context, cfg *Config, path string, kv jetstream.KeyValue, kvKeys []string) (*Config, error) {
+	cfg.path = path
+	cfg.kv = kv
+	cfg.kvKeys = kvKeys
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var meta struct {
+			APIVersion string `json:"apiVersion"`
+			Kind       string `json:"kind"`
+		}
+		if err := yaml.Unmarshal(data, &meta); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse config file %s", path)
+		}
+		if meta.APIVersion != APIVersion || meta.Kind != Kind {
+			return nil, fmt.Errorf("config file %s has apiVersion %q and kind %q, expected %s %s", path, meta.APIVersion, meta.Kind, APIVersion, Kind)
+		}
+		if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse config file %s", path)
+		}
+	}
+	if kv != nil {
+		if err := cfg.applyKV(ctx, kv, kvKeys); err != nil {
+			return nil, err
+		}
+		if cfg.APIVersion != APIVersion || cfg.Kind != Kind {
+			return nil, fmt.Errorf("config has apiVersion %q and kind %q, expected %s %s", cfg.APIVersion, cfg.Kind, APIVersion, Kind)
+		}
+	}
+	if err := ApplyEnv(cfg, os.Environ()); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Path returns the config file the config was loaded from.
+func (cfg *Config) Path() string {
+	return cfg.path
+}
+
+func (cfg *Config) Validate() error {
+	if cfg.NATS.Addr == "" {
+		return errors.New("missing nats address")
+	}
+	if err := cfg.Webhook.Validate(); err != nil {
+		return err
+	}
+	if err := cfg.Notifier.Validate(); err != nil {
+		return err
+	}
+	if err := cfg.Alerts.Validate(); err != nil {
+		return err
+	}
+	return cfg.Hostctl.Validate()
+}
+
+// PathFromArgs finds the config file from the --config flag in args,
+// falling back to the GH_CI_CONFIG env var. The config is loaded before
+// commands are created so that file values become the flag defaults.
+func PathFromArgs(args []string) string {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if v, found := cutFlag(arg, "config"); found {
+			if v != "" {
+				return v
+			}
+			if i+1 < len(args) {
+				return args[i+1]
+			}
+		}
+	}
+	return os.Getenv(EnvConfigFile)
+}
+
+func cutFlag(arg, name string) (string, bool) {
+	for _, prefix := range []string{"--" + name, "-" + name} {
+		if arg == prefix {
+			return "", true
+		}
+		if v, found := strings.CutPrefix(arg, prefix+"="); found {
+			return v, true
+		}
+	}
+	return "", false
+}
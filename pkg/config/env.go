@@ -0,0 +1,134 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// EnvPrefix is the prefix of environment variables overriding config
+// fields. Nested fields are separated by a double underscore and field
+// names are matched ignoring case and underscores, eg,
+// GH_CI_HOSTCTL__FIRECRACKER__NUM_INSTANCES=4 or GH_CI_NATS__ADDR=nats:4222
+const EnvPrefix = "GH_CI_"
+
+// ApplyEnv overrides config fields from env, given as KEY=value pairs.
+func ApplyEnv(cfg *Config, env []string) error {
+	for _, kv := range env {
+		key, value, _ := strings.Cut(kv, "=")
+		name, found := strings.CutPrefix(key, EnvPrefix)
+		if !found || key == EnvConfigFile {
+			continue
+		}
+		field, err := lookupField(reflect.ValueOf(cfg).Elem(), strings.Split(name, "__"))
+		if err != nil {
+			return fmt.Errorf("invalid env var %s: %v", key, err)
+		}
+		if err := setField(field, value); err != nil {
+			return fmt.Errorf("invalid env var %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+func lookupField(v reflect.Value, path []string) (reflect.Value, error) {
+	for _, name := range path {
+		if v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		if v.Kind() != reflect.Struct {
+			return v, fmt.Errorf("%s is not a config section", name)
+		}
+		f, found := findField(v, normalize(name))
+		if !found {
+			return v, fmt.Errorf("unknown field %s", name)
+		}
+		v = f
+	}
+	return v, nil
+}
+
+func findField(v reflect.Value, name string) (reflect.Value, bool) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		tag, _, _ := strings.Cut(sf.Tag.Get("json"), ",")
+		if tag == "-" {
+			continue
+		}
+		if sf.Anonymous && tag == "" {
+			if f, found := findField(v.Field(i), name); found {
+				return f, true
+			}
+			continue
+		}
+		if tag == "" {
+			tag = sf.Name
+		}
+		if normalize(tag) == name {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+func normalize(name string) string {
+	return strings.ToLower(strings.ReplaceAll(name, "_", ""))
+}
+
+// setField parses value as yaml into the field, so durations, numbers and
+// bools use the same format as the config file. Lists and maps also accept
+// the flag format, eg, a,b or k1=v1,k2=v2.
+func setField(f reflect.Value, value string) error {
+	switch {
+	case f.Kind() == reflect.String:
+		f.SetString(value)
+		return nil
+	case f.Kind() == reflect.Slice && f.Type().Elem().Kind() == reflect.String && !strings.HasPrefix(value, "["):
+		var items []string
+		if value != "" {
+			items = strings.Split(value, ",")
+		}
+		f.Set(reflect.ValueOf(items).Convert(f.Type()))
+		return nil
+	case f.Kind() == reflect.Map && f.Type().Elem().Kind() == reflect.String && !strings.HasPrefix(value, "{"):
+		m := reflect.MakeMap(f.Type())
+		for _, pair := range strings.Split(value, ",") {
+			if pair == "" {
+				continue
+			}
+			k, v, found := strings.Cut(pair, "=")
+			if !found {
+				return fmt.Errorf("expected key=value, found %q", pair)
+			}
+			m.SetMapIndex(reflect.ValueOf(k), reflect.ValueOf(v))
+		}
+		f.Set(m)
+		return nil
+	}
+	return yaml.Unmarshal([]byte(value), f.Addr().Interface())
+}
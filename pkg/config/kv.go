@@ -0,0 +1,146 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/appscodelabs/gh-ci-webhook/pkg/backend"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/pkg/errors"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// KVBucket stores partial config documents distributed to hosts
+	KVBucket = backend.StreamPrefix + "config"
+	// KVHistory is the number of revisions kept per key for rollback
+	KVHistory = 20
+
+	KeyGlobal     = "global"
+	KeyPoolPrefix = "pool."
+	KeyHostPrefix = "host."
+)
+
+// KVKeys returns the keys merged into the config of a host, in order.
+func KVKeys(pool, hostname string) []string {
+	keys := []string{KeyGlobal}
+	if pool != "" {
+		keys = append(keys, KeyPoolPrefix+pool)
+	}
+	return append(keys, KeyHostPrefix+hostname)
+}
+
+func ValidateKey(key string) error {
+	if key == KeyGlobal {
+		return nil
+	}
+	for _, prefix := range []string{KeyPoolPrefix, KeyHostPrefix} {
+		if name, found := strings.CutPrefix(key, prefix); found && name != "" && !strings.ContainsAny(name, ".*> ") {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid config key %q, expected %s, %s<pool> or %s<hostname>", key, KeyGlobal, KeyPoolPrefix, KeyHostPrefix)
+}
+
+func NewKV(ctx context.Context, nc *nats.Conn) (jetstream.KeyValue, error) {
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return nil, err
+	}
+	return js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{
+		Bucket:      KVBucket,
+		Description: "gh-ci config overrides",
+		History:     KVHistory,
+	})
+}
+
+// UseKV merges the keys from kv into the config on every reload, after
+// the config file and before env overrides and flags.
+func (cfg *Config) UseKV(kv jetstream.KeyValue, keys ...string) {
+	cfg.kv = kv
+	cfg.kvKeys = keys
+}
+
+func (cfg *Config) applyKV(ctx context.Context, kv jetstream.KeyValue, keys []string) error {
+	for _, key := range keys {
+		entry, err := kv.Get(ctx, key)
+		if errors.Is(err, jetstream.ErrKeyNotFound) {
+			continue
+		} else if err != nil {
+			return errors.Wrapf(err, "failed to read config key %s", key)
+		}
+		if err := yaml.UnmarshalStrict(entry.Value(), cfg); err != nil {
+			return errors.Wrapf(err, "failed to parse config key %s revision %d", key, entry.Revision())
+		}
+	}
+	return nil
+}
+
+// CheckDocument verifies that data is a valid partial config document.
+func CheckDocument(data []byte) error {
+	cfg := NewDefaults()
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return err
+	}
+	if cfg.APIVersion != APIVersion || cfg.Kind != Kind {
+		return fmt.Errorf("unexpected apiVersion %q and kind %q", cfg.APIVersion, cfg.Kind)
+	}
+	return cfg.Validate()
+}
+
+// SetField sets the value at a dotted path, eg, hostctl.firecracker.numInstances,
+// in a config document. The value is parsed as yaml. A nil value removes the field.
+func SetField(data []byte, path string, value *string) ([]byte, error) {
+	doc := map[string]any{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		doc = map[string]any{}
+	}
+
+	parts := strings.Split(path, ".")
+	m := doc
+	for _, p := range parts[:len(parts)-1] {
+		next, ok := m[p].(map[string]any)
+		if !ok {
+			if value == nil {
+				return yaml.Marshal(doc)
+			}
+			next = map[string]any{}
+			m[p] = next
+		}
+		m = next
+	}
+
+	last := parts[len(parts)-1]
+	if value == nil {
+		delete(m, last)
+	} else {
+		var v any
+		if err := yaml.Unmarshal([]byte(*value), &v); err != nil {
+			return nil, errors.Wrapf(err, "invalid value for %s", path)
+		}
+		m[last] = v
+	}
+	return yaml.Marshal(doc)
+}
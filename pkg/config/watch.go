@@ -0,0 +1,107 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/spf13/pflag"
+	"k8s.io/klog/v2"
+)
+
+// Watch reloads the config on SIGHUP and on changes to the config keys in
+// NATS KV, and calls fn with the latest config. addFlags binds the flags of
+// the running command, so that flags passed on the command line keep
+// precedence over the reloaded config.
+func Watch(ctx context.Context, cur *Config, addFlags func(fs *pflag.FlagSet, cfg *Config), fn func(latest *Config)) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	defer signal.Stop(ch)
+
+	var updates <-chan jetstream.KeyValueEntry
+	if cur.kv != nil {
+		w, err := cur.kv.WatchFiltered(ctx, cur.kvKeys, jetstream.UpdatesOnly())
+		if err != nil {
+			klog.ErrorS(err, "failed to watch config keys", "bucket", KVBucket, "keys", cur.kvKeys)
+		} else {
+			defer w.Stop() //nolint:errcheck
+			updates = w.Updates()
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ch:
+			if cur.path == "" && cur.kv == nil {
+				klog.Warningln("received SIGHUP, but no config file is used")
+				continue
+			}
+		case entry, ok := <-updates:
+			if !ok {
+				updates = nil
+				continue
+			}
+			if entry == nil {
+				continue
+			}
+			klog.InfoS("config key changed", "key", entry.Key(), "revision", entry.Revision(), "op", entry.Operation())
+		}
+
+		latest, err := Reload(ctx, cur, os.Args[1:], addFlags)
+		if err != nil {
+			klog.ErrorS(err, "failed to reload config", "path", cur.path)
+			continue
+		}
+		klog.InfoS("reloaded config", "path", cur.path)
+		fn(latest)
+	}
+}
+
+// Reload loads the config on top of fresh defaults from the sources used
+// by cur and applies the flags in args.
+func Reload(ctx context.Context, cur *Config, args []string, addFlags func(fs *pflag.FlagSet, cfg *Config)) (*Config, error) {
+	latest, err := load(ctx, NewDefaults(), cur.path, cur.kv, cur.kvKeys)
+	if err != nil {
+		return nil, err
+	}
+	fs := pflag.NewFlagSet("reload", pflag.ContinueOnError)
+	fs.ParseErrorsWhitelist.UnknownFlags = true
+	addFlags(fs, latest)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if err := latest.Validate(); err != nil {
+		return nil, err
+	}
+	return latest, nil
+}
+
+// RestartRequired logs a warning if a setting that is only read at startup
+// differs from cur, the setting in use. It is logged once per change, ie,
+// unless the setting is unchanged since prev, the previously loaded config.
+func RestartRequired(section string, cur, prev, latest any) {
+	if !reflect.DeepEqual(cur, latest) && !reflect.DeepEqual(prev, latest) {
+		klog.Warningf("%s settings changed, restart to apply them", section)
+	}
+}
@@ -0,0 +1,249 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package diskcache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// Store is a size bounded file cache on disk. Entries are evicted in least
+// recently used order when the total size exceeds the max size. The access
+// order survives restarts through the file modification times.
+type Store struct {
+	dir     string
+	maxSize int64
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List // front is the most recently used entry
+	entries map[string]*list.Element
+	hits    int64
+	misses  int64
+}
+
+type entry struct {
+	name string
+	size int64
+}
+
+type Stats struct {
+	Entries int     `json:"entries"`
+	Size    int64   `json:"size"`
+	MaxSize int64   `json:"maxSize"`
+	Hits    int64   `json:"hits"`
+	Misses  int64   `json:"misses"`
+	HitRate float64 `json:"hitRate"`
+}
+
+// Open opens the store in dir, loading existing entries.
+func Open(dir string, maxSize int64) (*Store, error) {
+	s := &Store{
+		dir:     dir,
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: map[string]*list.Element{},
+	}
+	if err := os.RemoveAll(filepath.Join(dir, "tmp")); err != nil {
+		return nil, err
+	}
+	for _, d := range []string{"data", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0o755); err != nil {
+			return nil, err
+		}
+	}
+
+	type file struct {
+		entry
+		modTime time.Time
+	}
+	var files []file
+	err := filepath.WalkDir(filepath.Join(dir, "data"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if len(d.Name()) != sha256.Size*2 {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, file{entry: entry{name: d.Name(), size: fi.Size()}, modTime: fi.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.After(files[j].modTime)
+	})
+	for _, f := range files {
+		s.entries[f.name] = s.lru.PushBack(&entry{name: f.name, size: f.size})
+		s.size += f.size
+	}
+	s.mu.Lock()
+	s.evict()
+	s.mu.Unlock()
+	return s, nil
+}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *Store) path(name string) string {
+	return filepath.Join(s.dir, "data", name[:2], name)
+}
+
+// Get opens the cached file for key. The caller must close the file.
+func (s *Store) Get(key string) (*os.File, bool) {
+	name := hashKey(key)
+
+	s.mu.Lock()
+	e, found := s.entries[name]
+	if found {
+		s.lru.MoveToFront(e)
+		s.hits++
+	} else {
+		s.misses++
+	}
+	s.mu.Unlock()
+	if !found {
+		return nil, false
+	}
+
+	filename := s.path(name)
+	f, err := os.Open(filename)
+	if err != nil {
+		s.remove(name)
+		return nil, false
+	}
+	now := time.Now()
+	_ = os.Chtimes(filename, now, now)
+	return f, true
+}
+
+// Create returns a writer for a new entry. The entry is only added to the
+// store by Commit.
+func (s *Store) Create() (*Writer, error) {
+	f, err := os.CreateTemp(filepath.Join(s.dir, "tmp"), "entry-")
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{File: f, s: s}, nil
+}
+
+func (s *Store) remove(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, found := s.entries[name]; found {
+		s.removeElement(e)
+	}
+}
+
+func (s *Store) removeElement(e *list.Element) {
+	ent := s.lru.Remove(e).(*entry)
+	delete(s.entries, ent.name)
+	s.size -= ent.size
+	if err := os.Remove(s.path(ent.name)); err != nil && !os.IsNotExist(err) {
+		klog.ErrorS(err, "failed to remove cache entry", "name", ent.name)
+	}
+}
+
+// evict removes least recently used entries until the store fits in max
+// size. It must be called with s.mu held.
+func (s *Store) evict() {
+	for s.maxSize > 0 && s.size > s.maxSize && s.lru.Len() > 0 {
+		s.removeElement(s.lru.Back())
+	}
+}
+
+func (s *Store) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := Stats{
+		Entries: len(s.entries),
+		Size:    s.size,
+		MaxSize: s.maxSize,
+		Hits:    s.hits,
+		Misses:  s.misses,
+	}
+	if total := s.hits + s.misses; total > 0 {
+		stats.HitRate = float64(s.hits) / float64(total)
+	}
+	return stats
+}
+
+// Writer writes a new store entry to a temporary file.
+type Writer struct {
+	*os.File
+	s *Store
+}
+
+// Commit adds the written file to the store as key, replacing any existing
+// entry.
+func (w *Writer) Commit(key string) error {
+	if err := w.File.Close(); err != nil {
+		w.Abort()
+		return err
+	}
+	fi, err := os.Stat(w.Name())
+	if err != nil {
+		w.Abort()
+		return err
+	}
+
+	name := hashKey(key)
+	filename := w.s.path(name)
+	if err := os.MkdirAll(filepath.Dir(filename), 0o755); err != nil {
+		w.Abort()
+		return err
+	}
+
+	w.s.mu.Lock()
+	defer w.s.mu.Unlock()
+	if e, found := w.s.entries[name]; found {
+		ent := w.s.lru.Remove(e).(*entry)
+		delete(w.s.entries, name)
+		w.s.size -= ent.size
+	}
+	if err := os.Rename(w.Name(), filename); err != nil {
+		_ = os.Remove(w.Name())
+		return err
+	}
+	w.s.entries[name] = w.s.lru.PushFront(&entry{name: name, size: fi.Size()})
+	w.s.size += fi.Size()
+	w.s.evict()
+	return nil
+}
+
+// Abort discards the written file.
+func (w *Writer) Abort() {
+	_ = w.File.Close()
+	_ = os.Remove(w.Name())
+}
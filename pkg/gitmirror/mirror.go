@@ -0,0 +1,277 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitmirror
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/cgi"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/appscodelabs/gh-ci-webhook/pkg/netacl"
+
+	"github.com/pkg/errors"
+	"gomodules.xyz/go-sh"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// usedMarker is touched inside a mirror whenever it is served
+	usedMarker = "gh-ci-used"
+
+	maintenanceInterval = time.Hour
+)
+
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// ScopeFunc returns the repository of the job running on the client at
+// remoteAddr.
+type ScopeFunc func(remoteAddr string) (string, bool)
+
+// Server keeps bare mirrors of the repositories of jobs run on the host and
+// serves them read only to VMs using git http-backend. A mirror is created
+// when a VM first asks for it and is fetched when a job is queued for the
+// repository or before it is served, if it is stale.
+type Server struct {
+	opts  *Options
+	acl   netacl.ACL
+	scope ScopeFunc
+	git   string
+
+	mu    sync.Mutex
+	repos map[string]*repo
+}
+
+type repo struct {
+	mu      sync.Mutex
+	fetched time.Time
+}
+
+func New(opts *Options, scope ScopeFunc) (*Server, error) {
+	acl, err := netacl.Parse(opts.AllowedNetworks)
+	if err != nil {
+		return nil, err
+	}
+	git, err := exec.LookPath("git")
+	if err != nil {
+		return nil, errors.Wrap(err, "git mirror requires git")
+	}
+	if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &Server{
+		opts:  opts,
+		acl:   acl,
+		scope: scope,
+		git:   git,
+		repos: map[string]*repo{},
+	}, nil
+}
+
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	srv := &http.Server{
+		Addr:    s.opts.Addr,
+		Handler: s,
+	}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+	go wait.UntilWithContext(ctx, func(ctx context.Context) {
+		s.removeUnused()
+	}, maintenanceInterval)
+
+	klog.InfoS("starting git mirror", "addr", s.opts.Addr, "dir", s.opts.Dir)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// splitRepo returns the owner/repo of a path like /owner/repo.git/info/refs.
+func splitRepo(p string) (string, bool) {
+	parts := strings.SplitN(strings.TrimPrefix(p, "/"), "/", 3)
+	if len(parts) < 3 {
+		return "", false
+	}
+	owner, name := parts[0], strings.TrimSuffix(parts[1], ".git")
+	if !namePattern.MatchString(owner) || !namePattern.MatchString(name) || name == "." || name == ".." {
+		return "", false
+	}
+	return owner + "/" + name, true
+}
+
+func (s *Server) path(fullName string) string {
+	return filepath.Join(s.opts.Dir, fullName+".git")
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.acl.Allowed(r.RemoteAddr) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	fullName, ok := splitRepo(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if jobRepo, found := s.scope(r.RemoteAddr); !found || !strings.EqualFold(jobRepo, fullName) {
+		http.Error(w, "repository is not used by the job of this client", http.StatusForbidden)
+		return
+	}
+	if r.URL.Query().Get("service") == "git-receive-pack" || strings.HasSuffix(r.URL.Path, "/git-receive-pack") {
+		http.Error(w, "git mirror is read only", http.StatusForbidden)
+		return
+	}
+
+	if err := s.ensureFresh(r.Context(), fullName); err != nil {
+		klog.ErrorS(err, "failed to refresh git mirror", "repo", fullName)
+		http.Error(w, "failed to refresh git mirror", http.StatusBadGateway)
+		return
+	}
+	now := time.Now()
+	_ = os.Chtimes(filepath.Join(s.path(fullName), usedMarker), now, now)
+
+	h := &cgi.Handler{
+		Path: s.git,
+		Args: []string{"http-backend"},
+		Env: []string{
+			"GIT_PROJECT_ROOT=" + s.opts.Dir,
+			"GIT_HTTP_EXPORT_ALL=1",
+		},
+	}
+	h.ServeHTTP(w, r)
+}
+
+func (s *Server) getRepo(fullName string) *repo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rp, found := s.repos[fullName]
+	if !found {
+		rp = &repo{}
+		s.repos[fullName] = rp
+	}
+	return rp
+}
+
+// ensureFresh creates the mirror of a repository or fetches it if it was
+// not fetched within max staleness.
+func (s *Server) ensureFresh(ctx context.Context, fullName string) error {
+	rp := s.getRepo(fullName)
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if time.Since(rp.fetched) < s.opts.MaxStaleness.Duration {
+		return nil
+	}
+	return s.fetch(fullName, rp)
+}
+
+// Refresh fetches the mirror of a repository, if it exists.
+func (s *Server) Refresh(fullName string) {
+	if _, ok := splitRepo("/" + fullName + ".git/"); !ok {
+		return
+	}
+	if _, err := os.Stat(s.path(fullName)); err != nil {
+		return
+	}
+	rp := s.getRepo(fullName)
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if err := s.fetch(fullName, rp); err != nil {
+		klog.ErrorS(err, "failed to refresh git mirror", "repo", fullName)
+	}
+}
+
+// fetch must be called with rp.mu held.
+func (s *Server) fetch(fullName string, rp *repo) error {
+	dir := s.path(fullName)
+	start := time.Now()
+
+	session := sh.NewSession().
+		SetEnv("GIT_TERMINAL_PROMPT", "0")
+	if s.opts.GitHubToken != "" {
+		// pass the token via env, so that it is not visible in the process list
+		auth := base64.StdEncoding.EncodeToString([]byte("x-access-token:" + s.opts.GitHubToken))
+		session.SetEnv("GIT_CONFIG_COUNT", "1").
+			SetEnv("GIT_CONFIG_KEY_0", "http.https://github.com/.extraheader").
+			SetEnv("GIT_CONFIG_VALUE_0", "AUTHORIZATION: basic "+auth)
+	}
+
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		tmp := dir + ".tmp"
+		_ = os.RemoveAll(tmp)
+		if err := os.MkdirAll(filepath.Dir(dir), 0o755); err != nil {
+			return err
+		}
+		url := fmt.Sprintf("https://github.com/%s.git", fullName)
+		if out, err := session.Command(s.git, "clone", "--mirror", "--quiet", url, tmp).CombinedOutput(); err != nil {
+			_ = os.RemoveAll(tmp)
+			return errors.Wrapf(err, "git clone failed: %s", out)
+		}
+		if err := os.WriteFile(filepath.Join(tmp, usedMarker), nil, 0o644); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, dir); err != nil {
+			return err
+		}
+		klog.InfoS("created git mirror", "repo", fullName, "duration", time.Since(start))
+	} else {
+		if out, err := session.Command(s.git, "-C", dir, "remote", "update", "--prune").CombinedOutput(); err != nil {
+			return errors.Wrapf(err, "git remote update failed: %s", out)
+		}
+		klog.V(2).InfoS("fetched git mirror", "repo", fullName, "duration", time.Since(start))
+	}
+	rp.fetched = time.Now()
+	return nil
+}
+
+// removeUnused removes mirrors not served for max age.
+func (s *Server) removeUnused() {
+	markers, err := filepath.Glob(filepath.Join(s.opts.Dir, "*", "*.git", usedMarker))
+	if err != nil {
+		klog.ErrorS(err, "failed to list git mirrors")
+		return
+	}
+	for _, marker := range markers {
+		fi, err := os.Stat(marker)
+		if err != nil || time.Since(fi.ModTime()) < s.opts.MaxAge.Duration {
+			continue
+		}
+		dir := filepath.Dir(marker)
+		fullName := strings.TrimSuffix(strings.TrimPrefix(dir, s.opts.Dir+string(filepath.Separator)), ".git")
+
+		rp := s.getRepo(fullName)
+		rp.mu.Lock()
+		err = os.RemoveAll(dir)
+		rp.fetched = time.Time{}
+		rp.mu.Unlock()
+		if err != nil {
+			klog.ErrorS(err, "failed to remove git mirror", "repo", fullName)
+			continue
+		}
+		klog.InfoS("removed unused git mirror", "repo", fullName)
+	}
+}
@@ -0,0 +1,83 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitmirror
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/appscodelabs/gh-ci-webhook/pkg/netacl"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type Options struct {
+	// Addr is the listen address of the git mirror, disabled if empty
+	Addr string `json:"addr,omitempty"`
+	// Dir stores the bare mirror repositories
+	Dir string `json:"dir,omitempty"`
+	// MaxStaleness is the max age of a mirror served to VMs, older mirrors are fetched first
+	MaxStaleness metav1.Duration `json:"maxStaleness,omitempty"`
+	// MaxAge removes mirrors not used for this long
+	MaxAge metav1.Duration `json:"maxAge,omitempty"`
+	// AllowedNetworks are the client networks allowed to use the mirror,
+	// the networks of the VMs if empty
+	AllowedNetworks []string `json:"allowedNetworks,omitempty"`
+
+	GitHubToken string `json:"-"`
+}
+
+func NewOptions() *Options {
+	return &Options{
+		Dir:          "/var/lib/gh-ci/git",
+		MaxStaleness: metav1.Duration{Duration: 30 * time.Second},
+		MaxAge:       metav1.Duration{Duration: 14 * 24 * time.Hour},
+	}
+}
+
+func (opts *Options) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&opts.Addr, "git-mirror.addr", opts.Addr, "Listen address of the git mirror used by VMs, eg, :8082 (disabled if empty)")
+	fs.StringVar(&opts.Dir, "git-mirror.dir", opts.Dir, "PATH to directory where git mirror stores bare repositories")
+	fs.DurationVar(&opts.MaxStaleness.Duration, "git-mirror.max-staleness", opts.MaxStaleness.Duration, "Fetch a mirror before serving it if it is older than this")
+	fs.DurationVar(&opts.MaxAge.Duration, "git-mirror.max-age", opts.MaxAge.Duration, "Remove mirrors not used for this long")
+	fs.StringSliceVar(&opts.AllowedNetworks, "git-mirror.allowed-networks", opts.AllowedNetworks, "Client networks allowed to use the git mirror, defaults to the networks of the VMs")
+}
+
+// Port returns the port the mirror listens on.
+func (opts *Options) Port() (string, error) {
+	_, port, err := net.SplitHostPort(opts.Addr)
+	return port, err
+}
+
+func (opts *Options) Validate() error {
+	if opts.Addr == "" {
+		return nil
+	}
+	if _, err := opts.Port(); err != nil {
+		return fmt.Errorf("invalid git mirror address %q: %v", opts.Addr, err)
+	}
+	if opts.Dir == "" {
+		return fmt.Errorf("missing git mirror dir")
+	}
+	if _, err := netacl.Parse(opts.AllowedNetworks); err != nil {
+		return errors.Wrap(err, "invalid git mirror allowed networks")
+	}
+	return nil
+}
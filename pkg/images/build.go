@@ -0,0 +1,358 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package images
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	"gomodules.xyz/go-sh"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/klog/v2"
+)
+
+type BuildOptions struct {
+	// ImageDir is where the image set is written, as <imageDir>/<os>
+	ImageDir string
+	OS       string
+	Version  string
+
+	// From is a container image archive (docker save or OCI layout), an
+	// exported container filesystem archive or a directory
+	From string
+	// Context is a Dockerfile build context, built with docker
+	Context string
+
+	// Kernel is an uncompressed vmlinux kernel
+	Kernel string
+	Initrd string
+
+	RootFSSize    resource.QuantityValue
+	RunnerVersion string
+	WorkDir       string
+}
+
+func NewBuildOptions() *BuildOptions {
+	return &BuildOptions{
+		Version:       time.Now().UTC().Format("20060102.150405"),
+		RootFSSize:    resource.QuantityValue{Quantity: resource.MustParse("20Gi")},
+		RunnerVersion: "2.321.0",
+		WorkDir:       os.TempDir(),
+	}
+}
+
+func (opts *BuildOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&opts.ImageDir, "image-dir", opts.ImageDir, "PATH to directory with OS images")
+	fs.StringVar(&opts.OS, "os", opts.OS, "OS image code")
+	fs.StringVar(&opts.Version, "version", opts.Version, "Version of the image set")
+	fs.StringVar(&opts.From, "from", opts.From, "Container image archive (docker save or OCI layout), exported container filesystem archive or directory")
+	fs.StringVar(&opts.Context, "context", opts.Context, "Dockerfile build context, built with docker")
+	fs.StringVar(&opts.Kernel, "kernel", opts.Kernel, "PATH to uncompressed vmlinux kernel")
+	fs.StringVar(&opts.Initrd, "initrd", opts.Initrd, "PATH to initrd")
+	fs.Var(&opts.RootFSSize, "rootfs-size", "Size of the rootfs")
+	fs.StringVar(&opts.RunnerVersion, "runner-version", opts.RunnerVersion, "Version of the GitHub Actions runner installed in the rootfs")
+	fs.StringVar(&opts.WorkDir, "work-dir", opts.WorkDir, "PATH to directory used while building")
+}
+
+func (opts *BuildOptions) Validate() error {
+	if opts.ImageDir == "" || opts.OS == "" {
+		return errors.New("image dir and os are required")
+	}
+	if err := ValidateOS(opts.OS); err != nil {
+		return err
+	}
+	if (opts.From == "") == (opts.Context == "") {
+		return errors.New("exactly one of --from and --context is required")
+	}
+	if opts.Kernel == "" || opts.Initrd == "" {
+		return errors.New("kernel and initrd are required")
+	}
+	if opts.RootFSSize.Cmp(resource.MustParse("1Gi")) < 0 {
+		return fmt.Errorf("rootfs size %s must be at least 1Gi", opts.RootFSSize.String())
+	}
+	return nil
+}
+
+// provisionScript installs what VMs need to boot and run jobs into the
+// rootfs: systemd, cloud-init, docker, the GitHub cli and the GitHub
+// Actions runner.
+const provisionScript = `set -ex
+export DEBIAN_FRONTEND=noninteractive
+apt-get update
+apt-get install -y --no-install-recommends systemd systemd-sysv udev kmod iproute2 netplan.io \
+	cloud-init openssh-server sudo ca-certificates curl wget gnupg jq rsync git build-essential
+install -m 0755 -d /etc/apt/keyrings
+
+# https://docs.docker.com/engine/install/ubuntu/
+curl -fsSL https://download.docker.com/linux/ubuntu/gpg -o /etc/apt/keyrings/docker.asc
+echo "deb [arch=$(dpkg --print-architecture) signed-by=/etc/apt/keyrings/docker.asc] https://download.docker.com/linux/ubuntu $(. /etc/os-release && echo $VERSION_CODENAME) stable" > /etc/apt/sources.list.d/docker.list
+
+# https://github.com/cli/cli/blob/trunk/docs/install_linux.md
+curl -fsSL https://cli.github.com/packages/githubcli-archive-keyring.gpg -o /etc/apt/keyrings/githubcli-archive-keyring.gpg
+echo "deb [arch=$(dpkg --print-architecture) signed-by=/etc/apt/keyrings/githubcli-archive-keyring.gpg] https://cli.github.com/packages stable main" > /etc/apt/sources.list.d/github-cli.list
+
+apt-get update
+apt-get install -y docker-ce docker-ce-cli containerd.io docker-buildx-plugin qemu-user-static gh
+
+# https://github.com/actions/runner/releases
+mkdir -p /opt/actions-runner
+curl -fsSL https://github.com/actions/runner/releases/download/v${RUNNER_VERSION}/actions-runner-linux-x64-${RUNNER_VERSION}.tar.gz | tar -xz -C /opt/actions-runner
+/opt/actions-runner/bin/installdependencies.sh
+
+echo '/dev/vda / ext4 defaults 0 1' > /etc/fstab
+systemctl enable ssh docker
+truncate -s 0 /etc/machine-id
+apt-get clean
+rm -rf /var/lib/apt/lists/*
+`
+
+// Build builds the rootfs of an OS image from a container image or
+// filesystem, and writes it with the kernel, initrd and a manifest to
+// <imageDir>/<os>.
+func Build(ctx context.Context, opts *BuildOptions) (*Manifest, error) {
+	work, err := os.MkdirTemp(opts.WorkDir, "build-image-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(work) //nolint:errcheck
+	root := filepath.Join(work, "root")
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, err
+	}
+
+	source := opts.From
+	if opts.Context != "" {
+		source = opts.Context
+		archive, err := dockerBuild(ctx, opts.Context, work)
+		if err != nil {
+			return nil, err
+		}
+		opts.From = archive
+	}
+
+	klog.InfoS("unpacking filesystem", "from", opts.From)
+	if err := unpack(opts.From, work, root); err != nil {
+		return nil, errors.Wrap(err, "failed to unpack filesystem")
+	}
+
+	klog.InfoS("provisioning rootfs", "runnerVersion", opts.RunnerVersion)
+	if err := provision(ctx, root, opts.RunnerVersion); err != nil {
+		return nil, errors.Wrap(err, "failed to provision rootfs")
+	}
+
+	out := filepath.Join(work, "out")
+	if err := os.MkdirAll(out, 0o755); err != nil {
+		return nil, err
+	}
+	rootfs := filepath.Join(out, opts.OS+".rootfs")
+	klog.InfoS("creating rootfs", "size", opts.RootFSSize.String())
+	if err := createSparse(rootfs, opts.RootFSSize.Value()); err != nil {
+		return nil, err
+	}
+	if out, err := sh.Command("mkfs.ext4", "-F", "-q", "-L", "rootfs", "-d", root, rootfs).CombinedOutput(); err != nil {
+		return nil, errors.Wrapf(err, "mkfs.ext4 failed: %s", out)
+	}
+	for src, name := range map[string]string{opts.Kernel: opts.OS + ".vmlinux", opts.Initrd: opts.OS + ".initrd"} {
+		if out, err := sh.Command("cp", src, filepath.Join(out, name)).CombinedOutput(); err != nil {
+			return nil, errors.Wrapf(err, "cp failed: %s", out)
+		}
+	}
+
+	m := &Manifest{
+		OS:            opts.OS,
+		Version:       opts.Version,
+		Created:       time.Now().UTC(),
+		Source:        source,
+		RunnerVersion: opts.RunnerVersion,
+	}
+	klog.InfoS("computing checksums")
+	for _, f := range []struct {
+		name string
+		file *File
+	}{
+		{opts.OS + ".rootfs", &m.RootFS},
+		{opts.OS + ".vmlinux", &m.Kernel},
+		{opts.OS + ".initrd", &m.Initrd},
+	} {
+		if *f.file, err = Describe(filepath.Join(out, f.name)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := install(out, filepath.Join(opts.ImageDir, opts.OS), m); err != nil {
+		return nil, err
+	}
+	klog.InfoS("built image", "os", m.OS, "version", m.Version, "rootfs", m.RootFS.SHA256)
+	return m, nil
+}
+
+// install moves the files of an image set into dir. The manifest is
+// written last, so that it only describes complete image sets.
+func install(src, dir string, m *Manifest) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	for _, f := range []File{m.RootFS, m.Kernel, m.Initrd} {
+		if err := moveFile(filepath.Join(src, f.Name), filepath.Join(dir, f.Name)); err != nil {
+			return err
+		}
+	}
+	return m.Write(dir)
+}
+
+// moveFile renames src to dst, copying it if they are on different
+// filesystems. dst is replaced atomically.
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	tmp := filepath.Join(filepath.Dir(dst), "."+filepath.Base(dst))
+	if out, err := sh.Command("cp", "--sparse=always", src, tmp).CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "cp failed: %s", out)
+	}
+	return os.Rename(tmp, dst)
+}
+
+func createSparse(path string, size int64) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(size); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// dockerBuild builds a Dockerfile context and saves the image to an
+// archive in work.
+func dockerBuild(ctx context.Context, contextDir, work string) (string, error) {
+	tag := "gh-ci-build-image:" + filepath.Base(work)
+	cmd := exec.CommandContext(ctx, "docker", "build", "-t", tag, contextDir)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", errors.Wrap(err, "docker build failed")
+	}
+	defer sh.Command("docker", "rmi", tag).Run() //nolint:errcheck
+
+	archive := filepath.Join(work, "image.tar")
+	if out, err := sh.Command("docker", "save", "-o", archive, tag).CombinedOutput(); err != nil {
+		return "", errors.Wrapf(err, "docker save failed: %s", out)
+	}
+	return archive, nil
+}
+
+// unpack fills root from a container image archive, a container filesystem
+// archive or a directory.
+func unpack(from, work, root string) error {
+	fi, err := os.Stat(from)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		if out, err := sh.Command("cp", "-a", from+"/.", root).CombinedOutput(); err != nil {
+			return errors.Wrapf(err, "cp failed: %s", out)
+		}
+		return nil
+	}
+
+	isImage, err := isImageArchive(from)
+	if err != nil {
+		return err
+	}
+	if !isImage {
+		return extractTar(from, root)
+	}
+
+	image := filepath.Join(work, "image")
+	if err := extractTar(from, image); err != nil {
+		return err
+	}
+	layers, err := imageLayers(image)
+	if err != nil {
+		return err
+	}
+	for i, layer := range layers {
+		klog.V(2).InfoS("applying layer", "layer", i+1, "of", len(layers))
+		if err := applyLayer(root, layer); err != nil {
+			return errors.Wrapf(err, "failed to apply layer %s", filepath.Base(layer))
+		}
+	}
+	return os.RemoveAll(image)
+}
+
+// provision runs provisionScript chrooted in root.
+func provision(ctx context.Context, root, runnerVersion string) error {
+	if _, err := os.Stat(filepath.Join(root, "bin", "bash")); err != nil {
+		return errors.New("rootfs has no /bin/bash")
+	}
+
+	var mounted []string
+	defer func() {
+		for i := len(mounted) - 1; i >= 0; i-- {
+			_ = sh.Command("umount", "--recursive", "--lazy", mounted[i]).Run()
+		}
+	}()
+	for _, m := range [][]string{
+		{"-t", "proc", "proc", "proc"},
+		{"--rbind", "/sys", "sys"},
+		{"--rbind", "/dev", "dev"},
+	} {
+		target := filepath.Join(root, m[len(m)-1])
+		if err := os.MkdirAll(target, 0o755); err != nil {
+			return err
+		}
+		args := append(append([]string{}, m[:len(m)-1]...), target)
+		if out, err := sh.Command("mount", args).CombinedOutput(); err != nil {
+			return errors.Wrapf(err, "mount %s: %s", strings.Join(args, " "), out)
+		}
+		mounted = append(mounted, target)
+	}
+
+	// use the DNS config of the host while provisioning
+	resolvConf := filepath.Join(root, "etc", "resolv.conf")
+	backup := resolvConf + ".gh-ci"
+	_ = os.Rename(resolvConf, backup)
+	defer func() {
+		_ = os.Remove(resolvConf)
+		_ = os.Rename(backup, resolvConf)
+	}()
+	data, err := os.ReadFile("/etc/resolv.conf")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(resolvConf, data, 0o644); err != nil {
+		return err
+	}
+
+	cmd := exec.CommandContext(ctx, "chroot", root, "/bin/bash", "-c", provisionScript)
+	cmd.Env = []string{
+		"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+		"HOME=/root",
+		"RUNNER_VERSION=" + runnerVersion,
+	}
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	return cmd.Run()
+}
@@ -0,0 +1,128 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package images
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	"github.com/pkg/errors"
+	"k8s.io/klog/v2"
+)
+
+var osName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// ValidateOS checks that an OS image code can be used as a directory name
+// and in runner labels.
+func ValidateOS(name string) error {
+	if !osName.MatchString(name) {
+		return fmt.Errorf("invalid os image code %q", name)
+	}
+	return nil
+}
+
+// Image is an OS image set in <imageDir>/<os>.
+type Image struct {
+	Manifest
+	Dir string `json:"dir"`
+}
+
+func (img *Image) RootFSPath() string {
+	return filepath.Join(img.Dir, img.RootFS.Name)
+}
+
+func (img *Image) KernelPath() string {
+	return filepath.Join(img.Dir, img.Kernel.Name)
+}
+
+func (img *Image) InitrdPath() string {
+	return filepath.Join(img.Dir, img.Initrd.Name)
+}
+
+// Key identifies the contents of an image.
+func (img *Image) Key() string {
+	return img.OS + "/" + img.Version + "/" + img.RootFS.SHA256
+}
+
+// Verify checks the size and checksum of the files of the image against
+// its manifest.
+func (img *Image) Verify() error {
+	for _, f := range []File{img.RootFS, img.Kernel, img.Initrd} {
+		if f.Name == "" || f.SHA256 == "" {
+			return fmt.Errorf("image %s: manifest has no checksum for %q", img.OS, f.Name)
+		}
+		got, err := Describe(filepath.Join(img.Dir, f.Name))
+		if err != nil {
+			return errors.Wrapf(err, "image %s", img.OS)
+		}
+		if got.Size != f.Size {
+			return fmt.Errorf("image %s: %s has size %d, manifest has %d", img.OS, f.Name, got.Size, f.Size)
+		}
+		if got.SHA256 != f.SHA256 {
+			return fmt.Errorf("image %s: %s has sha256 %s, manifest has %s", img.OS, f.Name, got.SHA256, f.SHA256)
+		}
+	}
+	return nil
+}
+
+// LoadCatalog reads the manifests of the images in imageDir. Directories
+// without a manifest are skipped.
+func LoadCatalog(imageDir string) (map[string]*Image, error) {
+	entries, err := os.ReadDir(imageDir)
+	if err != nil {
+		return nil, err
+	}
+	catalog := map[string]*Image{}
+	for _, e := range entries {
+		if isHidden(e.Name()) {
+			continue
+		}
+		// synced images are symlinks to their active version
+		dir, err := filepath.EvalSymlinks(filepath.Join(imageDir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			continue
+		}
+		m, err := ReadManifest(dir)
+		if os.IsNotExist(err) {
+			klog.V(2).InfoS("skipping image dir without manifest", "dir", dir)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if m.OS != e.Name() {
+			return nil, fmt.Errorf("manifest in %s is for os %q", dir, m.OS)
+		}
+		catalog[m.OS] = &Image{Manifest: *m, Dir: dir}
+	}
+	return catalog, nil
+}
+
+// Names returns the sorted OS image codes of a catalog.
+func Names(catalog map[string]*Image) []string {
+	names := make([]string, 0, len(catalog))
+	for name := range catalog {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
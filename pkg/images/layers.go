@@ -0,0 +1,330 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package images
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+	xattrPrefix    = "SCHILY.xattr."
+)
+
+// isImageArchive checks if the tar archive at filename is a container image
+// saved by docker save or in OCI layout, as opposed to an exported
+// container filesystem.
+func isImageArchive(filename string) (bool, error) {
+	var found bool
+	err := walkTar(filename, func(hdr *tar.Header, _ io.Reader) error {
+		switch path.Clean(hdr.Name) {
+		case "manifest.json", "index.json", "oci-layout":
+			found = true
+			return io.EOF
+		}
+		return nil
+	})
+	return found, err
+}
+
+// walkTar calls fn for each entry of a tar archive, which may be gzip
+// compressed. fn stops the walk by returning io.EOF.
+func walkTar(filename string, fn func(hdr *tar.Header, r io.Reader) error) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, err := decompress(f)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Wrapf(err, "failed to read %s", filename)
+		}
+		if err := fn(hdr, tr); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+func decompress(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	switch {
+	case len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b:
+		return gzip.NewReader(br)
+	case len(magic) >= 4 && magic[0] == 0x28 && magic[1] == 0xb5 && magic[2] == 0x2f && magic[3] == 0xfd:
+		return nil, errors.New("zstd compressed layers are not supported")
+	}
+	return br, nil
+}
+
+// imageLayers returns the layers of the image in dir, extracted from a
+// docker save or OCI layout archive, from the bottom layer up.
+func imageLayers(dir string) ([]string, error) {
+	// docker save
+	if data, err := os.ReadFile(filepath.Join(dir, "manifest.json")); err == nil {
+		var manifests []struct {
+			Layers []string `json:"Layers"`
+		}
+		if err := json.Unmarshal(data, &manifests); err != nil {
+			return nil, errors.Wrap(err, "failed to parse manifest.json")
+		}
+		if len(manifests) != 1 {
+			return nil, fmt.Errorf("archive must contain one image, found %d", len(manifests))
+		}
+		layers := make([]string, 0, len(manifests[0].Layers))
+		for _, l := range manifests[0].Layers {
+			layers = append(layers, filepath.Join(dir, filepath.Clean("/"+l)))
+		}
+		return layers, nil
+	}
+
+	// OCI layout
+	type descriptor struct {
+		MediaType string `json:"mediaType"`
+		Digest    string `json:"digest"`
+		Platform  *struct {
+			Architecture string `json:"architecture"`
+			OS           string `json:"os"`
+		} `json:"platform,omitempty"`
+	}
+	var index struct {
+		MediaType string       `json:"mediaType"`
+		Manifests []descriptor `json:"manifests"`
+		Layers    []descriptor `json:"layers"`
+	}
+	blob := func(digest string) string {
+		return filepath.Join(dir, "blobs", filepath.Clean("/"+strings.Replace(digest, ":", "/", 1)))
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil {
+		return nil, errors.New("archive has neither manifest.json nor index.json")
+	}
+	// follow nested indexes down to the image manifest for linux/amd64
+	for depth := 0; index.Layers == nil; depth++ {
+		index.Manifests, index.Layers = nil, nil
+		if err := json.Unmarshal(data, &index); err != nil {
+			return nil, errors.Wrap(err, "failed to parse OCI index")
+		}
+		if index.Layers != nil {
+			break
+		}
+		if depth > 4 || len(index.Manifests) == 0 {
+			return nil, errors.New("no image manifest found in OCI layout")
+		}
+		desc := index.Manifests[0]
+		for _, m := range index.Manifests {
+			if m.Platform != nil && m.Platform.OS == "linux" && m.Platform.Architecture == "amd64" {
+				desc = m
+				break
+			}
+		}
+		if data, err = os.ReadFile(blob(desc.Digest)); err != nil {
+			return nil, err
+		}
+	}
+	layers := make([]string, 0, len(index.Layers))
+	for _, l := range index.Layers {
+		layers = append(layers, blob(l.Digest))
+	}
+	return layers, nil
+}
+
+// extractTar extracts a tar archive into dir, without applying whiteouts.
+func extractTar(filename, dir string) error {
+	return walkTar(filename, func(hdr *tar.Header, r io.Reader) error {
+		return applyEntry(dir, hdr, r, false)
+	})
+}
+
+// applyLayer applies a layer of a container image to the root filesystem
+// in root.
+func applyLayer(root, layer string) error {
+	return walkTar(layer, func(hdr *tar.Header, r io.Reader) error {
+		return applyEntry(root, hdr, r, true)
+	})
+}
+
+func applyEntry(root string, hdr *tar.Header, r io.Reader, whiteouts bool) error {
+	name := filepath.Clean("/" + hdr.Name)
+	if name == "/" {
+		return nil
+	}
+	parent, err := secureJoin(root, filepath.Dir(name))
+	if err != nil {
+		return err
+	}
+	base := filepath.Base(name)
+	target := filepath.Join(parent, base)
+
+	if whiteouts {
+		if base == whiteoutOpaque {
+			entries, err := os.ReadDir(parent)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			for _, e := range entries {
+				if err := os.RemoveAll(filepath.Join(parent, e.Name())); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			return os.RemoveAll(filepath.Join(parent, strings.TrimPrefix(base, whiteoutPrefix)))
+		}
+	}
+
+	if err := os.MkdirAll(parent, 0o755); err != nil {
+		return err
+	}
+	if fi, err := os.Lstat(target); err == nil && !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+		if err := os.RemoveAll(target); err != nil {
+			return err
+		}
+	}
+
+	mode := hdr.FileInfo().Mode()
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(target, 0o755); err != nil {
+			return err
+		}
+	case tar.TypeReg:
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, r)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, target); err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		linkName := filepath.Clean("/" + hdr.Linkname)
+		linkParent, err := secureJoin(root, filepath.Dir(linkName))
+		if err != nil {
+			return err
+		}
+		if err := os.Link(filepath.Join(linkParent, filepath.Base(linkName)), target); err != nil {
+			return err
+		}
+		return nil
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		devType := uint32(unix.S_IFCHR)
+		if hdr.Typeflag == tar.TypeBlock {
+			devType = unix.S_IFBLK
+		} else if hdr.Typeflag == tar.TypeFifo {
+			devType = unix.S_IFIFO
+		}
+		dev := int(unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor)))
+		if err := unix.Mknod(target, devType|uint32(mode.Perm()), dev); err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+
+	if err := os.Lchown(target, hdr.Uid, hdr.Gid); err != nil {
+		return err
+	}
+	for key, value := range hdr.PAXRecords {
+		if attr, found := strings.CutPrefix(key, xattrPrefix); found {
+			if err := unix.Lsetxattr(target, attr, []byte(value), 0); err != nil {
+				return errors.Wrapf(err, "failed to set xattr %s on %s", attr, hdr.Name)
+			}
+		}
+	}
+	if hdr.Typeflag == tar.TypeSymlink {
+		return nil
+	}
+	if err := os.Chmod(target, mode); err != nil {
+		return err
+	}
+	return os.Chtimes(target, hdr.AccessTime, hdr.ModTime)
+}
+
+// secureJoin resolves p in root like a process chrooted to root would,
+// following symlinks without leaving root.
+func secureJoin(root, p string) (string, error) {
+	resolved := ""
+	remaining := p
+	for links := 0; remaining != ""; {
+		var part string
+		part, remaining, _ = strings.Cut(remaining, "/")
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = path.Dir(resolved)
+			if resolved == "." || resolved == "/" {
+				resolved = ""
+			}
+			continue
+		}
+
+		next := path.Join(resolved, part)
+		fi, err := os.Lstat(filepath.Join(root, next))
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		if links++; links > 255 {
+			return "", fmt.Errorf("too many levels of symbolic links in %s", p)
+		}
+		dest, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(dest) {
+			resolved = ""
+		}
+		remaining = dest + "/" + remaining
+	}
+	return filepath.Join(root, resolved), nil
+}
@@ -0,0 +1,125 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package images
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// VersionsDir keeps the synced versions of every image, as
+	// <imageDir>/.versions/<os>/<version>. <imageDir>/<os> is a symlink to
+	// the active version.
+	VersionsDir = ".versions"
+	// StageDir keeps the versions being synced, as <imageDir>/.sync/<os>@<version>
+	StageDir = ".sync"
+)
+
+// Activate moves a complete image set from stage into the versions dir and
+// atomically points <imageDir>/<os> to it. An <imageDir>/<os> directory
+// that is not a symlink is moved into the versions dir first.
+func Activate(imageDir, name, version, stage string) error {
+	versions := filepath.Join(imageDir, VersionsDir, name)
+	if err := os.MkdirAll(versions, 0o755); err != nil {
+		return err
+	}
+	target := filepath.Join(versions, version)
+	if err := os.RemoveAll(target); err != nil {
+		return err
+	}
+	if err := os.Rename(stage, target); err != nil {
+		return err
+	}
+
+	link := filepath.Join(imageDir, name)
+	if fi, err := os.Lstat(link); err == nil && fi.IsDir() {
+		old := "unversioned"
+		if m, err := ReadManifest(link); err == nil {
+			old = m.Version
+		}
+		old = fmt.Sprintf("%s.%d", old, time.Now().Unix())
+		if err := os.Rename(link, filepath.Join(versions, old)); err != nil {
+			return err
+		}
+		klog.InfoS("moved image into versions dir", "os", name, "version", old)
+	}
+
+	tmp := filepath.Join(imageDir, "."+name+".tmp")
+	_ = os.Remove(tmp)
+	if err := os.Symlink(filepath.Join(VersionsDir, name, version), tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, link)
+}
+
+// GC removes all but the newest keep versions of an image from the
+// versions dir, and abandoned partial syncs of other versions. The active
+// version is always kept.
+func GC(imageDir, name string, keep int) error {
+	active, _ := filepath.EvalSymlinks(filepath.Join(imageDir, name))
+
+	versions := filepath.Join(imageDir, VersionsDir, name)
+	entries, err := os.ReadDir(versions)
+	if err != nil {
+		return err
+	}
+	type version struct {
+		path    string
+		modTime time.Time
+	}
+	var all []version
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !e.IsDir() {
+			continue
+		}
+		all = append(all, version{path: filepath.Join(versions, e.Name()), modTime: info.ModTime()})
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].modTime.After(all[j].modTime)
+	})
+	kept := 0
+	for _, v := range all {
+		if path, _ := filepath.EvalSymlinks(v.path); path == active || kept < keep {
+			kept++
+			continue
+		}
+		if err := os.RemoveAll(v.path); err != nil {
+			return err
+		}
+		klog.InfoS("removed old image version", "os", name, "path", v.path)
+	}
+
+	stages, _ := filepath.Glob(filepath.Join(imageDir, StageDir, name+"@*"))
+	for _, stage := range stages {
+		if err := os.RemoveAll(stage); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isHidden(name string) bool {
+	return strings.HasPrefix(name, ".")
+}
@@ -0,0 +1,101 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package images
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ManifestFile describes the image set in a directory.
+const ManifestFile = "manifest.json"
+
+// Manifest describes the rootfs, kernel and initrd of an OS image, stored
+// in <imageDir>/<os> as <os>.rootfs, <os>.vmlinux and <os>.initrd.
+type Manifest struct {
+	OS      string    `json:"os"`
+	Version string    `json:"version"`
+	Created time.Time `json:"created"`
+	// Source is the container image or filesystem the rootfs was built from
+	Source string `json:"source,omitempty"`
+	// RunnerVersion is the GitHub Actions runner installed in the rootfs
+	RunnerVersion string `json:"runnerVersion,omitempty"`
+
+	RootFS File `json:"rootfs"`
+	Kernel File `json:"kernel"`
+	Initrd File `json:"initrd"`
+}
+
+type File struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// ReadManifest reads the manifest of the image set in dir.
+func ReadManifest(dir string) (*Manifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, ManifestFile))
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s", filepath.Join(dir, ManifestFile))
+	}
+	return &m, nil
+}
+
+// Write writes the manifest to dir, replacing the previous manifest
+// atomically.
+func (m *Manifest) Write(dir string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, "."+ManifestFile)
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, ManifestFile))
+}
+
+// Describe returns the size and checksum of a file.
+func Describe(path string) (File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return File{}, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return File{}, err
+	}
+	return File{
+		Name:   filepath.Base(path),
+		Size:   n,
+		SHA256: hex.EncodeToString(h.Sum(nil)),
+	}, nil
+}
@@ -0,0 +1,450 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package images
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/appscodelabs/gh-ci-webhook/pkg/backend"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/pkg/errors"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// Bucket is the object store the image sets are pushed to
+	Bucket = backend.StreamPrefix + "images"
+	// ChunkSize is the size of the chunks image files are stored in
+	ChunkSize = 64 << 20
+
+	latestObject = "latest"
+	chunksSuffix = ".chunks"
+)
+
+// ChunkList describes the chunks an image file is stored in, as objects
+// <os>/<version>/<file>/<index>.
+type ChunkList struct {
+	Name      string  `json:"name"`
+	Size      int64   `json:"size"`
+	ChunkSize int64   `json:"chunkSize"`
+	Chunks    []Chunk `json:"chunks"`
+}
+
+type Chunk struct {
+	SHA256 string `json:"sha256"`
+	// Zero chunks are not stored; they are holes in sparse files
+	Zero bool `json:"zero,omitempty"`
+}
+
+// Store keeps image sets in a NATS object store. Every image set is
+// stored under <os>/<version>/ with its manifest, and <os>/latest holds the
+// version hosts sync.
+type Store struct {
+	obs jetstream.ObjectStore
+}
+
+func NewStore(ctx context.Context, nc *nats.Conn) (*Store, error) {
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return nil, err
+	}
+	obs, err := js.CreateOrUpdateObjectStore(ctx, jetstream.ObjectStoreConfig{
+		Bucket:      Bucket,
+		Description: "gh-ci OS images",
+		Storage:     jetstream.FileStorage,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create image bucket")
+	}
+	return &Store{obs: obs}, nil
+}
+
+func versionPrefix(name, version string) string {
+	return name + "/" + version + "/"
+}
+
+func chunkObject(name, version, file string, i int) string {
+	return versionPrefix(name, version) + file + "/" + strconv.Itoa(i)
+}
+
+// Push uploads the image set in dir. Chunks already in the store are
+// skipped, so an interrupted push can be resumed. With activate, hosts
+// sync the pushed version.
+func (s *Store) Push(ctx context.Context, dir string, activate bool) (*Manifest, error) {
+	m, err := ReadManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	img := &Image{Manifest: *m, Dir: dir}
+	klog.InfoS("verifying image", "os", m.OS, "version", m.Version)
+	if err := img.Verify(); err != nil {
+		return nil, err
+	}
+
+	prefix := versionPrefix(m.OS, m.Version)
+	for _, f := range []File{m.RootFS, m.Kernel, m.Initrd} {
+		cl, err := s.pushFile(ctx, m, filepath.Join(dir, f.Name))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to push %s", f.Name)
+		}
+		data, err := json.Marshal(cl)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := s.obs.PutBytes(ctx, prefix+f.Name+chunksSuffix, data); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.obs.PutBytes(ctx, prefix+ManifestFile, data); err != nil {
+		return nil, err
+	}
+	if activate {
+		if _, err := s.obs.PutString(ctx, m.OS+"/"+latestObject, m.Version); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (s *Store) pushFile(ctx context.Context, m *Manifest, path string) (*ChunkList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	cl := &ChunkList{
+		Name:      filepath.Base(path),
+		Size:      fi.Size(),
+		ChunkSize: ChunkSize,
+	}
+	buf := make([]byte, ChunkSize)
+	zeros := make([]byte, ChunkSize)
+	var uploaded, skipped int
+	for i := 0; ; i++ {
+		n, err := io.ReadFull(f, buf)
+		if err == io.EOF {
+			break
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		chunk := buf[:n]
+		h := sha256.New()
+		h.Write(chunk)
+		c := Chunk{
+			SHA256: hex.EncodeToString(h.Sum(nil)),
+			Zero:   bytes.Equal(chunk, zeros[:n]),
+		}
+		cl.Chunks = append(cl.Chunks, c)
+
+		if !c.Zero {
+			name := chunkObject(m.OS, m.Version, cl.Name, i)
+			if info, err := s.obs.GetInfo(ctx, name); err == nil && info.Digest == jetstream.GetObjectDigestValue(h) {
+				skipped++
+			} else {
+				if _, err := s.obs.PutBytes(ctx, name, chunk); err != nil {
+					return nil, err
+				}
+				uploaded++
+			}
+		}
+		if n < ChunkSize {
+			break
+		}
+	}
+	klog.InfoS("pushed file", "file", cl.Name, "chunks", len(cl.Chunks), "uploaded", uploaded, "skipped", skipped)
+	return cl, nil
+}
+
+// LatestVersion returns the version of an image hosts sync.
+func (s *Store) LatestVersion(ctx context.Context, name string) (string, error) {
+	return s.obs.GetString(ctx, name+"/"+latestObject)
+}
+
+func (s *Store) Manifest(ctx context.Context, name, version string) (*Manifest, error) {
+	data, err := s.obs.GetBytes(ctx, versionPrefix(name, version)+ManifestFile)
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// Versions returns the manifests of the versions of every image in the
+// store, sorted by os and creation time.
+func (s *Store) Versions(ctx context.Context) ([]*Manifest, error) {
+	objects, err := s.obs.List(ctx)
+	if errors.Is(err, jetstream.ErrNoObjectsFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var out []*Manifest
+	for _, o := range objects {
+		parts := strings.Split(o.Name, "/")
+		if len(parts) != 3 || parts[2] != ManifestFile {
+			continue
+		}
+		m, err := s.Manifest(ctx, parts[0], parts[1])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, m)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].OS != out[j].OS {
+			return out[i].OS < out[j].OS
+		}
+		return out[i].Created.Before(out[j].Created)
+	})
+	return out, nil
+}
+
+// Prune deletes all but the newest keep versions of an image from the
+// store. The latest version is always kept.
+func (s *Store) Prune(ctx context.Context, name string, keep int) error {
+	versions, err := s.Versions(ctx)
+	if err != nil {
+		return err
+	}
+	latest, _ := s.LatestVersion(ctx, name)
+
+	var old []string
+	kept := 0
+	for i := len(versions) - 1; i >= 0; i-- {
+		m := versions[i]
+		if m.OS != name {
+			continue
+		}
+		if m.Version == latest || kept < keep {
+			kept++
+			continue
+		}
+		old = append(old, m.Version)
+	}
+	if len(old) == 0 {
+		return nil
+	}
+
+	objects, err := s.obs.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, version := range old {
+		prefix := versionPrefix(name, version)
+		for _, o := range objects {
+			if strings.HasPrefix(o.Name, prefix) {
+				if err := s.obs.Delete(ctx, o.Name); err != nil {
+					return err
+				}
+			}
+		}
+		klog.InfoS("pruned image", "os", name, "version", version)
+	}
+	return nil
+}
+
+// Pull downloads the files of an image set into stage. Chunks are verified
+// as they are written, and chunks matching the files in reuseDir are copied
+// from there instead of downloaded. Progress is recorded next to each file,
+// so an interrupted pull is resumed.
+func (s *Store) Pull(ctx context.Context, m *Manifest, stage, reuseDir string) error {
+	if err := os.MkdirAll(stage, 0o755); err != nil {
+		return err
+	}
+	for _, f := range []File{m.RootFS, m.Kernel, m.Initrd} {
+		data, err := s.obs.GetBytes(ctx, versionPrefix(m.OS, m.Version)+f.Name+chunksSuffix)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read chunks of %s", f.Name)
+		}
+		var cl ChunkList
+		if err := json.Unmarshal(data, &cl); err != nil {
+			return err
+		}
+		if err := s.pullFile(ctx, m, &cl, filepath.Join(stage, f.Name), filepath.Join(reuseDir, f.Name)); err != nil {
+			return errors.Wrapf(err, "failed to pull %s", f.Name)
+		}
+	}
+	return nil
+}
+
+func (s *Store) pullFile(ctx context.Context, m *Manifest, cl *ChunkList, path, reusePath string) error {
+	progress := path + ".progress"
+	done, err := readProgress(progress)
+	if err != nil {
+		return err
+	}
+	if len(done) == 0 {
+		// start over, in case the file was written without progress
+		_ = os.Remove(path)
+	}
+
+	out, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if err := out.Truncate(cl.Size); err != nil {
+		return err
+	}
+	pf, err := os.OpenFile(progress, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	defer pf.Close()
+
+	var reuse *os.File
+	if f, err := os.Open(reusePath); err == nil {
+		reuse = f
+		defer reuse.Close()
+	}
+
+	buf := make([]byte, cl.ChunkSize)
+	var downloaded, reused int
+	for i, c := range cl.Chunks {
+		if done[i] || c.Zero {
+			continue
+		}
+		off := int64(i) * cl.ChunkSize
+		size := cl.ChunkSize
+		if off+size > cl.Size {
+			size = cl.Size - off
+		}
+
+		var chunk []byte
+		if reuse != nil {
+			if n, err := reuse.ReadAt(buf[:size], off); int64(n) == size && (err == nil || err == io.EOF) && checksum(buf[:size]) == c.SHA256 {
+				chunk = buf[:size]
+				reused++
+			}
+		}
+		if chunk == nil {
+			data, err := s.obs.GetBytes(ctx, chunkObject(m.OS, m.Version, cl.Name, i))
+			if err != nil {
+				return errors.Wrapf(err, "failed to download chunk %d", i)
+			}
+			if int64(len(data)) != size || checksum(data) != c.SHA256 {
+				return fmt.Errorf("chunk %d of %s is corrupt", i, cl.Name)
+			}
+			chunk = data
+			downloaded++
+		}
+		if _, err := out.WriteAt(chunk, off); err != nil {
+			return err
+		}
+		if err := out.Sync(); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintln(pf, i); err != nil {
+			return err
+		}
+	}
+	klog.InfoS("pulled file", "file", cl.Name, "chunks", len(cl.Chunks), "downloaded", downloaded, "reused", reused, "resumed", len(done))
+	return os.Remove(progress)
+}
+
+func readProgress(path string) (map[int]bool, error) {
+	done := map[int]bool{}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return done, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if i, err := strconv.Atoi(scanner.Text()); err == nil {
+			done[i] = true
+		}
+	}
+	return done, scanner.Err()
+}
+
+func checksum(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+// Sync makes the latest version of an image in the store the active
+// version in imageDir, keeping keep versions locally. It returns the
+// manifest of the activated version, or nil if the image is up to date or
+// not in the store.
+func (s *Store) Sync(ctx context.Context, imageDir, name string, keep int) (*Manifest, error) {
+	version, err := s.LatestVersion(ctx, name)
+	if errors.Is(err, jetstream.ErrObjectNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(imageDir, name)
+	if local, err := ReadManifest(dir); err == nil && local.Version == version {
+		return nil, nil
+	}
+
+	m, err := s.Manifest(ctx, name, version)
+	if err != nil {
+		return nil, err
+	}
+	klog.InfoS("syncing image", "os", name, "version", version)
+	stage := filepath.Join(imageDir, StageDir, name+"@"+version)
+	if err := s.Pull(ctx, m, stage, dir); err != nil {
+		return nil, err
+	}
+	img := &Image{Manifest: *m, Dir: stage}
+	if err := img.Verify(); err != nil {
+		_ = os.RemoveAll(stage)
+		return nil, err
+	}
+	if err := m.Write(stage); err != nil {
+		return nil, err
+	}
+	if err := Activate(imageDir, name, version, stage); err != nil {
+		return nil, err
+	}
+	klog.InfoS("activated image", "os", name, "version", version)
+	if err := GC(imageDir, name, keep); err != nil {
+		klog.ErrorS(err, "failed to remove old image versions", "os", name)
+	}
+	return m, nil
+}
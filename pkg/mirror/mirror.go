@@ -0,0 +1,424 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mirror
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/appscodelabs/gh-ci-webhook/pkg/netacl"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/pkg/errors"
+	"k8s.io/klog/v2"
+)
+
+const (
+	headerDigest = "Docker-Content-Digest"
+
+	manifestAccept = "application/vnd.oci.image.index.v1+json, application/vnd.docker.distribution.manifest.list.v2+json, " +
+		"application/vnd.oci.image.manifest.v1+json, application/vnd.docker.distribution.manifest.v2+json"
+)
+
+// Server is a pull-through cache for an upstream OCI distribution registry.
+// It serves the read only part of the distribution API used by docker pull.
+// Manifests pulled by digest and blobs are cached forever, manifests pulled
+// by tag are refreshed after the manifest ttl and served stale if the
+// upstream registry is not reachable.
+type Server struct {
+	opts     *Options
+	upstream *url.URL
+	reg      name.Registry
+	acl      netacl.ACL
+	creds    map[string]credential
+
+	mu         sync.Mutex
+	transports map[string]http.RoundTripper
+}
+
+func New(opts *Options) (*Server, error) {
+	u, err := url.Parse(opts.Upstream)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid upstream registry")
+	}
+	var regOpts []name.Option
+	if u.Scheme == "http" {
+		regOpts = append(regOpts, name.Insecure)
+	}
+	reg, err := name.NewRegistry(u.Host, regOpts...)
+	if err != nil {
+		return nil, err
+	}
+	acl, err := netacl.Parse(opts.AllowedNetworks)
+	if err != nil {
+		return nil, err
+	}
+	creds, err := parseCredentials(opts.Credentials, true)
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range []string{"blobs", "tags", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(opts.Dir, dir), 0o755); err != nil {
+			return nil, err
+		}
+	}
+	return &Server{
+		opts:       opts,
+		upstream:   u,
+		reg:        reg,
+		acl:        acl,
+		creds:      creds,
+		transports: map[string]http.RoundTripper{},
+	}, nil
+}
+
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	srv := &http.Server{
+		Addr:    s.opts.Addr,
+		Handler: s,
+	}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+	klog.InfoS("starting registry mirror", "addr", s.opts.Addr, "upstream", s.opts.Upstream)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.acl.Allowed(r.RemoteAddr) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "registry mirror is read only", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.URL.Path == "/v2/" || r.URL.Path == "/v2" {
+		w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+		_, _ = w.Write([]byte("{}"))
+		return
+	}
+
+	p := strings.TrimPrefix(r.URL.Path, "/v2/")
+	if repo, ref, found := cutLast(p, "/manifests/"); found {
+		s.serveManifest(w, r, repo, ref)
+		return
+	}
+	if repo, digest, found := cutLast(p, "/blobs/"); found {
+		s.serveBlob(w, r, repo, digest)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+func cutLast(s, sep string) (string, string, bool) {
+	i := strings.LastIndex(s, sep)
+	if i <= 0 {
+		return "", "", false
+	}
+	return s[:i], s[i+len(sep):], true
+}
+
+func (s *Server) serveManifest(w http.ResponseWriter, r *http.Request, repo, ref string) {
+	if strings.ContainsAny(ref, "/\\") || strings.Contains(repo, "..") {
+		http.Error(w, "invalid reference", http.StatusBadRequest)
+		return
+	}
+
+	isDigest := strings.HasPrefix(ref, "sha256:")
+	digest := ref
+	if !isDigest {
+		digest = s.cachedTag(repo, ref, false)
+	}
+	if digest != "" {
+		if data, mediaType, err := s.readManifest(digest); err == nil {
+			writeManifest(w, r, digest, mediaType, data)
+			return
+		}
+	}
+
+	data, mediaType, digest, err := s.fetchManifest(r.Context(), repo, ref)
+	if err != nil {
+		// serve stale tags while upstream is not reachable
+		if !isDigest {
+			if digest := s.cachedTag(repo, ref, true); digest != "" {
+				if data, mediaType, err2 := s.readManifest(digest); err2 == nil {
+					klog.InfoS("serving stale manifest", "repo", repo, "tag", ref, "error", err)
+					writeManifest(w, r, digest, mediaType, data)
+					return
+				}
+			}
+		}
+		writeError(w, err)
+		return
+	}
+	if isDigest && digest != ref {
+		http.Error(w, "manifest digest mismatch", http.StatusBadGateway)
+		return
+	}
+	if err := s.storeManifest(repo, ref, digest, mediaType, data); err != nil {
+		klog.ErrorS(err, "failed to cache manifest", "repo", repo, "ref", ref)
+	}
+	writeManifest(w, r, digest, mediaType, data)
+}
+
+func writeManifest(w http.ResponseWriter, r *http.Request, digest, mediaType string, data []byte) {
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set(headerDigest, digest)
+	if r.Method == http.MethodHead {
+		return
+	}
+	_, _ = w.Write(data)
+}
+
+// cachedTag returns the digest of a cached tag, if it is not older than the
+// manifest ttl or stale is true.
+func (s *Server) cachedTag(repo, tag string, stale bool) string {
+	filename := filepath.Join(s.opts.Dir, "tags", repo, tag)
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return ""
+	}
+	if !stale && time.Since(fi.ModTime()) > s.opts.ManifestTTL.Duration {
+		return ""
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func (s *Server) blobPath(digest string) (string, error) {
+	hexDigest, found := strings.CutPrefix(digest, "sha256:")
+	if !found || len(hexDigest) != sha256.Size*2 {
+		return "", fmt.Errorf("unsupported digest %q", digest)
+	}
+	if _, err := hex.DecodeString(hexDigest); err != nil {
+		return "", fmt.Errorf("invalid digest %q", digest)
+	}
+	return filepath.Join(s.opts.Dir, "blobs", "sha256", hexDigest), nil
+}
+
+func (s *Server) readManifest(digest string) ([]byte, string, error) {
+	filename, err := s.blobPath(digest)
+	if err != nil {
+		return nil, "", err
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, "", err
+	}
+	mediaType, err := os.ReadFile(filename + ".type")
+	if err != nil {
+		return nil, "", err
+	}
+	return data, string(mediaType), nil
+}
+
+func (s *Server) storeManifest(repo, ref, digest, mediaType string, data []byte) error {
+	filename, err := s.blobPath(digest)
+	if err != nil {
+		return err
+	}
+	if err := writeFile(filename, data); err != nil {
+		return err
+	}
+	if err := writeFile(filename+".type", []byte(mediaType)); err != nil {
+		return err
+	}
+	if ref == digest {
+		return nil
+	}
+	return writeFile(filepath.Join(s.opts.Dir, "tags", repo, ref), []byte(digest))
+}
+
+func writeFile(filename string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0o755); err != nil {
+		return err
+	}
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+func (s *Server) fetchManifest(ctx context.Context, repo, ref string) ([]byte, string, string, error) {
+	resp, err := s.get(ctx, http.MethodGet, repo, "manifests/"+ref, manifestAccept)
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", "", err
+	}
+	sum := sha256.Sum256(data)
+	return data, resp.Header.Get("Content-Type"), "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+func (s *Server) serveBlob(w http.ResponseWriter, r *http.Request, repo, digest string) {
+	filename, err := s.blobPath(digest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if f, err := os.Open(filename); err == nil {
+		defer f.Close()
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set(headerDigest, digest)
+		http.ServeContent(w, r, "", time.Time{}, f)
+		return
+	}
+
+	resp, err := s.get(r.Context(), r.Method, repo, "blobs/"+digest, "")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set(headerDigest, digest)
+	if resp.ContentLength >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	// stream the blob to the client while writing it to the cache
+	tmp, err := os.CreateTemp(filepath.Join(s.opts.Dir, "tmp"), "blob-")
+	if err != nil {
+		klog.ErrorS(err, "failed to create cache file")
+		_, _ = io.Copy(w, resp.Body)
+		return
+	}
+	defer os.Remove(tmp.Name()) //nolint:errcheck
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(w, tmp, h), resp.Body)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		klog.ErrorS(err, "failed to proxy blob", "repo", repo, "digest", digest)
+		return
+	}
+	if got := "sha256:" + hex.EncodeToString(h.Sum(nil)); got != digest {
+		klog.ErrorS(nil, "blob digest mismatch", "repo", repo, "digest", digest, "got", got)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0o755); err != nil {
+		klog.ErrorS(err, "failed to cache blob", "digest", digest)
+		return
+	}
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		klog.ErrorS(err, "failed to cache blob", "digest", digest)
+	}
+}
+
+type upstreamError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *upstreamError) Error() string {
+	return fmt.Sprintf("upstream registry returned %d: %s", e.StatusCode, e.Body)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	var ue *upstreamError
+	if errors.As(err, &ue) {
+		http.Error(w, ue.Body, ue.StatusCode)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadGateway)
+}
+
+func (s *Server) get(ctx context.Context, method, repo, p, accept string) (*http.Response, error) {
+	rt, err := s.transport(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+	u := *s.upstream
+	u.Path = "/v2/" + repo + "/" + p
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	resp, err := (&http.Client{Transport: rt}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, &upstreamError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+	return resp, nil
+}
+
+// transport returns a round tripper that authenticates pulls of repo with
+// the credentials of its namespace.
+func (s *Server) transport(ctx context.Context, repo string) (http.RoundTripper, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if rt, found := s.transports[repo]; found {
+		return rt, nil
+	}
+
+	var auth authn.Authenticator = authn.Anonymous
+	ns, _, _ := strings.Cut(repo, "/")
+	if c, found := s.creds[ns]; found {
+		auth = &authn.Basic{Username: c.Username, Password: c.Password}
+	} else if c, found := s.creds["*"]; found {
+		auth = &authn.Basic{Username: c.Username, Password: c.Password}
+	}
+
+	scope := "repository:" + repo + ":" + transport.PullScope
+	rt, err := transport.NewWithContext(ctx, s.reg, auth, http.DefaultTransport, []string{scope})
+	if err != nil {
+		return nil, err
+	}
+	s.transports[repo] = rt
+	return rt, nil
+}
@@ -0,0 +1,118 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mirror
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/appscodelabs/gh-ci-webhook/pkg/netacl"
+	"github.com/appscodelabs/gh-ci-webhook/pkg/secrets"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type Options struct {
+	// Addr is the listen address of the registry mirror, disabled if empty
+	Addr string `json:"addr,omitempty"`
+	// Dir stores cached manifests and blobs
+	Dir      string `json:"dir,omitempty"`
+	Upstream string `json:"upstream,omitempty"`
+	// ManifestTTL is the duration a manifest pulled by tag is served from cache
+	ManifestTTL metav1.Duration `json:"manifestTTL,omitempty"`
+	// AllowedNetworks are the client networks allowed to use the mirror,
+	// the networks of the VMs if empty
+	AllowedNetworks []string `json:"allowedNetworks,omitempty"`
+	// Credentials for upstream repositories, as <namespace>=<username>:<password>
+	// where password can be a secret reference. Namespace * matches any
+	// repository without its own credentials.
+	Credentials []string `json:"credentials,omitempty"`
+}
+
+func NewOptions() *Options {
+	return &Options{
+		Dir:         "/var/lib/gh-ci/registry",
+		Upstream:    "https://registry-1.docker.io",
+		ManifestTTL: metav1.Duration{Duration: 10 * time.Minute},
+	}
+}
+
+func (opts *Options) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&opts.Addr, "registry-mirror.addr", opts.Addr, "Listen address of the pull-through registry mirror for VMs, eg, :5000 (disabled if empty)")
+	fs.StringVar(&opts.Dir, "registry-mirror.dir", opts.Dir, "PATH to directory where registry mirror caches images")
+	fs.StringVar(&opts.Upstream, "registry-mirror.upstream", opts.Upstream, "URL of the upstream registry")
+	fs.DurationVar(&opts.ManifestTTL.Duration, "registry-mirror.manifest-ttl", opts.ManifestTTL.Duration, "Duration a manifest pulled by tag is served from cache")
+	fs.StringSliceVar(&opts.AllowedNetworks, "registry-mirror.allowed-networks", opts.AllowedNetworks, "Client networks allowed to use the registry mirror, defaults to the networks of the VMs")
+	fs.StringArrayVar(&opts.Credentials, "registry-mirror.credential", opts.Credentials, "Upstream credential, as <namespace>=<username>:<password or secret reference> (eg, appscode=tigerworks:systemd:dockerhub-token)")
+}
+
+// Port returns the port the mirror listens on.
+func (opts *Options) Port() (string, error) {
+	_, port, err := net.SplitHostPort(opts.Addr)
+	return port, err
+}
+
+func (opts *Options) Validate() error {
+	if opts.Addr == "" {
+		return nil
+	}
+	if _, err := opts.Port(); err != nil {
+		return fmt.Errorf("invalid registry mirror address %q: %v", opts.Addr, err)
+	}
+	if opts.Dir == "" {
+		return fmt.Errorf("missing registry mirror dir")
+	}
+	if _, err := netacl.Parse(opts.AllowedNetworks); err != nil {
+		return errors.Wrap(err, "invalid registry mirror allowed networks")
+	}
+	_, err := parseCredentials(opts.Credentials, false)
+	return err
+}
+
+type credential struct {
+	Username string
+	Password string
+}
+
+// parseCredentials parses credentials by namespace. Passwords are only
+// resolved if resolve is true.
+func parseCredentials(in []string, resolve bool) (map[string]credential, error) {
+	out := map[string]credential{}
+	for _, s := range in {
+		ns, userpass, found := strings.Cut(s, "=")
+		if !found || ns == "" {
+			return nil, fmt.Errorf("invalid registry credential for %q, expected <namespace>=<username>:<password>", ns)
+		}
+		username, password, found := strings.Cut(userpass, ":")
+		if !found || username == "" {
+			return nil, fmt.Errorf("invalid registry credential for %q, expected <namespace>=<username>:<password>", ns)
+		}
+		if resolve {
+			var err error
+			password, err = secrets.Resolve(password)
+			if err != nil {
+				return nil, err
+			}
+		}
+		out[ns] = credential{Username: username, Password: password}
+	}
+	return out, nil
+}
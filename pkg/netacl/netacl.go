@@ -0,0 +1,70 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package netacl
+
+import (
+	"fmt"
+	"net"
+)
+
+// ACL is a list of client networks allowed to use a host service.
+type ACL []*net.IPNet
+
+func Parse(networks []string) (ACL, error) {
+	out := make(ACL, 0, len(networks))
+	for _, s := range networks {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q: %v", s, err)
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+// Allowed reports whether the host of remoteAddr (host:port) is in any of
+// the networks.
+func (acl ACL) Allowed(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, n := range acl {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Covers reports whether all addresses of the network cidr are in any of
+// the networks.
+func (acl ACL) Covers(cidr string) bool {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return false
+	}
+	ones, bits := n.Mask.Size()
+	for _, a := range acl {
+		aOnes, aBits := a.Mask.Size()
+		if aBits == bits && aOnes <= ones && a.Contains(n.IP) {
+			return true
+		}
+	}
+	return false
+}
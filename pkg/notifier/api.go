@@ -0,0 +1,78 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package notifier
+
+import (
+	"context"
+	"time"
+)
+
+type EventType string
+
+const (
+	EventVMStarting EventType = "vm-starting"
+	EventVMStarted  EventType = "vm-started"
+	EventVMStopping EventType = "vm-stopping"
+	EventVMStopped  EventType = "vm-stopped"
+
+	EventAlertFiring   EventType = "alert-firing"
+	EventAlertResolved EventType = "alert-resolved"
+
+	EventImagePromoted   EventType = "image-promoted"
+	EventImageRolledBack EventType = "image-rolled-back"
+
+	// EventAny matches every event type in a route.
+	EventAny EventType = "*"
+)
+
+// eventTypes are the event types that can be routed.
+var eventTypes = map[EventType]bool{
+	EventVMStarting:      true,
+	EventVMStarted:       true,
+	EventVMStopping:      true,
+	EventVMStopped:       true,
+	EventAlertFiring:     true,
+	EventAlertResolved:   true,
+	EventImagePromoted:   true,
+	EventImageRolledBack: true,
+	EventAny:             true,
+}
+
+// Event describes something that happened on a host or the webhook server.
+// Events are rendered into a Message using the templates configured for
+// their type.
+type Event struct {
+	Type      EventType
+	Host      string
+	Machine   string
+	Job       string
+	Message   string
+	Timestamp time.Time
+	Details   map[string]string
+}
+
+type Message struct {
+	Subject string `json:"subject"`
+	Body    string `json:"body"` // markdown
+}
+
+// Interface is implemented by every notification backend.
+// The address is backend specific, eg, an email recipient or a webhook URL.
+type Interface interface {
+	Name() string
+	Send(ctx context.Context, address string, msg Message) error
+}
@@ -0,0 +1,282 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package notifier
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	rateLimitWindow = time.Hour
+	// retry interval for messages held back by the rate limiter
+	retryInterval = time.Minute
+	// max number of messages kept in a digest, older messages are dropped
+	maxPending = 100
+)
+
+type queue struct {
+	target  target
+	pending []Message
+	dropped int
+	sent    []time.Time
+}
+
+// Dispatcher renders events and delivers them to the targets of matching
+// routes. Messages for a target are rate limited and, if a digest interval
+// is set, batched into a single digest message.
+type Dispatcher struct {
+	opts     *Options
+	hostname string
+	tpl      *template.Template
+	routes   map[EventType][]target
+	backends map[string]Interface
+
+	mu     sync.Mutex
+	queues map[target]*queue
+	kick   chan struct{}
+}
+
+func NewDispatcher(opts *Options) (*Dispatcher, error) {
+	routes, err := opts.parseRoutes()
+	if err != nil {
+		return nil, err
+	}
+	tpl, err := loadTemplates(opts.TemplateDir)
+	if err != nil {
+		return nil, err
+	}
+
+	backends := map[string]Interface{}
+	for _, b := range []Interface{
+		&emailNotifier{
+			sender:   opts.EmailSender,
+			addr:     opts.SMTPAddress,
+			username: opts.SMTPUsername,
+			password: opts.SMTPPassword,
+		},
+		NewSlackNotifier(),
+		NewDiscordNotifier(),
+		NewTeamsNotifier(),
+		NewWebhookNotifier(),
+	} {
+		backends[b.Name()] = b
+	}
+	for _, targets := range routes {
+		for _, t := range targets {
+			if _, found := backends[t.Backend]; !found {
+				return nil, fmt.Errorf("unknown notifier backend %q", t.Backend)
+			}
+		}
+	}
+
+	hostname, _ := os.Hostname()
+	return &Dispatcher{
+		opts:     opts,
+		hostname: hostname,
+		tpl:      tpl,
+		routes:   routes,
+		backends: backends,
+		queues:   map[target]*queue{},
+		kick:     make(chan struct{}, 1),
+	}, nil
+}
+
+func (d *Dispatcher) Notify(e Event) {
+	targets := d.targets(e.Type)
+	if len(targets) == 0 {
+		return
+	}
+
+	if e.Host == "" {
+		e.Host = d.hostname
+	}
+	if e.Timestamp.IsZero() {
+		e.Timestamp = time.Now()
+	}
+	msg, err := render(d.tpl, e)
+	if err != nil {
+		klog.ErrorS(err, "failed to render notification", "event", e.Type)
+		return
+	}
+
+	d.mu.Lock()
+	for _, t := range targets {
+		q, found := d.queues[t]
+		if !found {
+			q = &queue{target: t}
+			d.queues[t] = q
+		}
+		q.pending = append(q.pending, msg)
+		if n := len(q.pending) - maxPending; n > 0 {
+			q.pending = q.pending[n:]
+			q.dropped += n
+		}
+	}
+	d.mu.Unlock()
+
+	select {
+	case d.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (d *Dispatcher) targets(et EventType) []target {
+	var result []target
+	seen := map[target]bool{}
+	for _, routes := range [][]target{d.routes[et], d.routes[EventAny]} {
+		for _, t := range routes {
+			if !seen[t] {
+				seen[t] = true
+				result = append(result, t)
+			}
+		}
+	}
+	return result
+}
+
+// Run delivers queued messages until ctx is done.
+func (d *Dispatcher) Run(ctx context.Context) {
+	interval := d.opts.DigestInterval.Duration
+	if interval <= 0 {
+		interval = retryInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			d.flush(context.Background())
+			return
+		case <-d.kick:
+			if d.opts.DigestInterval.Duration <= 0 {
+				d.flush(ctx)
+			}
+		case <-ticker.C:
+			d.flush(ctx)
+		}
+	}
+}
+
+func (d *Dispatcher) flush(ctx context.Context) {
+	type delivery struct {
+		target target
+		msg    Message
+	}
+	var deliveries []delivery
+
+	now := time.Now()
+	d.mu.Lock()
+	for _, q := range d.queues {
+		if len(q.pending) == 0 {
+			continue
+		}
+
+		recent := q.sent[:0]
+		for _, t := range q.sent {
+			if now.Sub(t) < rateLimitWindow {
+				recent = append(recent, t)
+			}
+		}
+		q.sent = recent
+		if d.opts.RateLimit > 0 && len(q.sent) >= d.opts.RateLimit {
+			continue
+		}
+
+		deliveries = append(deliveries, delivery{
+			target: q.target,
+			msg:    d.digest(q.pending, q.dropped),
+		})
+		q.sent = append(q.sent, now)
+		q.pending = nil
+		q.dropped = 0
+	}
+	d.mu.Unlock()
+
+	for _, x := range deliveries {
+		err := d.backends[x.target.Backend].Send(ctx, x.target.Address, x.msg)
+		if err != nil {
+			klog.ErrorS(err, "failed to send notification", "backend", x.target.Backend, "subject", x.msg.Subject)
+		}
+	}
+}
+
+func (d *Dispatcher) digest(msgs []Message, dropped int) Message {
+	if len(msgs) == 1 && dropped == 0 {
+		return msgs[0]
+	}
+
+	var buf strings.Builder
+	for i, msg := range msgs {
+		if i > 0 {
+			buf.WriteString("\n---\n\n")
+		}
+		buf.WriteString("### " + msg.Subject + "\n\n")
+		buf.WriteString(msg.Body)
+	}
+	if dropped > 0 {
+		_, _ = fmt.Fprintf(&buf, "\n---\n\n%d older notifications were dropped\n", dropped)
+	}
+	return Message{
+		Subject: fmt.Sprintf("%d notifications from %s", len(msgs)+dropped, d.hostname),
+		Body:    buf.String(),
+	}
+}
+
+var (
+	defaultDispatcher atomic.Pointer[Dispatcher]
+	stopDefault       context.CancelFunc
+	startMu           sync.Mutex
+)
+
+// Start creates the default dispatcher used by Notify and runs it until ctx
+// is done. Calling Start again replaces the running dispatcher, eg, after
+// the options are reloaded.
+func Start(ctx context.Context, opts *Options) error {
+	d, err := NewDispatcher(opts)
+	if err != nil {
+		return err
+	}
+
+	startMu.Lock()
+	defer startMu.Unlock()
+
+	if stopDefault != nil {
+		stopDefault()
+	}
+	ctx, stopDefault = context.WithCancel(ctx)
+	defaultDispatcher.Store(d)
+	go d.Run(ctx)
+	return nil
+}
+
+// Notify sends the event via the default dispatcher.
+// It is a no-op until Start is called.
+func Notify(e Event) {
+	if d := defaultDispatcher.Load(); d != nil {
+		d.Notify(e)
+	}
+}
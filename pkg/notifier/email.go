@@ -0,0 +1,66 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package notifier
+
+import (
+	"context"
+	"net"
+	"net/smtp"
+
+	"github.com/pkg/errors"
+	"gomodules.xyz/mailer"
+)
+
+type emailNotifier struct {
+	sender   string
+	addr     string
+	username string
+	password string
+}
+
+var _ Interface = &emailNotifier{}
+
+func (_ emailNotifier) Name() string {
+	return "email"
+}
+
+func (n emailNotifier) Send(_ context.Context, address string, msg Message) error {
+	if address == "" {
+		return errors.New("missing email recipient")
+	}
+	sender := n.sender
+	if sender == "" {
+		sender = address
+	}
+	mm := mailer.Mailer{
+		Sender:  sender,
+		Subject: msg.Subject,
+		Body:    msg.Body,
+	}
+	host, _, err := net.SplitHostPort(n.addr)
+	if err != nil {
+		return errors.Wrap(err, "invalid smtp address")
+	}
+	mg := &mailer.SMTPService{
+		Address: n.addr,
+	}
+	// servers without auth, eg, a local relay, reject AUTH
+	if n.username != "" {
+		mg.Auth = smtp.PlainAuth("", n.username, n.password, host)
+	}
+	return mm.SendMail(mg, address, "", nil)
+}
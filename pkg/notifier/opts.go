@@ -0,0 +1,148 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package notifier
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/appscodelabs/gh-ci-webhook/pkg/secrets"
+
+	"github.com/spf13/pflag"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type Options struct {
+	// Routes maps event types to targets, as <event>=<target>[,<target>...]
+	// A target is <backend>[:<address>], eg, email:ops@example.com or slack
+	Routes      []string `json:"routes,omitempty"`
+	TemplateDir string   `json:"templateDir,omitempty"`
+
+	// RateLimit is the max number of messages sent to a single target per hour
+	RateLimit int `json:"rateLimit,omitempty"`
+	// DigestInterval batches events sent to a target into a single message
+	DigestInterval metav1.Duration `json:"digestInterval,omitempty"`
+
+	EmailSender  string `json:"emailSender,omitempty"`
+	SMTPAddress  string `json:"smtpAddress,omitempty"`
+	SMTPUsername string `json:"smtpUsername,omitempty"`
+	SMTPPassword string `json:"smtpPassword,omitempty"`
+
+	SlackWebhookURL   string `json:"slackWebhookURL,omitempty"`
+	DiscordWebhookURL string `json:"discordWebhookURL,omitempty"`
+	TeamsWebhookURL   string `json:"teamsWebhookURL,omitempty"`
+	WebhookURL        string `json:"webhookURL,omitempty"`
+}
+
+var DefaultOptions = NewOptions()
+
+func NewOptions() *Options {
+	return &Options{
+		RateLimit:         20,
+		EmailSender:       os.Getenv("SMTP_SENDER"),
+		SMTPAddress:       os.Getenv("SMTP_ADDRESS"),
+		SMTPUsername:      os.Getenv("SMTP_USERNAME"),
+		SMTPPassword:      os.Getenv("SMTP_PASSWORD"),
+		SlackWebhookURL:   os.Getenv("SLACK_WEBHOOK_URL"),
+		DiscordWebhookURL: os.Getenv("DISCORD_WEBHOOK_URL"),
+		TeamsWebhookURL:   os.Getenv("TEAMS_WEBHOOK_URL"),
+	}
+}
+
+func (opts *Options) AddFlags(fs *pflag.FlagSet) {
+	fs.StringArrayVar(&opts.Routes, "notify.route", opts.Routes, "Route events to targets, as <event>=<target>[,<target>...] (eg, vm-stopped=email:ops@example.com,slack)")
+	fs.StringVar(&opts.TemplateDir, "notify.template-dir", opts.TemplateDir, "PATH to directory with *.tmpl files overriding notification templates")
+	fs.IntVar(&opts.RateLimit, "notify.rate-limit", opts.RateLimit, "Max number of messages sent to a target per hour (0 for unlimited)")
+	fs.DurationVar(&opts.DigestInterval.Duration, "notify.digest-interval", opts.DigestInterval.Duration, "Batch events into a single digest message per interval (0 to send immediately)")
+	fs.StringVar(&opts.EmailSender, "notify.email.sender", opts.EmailSender, "Sender address of notification emails")
+	fs.StringVar(&opts.SMTPAddress, "notify.email.smtp-address", opts.SMTPAddress, "host:port of the SMTP server")
+	fs.StringVar(&opts.SMTPUsername, "notify.email.smtp-username", opts.SMTPUsername, "SMTP username")
+	secrets.StringVar(fs, &opts.SMTPPassword, "notify.email.smtp-password", "SMTP password or secret reference")
+	secrets.StringVar(fs, &opts.SlackWebhookURL, "notify.slack.webhook-url", "Default Slack incoming webhook URL or secret reference")
+	secrets.StringVar(fs, &opts.DiscordWebhookURL, "notify.discord.webhook-url", "Default Discord webhook URL or secret reference")
+	secrets.StringVar(fs, &opts.TeamsWebhookURL, "notify.teams.webhook-url", "Default Microsoft Teams incoming webhook URL or secret reference")
+	secrets.StringVar(fs, &opts.WebhookURL, "notify.webhook-url", "Default URL for generic webhook notifications or secret reference")
+}
+
+// ResolveSecrets replaces secret references with their values.
+func (opts *Options) ResolveSecrets() error {
+	return secrets.ResolveAll(&opts.SMTPPassword, &opts.SlackWebhookURL, &opts.DiscordWebhookURL, &opts.TeamsWebhookURL, &opts.WebhookURL)
+}
+
+func (opts *Options) Validate() error {
+	if _, err := opts.parseRoutes(); err != nil {
+		return err
+	}
+	if _, err := loadTemplates(opts.TemplateDir); err != nil {
+		return err
+	}
+	return nil
+}
+
+type target struct {
+	Backend string
+	Address string
+}
+
+func (t target) String() string {
+	return t.Backend + ":" + t.Address
+}
+
+func (opts *Options) parseRoutes() (map[EventType][]target, error) {
+	routes := map[EventType][]target{}
+	for _, route := range opts.Routes {
+		et, targets, found := strings.Cut(route, "=")
+		if !found || et == "" || targets == "" {
+			return nil, fmt.Errorf("invalid route %q, expected <event>=<target>[,<target>...]", route)
+		}
+		if !eventTypes[EventType(et)] {
+			return nil, fmt.Errorf("unknown event type %q in route %q", et, route)
+		}
+		for _, s := range strings.Split(targets, ",") {
+			backend, addr, _ := strings.Cut(strings.TrimSpace(s), ":")
+			if backend == "" {
+				return nil, fmt.Errorf("invalid target %q in route %q", s, route)
+			}
+			if addr == "" {
+				addr = opts.defaultAddress(backend)
+			}
+			if addr == "" {
+				return nil, fmt.Errorf("missing address of target %q in route %q", s, route)
+			}
+			if backend == "email" && opts.SMTPAddress == "" {
+				return nil, fmt.Errorf("route %q sends email, but the smtp address is not set", route)
+			}
+			routes[EventType(et)] = append(routes[EventType(et)], target{Backend: backend, Address: addr})
+		}
+	}
+	return routes, nil
+}
+
+func (opts *Options) defaultAddress(backend string) string {
+	switch backend {
+	case "slack":
+		return opts.SlackWebhookURL
+	case "discord":
+		return opts.DiscordWebhookURL
+	case "teams":
+		return opts.TeamsWebhookURL
+	case "webhook":
+		return opts.WebhookURL
+	}
+	return ""
+}
@@ -0,0 +1,105 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package notifier
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+// Templates are looked up as "<event>.subject" and "<event>.body", falling
+// back to "subject" and "body". Files in the template dir can redefine any
+// of them, eg, {{ define "vm-stopped.body" }}...{{ end }}
+const defaultTemplates = `
+{{- define "subject" }}{{ .Type }} {{ .Machine }}{{ end }}
+{{- define "vm-starting.subject" }}Starting VM {{ .Machine }}{{ end }}
+{{- define "vm-started.subject" }}Started VM {{ .Machine }}{{ end }}
+{{- define "vm-stopping.subject" }}Shutting VM {{ .Machine }}{{ end }}
+{{- define "vm-stopped.subject" }}Shut down VM {{ .Machine }}{{ end }}
+{{- define "alert-firing.subject" }}[FIRING] {{ .Details.Rule }} {{ .Details.Subject }}{{ end }}
+{{- define "alert-resolved.subject" }}[RESOLVED] {{ .Details.Rule }} {{ .Details.Subject }}{{ end }}
+{{- define "image-promoted.subject" }}Promoted image {{ .Details.Image }} {{ .Details.Version }}{{ end }}
+{{- define "image-rolled-back.subject" }}Rolled back image {{ .Details.Image }} {{ .Details.Version }}{{ end }}
+{{- define "body" }}
+{{- with .Message }}{{ . }}
+
+{{ end -}}
+**Host:** {{ .Host }}
+{{- with .Machine }}
+**Machine:** {{ . }}
+{{- end }}
+{{- with .Job }}
+**Job:** {{ . }}
+{{- end }}
+**Time:** {{ .Timestamp.Format "2006-01-02 15:04:05 MST" }}
+{{- range $k, $v := .Details }}
+**{{ $k }}:** {{ $v }}
+{{- end }}
+{{ end }}`
+
+func loadTemplates(dir string) (*template.Template, error) {
+	tpl, err := template.New("notifier").Option("missingkey=zero").Parse(defaultTemplates)
+	if err != nil {
+		return nil, err
+	}
+	if dir == "" {
+		return tpl, nil
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.tmpl"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return tpl, nil
+	}
+	tpl, err = tpl.ParseFiles(files...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse templates in %s", dir)
+	}
+	return tpl, nil
+}
+
+func render(tpl *template.Template, e Event) (Message, error) {
+	subject, err := execute(tpl, string(e.Type)+".subject", "subject", e)
+	if err != nil {
+		return Message{}, err
+	}
+	body, err := execute(tpl, string(e.Type)+".body", "body", e)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{
+		Subject: strings.TrimSpace(subject),
+		Body:    body,
+	}, nil
+}
+
+func execute(tpl *template.Template, name, fallback string, data any) (string, error) {
+	t := tpl.Lookup(name)
+	if t == nil {
+		t = tpl.Lookup(fallback)
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", errors.Wrapf(err, "failed to render template %s", t.Name())
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,129 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package notifier
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+const webhookTimeout = 10 * time.Second
+
+// webhookNotifier posts the json encoding of the payload returned by
+// encode to the target address. Slack, Discord, Microsoft Teams and
+// generic webhooks only differ in their payload format.
+type webhookNotifier struct {
+	name   string
+	encode func(msg Message) any
+}
+
+var _ Interface = &webhookNotifier{}
+
+func (n webhookNotifier) Name() string {
+	return n.name
+}
+
+func (n webhookNotifier) Send(ctx context.Context, address string, msg Message) error {
+	if address == "" {
+		return fmt.Errorf("missing %s webhook url", n.name)
+	}
+	data, err := json.Marshal(n.encode(msg))
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, address, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s webhook returned %s: %s", n.name, resp.Status, string(body))
+	}
+	return nil
+}
+
+// https://api.slack.com/messaging/webhooks
+func NewSlackNotifier() Interface {
+	return &webhookNotifier{
+		name: "slack",
+		encode: func(msg Message) any {
+			return map[string]string{
+				"text": fmt.Sprintf("*%s*\n%s", msg.Subject, msg.Body),
+			}
+		},
+	}
+}
+
+// https://discord.com/developers/docs/resources/webhook#execute-webhook
+func NewDiscordNotifier() Interface {
+	const maxContentLength = 2000
+	return &webhookNotifier{
+		name: "discord",
+		encode: func(msg Message) any {
+			content := fmt.Sprintf("**%s**\n%s", msg.Subject, msg.Body)
+			// the limit is in characters; cutting bytes could split a
+			// multi-byte character, which discord rejects
+			if runes := []rune(content); len(runes) > maxContentLength {
+				content = string(runes[:maxContentLength-3]) + "..."
+			}
+			return map[string]string{
+				"content": content,
+			}
+		},
+	}
+}
+
+// https://learn.microsoft.com/en-us/microsoftteams/platform/webhooks-and-connectors/how-to/connectors-using
+func NewTeamsNotifier() Interface {
+	return &webhookNotifier{
+		name: "teams",
+		encode: func(msg Message) any {
+			return map[string]string{
+				"@type":    "MessageCard",
+				"@context": "https://schema.org/extensions",
+				"summary":  msg.Subject,
+				"title":    msg.Subject,
+				"text":     msg.Body,
+			}
+		},
+	}
+}
+
+func NewWebhookNotifier() Interface {
+	return &webhookNotifier{
+		name: "webhook",
+		encode: func(msg Message) any {
+			return msg
+		},
+	}
+}
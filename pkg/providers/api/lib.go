@@ -34,6 +34,12 @@ type Interface interface {
 	Status() ([]byte, error)
 }
 
+// Reloader is implemented by providers that can apply option changes
+// without restarting the host controller.
+type Reloader interface {
+	Reload() error
+}
+
 var (
 	providers = map[string]Interface{}
 	mu        sync.Mutex
@@ -0,0 +1,160 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package firecracker
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+type capability struct {
+	bit    int
+	name   string
+	reason string
+}
+
+// requiredCapabilities returns the capabilities hostctl needs to run VMs
+// with the current options, in addition to access to /dev/kvm.
+func requiredCapabilities(rootfs string) []capability {
+	caps := []capability{
+		{unix.CAP_NET_ADMIN, "CAP_NET_ADMIN", "tap devices, routes and nftables rules of the VMs"},
+		{unix.CAP_NET_RAW, "CAP_NET_RAW", "iptables FORWARD rules of the VMs"},
+	}
+	switch {
+	case Current().Jailer:
+		caps = append(caps, capability{unix.CAP_SYS_ADMIN, "CAP_SYS_ADMIN", "network namespaces of the slots and the mount namespace of the jailer"})
+	case Current().Snapshots:
+		caps = append(caps, capability{unix.CAP_SYS_ADMIN, "CAP_SYS_ADMIN", "network and mount namespaces of VMs restored from snapshots"})
+	case rootfs == RootFSDMSnapshot:
+		caps = append(caps, capability{unix.CAP_SYS_ADMIN, "CAP_SYS_ADMIN", "loop and device-mapper devices of the dm-snapshot rootfs strategy"})
+	}
+	if Current().Cgroups && !Current().Jailer {
+		caps = append(caps, capability{unix.CAP_DAC_OVERRIDE, "CAP_DAC_OVERRIDE", "cgroups of the VMs"})
+	}
+	if Current().Jailer {
+		caps = append(caps,
+			capability{unix.CAP_SYS_CHROOT, "CAP_SYS_CHROOT", "chroot of the jailer"},
+			capability{unix.CAP_SETUID, "CAP_SETUID", "uid of the jailed VMs"},
+			capability{unix.CAP_SETGID, "CAP_SETGID", "gid of the jailed VMs"},
+			capability{unix.CAP_MKNOD, "CAP_MKNOD", "devices in the chroot of the jailed VMs"},
+			capability{unix.CAP_CHOWN, "CAP_CHOWN", "files in the chroot of the jailed VMs"},
+			capability{unix.CAP_DAC_OVERRIDE, "CAP_DAC_OVERRIDE", "cgroups of the jailed VMs"},
+		)
+	}
+	return caps
+}
+
+// requiredTools are the binaries hostctl runs to set up the networking of
+// the VMs.
+var requiredTools = []struct{ name, reason string }{
+	{"nft", "nftables rules of the VMs"},
+	{"iptables", "iptables FORWARD rules of the VMs"},
+}
+
+// checkCapabilities checks that hostctl has the capabilities and the tools
+// it needs. Unless running as root, the capabilities must also be ambient,
+// so that they are passed to nft, iptables and the jailer.
+func checkCapabilities(rootfs string) error {
+	var tools []string
+	for _, t := range requiredTools {
+		if _, err := exec.LookPath(t.name); err != nil {
+			tools = append(tools, fmt.Sprintf("%s (%s)", t.name, t.reason))
+		}
+	}
+	if len(tools) > 0 {
+		return fmt.Errorf("missing binaries in PATH: %s", strings.Join(tools, ", "))
+	}
+
+	eff, amb, err := processCapabilities()
+	if err != nil {
+		return err
+	}
+	root := os.Geteuid() == 0
+
+	var missing []string
+	for _, c := range requiredCapabilities(rootfs) {
+		if eff&(1<<c.bit) == 0 {
+			missing = append(missing, fmt.Sprintf("%s (%s)", c.name, c.reason))
+		} else if !root && amb&(1<<c.bit) == 0 {
+			missing = append(missing, fmt.Sprintf("ambient %s (%s)", c.name, c.reason))
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing capabilities: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// processCapabilities returns the effective and ambient capability sets of
+// hostctl.
+func processCapabilities() (eff uint64, amb uint64, err error) {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close() //nolint:errcheck
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), ":")
+		if !found {
+			continue
+		}
+		switch key {
+		case "CapEff":
+			eff, err = strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+		case "CapAmb":
+			amb, err = strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+		}
+		if err != nil {
+			return 0, 0, errors.Wrapf(err, "failed to parse %s", key)
+		}
+	}
+	return eff, amb, scanner.Err()
+}
+
+// sameFilesystem checks that dirs are on the filesystem of dir, so that
+// files in them can be hard linked into dir.
+func sameFilesystem(dir string, dirs ...string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	var st unix.Stat_t
+	if err := unix.Stat(dir, &st); err != nil {
+		return err
+	}
+	for _, d := range dirs {
+		if err := os.MkdirAll(d, 0o755); err != nil {
+			return err
+		}
+		var other unix.Stat_t
+		if err := unix.Stat(d, &other); err != nil {
+			return err
+		}
+		if other.Dev != st.Dev {
+			return fmt.Errorf("%s is not on the filesystem of %s", d, dir)
+		}
+	}
+	return nil
+}
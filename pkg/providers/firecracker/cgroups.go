@@ -0,0 +1,286 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package firecracker
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/appscodelabs/gh-ci-webhook/pkg/backend"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+)
+
+const cgroupRoot = "/sys/fs/cgroup"
+
+// cgroupControllers are the controllers enabled for the cgroups of the slots.
+var cgroupControllers = []string{"cpu", "memory", "io"}
+
+// ioMaxKeys are the limits accepted in io.max.
+var ioMaxKeys = []string{"rbps", "wbps", "riops", "wiops"}
+
+// slotCgroups returns true if the VMs run in a cgroup per slot.
+func slotCgroups() bool {
+	opts := Current()
+	return opts.Cgroups || opts.Jailer
+}
+
+// slotCgroup returns the cgroup of the VM of a slot. Jailed VMs use the
+// cgroup created by the jailer.
+func slotCgroup(id int) string {
+	if Current().Jailer {
+		return jailCgroup(id)
+	}
+	return filepath.Join(cgroupRoot, Current().CgroupParent, jailID(id))
+}
+
+// prepareCgroup enables the controllers of the cgroup of a slot in its
+// parents and, unless jailed, creates the cgroup with its limits.
+func prepareCgroup(id int) error {
+	dir := slotCgroup(id)
+	removeCgroup(dir)
+	if err := enableControllers(filepath.Dir(dir)); err != nil {
+		return err
+	}
+	if Current().Jailer {
+		return nil
+	}
+	if err := os.Mkdir(dir, 0o755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return setCgroupLimits(dir)
+}
+
+// enableControllers creates dir and enables the cgroup controllers of the
+// slots in dir and its parents.
+func enableControllers(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(cgroupRoot, dir)
+	if err != nil {
+		return err
+	}
+	enable := "+" + strings.Join(cgroupControllers, " +")
+	cur := cgroupRoot
+	for _, part := range append([]string{""}, strings.Split(rel, string(filepath.Separator))...) {
+		cur = filepath.Join(cur, part)
+		if err := os.WriteFile(filepath.Join(cur, "cgroup.subtree_control"), []byte(enable), 0o644); err != nil {
+			return errors.Wrapf(err, "failed to enable cgroup controllers in %s", cur)
+		}
+	}
+	return nil
+}
+
+// setCgroupLimits writes the cpu weight, memory max and io max of a slot
+// to its cgroup.
+func setCgroupLimits(dir string) error {
+	opts := Current()
+	files := map[string]string{
+		"cpu.weight": strconv.Itoa(opts.CPUWeight),
+		"memory.max": "max",
+	}
+	if v := opts.MemoryMax.Value(); v > 0 {
+		files["memory.max"] = strconv.FormatInt(v, 10)
+	}
+	for name, value := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(value), 0o644); err != nil {
+			return errors.Wrapf(err, "failed to write %s", filepath.Join(dir, name))
+		}
+	}
+	if opts.IOMax == "" {
+		return nil
+	}
+	for _, dev := range ioDevices() {
+		line := dev + " " + opts.IOMax
+		if err := os.WriteFile(filepath.Join(dir, "io.max"), []byte(line), 0o644); err != nil {
+			return errors.Wrapf(err, "failed to write io.max %q", line)
+		}
+	}
+	return nil
+}
+
+// ioDevices returns the disks, as major:minor, that store the rootfs and
+// cache volumes of the VMs.
+func ioDevices() []string {
+	opts := Current()
+	dirs := []string{workflowDir()}
+	if opts.CacheVolumeDir != "" {
+		dirs = append(dirs, opts.CacheVolumeDir)
+	}
+	seen := map[string]bool{}
+	var devs []string
+	for _, dir := range dirs {
+		var st unix.Stat_t
+		if err := unix.Stat(dir, &st); err != nil {
+			continue
+		}
+		if unix.Major(st.Dev) == 0 {
+			// eg, tmpfs
+			continue
+		}
+		dev := fmt.Sprintf("%d:%d", unix.Major(st.Dev), unix.Minor(st.Dev))
+		// io.max applies to disks, not partitions
+		sys := filepath.Join("/sys/dev/block", dev)
+		if _, err := os.Stat(filepath.Join(sys, "partition")); err == nil {
+			if data, err := os.ReadFile(filepath.Join(sys, "..", "dev")); err == nil {
+				dev = strings.TrimSpace(string(data))
+			}
+		}
+		if !seen[dev] {
+			seen[dev] = true
+			devs = append(devs, dev)
+		}
+	}
+	return devs
+}
+
+// validateIOMax checks io.max limits, eg, "wbps=52428800 riops=max".
+func validateIOMax(s string) error {
+	for _, field := range strings.Fields(s) {
+		key, value, found := strings.Cut(field, "=")
+		if !found || !slices.Contains(ioMaxKeys, key) {
+			return fmt.Errorf("firecracker io max %q must be one of %s=<n|max>", field, strings.Join(ioMaxKeys, ","))
+		}
+		if value == "max" {
+			continue
+		}
+		if n, err := strconv.ParseUint(value, 10, 64); err != nil || n == 0 {
+			return fmt.Errorf("firecracker io max %q must be a positive number or max", field)
+		}
+	}
+	return nil
+}
+
+// runInCgroup starts cmd in the cgroup of a slot. The returned func closes
+// the cgroup, once cmd is started.
+func runInCgroup(cmd *exec.Cmd, id int) (func(), error) {
+	f, err := os.Open(slotCgroup(id))
+	if err != nil {
+		return nil, err
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(f.Fd())
+	return func() { _ = f.Close() }, nil
+}
+
+// removeCgroup removes a cgroup. It is busy until the VMM exited, it is
+// removed again before the next VM of the slot starts.
+func removeCgroup(dir string) {
+	if err := os.Remove(dir); err != nil && !os.IsNotExist(err) && !errors.Is(err, unix.EBUSY) {
+		klog.ErrorS(err, "failed to remove cgroup", "cgroup", dir)
+	}
+}
+
+// slotUsage returns the resources used by the VM of a slot so far, from
+// the stats of its cgroup and the counters of its host network device.
+func slotUsage(id int) *backend.ResourceUsage {
+	usage := &backend.ResourceUsage{}
+	if slotCgroups() {
+		dir := slotCgroup(id)
+		if stat, err := readKeyValues(filepath.Join(dir, "cpu.stat")); err == nil {
+			usage.CPUSeconds = float64(stat["usage_usec"]) / 1e6
+		}
+		if peak, err := readInt(filepath.Join(dir, "memory.peak")); err == nil {
+			usage.MemoryPeakBytes = peak
+		}
+		if rd, wr, err := readIOStat(filepath.Join(dir, "io.stat")); err == nil {
+			usage.DiskReadBytes, usage.DiskWriteBytes = rd, wr
+		}
+	}
+	// the host side of the network device of the VM: bytes received by the
+	// host were sent by the VM
+	dev := hostVeth(id)
+	if _, err := os.Stat(filepath.Join("/sys/class/net", dev)); err != nil {
+		_, dev = slotTaps(id)
+	}
+	stats := filepath.Join("/sys/class/net", dev, "statistics")
+	if n, err := readInt(filepath.Join(stats, "rx_bytes")); err == nil {
+		usage.NetTxBytes = n
+	}
+	if n, err := readInt(filepath.Join(stats, "tx_bytes")); err == nil {
+		usage.NetRxBytes = n
+	}
+	return usage
+}
+
+func readInt(path string) (int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// readKeyValues reads a cgroup file of "key value" lines, eg, cpu.stat.
+func readKeyValues(path string) (map[string]int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() //nolint:errcheck
+
+	out := map[string]int64{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), " ")
+		if !found {
+			continue
+		}
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+			out[key] = n
+		}
+	}
+	return out, scanner.Err()
+}
+
+// readIOStat returns the bytes read and written on all devices, from
+// io.stat lines like "8:0 rbytes=1 wbytes=2 rios=3 wios=4 dbytes=0 dios=0".
+func readIOStat(path string) (rd, wr int64, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		for _, field := range strings.Fields(line) {
+			key, value, found := strings.Cut(field, "=")
+			if !found {
+				continue
+			}
+			n, _ := strconv.ParseInt(value, 10, 64)
+			switch key {
+			case "rbytes":
+				rd += n
+			case "wbytes":
+				wr += n
+			}
+		}
+	}
+	return rd, wr, nil
+}
@@ -19,19 +19,23 @@ package firecracker
 import (
 	"bytes"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
-	"io"
 	"mime/multipart"
-	"net/http"
+	"net"
 	"net/textproto"
 	"os"
 	"sort"
 	"strings"
 
+	"github.com/appscodelabs/gh-ci-webhook/pkg/secrets"
+
+	"k8s.io/klog/v2"
 	"sigs.k8s.io/yaml"
 )
 
-func BuildNetCfg(eth0Mac, eth1Mac, ip0, ip1 string) (string, error) {
+func BuildNetCfg(eth0Mac, eth1Mac string, sn SlotNetwork) (string, error) {
+	ip0 := sn.Gateway()
 	/*
 		version: 2
 		ethernets:
@@ -81,10 +85,9 @@ func BuildNetCfg(eth0Mac, eth1Mac, ip0, ip1 string) (string, error) {
 				Match: EthernetMatcher{
 					Macaddress: eth1Mac, // __MAC_OCTET__
 				},
-				Addresses: []string{
-					fmt.Sprintf("%s/%d", ip1, VMS_NETWORK_SUBNET), // __INSTANCE_IP__/24
-				},
-				Gateway4: ip0, // __GATEWAY__
+				Addresses: sn.vmCIDRs(), // __INSTANCE_IP__/24
+				Gateway4:  ip0,          // __GATEWAY__
+				Gateway6:  sn.Gateway6(),
 				Nameservers: &Nameservers{
 					Addresses: []string{
 						"1.1.1.1",
@@ -121,176 +124,74 @@ func BuildNetCfg(eth0Mac, eth1Mac, ip0, ip1 string) (string, error) {
 	return cfg, nil
 }
 
-// https://gist.github.com/tamalsaha/af2f99c80f84410253bd1e532bdfabc7
-func BuildData(ghToken string, instanceID int, ghUsernames ...string) (*MMDSConfig, error) {
-	/*
-		#cloud-config
-		users:
-		  - name: fc
-		    gecos: Firecracker user
-		    shell: /bin/bash
-		    groups: sudo
-		    sudo: ALL=(ALL) NOPASSWD:ALL
-		    ssh_authorized_keys:
-		      - __SSH_PUB_KEY__
-	*/
-	keys, err := getSSHPubKeys(ghUsernames...)
+// BuildData returns the metadata of a cold booted VM. Its user-data is
+// rendered from the user-data templates.
+func BuildData(ghToken string, ins *Instance) (*MMDSConfig, error) {
+	hostname, err := os.Hostname()
 	if err != nil {
 		return nil, err
 	}
-	userData := UserData{
-		Users: []User{
-			{
-				Name:              "default",
-				SSHAuthorizedKeys: keys,
-			},
-			{
-				Name:              "root",
-				Gecos:             "Root user",
-				Shell:             "/bin/bash",
-				SSHAuthorizedKeys: keys,
-			},
-			{
-				Name:              "runner",
-				Gecos:             "GitHub Action Runner",
-				Shell:             "/bin/bash",
-				Groups:            strings.Join([]string{"sudo"}, ", "),
-				Sudo:              "ALL=(ALL) NOPASSWD:ALL",
-				SSHAuthorizedKeys: keys,
-			},
-		},
-		// stopped using nomodules in /proc/cmdline
-		//Bootcmd: []string{
-		//	// BUG: https://bugs.launchpad.net/ubuntu/+source/cloud-initramfs-tools/+bug/1958260
-		//	"apt install --reinstall linux-modules-`uname -r`",
-		//},
+	vars, err := newUserDataVars(hostname, ins.ID, false)
+	if err != nil {
+		return nil, err
 	}
+	vars.setInstance(ins)
+	vars.Runner.Token = ghToken
+	if vars.SSHKeys, err = authorizedKeys(); err != nil {
+		return nil, err
+	}
+	return buildMMDSConfig(vars.Runner.Name, vars)
+}
 
+// BuildBakeData returns the metadata of the VM booted to bake a snapshot.
+// The VM is provisioned like a cold booted VM, but no runner is registered
+// and no secrets are passed. Instead, it waits for the identity of the VM
+// restored from the snapshot in MMDS.
+func BuildBakeData() (*MMDSConfig, error) {
 	hostname, err := os.Hostname()
 	if err != nil {
 		return nil, err
 	}
-	runnerName := fmt.Sprintf("%s-%d", hostname, instanceID)
-
-	//	script := `#!/bin/bash
-	//mkdir test-userscript
-	//touch /test-userscript/userscript.txt
-	//echo "Created by bash shell script" >> /test-userscript/userscript.txt
-	//`
-
-	encDockerHubToken := "ZGNrcl9wYXRfTGhOV3VDdTNYeml0cWd5bmxrSE9wM1VoQVRnCg=="
-	dockerHubToken, err := base64.StdEncoding.DecodeString(encDockerHubToken)
+	vars, err := newUserDataVars(hostname, bakeSlotID, true)
 	if err != nil {
 		return nil, err
 	}
+	vars.Image.OS = Current().OS
+	if vars.SSHKeys, err = authorizedKeys(); err != nil {
+		return nil, err
+	}
+	return buildMMDSConfig(vars.Runner.Name, vars)
+}
 
-	script := fmt.Sprintf(`#! /bin/bash
-set -x
-
-# <UDF name="runner_owner" label="GitHub Org or repo" />
-# <UDF name="runner_cfg_pat" label="GitHub Personal Token" />
-# <UDF name="runner_name" label="Runner Name" />
-
-exec >/root/stackscript.log 2>&1
-# http://redsymbol.net/articles/bash-exit-traps/
-# https://unix.stackexchange.com/a/308209
-function finish {
-    result=$?
-    [ ! -f /root/result.txt ] && echo $result > /root/result.txt
+// RenderUserData returns the user-data of the VM of a slot, or of the VM
+// baked into a snapshot, exactly as it is passed to cloud-init.
+func RenderUserData(vars UserDataVars) ([]byte, error) {
+	tpl, err := userDataTemplates()
+	if err != nil {
+		return nil, err
+	}
+	parts, err := renderUserDataParts(tpl, Current().UserDataParts, vars)
+	if err != nil {
+		return nil, err
+	}
+	return PrepareCloudInitUserData(parts...)
 }
-trap finish EXIT
-# https://cloud.linode.com/stackscripts/669224
-apt-get update
-apt upgrade -y
-apt remove docker docker-engine docker.io containerd runc
-apt-get install -y --no-install-recommends apt-transport-https ca-certificates linux-modules-`+"`uname -r`"+` curl jq gnupg-agent software-properties-common build-essential
-curl -fsSL https://download.docker.com/linux/ubuntu/gpg | sudo apt-key add -
-apt-key fingerprint 0EBFCD88
-add-apt-repository \
-   "deb [arch=amd64] https://download.docker.com/linux/ubuntu \
-   $(lsb_release -cs) \
-   stable"
-apt update
-# https://github.com/docker/setup-qemu-action/issues/67
-apt install docker-ce docker-ce-cli containerd.io docker-buildx-plugin qemu-user-static -y
-echo \
-  "{
-    \"metrics-addr\" : \"0.0.0.0:9323\",
-    \"experimental\" : true
-  }" > /etc/docker/daemon.json
-systemctl restart docker
-hostnamectl set-hostname ${RUNNER_NAME}
-echo 127.0.1.1 $HOSTNAME.localdomain ${RUNNER_NAME} >> /etc/hosts
-
-chmod a+w /usr/local/bin
-
-# bypass docker hub rate limits
-docker login -u tigerworks -p %s
-
-for IMAGE_NAME in tonistiigi/binfmt:latest moby/buildkit:buildx-stable-1; do
-	until docker pull "$IMAGE_NAME"; do
-	  echo "Docker pull failed, retrying..."
-	  sleep 5 # Wait for 5 seconds before retrying
-	done
-done
-
-# install github cli
-# https://github.com/cli/cli/blob/trunk/docs/install_linux.md
-(type -p wget >/dev/null || (sudo apt update && sudo apt-get install wget -y)) \
-	&& sudo mkdir -p -m 755 /etc/apt/keyrings \
-        && out=$(mktemp) && wget -nv -O$out https://cli.github.com/packages/githubcli-archive-keyring.gpg \
-        && cat $out | sudo tee /etc/apt/keyrings/githubcli-archive-keyring.gpg > /dev/null \
-	&& sudo chmod go+r /etc/apt/keyrings/githubcli-archive-keyring.gpg \
-	&& echo "deb [arch=$(dpkg --print-architecture) signed-by=/etc/apt/keyrings/githubcli-archive-keyring.gpg] https://cli.github.com/packages stable main" | sudo tee /etc/apt/sources.list.d/github-cli.list > /dev/null \
-	&& sudo apt update \
-	&& sudo apt install gh -y
-
-# Prepare GitHun Runner user
-export USER=runner
-# https://docs.docker.com/engine/install/linux-postinstall/
-sudo usermod -aG docker $USER
-newgrp docker
-rsync --archive --chown=$USER:$USER ~/.docker /home/$USER
-
-# Install GitHub Runner
-su $USER
-cd /home/$USER
-
-export TESTRIG=%v
-
-export NATS_URL=%s
-export NATS_USERNAME=%s
-export NATS_PASSWORD=%s
-
-# export RUNNER_OWNER=$(cat repo_owner.txt)
-export RUNNER_CFG_PAT=%s
-export RUNNER_NAME=%s
-
-# https://github.com/actions/runner/blob/main/docs/automate.md
-# https://github.com/actions/actions-runner-controller/issues/84#issuecomment-756971038
-# -l ubuntu-latest,ubuntu-20.04
-# curl -s https://raw.githubusercontent.com/actions/runner/main/scripts/create-latest-svc.sh | bash -s -- -s ${RUNNER_OWNER} -n ${RUNNER_NAME} -f
-# ephemeral runner: https://docs.github.com/en/actions/hosting-your-own-runners/autoscaling-with-self-hosted-runners#using-ephemeral-runners-for-autoscaling
-# https://github.blog/changelog/2021-09-20-github-actions-ephemeral-self-hosted-runners-new-webhooks-for-auto-scaling/
-curl -fsSL https://gist.githubusercontent.com/tamalsaha/af2f99c80f84410253bd1e532bdfabc7/raw/27fb0c094182f09b121750bb61ca32ba0ddf7658/start-runner.sh | bash -s -- -n ${RUNNER_NAME} -f
-`, string(dockerHubToken), DefaultOptions.Testrig, DefaultOptions.NatsURL, DefaultOptions.NatsUsername, DefaultOptions.NatsPassword, ghToken, runnerName)
-
-	udBytes, err := PrepareCloudInitUserData(userData, script)
+
+func buildMMDSConfig(name string, vars UserDataVars) (*MMDSConfig, error) {
+	udBytes, err := RenderUserData(vars)
 	if err != nil {
 		return nil, err
 	}
-	fmt.Println(string(udBytes))
+	klog.V(4).InfoS("generated user-data", "runner", name, "data", secrets.Redact(string(udBytes)))
 
 	md := Metadata{
-		InstanceID:    runnerName, // fmt.Sprintf("i-%d", instanceID),
-		LocalHostname: runnerName, // "gh-runner",
+		InstanceID:    name, // fmt.Sprintf("i-%d", instanceID),
+		LocalHostname: name, // "gh-runner",
 	}
 	mdBytes, err := yaml.Marshal(md)
 	if err != nil {
 		return nil, err
 	}
-	fmt.Println(string(mdBytes))
-
 	return &MMDSConfig{
 		Latest: LatestConfig{
 			MetaData: string(mdBytes),
@@ -299,27 +200,135 @@ curl -fsSL https://gist.githubusercontent.com/tamalsaha/af2f99c80f84410253bd1e53
 	}, nil
 }
 
-// https://github.com/tamalsaha.keys
-func getSSHPubKeys(ghUsernames ...string) ([]string, error) {
-	var keys []string
-	var buf bytes.Buffer
-	for _, username := range ghUsernames {
-		resp, err := http.Get(fmt.Sprintf("https://github.com/%s.keys", username))
-		if err != nil {
-			return nil, err
-		}
-		defer resp.Body.Close()
-		buf.Reset()
-		if _, err = io.Copy(&buf, resp.Body); err != nil {
-			return nil, err
-		}
-		userKeys := strings.Split(strings.TrimSpace(buf.String()), "\n")
-		keys = append(keys, userKeys...)
+// BuildRestoreData returns the metadata of a VM restored from a snapshot.
+// It gives the VM the network address of its slot, its name and the runner
+// registration.
+func BuildRestoreData(ghToken string, ins *Instance) (*MMDSConfig, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	vars, err := newUserDataVars(hostname, ins.ID, false)
+	if err != nil {
+		return nil, err
+	}
+	vars.setInstance(ins)
+	vars.Runner.Token = ghToken
+
+	tpl, err := userDataTemplates()
+	if err != nil {
+		return nil, err
+	}
+	script, err := renderTemplate(tpl, "restore", vars)
+	if err != nil {
+		return nil, err
+	}
+	klog.V(4).InfoS("generated restore script", "runner", vars.Runner.Name, "script", secrets.Redact(script))
+
+	return &MMDSConfig{
+		Latest: LatestConfig{
+			Identity: &Identity{
+				Script: script,
+			},
+		},
+	}, nil
+}
+
+func dockerLogin() string {
+	opts := Current()
+	if opts.DockerHubToken == "" {
+		return "# docker hub token not configured"
+	}
+	return fmt.Sprintf("printf '%%s\\n' %s | docker login -u %s --password-stdin", shellQuote(opts.DockerHubToken), shellQuote(opts.DockerHubUsername))
+}
+
+// shellQuote quotes s as a single word of a shell command.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// dockerDaemonConfig returns the docker daemon.json of a VM. Images are
+// pulled through the registry mirror on the host, reached at gateway, if it
+// is running.
+func dockerDaemonConfig(gateway string) (string, error) {
+	opts := Current()
+	cfg := map[string]any{
+		"metrics-addr": "0.0.0.0:9323",
+		"experimental": true,
+	}
+	if opts.RegistryMirrorPort != "" {
+		mirror := net.JoinHostPort(gateway, opts.RegistryMirrorPort)
+		cfg["registry-mirrors"] = []string{"http://" + mirror}
+		cfg["insecure-registries"] = []string{mirror}
+	}
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// hostServicesConfig returns the shell commands that point a VM to the
+// caching proxy, actions cache, git mirror and cache volumes on the host, if
+// these are enabled. The host is reached at gateway.
+func hostServicesConfig(gateway string) string {
+	opts := Current()
+	var lines, env []string
+	if opts.CacheProxyPort != "" {
+		addr := "http://" + net.JoinHostPort(gateway, opts.CacheProxyPort)
+		lines = append(lines, fmt.Sprintf(`echo 'Acquire::http::Proxy "%s";' > /etc/apt/apt.conf.d/01proxy`, addr))
+		env = append(env,
+			"GOPROXY="+addr+"/gomod,https://proxy.golang.org,direct",
+			"npm_config_registry="+addr+"/npm/",
+		)
+	}
+	if opts.ActionsCachePort != "" {
+		env = append(env, "ACTIONS_CACHE_URL=http://"+net.JoinHostPort(gateway, opts.ActionsCachePort)+"/")
+	}
+	if opts.GitMirrorPort != "" {
+		env = append(env, "GH_CI_WAIT_FOR_JOB__GIT_MIRROR=http://"+net.JoinHostPort(gateway, opts.GitMirrorPort))
+	}
+	if opts.CacheVolumeDir != "" {
+		env = append(env, "GH_CI_WAIT_FOR_JOB__CACHE_VOLUME=true")
+	}
+	if len(opts.SSHDebugUsers) > 0 && !opts.DisableSSH {
+		env = append(env, "GH_CI_WAIT_FOR_JOB__SSH_DEBUG_KEYS=true")
+	}
+	if len(lines) == 0 && len(env) == 0 {
+		return "# host services not configured"
 	}
-	return keys, nil
+
+	lines = append(lines, "cat >> /etc/environment <<'EOF'")
+	lines = append(lines, env...)
+	lines = append(lines, "EOF")
+	for _, kv := range env {
+		lines = append(lines, "export "+kv)
+	}
+	return "# use the services on the host\n" + strings.Join(lines, "\n")
 }
 
-func PrepareCloudInitUserData(ud UserData, script string) ([]byte, error) {
+// waitForJobConfig returns the shell commands that make wait-for-job pick
+// the jobs routed to the VM of a slot: the jobs of the runner labels of its
+// image and, for canary VMs, of the canary repos.
+func waitForJobConfig(ins *Instance) string {
+	opts := Current()
+	env := []string{"GH_CI_WAIT_FOR_JOB__LABELS=" + strings.Join(imageLabels(ins.role), ",")}
+	if ins.Canary && len(opts.CanaryRepos) > 0 {
+		env = append(env, "GH_CI_WAIT_FOR_JOB__REPOS="+strings.Join(opts.CanaryRepos, ","))
+	}
+
+	lines := []string{"# pick the jobs routed to this VM", "cat >> /etc/environment <<'EOF'"}
+	lines = append(lines, env...)
+	lines = append(lines, "EOF")
+	for _, kv := range env {
+		lines = append(lines, "export "+kv)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// PrepareCloudInitUserData returns the MIME multipart user-data made of
+// the given parts.
+func PrepareCloudInitUserData(parts ...UserDataPart) ([]byte, error) {
 	// New empty buffer
 	body := &bytes.Buffer{}
 	// Creates a new multipart Writer with a random boundary
@@ -353,43 +362,20 @@ func PrepareCloudInitUserData(ud UserData, script string) ([]byte, error) {
 		_, _ = fmt.Fprintf(body, "\r\n")
 	}
 
-	udBytes, err := yaml.Marshal(ud)
-	if err != nil {
-		return nil, err
-	}
-
-	// Metadata part
-	cloudInitHeader := textproto.MIMEHeader{}
-	// Set the Content-Type header
-	cloudInitHeader.Set("Content-Type", `text/cloud-config; charset="us-ascii"`)
-	cloudInitHeader.Set("MIME-Version", `1.0`)
-	cloudInitHeader.Set("Content-Transfer-Encoding", `7bit`)
-	cloudInitHeader.Set("Content-Disposition", `attachment; filename="cloud-config.txt"`)
-
-	// Create new multipart part
-	cloudInitPart, err := writer.CreatePart(cloudInitHeader)
-	if err != nil {
-		return nil, err
-	}
-	// Write the part body
-	_, _ = cloudInitPart.Write([]byte("#cloud-config" + "\n" + string(udBytes)))
-
-	if strings.TrimSpace(script) != "" {
-		// Metadata part
-		scriptHeader := textproto.MIMEHeader{}
-		// Set the Content-Type header
-		scriptHeader.Set("Content-Type", `text/x-shellscript; charset="us-ascii"`)
-		scriptHeader.Set("MIME-Version", `1.0`)
-		scriptHeader.Set("Content-Transfer-Encoding", `7bit`)
-		scriptHeader.Set("Content-Disposition", `attachment; filename="userdata.txt"`)
+	for _, part := range parts {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", part.ContentType)
+		header.Set("MIME-Version", `1.0`)
+		header.Set("Content-Transfer-Encoding", `7bit`)
+		header.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.txt"`, part.Name))
 
 		// Create new multipart part
-		scriptPart, err := writer.CreatePart(scriptHeader)
+		w, err := writer.CreatePart(header)
 		if err != nil {
 			return nil, err
 		}
 		// Write the part body
-		_, _ = scriptPart.Write([]byte(script))
+		_, _ = w.Write([]byte(part.Content))
 	}
 
 	// Finish constructing the multipart request body
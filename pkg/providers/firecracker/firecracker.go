@@ -16,25 +16,27 @@ package firecracker
 import (
 	"context"
 	"fmt"
+	"io"
 	"net"
 	"os"
 
 	"github.com/appscodelabs/gh-ci-webhook/pkg/backend"
-	"github.com/appscodelabs/gh-ci-webhook/pkg/providers"
+	"github.com/appscodelabs/gh-ci-webhook/pkg/notifier"
 
 	sdk "github.com/firecracker-microvm/firecracker-go-sdk"
 	"github.com/firecracker-microvm/firecracker-go-sdk/client/models"
 	. "github.com/klauspost/cpuid/v2"
 	log "github.com/sirupsen/logrus"
 	"gomodules.xyz/pointer"
+	"k8s.io/klog/v2"
 )
 
 const (
 	MMDS_IP     = "169.254.169.254"
 	MMDS_SUBNET = 16
 
-	VMS_NETWORK_PREFIX = "172.26.0"
-	VMS_NETWORK_SUBNET = 30
+	VMS_NETWORK_SUBNET  = 30
+	VMS_NETWORK6_SUBNET = 64
 )
 
 type configOpt func(*sdk.Config)
@@ -46,6 +48,7 @@ func withNetworkInterface(networkInterface sdk.NetworkInterface) configOpt {
 }
 
 func createNewConfig(ins *Instance, socketPath string, opts ...configOpt) sdk.Config {
+	cur := Current()
 	cpuTemplate := models.CPUTemplateT2
 	if CPU.VendorID != Intel {
 		cpuTemplate = ""
@@ -56,14 +59,19 @@ func createNewConfig(ins *Instance, socketPath string, opts ...configOpt) sdk.Co
 	isRootDevice := true
 	isReadOnly := false
 
+	kernel, initrd := cur.KernelImagePath(), cur.InitrdPath()
+	if ins.image != nil {
+		kernel, initrd = ins.image.KernelPath(), ins.image.InitrdPath()
+	}
+
 	cfg := sdk.Config{
 		SocketPath:      socketPath,
-		KernelImagePath: DefaultOptions.KernelImagePath(),
-		InitrdPath:      DefaultOptions.InitrdPath(),
+		KernelImagePath: kernel,
+		InitrdPath:      initrd,
 		MachineCfg: models.MachineConfiguration{
-			VcpuCount:   pointer.Int64P(DefaultOptions.VcpuCount),
+			VcpuCount:   pointer.Int64P(cur.VcpuCount),
 			CPUTemplate: cpuTemplate,
-			MemSizeMib:  pointer.Int64P(DefaultOptions.MemSizeMib),
+			MemSizeMib:  pointer.Int64P(cur.MemSizeMib),
 			Smt:         &smt,
 		},
 		Drives: []models.Drive{
@@ -71,83 +79,98 @@ func createNewConfig(ins *Instance, socketPath string, opts ...configOpt) sdk.Co
 				DriveID:      &driveID,
 				IsRootDevice: &isRootDevice,
 				IsReadOnly:   &isReadOnly,
-				PathOnHost:   pointer.StringP(WorkflowRunRootFSPath(ins.UID)),
+				PathOnHost:   pointer.StringP(ins.RootFS.Path),
 			},
 		},
 	}
 
+	if cur.CacheVolumeDir != "" {
+		// replaced by the cache volume of the job, once it is picked
+		cfg.Drives = append(cfg.Drives, models.Drive{
+			DriveID:      pointer.StringP(CacheDriveID),
+			IsRootDevice: pointer.BoolP(false),
+			IsReadOnly:   pointer.BoolP(false),
+			PathOnHost:   pointer.StringP(placeholderPath(ins.UID)),
+		})
+	}
+
 	for _, opt := range opts {
 		opt(&cfg)
 	}
+	applyRateLimitConfig(&cfg)
 
 	return cfg
 }
 
+// RunnerForAddr returns the runner name of the VM at remoteAddr (host:port).
+func RunnerForAddr(remoteAddr string) (string, bool) {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return "", false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "", false
+	}
+	id, found := slotForIP(ip)
+	if !found {
+		return "", false
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", false
+	}
+	return fmt.Sprintf("%s-%d", hostname, id), true
+}
+
 func (p impl) createVM(ctx context.Context, ins *Instance, runnerName, socketPath string) error {
+	opts := Current()
 	egressIface, err := GetEgressInterface()
 	if err != nil {
 		return err
 	}
-	fmt.Println("EgressInterface:", egressIface)
+	klog.V(2).InfoS("using egress interface", "slot", ins.ID, "interface", egressIface)
 
-	ip0 := fmt.Sprintf("%s.%d", VMS_NETWORK_PREFIX, ins.ID*4+1)
-	ip1 := fmt.Sprintf("%s.%d", VMS_NETWORK_PREFIX, ins.ID*4+2)
+	sn, err := slotNetwork(ins.ID)
+	if err != nil {
+		return err
+	}
+	ip0 := sn.Gateway()
+	ip1 := sn.IP()
 
 	eth0Mac := MacAddr(net.ParseIP(ip0).To4())
 	eth1Mac := MacAddr(net.ParseIP(ip1).To4())
-	fmt.Println("instanceID:", ins.ID, "IP:", ip1)
+	klog.V(2).InfoS("starting VM", "slot", ins.ID, "ip", ip1, "ip6", sn.IP6())
 
-	tap0 := fmt.Sprintf("fc%d", ins.ID*4+1)
-	tap1 := fmt.Sprintf("fc%d", ins.ID*4+2)
+	if opts.Jailer {
+		return p.createJailedVM(ctx, ins, runnerName, socketPath, egressIface)
+	}
 
-	if TapExists(tap0) {
-		if err := TapDelete(tap0); err != nil {
-			return err
-		}
+	tap0, tap1 := slotTaps(ins.ID)
+
+	if err := TapDelete(tap0); err != nil {
+		return err
 	}
 	if err := CreateTap(tap0, ""); err != nil {
 		return err
 	}
 
-	if TapExists(tap1) {
-		if err := TapDelete(tap1); err != nil {
-			return err
-		}
-	}
-	if err := CreateTap(tap1, fmt.Sprintf("%s/%d", ip0, VMS_NETWORK_SUBNET)); err != nil {
+	if err := TapDelete(tap1); err != nil {
 		return err
 	}
-
-	if err = SetupIPTables(egressIface, tap1); err != nil {
+	if err := createTap(tap1, noOwner, noOwner, sn.gatewayCIDRs()...); err != nil {
 		return err
 	}
 
-	nf0 := sdk.NetworkInterface{
-		StaticConfiguration: &sdk.StaticNetworkConfiguration{
-			MacAddress:  eth0Mac,
-			HostDevName: tap0,
-			IPConfiguration: &sdk.IPConfiguration{
-				IPAddr:      net.IPNet{IP: net.ParseIP(MMDS_IP), Mask: net.CIDRMask(MMDS_SUBNET, 8*net.IPv4len)},
-				Gateway:     nil,
-				Nameservers: nil,
-				IfName:      "eth0",
-			},
-		},
-		AllowMMDS: true,
+	if err = setupHostNetwork(egressIface); err != nil {
+		return err
 	}
-	nf1 := sdk.NetworkInterface{
-		StaticConfiguration: &sdk.StaticNetworkConfiguration{
-			MacAddress:  eth1Mac,
-			HostDevName: tap1,
-			IPConfiguration: &sdk.IPConfiguration{
-				IPAddr:      net.IPNet{IP: net.ParseIP(ip1), Mask: net.CIDRMask(VMS_NETWORK_SUBNET, 8*net.IPv4len)},
-				Gateway:     net.ParseIP(ip0),
-				Nameservers: []string{"1.1.1.1", "8.8.8.8"},
-				IfName:      "eth1",
-			},
-		},
+	if err = SetupFirewall(ins.ID, tap1, egressIface, tap0); err != nil {
+		return err
 	}
 
+	nf0, nf1 := networkInterfaces(tap0, tap1, eth0Mac, eth1Mac, ip0, ip1)
+
 	socketFile := fmt.Sprintf("%s.create", socketPath)
 
 	cfg := createNewConfig(ins, socketFile, withNetworkInterface(nf0), withNetworkInterface(nf1))
@@ -158,51 +181,69 @@ func (p impl) createVM(ctx context.Context, ins *Instance, runnerName, socketPat
 
 	// Use firecracker binary when making machine
 	cmd := sdk.VMCommandBuilder{}.
-		WithBin(DefaultOptions.FirecrackerBinaryPath).
+		WithBin(opts.FirecrackerBinaryPath).
 		WithSocketPath(socketFile).
 		WithStdin(os.Stdin).
 		WithStdout(os.Stdout).
 		WithStderr(os.Stderr).
 		Build(ctx)
+	if slotCgroups() {
+		if err := prepareCgroup(ins.ID); err != nil {
+			return err
+		}
+		done, err := runInCgroup(cmd, ins.ID)
+		if err != nil {
+			return err
+		}
+		defer done()
+	}
 
 	m, err := sdk.NewMachine(ctx, cfg, sdk.WithProcessRunner(cmd))
 	if err != nil {
 		return err
 	}
-	{
-		m.Handlers.FcInit = m.Handlers.FcInit.Swap(sdk.Handler{
-			Name: sdk.SetupKernelArgsHandlerName,
-			Fn: func(ctx context.Context, m *sdk.Machine) error {
-				kernelArgs := parseKernelArgs(m.Cfg.KernelArgs)
-
-				//// If any network interfaces have a static IP configured, we need to set the "ip=" boot param.
-				//// Validation that we are not overriding an existing "ip=" setting happens in the network validation
-				//if staticIPInterface := m.Cfg.NetworkInterfaces.staticIPInterface(); staticIPInterface != nil {
-				//	ipBootParam := staticIPInterface.StaticConfiguration.IPConfiguration.ipBootParam()
-				//	kernelArgs["ip"] = &ipBootParam
-				//}
+	return p.bootVM(ctx, m, ins, runnerName, eth0Mac, eth1Mac, sn)
+}
 
-				// ds=nocloud-net;s=http://169.254.169.254/latest/
-				// network-config=__NETWORK_CONFIG__",
+// createJailedVM cold boots the VM of a slot through the jailer. The VM
+// uses the network namespace of the slot, as VMs restored from a snapshot.
+func (p impl) createJailedVM(ctx context.Context, ins *Instance, runnerName, socketPath, egressIface string) error {
+	cleanupJail(ins.ID)
+	if err := SetupNetNS(ins.ID, egressIface); err != nil {
+		return err
+	}
 
-				// cloud-init=disabled
-				// disabled := "disabled"
-				// kernelArgs["cloud-init"] = &disabled
+	sn, err := slotNetwork(ins.ID)
+	if err != nil {
+		return err
+	}
+	ip0, ip1 := sn.Gateway(), sn.IP()
+	eth0Mac := MacAddr(net.ParseIP(ip0).To4())
+	eth1Mac := MacAddr(net.ParseIP(ip1).To4())
+	nf0, nf1 := networkInterfaces(snapshotTapMMDS, snapshotTap, eth0Mac, eth1Mac, ip0, ip1)
 
-				ds := fmt.Sprintf("nocloud-net;s=http://%s/latest/", MMDS_IP)
-				kernelArgs["ds"] = &ds
+	cfg := createNewConfig(ins, "", withNetworkInterface(nf0), withNetworkInterface(nf1))
+	cfg.MmdsAddress = net.ParseIP(MMDS_IP)
+	cfg.MmdsVersion = sdk.MMDSv1
+	cfg.LogLevel = "Debug"
+	if err := jailConfig(&cfg, ins.ID, fmt.Sprintf("%s.log", socketPath), nil); err != nil {
+		return err
+	}
+	if err := prepareCgroup(ins.ID); err != nil {
+		return err
+	}
 
-				netcfg, err := BuildNetCfg(eth0Mac, eth1Mac, ip0, ip1)
-				if err != nil {
-					return err
-				}
-				kernelArgs["network-config"] = &netcfg
+	m, err := sdk.NewMachine(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	return p.bootVM(ctx, m, ins, runnerName, eth0Mac, eth1Mac, sn)
+}
 
-				m.Cfg.KernelArgs = `keep_bootcon console=ttyS0 noapic reboot=k panic=1 pci=off rw ` + kernelArgs.String()
-				fmt.Println("KERNEL:", m.Cfg.KernelArgs)
-				return nil
-			},
-		})
+// bootVM cold boots the VM of a slot, with its user-data in MMDS.
+func (p impl) bootVM(ctx context.Context, m *sdk.Machine, ins *Instance, runnerName, eth0Mac, eth1Mac string, sn SlotNetwork) error {
+	{
+		m.Handlers.FcInit = m.Handlers.FcInit.Swap(setupKernelArgsHandler(eth0Mac, eth1Mac, sn))
 
 		// disable network validation
 		m.Handlers.Validation = m.Handlers.Validation.Swap(sdk.Handler{
@@ -214,7 +255,7 @@ func (p impl) createVM(ctx context.Context, ins *Instance, runnerName, socketPat
 
 		// Set Metadata
 		// ghRepo := e.GetRepo().GetOwner().GetLogin() + "/" + e.GetRepo().GetName()
-		mmds, err := BuildData(DefaultOptions.GitHubToken, ins.ID, "tamalsaha")
+		mmds, err := BuildData(Current().GitHubToken, ins)
 		if err != nil {
 			return err
 		}
@@ -224,30 +265,113 @@ func (p impl) createVM(ctx context.Context, ins *Instance, runnerName, socketPat
 	if err := m.Start(ctx); err != nil {
 		return err
 	}
+	if Current().Jailer {
+		// the jailer created the cgroup of the VM
+		if err := setCgroupLimits(slotCgroup(ins.ID)); err != nil {
+			_ = m.StopVMM()
+			return err
+		}
+	}
+	p.ins.SetMachine(ins.ID, m)
+	p.ins.SetRateLimit(ins.ID, m, DefaultRateLimit)
 
-	go func() {
-		defer func() {
-			if err := m.StopVMM(); err != nil {
-				log.Errorln(err)
-				return
-			}
-		}()
-		defer func() {
-			if err := m.Shutdown(ctx); err != nil {
-				log.Errorln(err)
-				return
+	go p.waitVM(ctx, m, runnerName)
+
+	return nil
+}
+
+// networkInterfaces returns the MMDS and the data network interfaces of a VM.
+func networkInterfaces(tap0, tap1, eth0Mac, eth1Mac, ip0, ip1 string) (sdk.NetworkInterface, sdk.NetworkInterface) {
+	nf0 := sdk.NetworkInterface{
+		StaticConfiguration: &sdk.StaticNetworkConfiguration{
+			MacAddress:  eth0Mac,
+			HostDevName: tap0,
+			IPConfiguration: &sdk.IPConfiguration{
+				IPAddr:      net.IPNet{IP: net.ParseIP(MMDS_IP), Mask: net.CIDRMask(MMDS_SUBNET, 8*net.IPv4len)},
+				Gateway:     nil,
+				Nameservers: nil,
+				IfName:      "eth0",
+			},
+		},
+		AllowMMDS: true,
+	}
+	nf1 := sdk.NetworkInterface{
+		StaticConfiguration: &sdk.StaticNetworkConfiguration{
+			MacAddress:  eth1Mac,
+			HostDevName: tap1,
+			IPConfiguration: &sdk.IPConfiguration{
+				IPAddr:      net.IPNet{IP: net.ParseIP(ip1), Mask: net.CIDRMask(VMS_NETWORK_SUBNET, 8*net.IPv4len)},
+				Gateway:     net.ParseIP(ip0),
+				Nameservers: []string{"1.1.1.1", "8.8.8.8"},
+				IfName:      "eth1",
+			},
+		},
+	}
+	return nf0, nf1
+}
+
+// setupKernelArgsHandler points cloud-init to MMDS and passes the network
+// config of the VM on the kernel command line.
+func setupKernelArgsHandler(eth0Mac, eth1Mac string, sn SlotNetwork) sdk.Handler {
+	return sdk.Handler{
+		Name: sdk.SetupKernelArgsHandlerName,
+		Fn: func(ctx context.Context, m *sdk.Machine) error {
+			kernelArgs := parseKernelArgs(m.Cfg.KernelArgs)
+
+			//// If any network interfaces have a static IP configured, we need to set the "ip=" boot param.
+			//// Validation that we are not overriding an existing "ip=" setting happens in the network validation
+			//if staticIPInterface := m.Cfg.NetworkInterfaces.staticIPInterface(); staticIPInterface != nil {
+			//	ipBootParam := staticIPInterface.StaticConfiguration.IPConfiguration.ipBootParam()
+			//	kernelArgs["ip"] = &ipBootParam
+			//}
+
+			// ds=nocloud-net;s=http://169.254.169.254/latest/
+			// network-config=__NETWORK_CONFIG__",
+
+			// cloud-init=disabled
+			// disabled := "disabled"
+			// kernelArgs["cloud-init"] = &disabled
+
+			ds := fmt.Sprintf("nocloud-net;s=http://%s/latest/", MMDS_IP)
+			kernelArgs["ds"] = &ds
+
+			netcfg, err := BuildNetCfg(eth0Mac, eth1Mac, sn)
+			if err != nil {
+				return err
 			}
-		}()
+			kernelArgs["network-config"] = &netcfg
 
-		sts, _ := p.Status()
-		_ = providers.SendMail(providers.Started, ins.ID, sts)
-		backend.ReportStatus(p.nc, runnerName, backend.StatusStarted)
+			m.Cfg.KernelArgs = `keep_bootcon console=ttyS0 noapic reboot=k panic=1 pci=off rw ` + kernelArgs.String()
+			fmt.Println("KERNEL:", m.Cfg.KernelArgs)
+			return nil
+		},
+	}
+}
 
-		// wait for the VMM to exit
-		if err := m.Wait(ctx); err != nil {
+// waitVM reports the VM as started and stops it once its VMM exits.
+func (p impl) waitVM(ctx context.Context, m *sdk.Machine, runnerName string) {
+	if c, ok := m.Cfg.FifoLogWriter.(io.Closer); ok {
+		// the log file of a jailed VM
+		defer c.Close() //nolint:errcheck
+	}
+	defer func() {
+		if err := m.StopVMM(); err != nil {
+			log.Errorln(err)
+			return
+		}
+	}()
+	defer func() {
+		if err := m.Shutdown(ctx); err != nil {
 			log.Errorln(err)
+			return
 		}
 	}()
 
-	return nil
+	p.notify(notifier.EventVMStarted, runnerName, "")
+	backend.ReportStatus(p.nc, runnerName, backend.StatusStarted)
+
+	// wait for the VMM to exit
+	if err := m.Wait(ctx); err != nil {
+		log.Errorln(err)
+	}
 }
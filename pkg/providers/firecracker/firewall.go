@@ -0,0 +1,271 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package firecracker
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"k8s.io/klog/v2"
+)
+
+// DefaultEgressDeny are the networks VMs can not reach by default: private,
+// shared address space and link local networks.
+var DefaultEgressDeny = []string{
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"100.64.0.0/10",
+	"169.254.0.0/16",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+// EgressRule matches the packets to a network, and optionally a port.
+type EgressRule struct {
+	CIDR     string
+	Protocol string
+	Ports    string
+}
+
+// ParseEgressRule parses <cidr>[:[<protocol>/]<port>[-<port>]], eg,
+// 10.0.0.0/8, 10.1.2.3:5432 or 0.0.0.0/0:udp/53. IPv6 networks are given in
+// brackets with a port, eg, [2001:db8::/32]:443. The protocol defaults to
+// tcp.
+func ParseEgressRule(s string) (EgressRule, error) {
+	addr, port, hasPort := s, "", false
+	if rest, found := strings.CutPrefix(s, "["); found {
+		addr, rest, found = strings.Cut(rest, "]")
+		port, hasPort = strings.CutPrefix(rest, ":")
+		if !found || (rest != "" && !hasPort) {
+			return EgressRule{}, fmt.Errorf("egress rule %q has an unterminated IPv6 network", s)
+		}
+	} else if strings.Count(s, ":") == 1 {
+		addr, port, hasPort = strings.Cut(s, ":")
+	}
+	if !strings.Contains(addr, "/") {
+		if strings.Contains(addr, ":") {
+			addr += "/128"
+		} else {
+			addr += "/32"
+		}
+	}
+	_, ipnet, err := net.ParseCIDR(addr)
+	if err != nil {
+		return EgressRule{}, fmt.Errorf("egress rule %q must start with a CIDR", s)
+	}
+	r := EgressRule{CIDR: ipnet.String()}
+	if !hasPort {
+		return r, nil
+	}
+	if r.Protocol, r.Ports, err = parsePorts(port); err != nil {
+		return EgressRule{}, errors.Wrapf(err, "egress rule %q", s)
+	}
+	return r, nil
+}
+
+// parsePorts parses [<protocol>/]<port>[-<port>].
+func parsePorts(s string) (string, string, error) {
+	proto, ports, found := strings.Cut(s, "/")
+	if !found {
+		proto, ports = "tcp", s
+	}
+	if proto != "tcp" && proto != "udp" {
+		return "", "", fmt.Errorf("protocol %q must be tcp or udp", proto)
+	}
+	from, to, isRange := strings.Cut(ports, "-")
+	if !isRange {
+		to = from
+	}
+	lo, err1 := strconv.ParseUint(from, 10, 16)
+	hi, err2 := strconv.ParseUint(to, 10, 16)
+	if err1 != nil || err2 != nil || lo == 0 || lo > hi {
+		return "", "", fmt.Errorf("invalid port %q", ports)
+	}
+	if lo == hi {
+		return proto, from, nil
+	}
+	return proto, from + "-" + to, nil
+}
+
+// match returns the nft expression that matches the packets of the rule.
+func (r EgressRule) match() string {
+	m := nftAddrMatch("daddr", r.CIDR)
+	if r.Ports != "" {
+		m += fmt.Sprintf(" %s dport %s", r.Protocol, r.Ports)
+	}
+	return m
+}
+
+func fwChain(id int) string {
+	return fmt.Sprintf("fc%d", id)
+}
+
+func fwInputChain(id int) string {
+	return fmt.Sprintf("fc%d-in", id)
+}
+
+// hostPorts returns the ports of the host services VMs use, and the ports
+// allowed by HostAllowPorts.
+func hostPorts(opts *Options) []string {
+	var ports []string
+	for _, port := range []string{
+		opts.RegistryMirrorPort,
+		opts.CacheProxyPort,
+		opts.ActionsCachePort,
+		opts.GitMirrorPort,
+	} {
+		if port != "" {
+			ports = append(ports, "tcp/"+port)
+		}
+	}
+	return append(ports, opts.HostAllowPorts...)
+}
+
+// SetupFirewall installs the firewall of the VM of a slot, whose packets
+// reach the host through dev. Packets to other VMs are rejected; packets to
+// egressIface are accepted unless denied by EgressDeny and not allowed by
+// EgressAllow. Of the host, VMs reach the ports of the host services only.
+// Packets from mmdsDev, the MMDS device of the VM in the host network
+// namespace, are dropped.
+//
+// The rules are the chains fc<id> and fc<id>-in of the gh-ci table, that the
+// forward and input chains jump to by the input device of a packet. They are
+// replaced in one transaction.
+func SetupFirewall(id int, dev, egressIface, mmdsDev string) error {
+	if !Current().Firewall {
+		return nil
+	}
+	devs := firewallDevs{dev: dev, egressIface: egressIface, mmdsDev: mmdsDev}
+	if err := setupFirewall(id, devs); err != nil {
+		return err
+	}
+	slotFirewalls.mu.Lock()
+	defer slotFirewalls.mu.Unlock()
+	slotFirewalls.m[id] = devs
+	return nil
+}
+
+// slotFirewalls records the devices of the installed firewalls, by slot, so
+// that they are reinstalled with the reloaded rules.
+var slotFirewalls = struct {
+	mu sync.Mutex
+	m  map[int]firewallDevs
+}{m: map[int]firewallDevs{}}
+
+type firewallDevs struct {
+	dev         string
+	egressIface string
+	mmdsDev     string
+}
+
+// reloadFirewalls reinstalls the firewalls of the running VMs with the
+// reloaded EgressAllow, EgressDeny and HostAllowPorts. Established
+// connections are kept.
+func reloadFirewalls() {
+	slotFirewalls.mu.Lock()
+	defer slotFirewalls.mu.Unlock()
+	for id, devs := range slotFirewalls.m {
+		if err := setupFirewall(id, devs); err != nil {
+			klog.ErrorS(err, "failed to reload firewall", "slot", id)
+		}
+	}
+}
+
+func setupFirewall(id int, devs firewallDevs) error {
+	opts := Current()
+	fwd := []string{"ct state established,related accept"}
+	for _, pool := range []string{opts.NetworkCIDR, opts.NetworkCIDR6} {
+		if pool != "" {
+			fwd = append(fwd, nftAddrMatch("daddr", pool)+" reject")
+		}
+	}
+	for _, s := range opts.EgressAllow {
+		r, _ := ParseEgressRule(s) // validated
+		fwd = append(fwd, r.match()+" accept")
+	}
+	for _, s := range opts.EgressDeny {
+		r, _ := ParseEgressRule(s) // validated
+		fwd = append(fwd, r.match()+" reject")
+	}
+	fwd = append(fwd, fmt.Sprintf("oifname %q accept", devs.egressIface), "reject")
+
+	in := []string{
+		"ct state established,related accept",
+		"meta l4proto { icmp, ipv6-icmp } accept",
+	}
+	for _, s := range hostPorts(opts) {
+		proto, ports, _ := parsePorts(s) // validated
+		in = append(in, fmt.Sprintf("%s dport %s accept", proto, ports))
+	}
+	in = append(in, "reject")
+
+	b := newNftBatch()
+	for chain, rules := range map[string][]string{fwChain(id): fwd, fwInputChain(id): in} {
+		b.add("add chain %s %s", nftTable, chain)
+		b.add("flush chain %s %s", nftTable, chain)
+		for _, rule := range rules {
+			b.add("add rule %s %s %s", nftTable, chain, rule)
+		}
+	}
+	b.add("add element %s %s { %q : jump %s }", nftTable, nftForwardMap, devs.dev, fwChain(id))
+	b.add("add element %s %s { %q : jump %s }", nftTable, nftInputMap, devs.dev, fwInputChain(id))
+	if devs.mmdsDev != "" {
+		b.add("add element %s %s { %q : drop }", nftTable, nftForwardMap, devs.mmdsDev)
+		b.add("add element %s %s { %q : drop }", nftTable, nftInputMap, devs.mmdsDev)
+	}
+	if err := b.run(); err != nil {
+		return errors.Wrapf(err, "failed to set up the firewall of slot %d", id)
+	}
+	return nil
+}
+
+// RemoveFirewall removes the firewall of the VM of a slot, if any.
+func RemoveFirewall(id int) {
+	slotFirewalls.mu.Lock()
+	delete(slotFirewalls.m, id)
+	slotFirewalls.mu.Unlock()
+	if err := removeFirewall(id); err != nil {
+		klog.ErrorS(err, "failed to remove firewall", "slot", id)
+	}
+}
+
+func removeFirewall(id int) error {
+	// nft fails to delete missing objects, so they are added first. The
+	// devices of a slot always map to the same verdict.
+	tap0, tap1 := slotTaps(id)
+	b := newNftBatch()
+	b.addSlotMaps()
+	for _, chain := range []string{fwChain(id), fwInputChain(id)} {
+		b.add("add chain %s %s", nftTable, chain)
+	}
+	for m, chain := range map[string]string{nftForwardMap: fwChain(id), nftInputMap: fwInputChain(id)} {
+		for dev, verdict := range map[string]string{tap0: "drop", tap1: "jump " + chain, hostVeth(id): "jump " + chain} {
+			b.add("add element %s %s { %q : %s }", nftTable, m, dev, verdict)
+			b.add("delete element %s %s { %q }", nftTable, m, dev)
+		}
+	}
+	for _, chain := range []string{fwChain(id), fwInputChain(id)} {
+		b.add("flush chain %s %s", nftTable, chain)
+		b.add("delete chain %s %s", nftTable, chain)
+	}
+	return b.run()
+}
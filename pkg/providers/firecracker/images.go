@@ -0,0 +1,238 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package firecracker
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/appscodelabs/gh-ci-webhook/pkg/backend"
+	"github.com/appscodelabs/gh-ci-webhook/pkg/images"
+
+	"github.com/pkg/errors"
+	"k8s.io/klog/v2"
+)
+
+// imageCatalog holds the OS images in ImageDir. Images with a manifest
+// are verified once per version. Images used by VMs may have no manifest,
+// if their files follow the <os>/<os>.rootfs layout.
+type imageCatalog struct {
+	mu       sync.Mutex
+	images   map[string]*images.Image
+	verified map[string]bool
+}
+
+func newImageCatalog() *imageCatalog {
+	return &imageCatalog{
+		images:   map[string]*images.Image{},
+		verified: map[string]bool{},
+	}
+}
+
+// Load reads the catalog and verifies the images that changed since the
+// last load. The previous catalog is kept on error.
+func (c *imageCatalog) Load() error {
+	catalog, err := images.LoadCatalog(Current().ImageDir)
+	if err != nil {
+		return errors.Wrap(err, "failed to read image catalog")
+	}
+	for _, name := range images.Names(catalog) {
+		img := catalog[name]
+		if !Current().VerifyImages || c.isVerified(img.Key()) {
+			continue
+		}
+		start := time.Now()
+		if err := img.Verify(); err != nil {
+			return err
+		}
+		c.setVerified(img.Key())
+		klog.InfoS("verified image", "os", img.OS, "version", img.Version, "duration", time.Since(start))
+	}
+
+	for _, name := range usedImages() {
+		img, found := catalog[name]
+		if !found {
+			img = unversionedImage(name)
+			catalog[name] = img
+			klog.InfoS("using image without manifest", "os", name, "dir", img.Dir)
+		}
+		for _, filename := range []string{img.RootFSPath(), img.KernelPath(), img.InitrdPath()} {
+			if s, err := os.Stat(filename); err != nil {
+				return errors.Wrap(err, "file: "+filename)
+			} else if s.Size() == 0 {
+				return errors.Errorf("file: %s is empty", filename)
+			}
+		}
+	}
+
+	c.mu.Lock()
+	c.images = catalog
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *imageCatalog) isVerified(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.verified[key]
+}
+
+func (c *imageCatalog) setVerified(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.verified[key] = true
+}
+
+// Get returns an image of the catalog.
+func (c *imageCatalog) Get(name string) (*images.Image, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	img, found := c.images[name]
+	return img, found
+}
+
+// List returns the images of the catalog, sorted by name.
+func (c *imageCatalog) List() []*images.Image {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make([]*images.Image, 0, len(c.images))
+	for _, name := range images.Names(c.images) {
+		out = append(out, c.images[name])
+	}
+	return out
+}
+
+// syncImages syncs the images used by VMs from the image bucket. It
+// returns true if a new image version was activated.
+func (p impl) syncImages() bool {
+	changed := false
+	for _, name := range usedImages() {
+		m, err := p.store.Sync(context.TODO(), Current().ImageDir, name, Current().ImageSyncKeep)
+		if err != nil {
+			klog.ErrorS(err, "failed to sync image", "os", name)
+			continue
+		}
+		if m != nil {
+			// verified while syncing
+			p.images.setVerified((&images.Image{Manifest: *m}).Key())
+			changed = true
+		}
+	}
+	return changed
+}
+
+// runImageSync syncs the images in the background and reloads the catalog
+// once a new image version is activated. Running VMs keep their image.
+func (p impl) runImageSync() {
+	for {
+		time.Sleep(Current().ImageSyncInterval.Duration)
+		if !Current().ImageSync || !p.syncImages() {
+			continue
+		}
+		if err := p.images.Load(); err != nil {
+			klog.ErrorS(err, "failed to reload image catalog")
+			continue
+		}
+		if err := p.rollout.Sync(p.images); err != nil {
+			klog.ErrorS(err, "failed to sync rollout")
+		}
+		p.pool.Refill()
+	}
+}
+
+// unversionedImage returns an image without manifest, stored in
+// <imageDir>/<os> as <os>.rootfs, <os>.vmlinux and <os>.initrd.
+func unversionedImage(name string) *images.Image {
+	return &images.Image{
+		Manifest: images.Manifest{
+			OS:     name,
+			RootFS: images.File{Name: name + ".rootfs"},
+			Kernel: images.File{Name: name + ".vmlinux"},
+			Initrd: images.File{Name: name + ".initrd"},
+		},
+		Dir: filepath.Join(Current().ImageDir, name),
+	}
+}
+
+// usedImages returns the images booted by VMs or selected by labels.
+func usedImages() []string {
+	used := map[string]bool{Current().OS: true}
+	for name, n := range Current().ImageSlots {
+		if n > 0 {
+			used[name] = true
+		}
+	}
+	for _, name := range Current().LabelImages {
+		used[name] = true
+	}
+	if Current().CanaryImage != "" {
+		used[Current().CanaryImage] = true
+	}
+	out := make([]string, 0, len(used))
+	for name := range used {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// slotImage returns the OS image booted in a slot. The first slots are
+// reserved for the images in ImageSlots, in name order; the other slots
+// boot the default OS image.
+func slotImage(id int) string {
+	names := make([]string, 0, len(Current().ImageSlots))
+	for name := range Current().ImageSlots {
+		if name != Current().OS {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	n := 0
+	for _, name := range names {
+		n += Current().ImageSlots[name]
+		if id < n {
+			return name
+		}
+	}
+	return Current().OS
+}
+
+// imageLabels returns the runner labels of the jobs picked by VMs booting
+// an OS image, in priority order. firecracker-<os> selects an image by
+// name. VMs of the default OS image also pick the jobs of the f0 and
+// firecracker labels.
+func imageLabels(name string) []string {
+	var labels []string
+	if name == Current().OS {
+		labels = append(labels, backend.RunnerHigh, backend.RunnerRegular)
+	}
+	labels = append(labels, backend.RunnerImagePrefix+name)
+
+	var routed []string
+	for label, img := range Current().LabelImages {
+		if img == name && label != backend.RunnerImagePrefix+name {
+			routed = append(routed, label)
+		}
+	}
+	sort.Strings(routed)
+	return append(labels, routed...)
+}
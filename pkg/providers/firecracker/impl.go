@@ -24,8 +24,11 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/appscodelabs/gh-ci-webhook/pkg/backend"
+	"github.com/appscodelabs/gh-ci-webhook/pkg/images"
+	"github.com/appscodelabs/gh-ci-webhook/pkg/notifier"
 	"github.com/appscodelabs/gh-ci-webhook/pkg/providers"
 	"github.com/appscodelabs/gh-ci-webhook/pkg/providers/api"
 
@@ -33,16 +36,25 @@ import (
 	"github.com/nats-io/nats.go"
 	"github.com/pkg/errors"
 	"golang.org/x/sys/unix"
-	"gomodules.xyz/go-sh"
 	"k8s.io/klog/v2"
 )
 
 type impl struct {
-	nc  *nats.Conn
-	ins *Instances
+	nc      *nats.Conn
+	ins     *Instances
+	volumes *volumePool
+	rootfs  RootFSProvisioner
+	pool    *rootfsPool
+	images  *imageCatalog
+	rollout *rollout
+	history *backend.JobHistory
+	store   *images.Store
 }
 
-var _ api.Interface = &impl{}
+var (
+	_ api.Interface = &impl{}
+	_ api.Reloader  = &impl{}
+)
 
 func init() {
 	api.MustRegister(&impl{})
@@ -53,37 +65,99 @@ func (_ impl) Name() string {
 }
 
 func (p *impl) Init(nc *nats.Conn) error {
-	p.ins = NewInstances(DefaultOptions.NumInstances)
+	p.nc = nc
+	p.ins = NewInstances(Current().NumInstances)
+	p.volumes = newVolumePool()
+	p.images = newImageCatalog()
+
+	if s, err := os.Stat(Current().FirecrackerBinaryPath); err != nil {
+		return errors.Wrap(err, "file: "+Current().FirecrackerBinaryPath)
+	} else if s.Size() == 0 {
+		return errors.Errorf("file: %s is empty", Current().FirecrackerBinaryPath)
+	}
 
 	/*
 		root@fc-tester:~# ls -l images/focal/
 		-rw-r--r-- 1 root root    27613996 Feb 11 09:03 focal.initrd
 		-rw-r--r-- 1 root root 21474836480 Feb 11 09:03 focal.rootfs
 		-rw-r--r-- 1 root root    49233800 Feb 11 09:03 focal.vmlinux
+		-rw-r--r-- 1 root root         612 Feb 11 09:03 manifest.json
 	*/
-	osFiles := []string{
-		DefaultOptions.FirecrackerBinaryPath,
-		DefaultOptions.RootFSPath(),
-		DefaultOptions.KernelImagePath(),
-		DefaultOptions.InitrdPath(),
-	}
-	for _, filename := range osFiles {
-		if s, err := os.Stat(filename); err != nil {
-			return errors.Wrap(err, "file: "+filename)
-		} else if s.Size() == 0 {
-			return errors.Errorf("file: %s is empty", filename)
+	var err error
+	if Current().ImageSync {
+		if p.store, err = images.NewStore(context.TODO(), nc); err != nil {
+			return err
 		}
+		// VMs can not start without their images, so the first sync blocks
+		p.syncImages()
+	}
+	if err := p.images.Load(); err != nil {
+		return err
+	}
+	if p.rollout, err = loadRollout(); err != nil {
+		return err
+	}
+	if err := p.rollout.Sync(p.images); err != nil {
+		return err
+	}
+	if p.history, err = backend.NewJobHistory(context.TODO(), nc); err != nil {
+		return err
+	}
+	if err := backend.SubscribeStatus(nc, p.onStatus); err != nil {
+		return err
+	}
+	if err := backend.SubscribeJobs(nc, p.onJob); err != nil {
+		return err
 	}
 
-	// Check for kvm and root access
-	err := unix.Access("/dev/kvm", unix.W_OK)
+	// Check for kvm access and capabilities
+	err = unix.Access("/dev/kvm", unix.W_OK)
 	if err != nil {
 		return errors.Wrap(err, "file: /dev/kvm")
 	}
 
-	if x, y := 0, os.Getuid(); x != y {
-		return errors.New("root access denied")
+	p.rootfs, err = NewRootFSProvisioner(Current().RootFSStrategy)
+	if err != nil {
+		return err
+	}
+	if err := checkCapabilities(p.rootfs.Name()); err != nil {
+		return err
+	}
+	if err := ReconcileNetwork(); err != nil {
+		return errors.Wrap(err, "failed to reconcile VM networking")
+	}
+	if err := loadIPAM(Current().NumInstances, false); err != nil {
+		return errors.Wrap(err, "failed to allocate the networks of the slots")
+	}
+	// the user-data of the slots is rendered with their networks
+	if err := LoadUserData(); err != nil {
+		return err
+	}
+	if Current().Jailer {
+		dirs := []string{workflowDir()}
+		if Current().CacheVolumeDir != "" {
+			dirs = append(dirs, Current().CacheVolumeDir)
+		}
+		if err := sameFilesystem(Current().JailerChrootBaseDir, dirs...); err != nil {
+			return errors.Wrap(err, "jailed VMs need their drives hard linked into their chroot")
+		}
+		cleanStaged(true)
+	}
+	p.pool = newRootFSPool(p.rootfs)
+	go p.pool.run()
+	if p.store != nil {
+		go p.runImageSync()
+	}
+
+	if Current().CacheVolumeDir != "" {
+		if err := p.serveVolumes(nc); err != nil {
+			return errors.Wrap(err, "failed to serve cache volumes")
+		}
+	}
+	if err := p.serveSSHKeys(nc); err != nil {
+		return errors.Wrap(err, "failed to serve ssh keys")
 	}
+	go warmSSHKeys()
 	return nil
 }
 
@@ -96,10 +170,12 @@ func (p impl) Done(slot any) {
 	if ins == nil {
 		return
 	}
+	p.volumes.release(ins.ID)
 	p.ins.Free(ins.ID)
+	p.pool.Refill()
 }
 
-func (p impl) StartRunner(slot any) error {
+func (p impl) StartRunner(slot any) (err error) {
 	ins := slot.(*Instance)
 	if ins == nil {
 		return nil
@@ -112,9 +188,14 @@ func (p impl) StartRunner(slot any) error {
 	runnerName := fmt.Sprintf("%s-%d", hostname, ins.ID)
 	klog.Infoln("Starting VM ", runnerName)
 	backend.ReportStatus(p.nc, runnerName, backend.StatusStarting)
+	defer func() {
+		if err != nil {
+			backend.ReportStatus(p.nc, runnerName, backend.StatusFailed, err.Error())
+			p.rollout.RecordBootFailure(ins.role, ins.Canary)
+		}
+	}()
 
-	sts, _ := p.Status()
-	_ = providers.SendMail(providers.Starting, ins.ID, sts)
+	p.notify(notifier.EventVMStarting, runnerName, "")
 
 	wfRootFSPath := WorkflowRunRootFSPath(ins.UID)
 	wfDir := filepath.Dir(wfRootFSPath)
@@ -124,19 +205,26 @@ func (p impl) StartRunner(slot any) error {
 	}
 	// defer os.RemoveAll(wfDir) // remove in StopRunner
 
-	// optimize rootfs copy
-	klog.InfoS("copying rootfs", "path", wfRootFSPath)
-	cpfs := fmt.Sprintf("%s-%d", DefaultOptions.RootFSPath(), ins.ID)
-	if _, err := os.Stat(cpfs); os.IsNotExist(err) {
-		// cp command runs faster than CopyFile
-		err = sh.Command("cp", DefaultOptions.RootFSPath(), wfRootFSPath).Run()
-		// err = ioutil.CopyFile(wfRootFSPath, DefaultOptions.RootFSPath())
-		if err != nil {
-			return err
-		}
-	} else {
-		err = os.Rename(cpfs, wfRootFSPath)
-		if err != nil {
+	role := slotImage(ins.ID)
+	name, canary := p.rollout.Image(role, ins.ID)
+	img, found := p.images.Get(name)
+	if !found {
+		return errors.Errorf("image %s not found in %s", name, Current().ImageDir)
+	}
+	ins.setImage(img, role, canary)
+
+	snap, restore := usableSnapshot(img.Key())
+	restore = restore && img.OS == Current().OS
+	base := img.RootFSPath()
+	if restore {
+		base = snap.RootFSPath()
+	}
+	if err = p.provisionRootFS(ins, base); err != nil {
+		return err
+	}
+
+	if Current().CacheVolumeDir != "" {
+		if err := createPlaceholder(ins.UID); err != nil {
 			return err
 		}
 	}
@@ -145,11 +233,46 @@ func (p impl) StartRunner(slot any) error {
 	socketPath := filepath.Join(wfDir, fmt.Sprintf("fc-%d", ins.ID))
 	fmt.Println("SOCKET_PATH:___", socketPath)
 
+	if restore {
+		ctx, cancel := context.WithCancel(context.Background())
+		ins.cancel = cancel
+		rerr := p.restoreVM(ctx, ins, snap, runnerName, socketPath)
+		if rerr == nil {
+			return nil
+		}
+		klog.ErrorS(rerr, "failed to restore VM from snapshot, cold booting", "runner", runnerName)
+		cancel()
+		CleanupSlotNetwork(ins.ID)
+		ins.releaseRootFS()
+		if err = p.provisionRootFS(ins, img.RootFSPath()); err != nil {
+			return err
+		}
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	ins.cancel = cancel
 	return p.createVM(ctx, ins, runnerName, socketPath)
 }
 
+// provisionRootFS gives the VM of a slot a rootfs provisioned from base,
+// taken from the prewarmed pool if possible.
+func (p impl) provisionRootFS(ins *Instance, base string) error {
+	if r, found := p.pool.Take(base); found {
+		ins.setRootFS(p.rootfs, r.uid, r.path, r.duration, true)
+		klog.InfoS("using prewarmed rootfs", "path", r.path, "strategy", p.rootfs.Name())
+		return nil
+	}
+
+	start := time.Now()
+	rootfs, err := p.rootfs.Provision(base, ins.UID)
+	if err != nil {
+		return errors.Wrapf(err, "failed to provision rootfs using %s", p.rootfs.Name())
+	}
+	ins.setRootFS(p.rootfs, ins.UID, rootfs, time.Since(start), false)
+	klog.InfoS("provisioned rootfs", "path", rootfs, "strategy", p.rootfs.Name(), "duration", ins.RootFS.Duration)
+	return nil
+}
+
 func (p impl) StopRunner(e *github.WorkflowJobEvent) error {
 	klog.Infoln("Stopping VM ", e.GetWorkflowJob().GetRunnerName(), "for", providers.EventKey(e))
 
@@ -161,36 +284,106 @@ func (p impl) StopRunner(e *github.WorkflowJobEvent) error {
 		return err
 	}
 
-	/*
-		// optimize rootfs copy
-		cpfs := fmt.Sprintf("%s-%d", DefaultOptions.RootFSPath(), instanceID)
-		klog.InfoS("copying rootfs", "path", cpfs)
-		// cp command runs faster than CopyFile
-		err = sh.Command("cp", DefaultOptions.RootFSPath(), cpfs).Run()
-		// err = ioutil.CopyFile(cpfs, DefaultOptions.RootFSPath())
-		if err != nil {
-			return err
-		}
-	*/
-
-	sts, _ := p.Status()
-	_ = providers.SendMail(providers.Shutting, instanceID, sts)
+	p.notify(notifier.EventVMStopping, e.GetWorkflowJob().GetRunnerName(), providers.EventKey(e))
 
+	if slot, found := p.ins.Get(instanceID); found && slot.InUse {
+		p.recordJob(e, slot)
+	}
 	p.ins.Free(instanceID)
+	p.volumes.release(instanceID)
+	p.pool.Refill()
+
+	CleanupSlotNetwork(instanceID)
+	if Current().Jailer {
+		cleanupJail(instanceID)
+	} else if Current().Cgroups {
+		removeCgroup(slotCgroup(instanceID))
+	}
 
-	tap0 := fmt.Sprintf("fc%d", instanceID*4+1)
-	tap1 := fmt.Sprintf("fc%d", instanceID*4+2)
-	_ = TapDelete(tap0)
-	_ = TapDelete(tap1)
-
-	sts2, _ := p.Status()
-	_ = providers.SendMail(providers.Shut, instanceID, sts2)
+	p.notify(notifier.EventVMStopped, e.GetWorkflowJob().GetRunnerName(), providers.EventKey(e))
 
 	backend.ReportStatus(p.nc, e.GetWorkflowJob().GetRunnerName(), backend.StatusStopped, providers.EventKey(e))
 
 	return nil
 }
 
+// recordJob stores the job run by the VM of a slot in the job history and
+// counts it for the rollout of its image.
+func (p impl) recordJob(e *github.WorkflowJobEvent, slot Instance) {
+	rec := backend.NewJobRecord(e)
+	rec.Image, rec.ImageVersion, rec.Canary, rec.BootTime = slot.OS, slot.ImageVersion, slot.Canary, slot.BootTime
+	// read before the VM is stopped
+	rec.Usage = slotUsage(slot.ID)
+	if err := p.history.Put(context.TODO(), rec); err != nil {
+		klog.ErrorS(err, "failed to record job", "job", providers.EventKey(e))
+	}
+	klog.InfoS("job completed", "job", providers.EventKey(e), "conclusion", rec.Conclusion, "image", rec.Image, "version", rec.ImageVersion, "canary", rec.Canary,
+		"cpuSeconds", rec.Usage.CPUSeconds, "memoryPeakBytes", rec.Usage.MemoryPeakBytes, "netTxBytes", rec.Usage.NetTxBytes)
+	p.rollout.RecordJob(slot.role, slot.Canary, rec.Conclusion)
+}
+
+// onStatus records the boot time of a VM when its runner starts waiting
+// for a job.
+func (p impl) onStatus(ms backend.MachineStatus) {
+	if ms.Status != backend.StatusWaiting && ms.Status != backend.StatusPicked {
+		return
+	}
+	id, ok := instanceIDForRunner(ms.Name)
+	if !ok {
+		return
+	}
+	if slot, d, ok := p.ins.SetBooted(id); ok {
+		klog.InfoS("runner ready", "runner", ms.Name, "image", slot.OS, "version", slot.ImageVersion, "bootTime", slot.BootTime)
+		p.rollout.RecordBoot(slot.role, slot.Canary, d)
+	}
+}
+
+// instanceIDForRunner returns the slot of a runner of this host.
+func instanceIDForRunner(runnerName string) (int, bool) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return 0, false
+	}
+	suffix, found := strings.CutPrefix(runnerName, hostname+"-")
+	if !found {
+		return 0, false
+	}
+	id, err := strconv.Atoi(suffix)
+	return id, err == nil
+}
+
+func (p impl) notify(et notifier.EventType, runnerName, job string) {
+	notifier.Notify(notifier.Event{
+		Type:    et,
+		Machine: runnerName,
+		Job:     job,
+		Details: map[string]string{
+			"Slots": p.ins.Summary(),
+		},
+	})
+}
+
+// Reload applies changes to the number of instances and prewarmed rootfs,
+// and reloads the image catalog. Other options are read when a VM is
+// started.
+func (p impl) Reload() error {
+	if err := allocateNetworks(Current().NumInstances); err != nil {
+		return err
+	}
+	p.ins.Resize(Current().NumInstances)
+	p.pool.Refill()
+	if err := p.images.Load(); err != nil {
+		return err
+	}
+	if err := p.rollout.Sync(p.images); err != nil {
+		return err
+	}
+	p.reloadRateLimits()
+	reloadFirewalls()
+	// invalid templates are reported, the templates in use are kept
+	return LoadUserData()
+}
+
 func (p impl) Status() ([]byte, error) {
 	return json.MarshalIndent(p.ins.slots, "", "  ")
 }
@@ -0,0 +1,474 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package firecracker
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// DefaultNetworkCIDR is the pool the networks of the slots are allocated from.
+	DefaultNetworkCIDR = "172.26.0.0/16"
+
+	// slotPrefix is the size of the network of a slot: the /30 of its tap
+	// device and the /30 of the veth pair of its network namespace.
+	slotPrefix = VMS_NETWORK_SUBNET - 1
+	// slotPrefix6 is the size of the IPv6 network of a slot: the /64 of its
+	// tap device and the /64 of the veth pair of its network namespace.
+	slotPrefix6 = VMS_NETWORK6_SUBNET - 1
+)
+
+// VMNetworks returns the pools the networks of the slots are allocated
+// from, that the host services allow by default.
+func (opts *Options) VMNetworks() []string {
+	out := []string{opts.NetworkCIDR}
+	if opts.NetworkCIDR6 != "" {
+		out = append(out, opts.NetworkCIDR6)
+	}
+	return out
+}
+
+// SlotNetwork is the network allocated to a slot.
+type SlotNetwork struct {
+	CIDR  string `json:"cidr"`
+	CIDR6 string `json:"cidr6,omitempty"`
+}
+
+// Gateway returns the host side address of the tap device of the slot.
+func (n SlotNetwork) Gateway() string { return slotAddr(n.CIDR, VMS_NETWORK_SUBNET, 0, 1) }
+
+// IP returns the address of the VM.
+func (n SlotNetwork) IP() string { return slotAddr(n.CIDR, VMS_NETWORK_SUBNET, 0, 2) }
+
+// HostVethIP returns the host side address of the veth pair of the slot.
+func (n SlotNetwork) HostVethIP() string { return slotAddr(n.CIDR, VMS_NETWORK_SUBNET, 1, 1) }
+
+// NetNSVethIP returns the address of the veth pair in the network namespace
+// of the slot.
+func (n SlotNetwork) NetNSVethIP() string { return slotAddr(n.CIDR, VMS_NETWORK_SUBNET, 1, 2) }
+
+// Gateway6 returns the host side IPv6 address of the tap device of the slot,
+// or "" without IPv6.
+func (n SlotNetwork) Gateway6() string { return slotAddr(n.CIDR6, VMS_NETWORK6_SUBNET, 0, 1) }
+
+// IP6 returns the IPv6 address of the VM, or "" without IPv6.
+func (n SlotNetwork) IP6() string { return slotAddr(n.CIDR6, VMS_NETWORK6_SUBNET, 0, 2) }
+
+// HostVethIP6 returns the host side IPv6 address of the veth pair of the
+// slot, or "" without IPv6.
+func (n SlotNetwork) HostVethIP6() string { return slotAddr(n.CIDR6, VMS_NETWORK6_SUBNET, 1, 1) }
+
+// NetNSVethIP6 returns the IPv6 address of the veth pair in the network
+// namespace of the slot, or "" without IPv6.
+func (n SlotNetwork) NetNSVethIP6() string { return slotAddr(n.CIDR6, VMS_NETWORK6_SUBNET, 1, 2) }
+
+// slotAddr returns the host-th address of the sub-th /prefix network of
+// cidr, or "" if cidr is empty.
+func slotAddr(cidr string, prefix, sub int, host int64) string {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return ""
+	}
+	ip, bits := baseIP(ipnet)
+	off := new(big.Int).Lsh(big.NewInt(int64(sub)), uint(bits-prefix))
+	return addIP(ip, off.Add(off, big.NewInt(host))).String()
+}
+
+// baseIP returns the address of a network, in 4 bytes for IPv4, and its
+// number of bits.
+func baseIP(ipnet *net.IPNet) (net.IP, int) {
+	if ip := ipnet.IP.To4(); ip != nil {
+		return ip, 32
+	}
+	return ipnet.IP.To16(), 128
+}
+
+func addIP(ip net.IP, off *big.Int) net.IP {
+	n := new(big.Int).SetBytes(ip)
+	return n.Add(n, off).FillBytes(make([]byte, len(ip)))
+}
+
+// subnet returns the k-th /prefix network of pool.
+func subnet(pool *net.IPNet, prefix, k int) *net.IPNet {
+	ip, bits := baseIP(pool)
+	off := new(big.Int).Lsh(big.NewInt(int64(k)), uint(bits-prefix))
+	return &net.IPNet{IP: addIP(ip, off), Mask: net.CIDRMask(prefix, bits)}
+}
+
+// numSubnets returns the number of /prefix networks in pool, up to 1<<20.
+func numSubnets(pool *net.IPNet, prefix int) int {
+	ones, _ := pool.Mask.Size()
+	if prefix-ones > 20 {
+		return 1 << 20
+	}
+	return 1 << (prefix - ones)
+}
+
+func overlaps(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// parsePool parses the pool of slot networks of a family; it must hold
+// numInstances networks of the slots, and the network used to bake
+// snapshots.
+func parsePool(cidr string, prefix int, v4 bool, numInstances int) (*net.IPNet, error) {
+	ip, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil || (ip.To4() != nil) != v4 {
+		return nil, fmt.Errorf("invalid network cidr %q", cidr)
+	}
+	if !ip.Equal(ipnet.IP) {
+		return nil, fmt.Errorf("network cidr %q has host bits set, use %s", cidr, ipnet)
+	}
+	if ones, _ := ipnet.Mask.Size(); ones > prefix {
+		return nil, fmt.Errorf("network cidr %q must be at least a /%d", cidr, prefix)
+	}
+	if n := numSubnets(ipnet, prefix) - 1; n < numInstances {
+		return nil, fmt.Errorf("network cidr %q has room for %d instances, %d needed", cidr, n, numInstances)
+	}
+	return ipnet, nil
+}
+
+// ipam allocates the networks of the slots from the pools of NetworkCIDR
+// and NetworkCIDR6. A slot keeps its network, across restarts, as long as
+// it is in the pools and does not collide with a route of the host. The
+// last network of each pool is reserved to bake snapshots.
+type ipam struct {
+	mu    sync.Mutex
+	pool  *net.IPNet
+	pool6 *net.IPNet
+	slots map[int]SlotNetwork
+	// readOnly allocations are not stored
+	readOnly bool
+}
+
+// ipamState is stored in IPAMStatePath.
+type ipamState struct {
+	Network  string              `json:"network"`
+	Network6 string              `json:"network6,omitempty"`
+	Slots    map[int]SlotNetwork `json:"slots"`
+}
+
+// addrs has the networks of the slots.
+var addrs = &ipam{slots: map[int]SlotNetwork{}}
+
+// slotNetwork returns the network allocated to a slot.
+func slotNetwork(id int) (SlotNetwork, error) {
+	addrs.mu.Lock()
+	defer addrs.mu.Unlock()
+	n, found := addrs.slots[id]
+	if !found {
+		return n, errors.Errorf("no network allocated to slot %d", id)
+	}
+	return n, nil
+}
+
+// slotForIP returns the slot whose VM has the address ip.
+func slotForIP(ip net.IP) (int, bool) {
+	addrs.mu.Lock()
+	defer addrs.mu.Unlock()
+	for id, n := range addrs.slots {
+		if id == bakeSlotID {
+			continue
+		}
+		if ip.Equal(net.ParseIP(n.IP())) || (n.CIDR6 != "" && ip.Equal(net.ParseIP(n.IP6()))) {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// loadIPAM reads the networks allocated to the slots and allocates the
+// networks of the slots up to numInstances. Allocations out of the pools,
+// eg, once NetworkCIDR changed, or colliding with a route of the host are
+// replaced. With readOnly, the allocations are not stored, eg, to render
+// the user-data of a slot outside of hostctl.
+func loadIPAM(numInstances int, readOnly bool) error {
+	addrs.mu.Lock()
+	defer addrs.mu.Unlock()
+	addrs.readOnly = readOnly
+
+	pool, err := parsePool(Current().NetworkCIDR, slotPrefix, true, numInstances)
+	if err != nil {
+		return err
+	}
+	var pool6 *net.IPNet
+	if Current().NetworkCIDR6 != "" {
+		if pool6, err = parsePool(Current().NetworkCIDR6, slotPrefix6, false, numInstances); err != nil {
+			return err
+		}
+	}
+	addrs.pool, addrs.pool6 = pool, pool6
+
+	var state ipamState
+	data, err := os.ReadFile(Current().IPAMStatePath)
+	if err == nil {
+		if err := json.Unmarshal(data, &state); err != nil {
+			return errors.Wrapf(err, "failed to parse %s", Current().IPAMStatePath)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	routes, err := hostNetworks()
+	if err != nil {
+		return err
+	}
+	addrs.slots = map[int]SlotNetwork{}
+	for id, n := range state.Slots {
+		if !addrs.valid(n.CIDR, addrs.pool, slotPrefix, routes) {
+			klog.InfoS("releasing network of slot", "slot", id, "cidr", n.CIDR)
+			continue
+		}
+		if !addrs.valid(n.CIDR6, addrs.pool6, slotPrefix6, routes) {
+			n.CIDR6 = ""
+		}
+		addrs.slots[id] = n
+	}
+	return addrs.allocate(numInstances, routes)
+}
+
+// allocateNetworks allocates the networks of the slots up to numInstances,
+// eg, once their number was raised.
+func allocateNetworks(numInstances int) error {
+	addrs.mu.Lock()
+	defer addrs.mu.Unlock()
+	if addrs.pool == nil {
+		return errors.New("ipam is not loaded")
+	}
+	routes, err := hostNetworks()
+	if err != nil {
+		return err
+	}
+	return addrs.allocate(numInstances, routes)
+}
+
+func (a *ipam) allocate(numInstances int, routes []*net.IPNet) error {
+	changed := false
+	for id := 0; id < numInstances; id++ {
+		n := a.slots[id]
+		if n.CIDR == "" {
+			ipnet, err := a.next(a.pool, slotPrefix, routes, func(n SlotNetwork) string { return n.CIDR })
+			if err != nil {
+				return err
+			}
+			n.CIDR = ipnet.String()
+		}
+		if a.pool6 != nil && n.CIDR6 == "" {
+			ipnet, err := a.next(a.pool6, slotPrefix6, routes, func(n SlotNetwork) string { return n.CIDR6 })
+			if err != nil {
+				return err
+			}
+			n.CIDR6 = ipnet.String()
+		}
+		if n != a.slots[id] {
+			klog.InfoS("allocated network of slot", "slot", id, "cidr", n.CIDR, "cidr6", n.CIDR6)
+			a.slots[id] = n
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return a.save()
+}
+
+// valid checks that cidr is a network of a slot in pool, not allocated to
+// another slot and not colliding with routes.
+func (a *ipam) valid(cidr string, pool *net.IPNet, prefix int, routes []*net.IPNet) bool {
+	if pool == nil || cidr == "" {
+		return false
+	}
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil || ipnet.String() != cidr {
+		return false
+	}
+	if ones, _ := ipnet.Mask.Size(); ones != prefix || !pool.Contains(ipnet.IP) {
+		return false
+	}
+	if ipnet.String() == subnet(pool, prefix, numSubnets(pool, prefix)-1).String() {
+		// reserved to bake snapshots
+		return false
+	}
+	for _, n := range a.slots {
+		if n.CIDR == cidr || n.CIDR6 == cidr {
+			return false
+		}
+	}
+	return !collides(ipnet, routes)
+}
+
+// next returns the first network of pool not allocated to a slot and not
+// colliding with routes.
+func (a *ipam) next(pool *net.IPNet, prefix int, routes []*net.IPNet, cidr func(SlotNetwork) string) (*net.IPNet, error) {
+	used := map[string]bool{}
+	for _, n := range a.slots {
+		used[cidr(n)] = true
+	}
+	// the last network is reserved to bake snapshots
+	for k := 0; k < numSubnets(pool, prefix)-1; k++ {
+		ipnet := subnet(pool, prefix, k)
+		if !used[ipnet.String()] && !collides(ipnet, routes) {
+			return ipnet, nil
+		}
+	}
+	return nil, fmt.Errorf("no free /%d network in %s", prefix, pool)
+}
+
+func (a *ipam) save() error {
+	if a.readOnly {
+		return nil
+	}
+	state := ipamState{Slots: a.slots}
+	if a.pool != nil {
+		state.Network = a.pool.String()
+	}
+	if a.pool6 != nil {
+		state.Network6 = a.pool6.String()
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(Current().IPAMStatePath), 0o755); err != nil {
+		return err
+	}
+	tmp := Current().IPAMStatePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, Current().IPAMStatePath)
+}
+
+// allocateBakeNetwork allocates the network reserved to bake snapshots, the
+// last network of each pool. It is not stored, as snapshots are baked by
+// another process than hostctl.
+func allocateBakeNetwork() error {
+	pool, err := parsePool(Current().NetworkCIDR, slotPrefix, true, 0)
+	if err != nil {
+		return err
+	}
+	n := SlotNetwork{CIDR: subnet(pool, slotPrefix, numSubnets(pool, slotPrefix)-1).String()}
+	if Current().NetworkCIDR6 != "" {
+		pool6, err := parsePool(Current().NetworkCIDR6, slotPrefix6, false, 0)
+		if err != nil {
+			return err
+		}
+		n.CIDR6 = subnet(pool6, slotPrefix6, numSubnets(pool6, slotPrefix6)-1).String()
+	}
+
+	routes, err := hostNetworks()
+	if err != nil {
+		return err
+	}
+	for _, cidr := range []string{n.CIDR, n.CIDR6} {
+		if _, ipnet, err := net.ParseCIDR(cidr); err == nil && collides(ipnet, routes) {
+			return fmt.Errorf("network %s to bake snapshots collides with a route of the host", cidr)
+		}
+	}
+
+	addrs.mu.Lock()
+	defer addrs.mu.Unlock()
+	addrs.slots[bakeSlotID] = n
+	return nil
+}
+
+// sampleNetwork returns the first network of each pool, to render sample
+// user-data with.
+func sampleNetwork() (SlotNetwork, error) {
+	pool, err := parsePool(Current().NetworkCIDR, slotPrefix, true, 0)
+	if err != nil {
+		return SlotNetwork{}, err
+	}
+	n := SlotNetwork{CIDR: subnet(pool, slotPrefix, 0).String()}
+	if Current().NetworkCIDR6 != "" {
+		pool6, err := parsePool(Current().NetworkCIDR6, slotPrefix6, false, 0)
+		if err != nil {
+			return SlotNetwork{}, err
+		}
+		n.CIDR6 = subnet(pool6, slotPrefix6, 0).String()
+	}
+	return n, nil
+}
+
+// hostNetworks returns the destinations of the routes of the host, except
+// default routes and the routes of the devices of the slots.
+func hostNetworks() ([]*net.IPNet, error) {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list routes")
+	}
+	names := map[int]string{}
+	var out []*net.IPNet
+	for _, r := range routes {
+		if r.Dst == nil {
+			continue
+		}
+		if ones, _ := r.Dst.Mask.Size(); ones == 0 {
+			continue
+		}
+		name, found := names[r.LinkIndex]
+		if !found {
+			if link, err := netlink.LinkByIndex(r.LinkIndex); err == nil {
+				name = link.Attrs().Name
+			}
+			names[r.LinkIndex] = name
+		}
+		if slotLinkRe.MatchString(name) {
+			continue
+		}
+		out = append(out, r.Dst)
+	}
+	return out, nil
+}
+
+func collides(ipnet *net.IPNet, routes []*net.IPNet) bool {
+	for _, r := range routes {
+		if overlaps(ipnet, r) {
+			return true
+		}
+	}
+	return false
+}
+
+// gatewayCIDRs returns the addresses of the host side of the tap device of
+// the slot.
+func (n SlotNetwork) gatewayCIDRs() []string {
+	out := []string{fmt.Sprintf("%s/%d", n.Gateway(), VMS_NETWORK_SUBNET)}
+	if n.CIDR6 != "" {
+		out = append(out, fmt.Sprintf("%s/%d", n.Gateway6(), VMS_NETWORK6_SUBNET))
+	}
+	return out
+}
+
+// vmCIDRs returns the addresses of the VM.
+func (n SlotNetwork) vmCIDRs() []string {
+	out := []string{fmt.Sprintf("%s/%d", n.IP(), VMS_NETWORK_SUBNET)}
+	if n.CIDR6 != "" {
+		out = append(out, fmt.Sprintf("%s/%d", n.IP6(), VMS_NETWORK6_SUBNET))
+	}
+	return out
+}
@@ -0,0 +1,372 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package firecracker
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	sdk "github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	"gomodules.xyz/pointer"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// jailSocket is the api socket of a jailed VM, relative to its chroot
+	jailSocket = "api.socket"
+	// jailCacheDrive is the cache volume attached to a jailed VM, relative
+	// to its chroot
+	jailCacheDrive = "cache.ext4"
+	// stagedDir keeps the files shared by the chroots of all slots, that are
+	// not on the filesystem of the chroot base dir
+	stagedDir = ".staged"
+)
+
+// Jailed VMs run in a chroot per slot, as a uid and gid per slot, in the
+// cgroup firecracker/fc-<slot> and in the network namespace of the slot.
+// Their kernel, initrd, drives and snapshot files are hard linked into the
+// chroot, block devices are recreated in it.
+
+func jailID(id int) string {
+	return fmt.Sprintf("fc-%d", id)
+}
+
+func jailUID(id int) int {
+	return Current().JailerUID + id
+}
+
+func jailGID(id int) int {
+	return Current().JailerGID + id
+}
+
+// jailDir returns the dir of the chroot of a slot.
+func jailDir(id int) string {
+	return filepath.Join(Current().JailerChrootBaseDir, filepath.Base(Current().FirecrackerBinaryPath), jailID(id))
+}
+
+// jailRoot returns the root of the chroot of a slot.
+func jailRoot(id int) string {
+	return filepath.Join(jailDir(id), "root")
+}
+
+// jailCgroup returns the cgroup v2 dir the jailer creates for a slot.
+func jailCgroup(id int) string {
+	return filepath.Join("/sys/fs/cgroup", filepath.Base(Current().FirecrackerBinaryPath), jailID(id))
+}
+
+// jailConfig makes cfg run the VM of a slot through the jailer. The log of
+// firecracker is written to logPath. drives maps the drive paths of cfg to
+// the files linked at these paths in the chroot, eg, for the drives of a
+// snapshot; other drives are linked at their base name.
+func jailConfig(cfg *sdk.Config, id int, logPath string, drives map[string]string) error {
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	cfg.SocketPath = jailSocket
+	cfg.LogPath = ""
+	cfg.LogFifo = logPath + ".fifo"
+	cfg.FifoLogWriter = logFile
+	cfg.NetNS = NetNSPath(id)
+	cfg.Seccomp.Enabled = true
+	cfg.JailerCfg = &sdk.JailerConfig{
+		ID:             jailID(id),
+		UID:            pointer.IntP(jailUID(id)),
+		GID:            pointer.IntP(jailGID(id)),
+		NumaNode:       pointer.IntP(0),
+		ExecFile:       Current().FirecrackerBinaryPath,
+		JailerBinary:   Current().JailerBinaryPath,
+		ChrootBaseDir:  Current().JailerChrootBaseDir,
+		CgroupVersion:  "2",
+		ChrootStrategy: chrootStrategy{id: id, drives: drives},
+		Stdout:         os.Stdout,
+		Stderr:         os.Stderr,
+	}
+	return nil
+}
+
+// chrootStrategy links the files of the VM of a slot into its chroot, once
+// the jailer created it.
+type chrootStrategy struct {
+	id     int
+	drives map[string]string
+}
+
+var _ sdk.HandlersAdapter = chrootStrategy{}
+
+func (s chrootStrategy) AdaptHandlers(handlers *sdk.Handlers) error {
+	if !handlers.FcInit.Has(sdk.CreateLogFilesHandlerName) {
+		return sdk.ErrRequiredHandlerMissing
+	}
+	handlers.FcInit = handlers.FcInit.AppendAfter(sdk.CreateLogFilesHandlerName, sdk.Handler{
+		Name: sdk.LinkFilesToRootFSHandlerName,
+		Fn:   s.linkFiles,
+	})
+	return nil
+}
+
+func (s chrootStrategy) linkFiles(ctx context.Context, m *sdk.Machine) error {
+	root := jailRoot(s.id)
+	if m.Cfg.KernelImagePath != "" {
+		name, err := jailStage(s.id, m.Cfg.KernelImagePath, "")
+		if err != nil {
+			return err
+		}
+		m.Cfg.KernelImagePath = name
+	}
+	if m.Cfg.InitrdPath != "" {
+		name, err := jailStage(s.id, m.Cfg.InitrdPath, "")
+		if err != nil {
+			return err
+		}
+		m.Cfg.InitrdPath = name
+	}
+	for i, drive := range m.Cfg.Drives {
+		path, name := pointer.String(drive.PathOnHost), ""
+		if src, ok := s.drives[path]; ok {
+			path, name = src, path
+		}
+		name, err := jailLink(s.id, path, name)
+		if err != nil {
+			return err
+		}
+		m.Cfg.Drives[i].PathOnHost = pointer.StringP(name)
+	}
+	if snap := &m.Cfg.Snapshot; snap.MemFilePath != "" {
+		mem, err := jailStage(s.id, snap.MemFilePath, "")
+		if err != nil {
+			return err
+		}
+		state, err := jailStage(s.id, snap.SnapshotPath, "")
+		if err != nil {
+			return err
+		}
+		snap.MemFilePath, snap.SnapshotPath = mem, state
+	}
+	if m.Cfg.LogFifo != "" {
+		name := filepath.Base(m.Cfg.LogFifo)
+		if err := os.Link(m.Cfg.LogFifo, filepath.Join(root, name)); err != nil {
+			return err
+		}
+		if err := os.Chown(filepath.Join(root, name), jailUID(s.id), jailGID(s.id)); err != nil {
+			return err
+		}
+		m.Cfg.LogFifo = name
+	}
+	return nil
+}
+
+// jailLink makes a drive available in the chroot of a slot, as name or
+// the base name of path if name is empty, and owned by the jailed user. Its
+// path in the chroot is returned.
+func jailLink(id int, path, name string) (string, error) {
+	if name == "" {
+		name = filepath.Base(path)
+	}
+	dst := filepath.Join(jailRoot(id), name)
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return "", err
+	}
+	_ = os.Remove(dst)
+
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return "", errors.Wrapf(err, "failed to stat %s", path)
+	}
+	if st.Mode&unix.S_IFMT == unix.S_IFBLK {
+		// eg, dm-snapshot rootfs
+		if err := unix.Mknod(dst, unix.S_IFBLK|0o600, int(st.Rdev)); err != nil {
+			return "", errors.Wrapf(err, "failed to create %s", dst)
+		}
+	} else if err := os.Link(path, dst); err != nil {
+		return "", errors.Wrapf(err, "failed to link %s into the chroot, it must be on the filesystem of %s", path, Current().JailerChrootBaseDir)
+	}
+	if err := os.Chown(dst, jailUID(id), jailGID(id)); err != nil {
+		return "", err
+	}
+	return filepath.Join("/", name), nil
+}
+
+// stagedFiles records the source of the files staged by this process, by
+// staged path. Staged files whose source changed or is unknown are removed
+// once no chroot links them anymore.
+var stagedFiles = struct {
+	mu sync.Mutex
+	m  map[string]stagedSource
+}{m: map[string]stagedSource{}}
+
+type stagedSource struct {
+	path    string
+	modTime time.Time
+}
+
+// jailStage makes a read only file available in the chroot of a slot, as
+// name or the base name of path if name is empty. Files on another
+// filesystem are copied once into the staged dir of the chroot base dir.
+func jailStage(id int, path, name string) (string, error) {
+	if name == "" {
+		name = filepath.Base(path)
+	}
+	dst := filepath.Join(jailRoot(id), name)
+	_ = os.Remove(dst)
+	if err := os.Link(path, dst); err == nil {
+		return filepath.Join("/", name), nil
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.Sum256([]byte(path + "@" + strconv.FormatInt(fi.ModTime().UnixNano(), 10)))
+	staged := filepath.Join(Current().JailerChrootBaseDir, stagedDir, hex.EncodeToString(h[:8])+"-"+filepath.Base(path))
+
+	src := stagedSource{path: path, modTime: fi.ModTime()}
+	stagedFiles.mu.Lock()
+	// recorded before the copy, so that it is kept until linked
+	stagedFiles.m[staged] = src
+	err = os.Link(staged, dst)
+	stagedFiles.mu.Unlock()
+	if err == nil {
+		return filepath.Join("/", name), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	// concurrent stages of the same file copy to their own temp file, the
+	// last rename wins with the same content
+	if err := copyFile(path, staged); err != nil {
+		return "", errors.Wrapf(err, "failed to stage %s", path)
+	}
+	klog.InfoS("staged file for jailed VMs", "path", path, "staged", staged)
+	if err := os.Link(staged, dst); err != nil {
+		return "", err
+	}
+	return filepath.Join("/", name), nil
+}
+
+// cleanStaged removes the staged files that no chroot links, unless their
+// source is unchanged. On startup, temp files of interrupted copies are
+// removed as well.
+func cleanStaged(startup bool) {
+	dir := filepath.Join(Current().JailerChrootBaseDir, stagedDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			klog.ErrorS(err, "failed to list staged files", "dir", dir)
+		}
+		return
+	}
+
+	stagedFiles.mu.Lock()
+	defer stagedFiles.mu.Unlock()
+	for _, e := range entries {
+		staged := filepath.Join(dir, e.Name())
+		if strings.HasPrefix(e.Name(), stagedTmpPrefix) {
+			if startup {
+				_ = os.Remove(staged)
+			}
+			continue
+		}
+		var st unix.Stat_t
+		if err := unix.Stat(staged, &st); err != nil || st.Nlink > 1 {
+			continue
+		}
+		if src, found := stagedFiles.m[staged]; found {
+			if fi, err := os.Stat(src.path); err == nil && fi.ModTime().Equal(src.modTime) {
+				continue
+			}
+		}
+		if err := os.Remove(staged); err != nil {
+			klog.ErrorS(err, "failed to remove staged file", "staged", staged)
+			continue
+		}
+		delete(stagedFiles.m, staged)
+		klog.InfoS("removed stale staged file", "staged", staged)
+	}
+}
+
+// stagedTmpPrefix is the prefix of the temp files of copies to the staged
+// dir, that are renamed into place once complete.
+const stagedTmpPrefix = ".tmp-"
+
+func copyFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close() //nolint:errcheck
+
+	out, err := os.CreateTemp(filepath.Dir(dst), stagedTmpPrefix+"*-"+filepath.Base(dst))
+	if err != nil {
+		return err
+	}
+	tmp := out.Name()
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := out.Chmod(0o644); err != nil {
+		_ = out.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// cleanupJail removes the chroot and cgroup of a slot and the staged files
+// that are left unused. Other files linked into the chroot are not affected. The cgroup is busy until the VMM exited, it
+// is removed again before the next VM of the slot starts.
+func cleanupJail(id int) {
+	if err := os.RemoveAll(jailDir(id)); err != nil {
+		klog.ErrorS(err, "failed to remove chroot", "slot", id)
+	}
+	removeCgroup(jailCgroup(id))
+	cleanStaged(false)
+}
+
+// tapOwner returns the uid and gid that let the jailed VM of a slot open
+// its tap devices.
+func tapOwner(id int) (uint32, uint32) {
+	if !Current().Jailer {
+		return noOwner, noOwner
+	}
+	return uint32(jailUID(id)), uint32(jailGID(id))
+}
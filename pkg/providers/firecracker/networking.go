@@ -18,64 +18,102 @@ package firecracker
 
 import (
 	"fmt"
+	"net"
 	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
 	"syscall"
 
 	"github.com/coreos/go-iptables/iptables"
 	"github.com/pkg/errors"
 	"github.com/vishvananda/netlink"
-	"gomodules.xyz/go-sh"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+	sh "gomodules.xyz/go-sh"
+	"k8s.io/klog/v2"
 )
 
-func GetEgressInterface() (string, error) {
-	egressIface, err := sh.
-		Command("ip", "route", "get", "1.1.1.1").
-		Command("grep", "uid").
-		Command("sed", `s/.* dev \([^ ]*\) .*/\1/`).
-		Output()
-	return strings.TrimSpace(string(egressIface)), err
-}
-
-// Host iface bond0
-// detect using
-// EGRESS_IFACE=`ip route get 8.8.8.8 |grep uid |sed 's/.* dev \([^ ]*\) .*/\1/'`
-func SetupIPTables(iface, tapDev string) error {
-	/*
-		sudo sh -c "echo 1 > /proc/sys/net/ipv4/ip_forward"
-		sudo iptables -t nat -A POSTROUTING -o eth0 -j MASQUERADE
-		sudo iptables -A FORWARD -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT
-		sudo iptables -A FORWARD -i tap0 -o eth0 -j ACCEPT
-	*/
-
-	// sudo sysctl -w net.ipv4.ip_forward=1 > /dev/null
-	filename := "/proc/sys/net/ipv4/ip_forward"
-	if err := os.WriteFile(filename, []byte("1"), 0o644); err != nil {
-		return errors.Wrapf(err, "failed to write file: %s", filename)
-	}
+// noOwner leaves a tap device usable by any process with CAP_NET_ADMIN, as
+// "ip tuntap add" does.
+const noOwner = ^uint32(0)
 
-	tbl, err := iptables.New(iptables.IPFamily(iptables.ProtocolIPv4), iptables.Timeout(5))
+// GetEgressInterface returns the interface of the default route, eg, bond0.
+func GetEgressInterface() (string, error) {
+	routes, err := netlink.RouteGet(net.ParseIP("1.1.1.1"))
 	if err != nil {
-		return errors.Wrap(err, "failed to construct iptables obj")
+		return "", errors.Wrap(err, "failed to get the route to 1.1.1.1")
+	}
+	if len(routes) == 0 {
+		return "", errors.New("no route to 1.1.1.1")
 	}
-	err = tbl.AppendUnique("nat", "POSTROUTING", "-o", iface, "-j", "MASQUERADE")
+	link, err := netlink.LinkByIndex(routes[0].LinkIndex)
 	if err != nil {
-		return errors.Wrap(err, "failed to exec: "+"iptables -t nat -A POSTROUTING -o "+iface+" -j MASQUERADE")
+		return "", err
 	}
+	return link.Attrs().Name, nil
+}
 
-	/*
-		sudo iptables -A FORWARD -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT
-		sudo iptables -A FORWARD -i tap0 -o eth0 -j ACCEPT
-	*/
-	err = tbl.AppendUnique("filter", "FORWARD", "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT")
-	if err != nil {
-		return errors.Wrap(err, "failed to exec: "+"iptables -A FORWARD -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT")
+// setupHostNetwork enables IPv4 forwarding and installs the gh-ci nftables
+// table, that masquerades the packets of VMs leaving through egressIface.
+func setupHostNetwork(egressIface string) error {
+	if err := enableForwarding(); err != nil {
+		return err
 	}
-	err = tbl.AppendUnique("filter", "FORWARD", "-i", tapDev, "-o", iface, "-j", "ACCEPT")
-	if err != nil {
-		return errors.Wrapf(err, "failed to exec: "+"-i %s -o %s -j ACCEPT", tapDev, iface)
+	if err := nftSetupBase(egressIface); err != nil {
+		return err
 	}
+	return allowForwarding()
+}
 
+// forwardRules accept the packets of VMs in the FORWARD chain of iptables.
+var forwardRules = [][]string{
+	{"-i", "fc+", "-j", "ACCEPT"},
+	{"-o", "fc+", "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"},
+}
+
+// allowForwarding inserts forwardRules into the FORWARD chain of iptables,
+// whose policy may be DROP, eg, when docker is installed. A packet must be
+// accepted by both nftables and iptables, so the firewall of the slots in
+// the gh-ci table still applies.
+func allowForwarding() error {
+	protos := []iptables.Protocol{iptables.ProtocolIPv4}
+	if Current().NetworkCIDR6 != "" {
+		protos = append(protos, iptables.ProtocolIPv6)
+	}
+	for _, proto := range protos {
+		tbl, err := iptables.New(iptables.IPFamily(proto), iptables.Timeout(5))
+		if err != nil {
+			return errors.Wrap(err, "failed to initialize iptables")
+		}
+		for _, rule := range forwardRules {
+			if err := tbl.InsertUnique("filter", "FORWARD", 1, rule...); err != nil {
+				return errors.Wrapf(err, "failed to insert iptables rule: %s", strings.Join(rule, " "))
+			}
+		}
+	}
+	return nil
+}
+
+// enableForwarding enables IPv4 forwarding, and IPv6 forwarding if VMs get
+// IPv6 addresses, in the network namespace of the calling thread. It is
+// skipped if already enabled, eg, by the host config, so that hostctl does
+// not need write access to /proc/sys.
+func enableForwarding() error {
+	files := []string{"/proc/sys/net/ipv4/ip_forward"}
+	if Current().NetworkCIDR6 != "" {
+		files = append(files, "/proc/sys/net/ipv6/conf/all/forwarding")
+	}
+	for _, filename := range files {
+		if data, err := os.ReadFile(filename); err == nil && strings.TrimSpace(string(data)) == "1" {
+			continue
+		}
+		if err := os.WriteFile(filename, []byte("1"), 0o644); err != nil {
+			return errors.Wrapf(err, "failed to write file: %s", filename)
+		}
+	}
 	return nil
 }
 
@@ -84,7 +122,16 @@ sudo ip tuntap add tap0 mode tap
 sudo ip addr add 172.16.0.1/24 dev tap0
 sudo ip link set tap0 up
 */
-func CreateTap_(name, cidr string) (netlink.Link, error) {
+func CreateTap(name, cidr string) error {
+	if cidr == "" {
+		return createTap(name, noOwner, noOwner)
+	}
+	return createTap(name, noOwner, noOwner, cidr)
+}
+
+// createTap creates a tap device with the addresses cidrs in the network
+// namespace of the calling thread, usable by uid and gid.
+func createTap(name string, uid, gid uint32, cidrs ...string) error {
 	tapLinkAttrs := netlink.NewLinkAttrs()
 	tapLinkAttrs.Name = name
 	tapLink := &netlink.Tuntap{
@@ -98,104 +145,376 @@ func CreateTap_(name, cidr string) (netlink.Link, error) {
 		Queues: 1,
 
 		Flags: netlink.TUNTAP_ONE_QUEUE | // single queue tap device
-			netlink.TUNTAP_VNET_HDR, // parse vnet headers added by the vm's virtio_net implementation
+			netlink.TUNTAP_VNET_HDR | // parse vnet headers added by the vm's virtio_net implementation
+			netlink.TUNTAP_NO_PI,
+
+		Owner: uid,
+		Group: gid,
+	}
+	if err := netlink.LinkAdd(tapLink); err != nil {
+		return fmt.Errorf("failed to create tap device %s: %w", name, err)
+	}
+	// the device is persistent
+	for _, fd := range tapLink.Fds {
+		_ = fd.Close()
 	}
 
-	err := netlink.LinkAdd(tapLink)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create tap device: %w", err)
-	}
-
-	//for _, tapFd := range tapLink.Fds {
-	//	err = unix.IoctlSetInt(int(tapFd.Fd()), unix.TUNSETOWNER, ownerUID)
-	//	if err != nil {
-	//		return nil, fmt.Errorf("failed to set tap %s owner to uid %d: %w",
-	//			name, ownerUID, err)
-	//
-	//	}
-	//
-	//	err = unix.IoctlSetInt(int(tapFd.Fd()), unix.TUNSETGROUP, ownerGID)
-	//	if err != nil {
-	//		return nil, fmt.Errorf("failed to set tap %s group to gid %d: %w",
-	//			name, ownerGID, err)
-	//
-	//	}
-	//}
-
-	//err = netlink.LinkSetMTU(tapLink, mtu)
-	//if err != nil {
-	//	return nil, fmt.Errorf("failed to set tap device MTU to %d: %w", mtu, err)
-	//}
-
-	if cidr != "" {
-		addr, err := netlink.ParseAddr(cidr) // "172.20.0.1/24"
+	if err := addAddrs(tapLink, cidrs...); err != nil {
+		return err
+	}
+	if err := netlink.LinkSetUp(tapLink); err != nil {
+		return fmt.Errorf("failed to set tap %s up: %w", name, err)
+	}
+	return nil
+}
+
+// addAddrs adds the addresses cidrs, eg, "172.20.0.1/24", to a device.
+// Duplicate address detection is skipped for IPv6 addresses, as the
+// networks of the slots are not shared.
+func addAddrs(link netlink.Link, cidrs ...string) error {
+	for _, cidr := range cidrs {
+		addr, err := netlink.ParseAddr(cidr)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		err = netlink.AddrAdd(tapLink, addr)
-		if err != nil && !errors.Is(err, syscall.EEXIST) {
-			// oneliners.FILE(err)
-			// fmt.Println("errors.Is(err, syscall.EEXIST) = ", errors.Is(err, syscall.EEXIST))
-			// fmt.Printf("%T\n", err)
-			return nil, err
+		if addr.IP.To4() == nil {
+			addr.Flags = unix.IFA_F_NODAD
+		}
+		if err := netlink.AddrAdd(link, addr); err != nil && !errors.Is(err, syscall.EEXIST) {
+			return errors.Wrapf(err, "failed to add %s to %s", cidr, link.Attrs().Name)
 		}
 	}
+	return nil
+}
+
+func TapExists(name string) bool {
+	l, err := netlink.LinkByName(name)
+	return l != nil && err == nil
+}
 
-	err = netlink.LinkSetUp(tapLink)
+// TapDelete deletes a network device, if it exists.
+// sudo ip link del tap0
+func TapDelete(name string) error {
+	l, err := netlink.LinkByName(name)
 	if err != nil {
-		return nil, fmt.Errorf("failed to set tap up: %w", err)
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return err
 	}
+	return netlink.LinkDel(l)
+}
 
-	return tapLink, nil
+const hexDigit = "0123456789abcdef"
+
+func MacAddr(b []byte) string {
+	s := make([]byte, len(b)*3)
+	for i, tn := range b {
+		s[i*3], s[i*3+1], s[i*3+2] = ':', hexDigit[tn>>4], hexDigit[tn&0xf]
+	}
+	return "AA:FC" + string(s)
 }
 
-/*
-sudo ip tuntap add tap0 mode tap
-sudo ip addr add 172.16.0.1/24 dev tap0
-sudo ip link set tap0 up
-*/
-func CreateTap(name, cidr string) error {
-	if err := sh.Command("ip", "tuntap", "add", name, "mode", "tap").Run(); err != nil {
+const (
+	// tap devices in the network namespace of a VM restored from a snapshot
+	snapshotTapMMDS = "fcsnap0"
+	snapshotTap     = "fcsnap1"
+)
+
+func netnsName(id int) string {
+	return fmt.Sprintf("fc%d", id)
+}
+
+// NetNSPath returns the network namespace of a slot.
+func NetNSPath(id int) string {
+	return "/var/run/netns/" + netnsName(id)
+}
+
+func hostVeth(id int) string {
+	return fmt.Sprintf("fcv%d", id)
+}
+
+// slotTaps returns the MMDS and data tap devices of a cold booted VM in the
+// host network namespace.
+func slotTaps(id int) (string, string) {
+	return fmt.Sprintf("fcm%d", id), fmt.Sprintf("fct%d", id)
+}
+
+// onLockedThread runs fn on a new OS thread, that is discarded afterwards,
+// so that a thread moved to another network namespace is never reused.
+func onLockedThread(fn func() error) error {
+	errCh := make(chan error, 1)
+	go func() {
+		// not unlocked: the thread exits with the goroutine
+		runtime.LockOSThread()
+		errCh <- fn()
+	}()
+	return <-errCh
+}
+
+// inNetNS runs fn in the network namespace of a slot. Commands started by fn
+// run in the network namespace too.
+func inNetNS(id int, fn func() error) error {
+	return onLockedThread(func() error {
+		ns, err := netns.GetFromName(netnsName(id))
+		if err != nil {
+			return errors.Wrapf(err, "failed to open network namespace %s", netnsName(id))
+		}
+		defer ns.Close() //nolint:errcheck
+		if err := netns.Set(ns); err != nil {
+			return err
+		}
+		return fn()
+	})
+}
+
+// SetupNetNS creates the network namespace of a slot, with the tap devices
+// used when the snapshot was taken. The VM keeps the address of its slot;
+// traffic to its gateway address is forwarded to the host, so that the host
+// services are reached as for cold booted VMs.
+func SetupNetNS(id int, egressIface string) error {
+	_ = DeleteNetNS(id)
+	sn, err := slotNetwork(id)
+	if err != nil {
+		return err
+	}
+
+	ns := netnsName(id)
+	if err := onLockedThread(func() error {
+		h, err := netns.NewNamed(ns)
+		if err == nil {
+			_ = h.Close()
+		}
+		return err
+	}); err != nil {
+		return errors.Wrapf(err, "failed to create network namespace %s", ns)
+	}
+	nsh, err := netns.GetFromName(ns)
+	if err != nil {
+		return err
+	}
+	defer nsh.Close() //nolint:errcheck
+
+	veth := &netlink.Veth{
+		LinkAttrs:     netlink.LinkAttrs{Name: hostVeth(id)},
+		PeerName:      "veth0",
+		PeerNamespace: netlink.NsFd(int(nsh)),
+	}
+	if err := netlink.LinkAdd(veth); err != nil {
+		return errors.Wrapf(err, "failed to create veth %s", hostVeth(id))
+	}
+	hostCIDRs := []string{fmt.Sprintf("%s/%d", sn.HostVethIP(), VMS_NETWORK_SUBNET)}
+	nsCIDRs := []string{fmt.Sprintf("%s/%d", sn.NetNSVethIP(), VMS_NETWORK_SUBNET)}
+	if sn.CIDR6 != "" {
+		hostCIDRs = append(hostCIDRs, fmt.Sprintf("%s/%d", sn.HostVethIP6(), VMS_NETWORK6_SUBNET))
+		nsCIDRs = append(nsCIDRs, fmt.Sprintf("%s/%d", sn.NetNSVethIP6(), VMS_NETWORK6_SUBNET))
+	}
+	if err := addrUp(hostVeth(id), hostCIDRs...); err != nil {
 		return err
 	}
-	if cidr != "" {
-		if err := sh.Command("ip", "addr", "add", cidr, "dev", name).Run(); err != nil {
+
+	uid, gid := tapOwner(id)
+	err = inNetNS(id, func() error {
+		if err := addrUp("lo"); err != nil {
 			return err
 		}
+		if err := addrUp("veth0", nsCIDRs...); err != nil {
+			return err
+		}
+		gws := []string{sn.HostVethIP()}
+		if sn.CIDR6 != "" {
+			gws = append(gws, sn.HostVethIP6())
+		}
+		for _, gw := range gws {
+			if err := netlink.RouteAdd(&netlink.Route{Gw: net.ParseIP(gw)}); err != nil {
+				return errors.Wrapf(err, "failed to add default route via %s", gw)
+			}
+		}
+		if err := createTap(snapshotTapMMDS, uid, gid); err != nil {
+			return err
+		}
+		if err := createTap(snapshotTap, uid, gid, sn.gatewayCIDRs()...); err != nil {
+			return err
+		}
+		if err := enableForwarding(); err != nil {
+			return err
+		}
+		return nftSetupNetNS(sn)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to set up network namespace %s", ns)
 	}
-	if err := sh.Command("ip", "link", "set", name, "up").Run(); err != nil {
+
+	link, err := netlink.LinkByName(hostVeth(id))
+	if err != nil {
 		return err
 	}
-	return nil
+	routes := map[string]string{sn.IP() + "/32": sn.NetNSVethIP()}
+	if sn.CIDR6 != "" {
+		routes[fmt.Sprintf("%s/%d", sn.IP6(), VMS_NETWORK6_SUBNET)] = sn.NetNSVethIP6()
+	}
+	for to, via := range routes {
+		_, dst, _ := net.ParseCIDR(to)
+		if err := netlink.RouteReplace(&netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Dst:       dst,
+			Gw:        net.ParseIP(via),
+		}); err != nil {
+			return errors.Wrapf(err, "failed to add route to %s", to)
+		}
+	}
+
+	if err := setupHostNetwork(egressIface); err != nil {
+		return err
+	}
+	return SetupFirewall(id, hostVeth(id), egressIface, "")
 }
 
-func TapExists(name string) bool {
-	l, err := netlink.LinkByName(name)
-	return l != nil && err == nil
+// addrUp adds the addresses cidrs to a device and sets it up.
+func addrUp(name string, cidrs ...string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	if err := addAddrs(link, cidrs...); err != nil {
+		return err
+	}
+	return netlink.LinkSetUp(link)
 }
 
-func TapDelete_(name string) error {
-	if l, err := netlink.LinkByName(name); err == nil {
-		return netlink.LinkDel(l)
-	} else {
-		if _, ok := err.(netlink.LinkNotFoundError); !ok {
-			return err
-		}
+// DeleteNetNS deletes the network namespace of a slot, if it exists. The
+// tap devices and veth pair are deleted with it.
+func DeleteNetNS(id int) error {
+	// deleted with the namespace, once the VMM exited
+	if err := TapDelete(hostVeth(id)); err != nil {
+		return err
 	}
-	return nil
+	if _, err := os.Stat(NetNSPath(id)); os.IsNotExist(err) {
+		return nil
+	}
+	return netns.DeleteNamed(netnsName(id))
 }
 
-// sudo ip link del tap0
-func TapDelete(name string) error {
-	return sh.Command("ip", "link", "del", name).Run()
+// CleanupSlotNetwork removes the firewall, tap devices and network
+// namespace of a slot. It is safe to call for a slot without them.
+func CleanupSlotNetwork(id int) {
+	RemoveFirewall(id)
+	tap0, tap1 := slotTaps(id)
+	for _, name := range []string{tap0, tap1} {
+		if err := TapDelete(name); err != nil {
+			klog.ErrorS(err, "failed to delete tap device", "name", name)
+		}
+	}
+	if err := DeleteNetNS(id); err != nil {
+		klog.ErrorS(err, "failed to delete network namespace", "slot", id)
+	}
 }
 
-const hexDigit = "0123456789abcdef"
+var (
+	slotChainRe = regexp.MustCompile(`^fc(\d+)(-in)?$`)
+	// the devices of the slots: fcm<id> and fct<id> taps, fcv<id> veths and
+	// the fc<4*id+1> and fc<4*id+2> taps of earlier versions
+	slotLinkRe = regexp.MustCompile(`^fc([mtv])?(\d+)$`)
+)
 
-func MacAddr(b []byte) string {
-	s := make([]byte, len(b)*3)
-	for i, tn := range b {
-		s[i*3], s[i*3+1], s[i*3+2] = ':', hexDigit[tn>>4], hexDigit[tn&0xf]
+// ReconcileNetwork removes the firewall, tap devices and network namespaces
+// left behind by slots, eg, by a crash of hostctl, and the iptables and
+// nftables rules installed by earlier versions. It runs at startup, before any VM is
+// created; the slot used to bake snapshots is left alone.
+func ReconcileNetwork() error {
+	ids := map[int]bool{}
+
+	chains, err := nftChains()
+	if err != nil {
+		return err
+	}
+	for _, chain := range chains {
+		if m := slotChainRe.FindStringSubmatch(chain); m != nil {
+			id, _ := strconv.Atoi(m[1])
+			ids[id] = true
+		}
+	}
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		return errors.Wrap(err, "failed to list network devices")
+	}
+	for _, link := range links {
+		m := slotLinkRe.FindStringSubmatch(link.Attrs().Name)
+		if m == nil {
+			continue
+		}
+		n, _ := strconv.Atoi(m[2])
+		if m[1] != "" {
+			ids[n] = true
+		} else if err := netlink.LinkDel(link); err != nil {
+			klog.ErrorS(err, "failed to delete tap device", "name", link.Attrs().Name)
+		}
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(NetNSPath(0)))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, e := range entries {
+		if m := slotLinkRe.FindStringSubmatch(e.Name()); m != nil && m[1] == "" {
+			id, _ := strconv.Atoi(m[2])
+			ids[id] = true
+		}
+	}
+
+	delete(ids, bakeSlotID)
+	for id := range ids {
+		klog.InfoS("cleaning up stale network", "slot", id)
+		CleanupSlotNetwork(id)
+	}
+	removeLegacyIPTables()
+	// the rules of the slots of earlier versions, in the ip family
+	_ = sh.Command("nft", "delete", "table", "ip", "gh-ci").Run()
+	return nil
+}
+
+// removeLegacyIPTables removes the iptables rules that earlier versions
+// appended for each VM. The MASQUERADE and conntrack rules are left, as
+// other services of the host may rely on them, and so are forwardRules.
+func removeLegacyIPTables() {
+	tbl, err := iptables.New(iptables.IPFamily(iptables.ProtocolIPv4), iptables.Timeout(5))
+	if err != nil {
+		return
+	}
+	legacy := func(spec []string) bool {
+		for i := 0; i+1 < len(spec); i++ {
+			if spec[i] == "-i" && slotLinkRe.MatchString(spec[i+1]) {
+				return true
+			}
+			if spec[i] == "-j" && strings.HasPrefix(spec[i+1], "GHCI-") {
+				return true
+			}
+		}
+		return false
+	}
+	for _, chain := range []string{"FORWARD", "INPUT"} {
+		rules, err := tbl.List("filter", chain)
+		if err != nil {
+			continue
+		}
+		for _, rule := range rules {
+			fields := strings.Fields(rule)
+			if len(fields) < 2 || fields[0] != "-A" || !legacy(fields[2:]) {
+				continue
+			}
+			if err := tbl.Delete("filter", chain, fields[2:]...); err != nil {
+				klog.ErrorS(err, "failed to delete iptables rule", "rule", rule)
+			}
+		}
+	}
+	chains, err := tbl.ListChains("filter")
+	if err != nil {
+		return
+	}
+	for _, chain := range chains {
+		if strings.HasPrefix(chain, "GHCI-") {
+			_ = tbl.ClearAndDeleteChain("filter", chain)
+		}
 	}
-	return "AA:FC" + string(s)
 }
@@ -0,0 +1,148 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package firecracker
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	sh "gomodules.xyz/go-sh"
+)
+
+const (
+	// nftTable holds the rules of gh-ci, in the host and in the network
+	// namespace of each slot.
+	nftTable = "inet gh-ci"
+
+	// nftForwardMap and nftInputMap map the devices of the slots to the
+	// chains of their firewall.
+	nftForwardMap = "forward_slots"
+	nftInputMap   = "input_slots"
+)
+
+// nftBatch is a list of nft commands, applied in one transaction.
+type nftBatch struct {
+	cmds []string
+}
+
+func newNftBatch() *nftBatch {
+	b := &nftBatch{}
+	b.add("add table %s", nftTable)
+	return b
+}
+
+func (b *nftBatch) add(format string, args ...any) {
+	b.cmds = append(b.cmds, fmt.Sprintf(format, args...))
+}
+
+func (b *nftBatch) addSlotMaps() {
+	b.add("add map %s %s { type ifname : verdict ; }", nftTable, nftForwardMap)
+	b.add("add map %s %s { type ifname : verdict ; }", nftTable, nftInputMap)
+}
+
+func (b *nftBatch) String() string {
+	return strings.Join(b.cmds, "\n") + "\n"
+}
+
+// run applies the batch in the network namespace of the calling thread.
+func (b *nftBatch) run() error {
+	out, err := sh.Command("nft", "-f", "-").SetInput(b.String()).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "nft: %s", out)
+	}
+	return nil
+}
+
+// nftSetupBase installs the base chains of the gh-ci table in the host. The
+// forward and input chains run before the filter chains of iptables and jump
+// to the firewall of the slot a packet comes from; the postrouting chain
+// masquerades the packets of VMs leaving through egressIface.
+func nftSetupBase(egressIface string) error {
+	b := newNftBatch()
+	b.addSlotMaps()
+	for _, c := range []struct{ name, hook, m string }{
+		{"forward", "forward", nftForwardMap},
+		{"input", "input", nftInputMap},
+	} {
+		b.add("add chain %s %s { type filter hook %s priority -1 ; policy accept ; }", nftTable, c.name, c.hook)
+		b.add("flush chain %s %s", nftTable, c.name)
+		b.add("add rule %s %s iifname vmap @%s", nftTable, c.name, c.m)
+	}
+	b.add("add chain %s postrouting { type nat hook postrouting priority 100 ; policy accept ; }", nftTable)
+	b.add("flush chain %s postrouting", nftTable)
+	for _, pool := range []string{Current().NetworkCIDR, Current().NetworkCIDR6} {
+		if pool != "" {
+			b.add("add rule %s postrouting %s oifname %q masquerade", nftTable, nftAddrMatch("saddr", pool), egressIface)
+		}
+	}
+	if err := b.run(); err != nil {
+		return errors.Wrap(err, "failed to set up nftables")
+	}
+	return nil
+}
+
+// nftSetupNetNS installs the gh-ci table in the network namespace of a slot,
+// that the calling thread is in. Traffic to the gateway address of the VM is
+// forwarded to the host; the MMDS device is served by firecracker only.
+func nftSetupNetNS(sn SlotNetwork) error {
+	b := newNftBatch()
+	b.add("add chain %s prerouting { type nat hook prerouting priority -100 ; policy accept ; }", nftTable)
+	b.add("add chain %s postrouting { type nat hook postrouting priority 100 ; policy accept ; }", nftTable)
+	b.add("add rule %s prerouting iifname %q ip daddr %s dnat ip to %s", nftTable, snapshotTap, sn.Gateway(), sn.HostVethIP())
+	for _, hook := range []string{"input", "forward"} {
+		b.add("add chain %s %s { type filter hook %s priority 0 ; policy accept ; }", nftTable, hook, hook)
+		b.add("add rule %s %s iifname %q drop", nftTable, hook, snapshotTapMMDS)
+	}
+	return b.run()
+}
+
+// nftChains returns the chains of the gh-ci table in the host, if any.
+func nftChains() ([]string, error) {
+	out, err := sh.Command("nft", "-j", "list", "table", nftTable).Output()
+	if err != nil {
+		// the table does not exist
+		return nil, nil
+	}
+	var ruleset struct {
+		Nftables []struct {
+			Chain *struct {
+				Name string `json:"name"`
+			} `json:"chain,omitempty"`
+		} `json:"nftables"`
+	}
+	if err := json.Unmarshal(out, &ruleset); err != nil {
+		return nil, errors.Wrap(err, "failed to parse nft ruleset")
+	}
+	var chains []string
+	for _, obj := range ruleset.Nftables {
+		if obj.Chain != nil {
+			chains = append(chains, obj.Chain.Name)
+		}
+	}
+	return chains, nil
+}
+
+// nftAddrMatch returns the nft expression that matches the source or
+// destination (field saddr or daddr) address of packets in cidr.
+func nftAddrMatch(field, cidr string) string {
+	if strings.Contains(cidr, ":") {
+		return fmt.Sprintf("ip6 %s %s", field, cidr)
+	}
+	return fmt.Sprintf("ip %s %s", field, cidr)
+}
@@ -17,40 +17,220 @@ limitations under the License.
 package firecracker
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/appscodelabs/gh-ci-webhook/pkg/backend"
+	"github.com/appscodelabs/gh-ci-webhook/pkg/images"
+	"github.com/appscodelabs/gh-ci-webhook/pkg/secrets"
 
 	. "github.com/klauspost/cpuid/v2"
 	"github.com/spf13/pflag"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 type Options struct {
-	OS                    string
-	ImageDir              string
-	FirecrackerBinaryPath string
+	OS                    string `json:"os,omitempty"`
+	ImageDir              string `json:"imageDir,omitempty"`
+	FirecrackerBinaryPath string `json:"binaryPath,omitempty"`
+	// ImageSlots is the number of slots booting each OS image other than OS
+	ImageSlots map[string]int `json:"imageSlots,omitempty"`
+	// LabelImages routes runner labels to OS images, in addition to firecracker-<os>
+	LabelImages map[string]string `json:"labelImages,omitempty"`
+	// VerifyImages checks the images in ImageDir against the checksums in their manifests
+	VerifyImages bool `json:"verifyImages,omitempty"`
+	// ImageSync syncs the images used by VMs from the NATS image bucket
+	ImageSync bool `json:"imageSync,omitempty"`
+	// ImageSyncInterval is how often the image bucket is checked for new versions
+	ImageSyncInterval metav1.Duration `json:"imageSyncInterval,omitempty"`
+	// ImageSyncKeep is the number of versions of each image kept on the host
+	ImageSyncKeep int `json:"imageSyncKeep,omitempty"`
+
+	// CanaryImage is an image rolled out to replace OS, disabled if empty
+	CanaryImage string `json:"canaryImage,omitempty"`
+	// CanaryPercent is the percentage of the slots of OS booting the canary image
+	CanaryPercent int `json:"canaryPercent,omitempty"`
+	// CanaryRepos limits the VMs booting the canary image to the jobs of these repos
+	CanaryRepos []string `json:"canaryRepos,omitempty"`
+	// CanaryMinJobs is the number of canary jobs run before it is promoted or rolled back
+	CanaryMinJobs int `json:"canaryMinJobs,omitempty"`
+	// CanaryMaxFailureRateIncrease is the max increase of the job failure rate, in percentage points
+	CanaryMaxFailureRateIncrease int `json:"canaryMaxFailureRateIncrease,omitempty"`
+	// CanaryMaxBootTimeIncrease is the max increase of the mean boot time, in percent
+	CanaryMaxBootTimeIncrease int `json:"canaryMaxBootTimeIncrease,omitempty"`
 
-	NumInstances int // 8
+	NumInstances int `json:"numInstances,omitempty"` // 8
 	// Number of vCPUs (either 1 or an even number)
 	// Required: true
 	// Maximum: 32
 	// Minimum: 1
-	VcpuCount int64
+	VcpuCount int64 `json:"vcpuCount,omitempty"`
 	// Memory size of VM
 	// Required: true
-	MemSizeMib int64
+	MemSizeMib int64 `json:"memSizeMib,omitempty"`
+	// RootFSStrategy is how the rootfs of a VM is created from the OS image:
+	// auto, reflink, dm-snapshot or copy
+	RootFSStrategy string `json:"rootfsStrategy,omitempty"`
+	// PrewarmCount is the number of rootfs provisioned ahead of time
+	PrewarmCount int `json:"prewarmCount,omitempty"`
+	// PrewarmMinFreeDisk is the free disk space left when prewarming rootfs
+	PrewarmMinFreeDisk resource.QuantityValue `json:"prewarmMinFreeDisk,omitempty"`
+	// Snapshots restores VMs from the snapshot of the OS image, if one matches the VM options
+	Snapshots bool `json:"snapshots,omitempty"`
+
+	// Cgroups runs each VM in its own cgroup v2, always enabled with Jailer
+	Cgroups bool `json:"cgroups,omitempty"`
+	// CgroupParent is the cgroup, under /sys/fs/cgroup, of the cgroups of VMs not jailed
+	CgroupParent string `json:"cgroupParent,omitempty"`
+	// CPUWeight is the cpu.weight of the cgroup of a VM, 1-10000
+	CPUWeight int `json:"cpuWeight,omitempty"`
+	// MemoryMax is the memory.max of the cgroup of a VM, unlimited if zero
+	MemoryMax resource.QuantityValue `json:"memoryMax,omitempty"`
+	// IOMax is the io.max of the cgroup of a VM on the disks of the rootfs and cache volumes, eg, "wbps=52428800 wiops=1000"
+	IOMax string `json:"ioMax,omitempty"`
+
+	// NetworkCIDR is the pool the /29 networks of the slots are allocated from
+	NetworkCIDR string `json:"networkCIDR,omitempty"`
+	// NetworkCIDR6 is the pool the /63 IPv6 networks of the slots are allocated from, IPv6 is disabled if empty
+	NetworkCIDR6 string `json:"networkCIDR6,omitempty"`
+	// IPAMStatePath stores the networks allocated to the slots
+	IPAMStatePath string `json:"ipamStatePath,omitempty"`
+
+	// Firewall installs a firewall per VM, that isolates VMs from each other and from the host
+	Firewall bool `json:"firewall,omitempty"`
+	// EgressAllow are networks, as cidr[:[proto/]port[-port]], VMs can reach even if denied by EgressDeny
+	EgressAllow []string `json:"egressAllow,omitempty"`
+	// EgressDeny are networks, as cidr[:[proto/]port[-port]], VMs can not reach
+	EgressDeny []string `json:"egressDeny,omitempty"`
+	// HostAllowPorts are host ports, as [proto/]port[-port], VMs can reach in addition to the host services
+	HostAllowPorts []string `json:"hostAllowPorts,omitempty"`
+
+	// RateLimits are the disk and network rate limits of VMs, by the runner label of their job.
+	// The default class applies to VMs until they pick a job, and to jobs without a label with limits.
+	RateLimits map[string]RateLimit `json:"rateLimits,omitempty"`
+
+	// Jailer launches VMs through the firecracker jailer, in a chroot, uid, gid, cgroup and network namespace per slot
+	Jailer bool `json:"jailer,omitempty"`
+	// JailerBinaryPath is the path to the jailer binary
+	JailerBinaryPath string `json:"jailerBinaryPath,omitempty"`
+	// JailerChrootBaseDir has the chroots of the slots, it must be on the filesystem of the VM rootfs and cache volumes
+	JailerChrootBaseDir string `json:"jailerChrootBaseDir,omitempty"`
+	// JailerUID is the uid of the VM in slot 0, slot n runs as JailerUID+n
+	JailerUID int `json:"jailerUID,omitempty"`
+	// JailerGID is the gid of the VM in slot 0, slot n runs as JailerGID+n
+	JailerGID int `json:"jailerGID,omitempty"`
+
+	// CacheVolumeDir stores the per repository cache volumes attached to VMs, disabled if empty
+	CacheVolumeDir string `json:"cacheVolumeDir,omitempty"`
+	// CacheVolumeSize is the size of new cache volumes
+	CacheVolumeSize resource.QuantityValue `json:"cacheVolumeSize,omitempty"`
+	// CacheVolumesMaxSize bounds the disk space used by all cache volumes
+	CacheVolumesMaxSize resource.QuantityValue `json:"cacheVolumesMaxSize,omitempty"`
 
-	GitHubToken string
+	// DockerHubUsername is used to log in to Docker Hub inside the VMs
+	DockerHubUsername string `json:"dockerHubUsername,omitempty"`
+	// DockerHubToken is a Docker Hub access token or secret reference
+	DockerHubToken string `json:"dockerHubToken,omitempty"`
+	// SSHAuthorizedKeysFiles are authorized_keys files whose keys are authorized in the VMs
+	SSHAuthorizedKeysFiles []string `json:"sshAuthorizedKeysFiles,omitempty"`
+	// SSHGitHubUsers are GitHub users whose public ssh keys are authorized in the VMs
+	SSHGitHubUsers []string `json:"sshGitHubUsers,omitempty"`
+	// SSHKeysCacheTTL is how long the keys of GitHub users are used before they are refreshed
+	SSHKeysCacheTTL metav1.Duration `json:"sshKeysCacheTTL,omitempty"`
+	// SSHDebugUsers are GitHub users, as org/user, whose keys are authorized in the VMs running jobs of their org
+	SSHDebugUsers []string `json:"sshDebugUsers,omitempty"`
+	// DisableSSH disables ssh access to the VMs
+	DisableSSH bool `json:"disableSSH,omitempty"`
+	// UserDataDir has *.tmpl files that redefine the user-data templates
+	UserDataDir string `json:"userDataDir,omitempty"`
+	// UserDataParts are the templates rendered into the user-data of VMs, in order
+	UserDataParts []string `json:"userDataParts,omitempty"`
 
-	NatsURL      string
-	NatsUsername string
-	NatsPassword string
+	GitHubToken string `json:"-"`
 
-	Testrig bool
+	NatsURL      string `json:"-"`
+	NatsUsername string `json:"-"`
+	NatsPassword string `json:"-"`
+
+	// RegistryMirrorPort is the port of the host registry mirror, if running
+	RegistryMirrorPort string `json:"-"`
+	// CacheProxyPort is the port of the host caching proxy, if running
+	CacheProxyPort string `json:"-"`
+	// ActionsCachePort is the port of the host actions cache, if running
+	ActionsCachePort string `json:"-"`
+	// GitMirrorPort is the port of the host git mirror, if running
+	GitMirrorPort string `json:"-"`
+
+	Testrig bool `json:"testrig,omitempty"`
 }
 
+// DefaultOptions are set by flags and the config file at startup. Once VMs
+// run, the options are read through Current, as a reload replaces them.
 var DefaultOptions = NewOptions()
 
+// current are the options published by the last reload.
+var current atomic.Pointer[Options]
+
+// Current returns the options in effect. They must not be modified; an
+// operation reads them once, so that a concurrent reload does not change
+// them midway.
+func Current() *Options {
+	if opts := current.Load(); opts != nil {
+		return opts
+	}
+	return DefaultOptions
+}
+
+// UpdateOptions publishes a copy of the options in effect with the settings
+// of next that are safe to change while VMs are running, and returns it.
+// VM sizes and images are used for VMs started afterwards.
+func UpdateOptions(next *Options) *Options {
+	opts := *Current()
+	opts.OS = next.OS
+	opts.ImageSlots = next.ImageSlots
+	opts.LabelImages = next.LabelImages
+	opts.VerifyImages = next.VerifyImages
+	opts.ImageSync = next.ImageSync
+	opts.ImageSyncInterval = next.ImageSyncInterval
+	opts.ImageSyncKeep = next.ImageSyncKeep
+	opts.CanaryImage = next.CanaryImage
+	opts.CanaryPercent = next.CanaryPercent
+	opts.CanaryRepos = next.CanaryRepos
+	opts.CanaryMinJobs = next.CanaryMinJobs
+	opts.CanaryMaxFailureRateIncrease = next.CanaryMaxFailureRateIncrease
+	opts.CanaryMaxBootTimeIncrease = next.CanaryMaxBootTimeIncrease
+	opts.NumInstances = next.NumInstances
+	opts.VcpuCount = next.VcpuCount
+	opts.MemSizeMib = next.MemSizeMib
+	opts.PrewarmCount = next.PrewarmCount
+	opts.Snapshots = next.Snapshots
+	opts.CPUWeight = next.CPUWeight
+	opts.MemoryMax = next.MemoryMax
+	opts.IOMax = next.IOMax
+	opts.RateLimits = next.RateLimits
+	opts.EgressAllow = next.EgressAllow
+	opts.EgressDeny = next.EgressDeny
+	opts.HostAllowPorts = next.HostAllowPorts
+	opts.DockerHubUsername = next.DockerHubUsername
+	opts.DockerHubToken = next.DockerHubToken
+	opts.SSHAuthorizedKeysFiles = next.SSHAuthorizedKeysFiles
+	opts.SSHGitHubUsers = next.SSHGitHubUsers
+	opts.SSHKeysCacheTTL = next.SSHKeysCacheTTL
+	opts.SSHDebugUsers = next.SSHDebugUsers
+	opts.DisableSSH = next.DisableSSH
+	opts.UserDataDir = next.UserDataDir
+	opts.UserDataParts = next.UserDataParts
+	opts.Testrig = next.Testrig
+	current.Store(&opts)
+	return &opts
+}
+
 func NewOptions() *Options {
 	dir, err := os.Getwd()
 	if err != nil {
@@ -61,12 +241,38 @@ func NewOptions() *Options {
 		maxInstances = 1
 	}
 	return &Options{
-		OS:                    "focal",
-		ImageDir:              "",
-		FirecrackerBinaryPath: filepath.Join(dir, "firecracker"),
-		NumInstances:          maxInstances,
-		VcpuCount:             4,
-		MemSizeMib:            1024 * 16,
+		OS:                           "focal",
+		ImageDir:                     "",
+		FirecrackerBinaryPath:        filepath.Join(dir, "firecracker"),
+		VerifyImages:                 true,
+		ImageSyncInterval:            metav1.Duration{Duration: time.Minute},
+		ImageSyncKeep:                2,
+		CanaryPercent:                10,
+		CanaryMinJobs:                20,
+		CanaryMaxFailureRateIncrease: 5,
+		CanaryMaxBootTimeIncrease:    50,
+		NumInstances:                 maxInstances,
+		VcpuCount:                    4,
+		MemSizeMib:                   1024 * 16,
+		RootFSStrategy:               RootFSAuto,
+		PrewarmCount:                 1,
+		PrewarmMinFreeDisk:           resource.QuantityValue{Quantity: resource.MustParse("50Gi")},
+		CgroupParent:                 "gh-ci",
+		NetworkCIDR:                  DefaultNetworkCIDR,
+		IPAMStatePath:                "/var/lib/gh-ci/ipam.json",
+		Firewall:                     true,
+		EgressDeny:                   DefaultEgressDeny,
+		CPUWeight:                    100,
+		JailerBinaryPath:             filepath.Join(dir, "jailer"),
+		JailerChrootBaseDir:          filepath.Join(workflowDir(), "jailer"),
+		JailerUID:                    10000,
+		JailerGID:                    10000,
+		CacheVolumeSize:              resource.QuantityValue{Quantity: resource.MustParse("20Gi")},
+		CacheVolumesMaxSize:          resource.QuantityValue{Quantity: resource.MustParse("200Gi")},
+		DockerHubUsername:            "tigerworks",
+		DockerHubToken:               os.Getenv("DOCKERHUB_TOKEN"),
+		SSHKeysCacheTTL:              metav1.Duration{Duration: time.Hour},
+		UserDataParts:                []string{"cloud-config", "script"},
 	}
 }
 
@@ -74,14 +280,202 @@ func (opts *Options) AddFlags(fs *pflag.FlagSet) {
 	fs.StringVar(&opts.ImageDir, "firecracker.image-dir", opts.ImageDir, "PATH to directory with OS images")
 	fs.StringVar(&opts.OS, "firecracker.os", opts.OS, "OS image code")
 	fs.StringVar(&opts.FirecrackerBinaryPath, "firecracker.binary-path", opts.FirecrackerBinaryPath, "Path to firecracker binary")
+	fs.StringToIntVar(&opts.ImageSlots, "firecracker.image-slots", opts.ImageSlots, "Number of slots booting each OS image other than --firecracker.os (eg, noble=2)")
+	fs.StringToStringVar(&opts.LabelImages, "firecracker.label-images", opts.LabelImages, "Runner labels routed to OS images, in addition to firecracker-<os> (eg, firecracker-lts=noble)")
+	fs.BoolVar(&opts.VerifyImages, "firecracker.verify-images", opts.VerifyImages, "Verify the checksums of the OS images in the image dir")
+	fs.BoolVar(&opts.ImageSync, "firecracker.image-sync", opts.ImageSync, "Sync the OS images used by VMs from the NATS image bucket")
+	fs.DurationVar(&opts.ImageSyncInterval.Duration, "firecracker.image-sync-interval", opts.ImageSyncInterval.Duration, "How often the image bucket is checked for new image versions")
+	fs.IntVar(&opts.ImageSyncKeep, "firecracker.image-sync-keep", opts.ImageSyncKeep, "Number of versions of each image kept on the host")
+
+	fs.StringVar(&opts.CanaryImage, "firecracker.canary-image", opts.CanaryImage, "OS image rolled out to replace --firecracker.os (disabled if empty)")
+	fs.IntVar(&opts.CanaryPercent, "firecracker.canary-percent", opts.CanaryPercent, "Percentage of the slots of --firecracker.os booting the canary image")
+	fs.StringSliceVar(&opts.CanaryRepos, "firecracker.canary-repos", opts.CanaryRepos, "Repos whose jobs run on the canary image (any repo if empty)")
+	fs.IntVar(&opts.CanaryMinJobs, "firecracker.canary-min-jobs", opts.CanaryMinJobs, "Number of canary jobs run before the canary image is promoted or rolled back")
+	fs.IntVar(&opts.CanaryMaxFailureRateIncrease, "firecracker.canary-max-failure-rate-increase", opts.CanaryMaxFailureRateIncrease, "Max increase of the job failure rate of the canary image, in percentage points")
+	fs.IntVar(&opts.CanaryMaxBootTimeIncrease, "firecracker.canary-max-boot-time-increase", opts.CanaryMaxBootTimeIncrease, "Max increase of the mean boot time of the canary image, in percent")
 
 	fs.IntVar(&opts.NumInstances, "firecracker.num-instances", opts.NumInstances, "Number of parallel instances")
 	fs.Int64Var(&opts.VcpuCount, "firecracker.vcpu-count", opts.VcpuCount, "Vcpu count for a single instance")
 	fs.Int64Var(&opts.MemSizeMib, "firecracker.mem-size-mib", opts.MemSizeMib, "Size(MiB) of memory for a single instance")
 
+	fs.StringVar(&opts.RootFSStrategy, "firecracker.rootfs-strategy", opts.RootFSStrategy, "How VM rootfs are created: auto, reflink, dm-snapshot or copy")
+	fs.BoolVar(&opts.Snapshots, "firecracker.snapshots", opts.Snapshots, "Restore VMs from the snapshot of the OS image made by firecracker bake-snapshot (cold boot if missing)")
+	fs.IntVar(&opts.PrewarmCount, "firecracker.prewarm-count", opts.PrewarmCount, "Number of VM rootfs provisioned ahead of time")
+	fs.Var(&opts.PrewarmMinFreeDisk, "firecracker.prewarm-min-free-disk", "Free disk space left when prewarming VM rootfs")
+
+	fs.BoolVar(&opts.Cgroups, "firecracker.cgroups", opts.Cgroups, "Run each VM in its own cgroup v2 (always with --firecracker.jailer)")
+	fs.StringVar(&opts.CgroupParent, "firecracker.cgroup-parent", opts.CgroupParent, "Cgroup, under /sys/fs/cgroup, of the cgroups of VMs not jailed")
+	fs.IntVar(&opts.CPUWeight, "firecracker.cpu-weight", opts.CPUWeight, "cpu.weight of the cgroup of a VM (1-10000)")
+	fs.Var(&opts.MemoryMax, "firecracker.memory-max", "memory.max of the cgroup of a VM (unlimited if zero)")
+	fs.StringVar(&opts.IOMax, "firecracker.io-max", opts.IOMax, "io.max of the cgroup of a VM on the disks of the rootfs and cache volumes (eg, wbps=52428800 wiops=1000)")
+
+	fs.StringVar(&opts.NetworkCIDR, "firecracker.network-cidr", opts.NetworkCIDR, "Pool the /29 networks of the slots are allocated from")
+	fs.StringVar(&opts.NetworkCIDR6, "firecracker.network-cidr6", opts.NetworkCIDR6, "Pool the /63 IPv6 networks of the slots are allocated from (eg, fd00:6768:6369::/48), IPv6 is disabled if empty")
+	fs.StringVar(&opts.IPAMStatePath, "firecracker.ipam-state-path", opts.IPAMStatePath, "File that stores the networks allocated to the slots")
+
+	fs.BoolVar(&opts.Firewall, "firecracker.firewall", opts.Firewall, "Install a firewall per VM, that isolates VMs from each other and from the host")
+	fs.StringSliceVar(&opts.EgressAllow, "firecracker.egress-allow", opts.EgressAllow, "Networks, as cidr[:[proto/]port[-port]], VMs can reach even if denied by --firecracker.egress-deny")
+	fs.StringSliceVar(&opts.EgressDeny, "firecracker.egress-deny", opts.EgressDeny, "Networks, as cidr[:[proto/]port[-port]], VMs can not reach")
+	fs.StringSliceVar(&opts.HostAllowPorts, "firecracker.host-allow-ports", opts.HostAllowPorts, "Host ports, as [proto/]port[-port], VMs can reach in addition to the host services")
+
+	fs.Var(rateLimitsValue{&opts.RateLimits}, "firecracker.rate-limits", "Disk and network rate limits of VMs by runner label, or default (eg, firecracker-large=disk-bandwidth=400Mi disk-ops=4000 net-bandwidth=200Mi)")
+
+	fs.BoolVar(&opts.Jailer, "firecracker.jailer", opts.Jailer, "Launch VMs through the firecracker jailer, in a chroot, uid, gid, cgroup and network namespace per slot")
+	fs.StringVar(&opts.JailerBinaryPath, "firecracker.jailer-binary-path", opts.JailerBinaryPath, "Path to jailer binary")
+	fs.StringVar(&opts.JailerChrootBaseDir, "firecracker.jailer-chroot-base-dir", opts.JailerChrootBaseDir, "PATH to directory with the chroots of jailed VMs, on the filesystem of the VM rootfs and cache volumes")
+	fs.IntVar(&opts.JailerUID, "firecracker.jailer-uid", opts.JailerUID, "Uid of the jailed VM in slot 0, slot n runs as uid+n")
+	fs.IntVar(&opts.JailerGID, "firecracker.jailer-gid", opts.JailerGID, "Gid of the jailed VM in slot 0, slot n runs as gid+n")
+
+	fs.StringVar(&opts.CacheVolumeDir, "firecracker.cache-volume-dir", opts.CacheVolumeDir, "PATH to directory with per repository cache volumes attached to VMs (disabled if empty)")
+	fs.Var(&opts.CacheVolumeSize, "firecracker.cache-volume-size", "Size of a cache volume")
+	fs.Var(&opts.CacheVolumesMaxSize, "firecracker.cache-volumes-max-size", "Max disk space used by all cache volumes")
+
+	fs.StringVar(&opts.DockerHubUsername, "firecracker.dockerhub-username", opts.DockerHubUsername, "Docker Hub username used inside VMs")
+	secrets.StringVar(fs, &opts.DockerHubToken, "firecracker.dockerhub-token", "Docker Hub access token or secret reference (docker login is skipped if empty)")
+	fs.StringSliceVar(&opts.SSHAuthorizedKeysFiles, "firecracker.ssh-authorized-keys-files", opts.SSHAuthorizedKeysFiles, "authorized_keys files whose keys are authorized in VMs")
+	fs.StringSliceVar(&opts.SSHGitHubUsers, "firecracker.ssh-github-users", opts.SSHGitHubUsers, "GitHub users whose ssh keys are authorized in VMs")
+	fs.DurationVar(&opts.SSHKeysCacheTTL.Duration, "firecracker.ssh-keys-cache-ttl", opts.SSHKeysCacheTTL.Duration, "How long the ssh keys of GitHub users are cached before they are refreshed")
+	fs.StringSliceVar(&opts.SSHDebugUsers, "firecracker.ssh-debug-users", opts.SSHDebugUsers, "GitHub users, as org/user, whose ssh keys are authorized in VMs running jobs of their org")
+	fs.BoolVar(&opts.DisableSSH, "firecracker.disable-ssh", opts.DisableSSH, "Disable ssh access to VMs")
+	fs.StringVar(&opts.UserDataDir, "firecracker.user-data-dir", opts.UserDataDir, "Directory with *.tmpl files that redefine the user-data templates of VMs")
+	fs.StringSliceVar(&opts.UserDataParts, "firecracker.user-data-parts", opts.UserDataParts, "Templates rendered into the user-data of VMs, in order")
+
 	fs.BoolVar(&opts.Testrig, "testrig", opts.Testrig, "Prefer testrig")
 }
 
+// ResolveSecrets replaces secret references with their values.
+func (opts *Options) ResolveSecrets() error {
+	return secrets.ResolveAll(&opts.DockerHubToken)
+}
+
+func (opts *Options) Validate() error {
+	if opts.NumInstances < 1 {
+		return fmt.Errorf("firecracker num instances %d must be at least 1", opts.NumInstances)
+	}
+	if opts.VcpuCount < 1 || opts.VcpuCount > 32 || (opts.VcpuCount > 1 && opts.VcpuCount%2 != 0) {
+		return fmt.Errorf("firecracker vcpu count %d must be 1 or an even number up to 32", opts.VcpuCount)
+	}
+	if opts.MemSizeMib < 1 {
+		return fmt.Errorf("firecracker mem size %d MiB must be positive", opts.MemSizeMib)
+	}
+	if opts.OS == "" {
+		return errors.New("missing firecracker os")
+	}
+	if len(opts.UserDataParts) == 0 {
+		return errors.New("missing firecracker user-data parts")
+	}
+	if opts.SSHKeysCacheTTL.Duration <= 0 {
+		return fmt.Errorf("firecracker ssh keys cache ttl %s must be positive", opts.SSHKeysCacheTTL.Duration)
+	}
+	for _, entry := range opts.SSHDebugUsers {
+		if org, user, found := strings.Cut(entry, "/"); !found || org == "" || user == "" {
+			return fmt.Errorf("firecracker ssh debug user %q must be org/user", entry)
+		}
+	}
+	if err := images.ValidateOS(opts.OS); err != nil {
+		return err
+	}
+	for name, n := range opts.ImageSlots {
+		if err := images.ValidateOS(name); err != nil {
+			return err
+		}
+		if n < 0 {
+			return fmt.Errorf("firecracker image slots %d for %s must not be negative", n, name)
+		}
+	}
+	for label, name := range opts.LabelImages {
+		if !backend.IsImageLabel(label) {
+			return fmt.Errorf("firecracker label %q must be %s<name>, with a lowercase name of letters, digits, - and _", label, backend.RunnerImagePrefix)
+		}
+		if name != opts.OS && opts.ImageSlots[name] < 1 {
+			return fmt.Errorf("firecracker label %s selects image %s, which boots in no slot", label, name)
+		}
+	}
+	if opts.ImageSync {
+		if opts.ImageSyncInterval.Duration <= 0 {
+			return fmt.Errorf("firecracker image sync interval %s must be positive", opts.ImageSyncInterval.Duration)
+		}
+		if opts.ImageSyncKeep < 1 {
+			return fmt.Errorf("firecracker image sync keep %d must be at least 1", opts.ImageSyncKeep)
+		}
+	}
+	if opts.CanaryImage != "" {
+		if err := images.ValidateOS(opts.CanaryImage); err != nil {
+			return err
+		}
+		if opts.CanaryImage == opts.OS {
+			return fmt.Errorf("firecracker canary image %s is the current os", opts.CanaryImage)
+		}
+		if opts.CanaryPercent < 0 || opts.CanaryPercent > 100 {
+			return fmt.Errorf("firecracker canary percent %d must be between 0 and 100", opts.CanaryPercent)
+		}
+		if opts.CanaryPercent == 0 && len(opts.CanaryRepos) == 0 {
+			return errors.New("firecracker canary needs a canary percent or canary repos")
+		}
+		if opts.CanaryMinJobs < 1 {
+			return fmt.Errorf("firecracker canary min jobs %d must be at least 1", opts.CanaryMinJobs)
+		}
+	}
+	if opts.PrewarmCount < 0 {
+		return fmt.Errorf("firecracker prewarm count %d must not be negative", opts.PrewarmCount)
+	}
+	switch opts.RootFSStrategy {
+	case "", RootFSAuto, RootFSReflink, RootFSDMSnapshot, RootFSCopy:
+	default:
+		return fmt.Errorf("unknown firecracker rootfs strategy %q", opts.RootFSStrategy)
+	}
+	if opts.CPUWeight < 1 || opts.CPUWeight > 10000 {
+		return fmt.Errorf("firecracker cpu weight %d must be between 1 and 10000", opts.CPUWeight)
+	}
+	if v := opts.MemoryMax.Value(); v != 0 && v < opts.MemSizeMib<<20 {
+		return fmt.Errorf("firecracker memory max %s must be at least mem size %d MiB", opts.MemoryMax.String(), opts.MemSizeMib)
+	}
+	if err := validateIOMax(opts.IOMax); err != nil {
+		return err
+	}
+	if _, err := parsePool(opts.NetworkCIDR, slotPrefix, true, opts.NumInstances); err != nil {
+		return fmt.Errorf("firecracker %s", err)
+	}
+	if opts.NetworkCIDR6 != "" {
+		if _, err := parsePool(opts.NetworkCIDR6, slotPrefix6, false, opts.NumInstances); err != nil {
+			return fmt.Errorf("firecracker %s", err)
+		}
+	}
+	if opts.IPAMStatePath == "" {
+		return errors.New("missing firecracker ipam state path")
+	}
+	for _, s := range append(append([]string{}, opts.EgressAllow...), opts.EgressDeny...) {
+		if _, err := ParseEgressRule(s); err != nil {
+			return fmt.Errorf("firecracker %s", err)
+		}
+	}
+	for _, s := range opts.HostAllowPorts {
+		if _, _, err := parsePorts(s); err != nil {
+			return fmt.Errorf("firecracker host allow port %q: %s", s, err)
+		}
+	}
+	for class, r := range opts.RateLimits {
+		if r.DiskBandwidth.Sign() < 0 || r.DiskOps < 0 || r.NetBandwidth.Sign() < 0 {
+			return fmt.Errorf("firecracker rate limits of %s must not be negative", class)
+		}
+	}
+	if opts.Cgroups && opts.CgroupParent == "" {
+		return errors.New("missing firecracker cgroup parent")
+	}
+	if opts.Jailer {
+		if opts.JailerChrootBaseDir == "" {
+			return errors.New("missing firecracker jailer chroot base dir")
+		}
+		if opts.JailerUID < 1 || opts.JailerGID < 1 {
+			return fmt.Errorf("firecracker jailer uid %d and gid %d must be positive", opts.JailerUID, opts.JailerGID)
+		}
+	}
+	if opts.CacheVolumeDir != "" && opts.CacheVolumeSize.Cmp(resource.MustParse("64Mi")) < 0 {
+		return fmt.Errorf("firecracker cache volume size %s must be at least 64Mi", opts.CacheVolumeSize.String())
+	}
+	return nil
+}
+
 /*
 script gist: https://gist.github.com/tamalsaha/af2f99c80f84410253bd1e532bdfabc7
 
@@ -103,6 +497,10 @@ func (opts *Options) InitrdPath() string {
 	return filepath.Join(opts.ImageDir, opts.OS, opts.OS+".initrd")
 }
 
+func (opts *Options) SnapshotDir() string {
+	return filepath.Join(opts.ImageDir, opts.OS, "snapshot")
+}
+
 func WorkflowRunRootFSPath(uid string) string {
 	return filepath.Join(os.TempDir(), fmt.Sprintf("fc/%s/vm.rootfs", uid))
 }
@@ -0,0 +1,179 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package firecracker
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+	passgen "gomodules.xyz/password-generator"
+	"k8s.io/klog/v2"
+)
+
+const pooledPrefix = "pool-"
+
+// pooledRootFS is a rootfs provisioned ahead of time.
+type pooledRootFS struct {
+	base     string
+	uid      string
+	path     string
+	duration time.Duration
+}
+
+// rootfsPool keeps rootfs of the current OS image ready, so that starting a
+// VM does not wait for the rootfs to be provisioned. It is refilled in the
+// background after a rootfs is taken, as long as the free disk space stays
+// above the configured minimum.
+type rootfsPool struct {
+	prov  RootFSProvisioner
+	kick  chan struct{}
+	mu    sync.Mutex
+	ready []pooledRootFS
+}
+
+func newRootFSPool(prov RootFSProvisioner) *rootfsPool {
+	p := &rootfsPool{
+		prov: prov,
+		kick: make(chan struct{}, 1),
+	}
+	p.cleanup()
+	return p
+}
+
+// cleanup releases the pooled rootfs left behind by a previous run.
+func (p *rootfsPool) cleanup() {
+	entries, err := os.ReadDir(workflowDir())
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if e.IsDir() && strings.HasPrefix(e.Name(), pooledPrefix) {
+			releaseRootFS(p.prov, e.Name())
+		}
+	}
+}
+
+// Refill asks the pool to provision missing rootfs.
+func (p *rootfsPool) Refill() {
+	select {
+	case p.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (p *rootfsPool) run() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		p.fill()
+		select {
+		case <-p.kick:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Take returns a ready rootfs of base, if any.
+func (p *rootfsPool) Take(base string) (pooledRootFS, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i, r := range p.ready {
+		if r.base == base {
+			p.ready = append(p.ready[:i], p.ready[i+1:]...)
+			return r, true
+		}
+	}
+	return pooledRootFS{}, false
+}
+
+// Size returns the number of ready rootfs.
+func (p *rootfsPool) Size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.ready)
+}
+
+func (p *rootfsPool) fill() {
+	base := activeBase()
+	want := Current().PrewarmCount
+
+	// drop rootfs of other OS images and rootfs beyond the wanted count
+	p.mu.Lock()
+	var stale []pooledRootFS
+	ready := p.ready[:0]
+	for _, r := range p.ready {
+		if r.base == base && len(ready) < want {
+			ready = append(ready, r)
+		} else {
+			stale = append(stale, r)
+		}
+	}
+	p.ready = ready
+	have := len(ready)
+	p.mu.Unlock()
+
+	for _, r := range stale {
+		releaseRootFS(p.prov, r.uid)
+	}
+
+	for ; have < want; have++ {
+		if !p.hasDiskSpace(base) {
+			klog.InfoS("not enough free disk space to prewarm rootfs", "ready", have, "want", want)
+			return
+		}
+
+		uid := pooledPrefix + passgen.GenerateForCharset(6, passgen.AlphaNum)
+		if err := os.MkdirAll(filepath.Dir(WorkflowRunRootFSPath(uid)), 0o755); err != nil {
+			klog.ErrorS(err, "failed to prewarm rootfs")
+			return
+		}
+		start := time.Now()
+		path, err := p.prov.Provision(base, uid)
+		if err != nil {
+			klog.ErrorS(err, "failed to prewarm rootfs", "strategy", p.prov.Name())
+			releaseRootFS(p.prov, uid)
+			return
+		}
+		r := pooledRootFS{base: base, uid: uid, path: path, duration: time.Since(start)}
+		klog.InfoS("prewarmed rootfs", "path", path, "strategy", p.prov.Name(), "duration", r.duration)
+
+		p.mu.Lock()
+		p.ready = append(p.ready, r)
+		p.mu.Unlock()
+	}
+}
+
+// hasDiskSpace checks if another rootfs of base can be provisioned without
+// the free disk space dropping below the configured minimum. The rootfs is
+// assumed to take as much space as the blocks allocated by base.
+func (p *rootfsPool) hasDiskSpace(base string) bool {
+	var st unix.Stat_t
+	if err := unix.Stat(base, &st); err != nil {
+		return false
+	}
+	var fs unix.Statfs_t
+	if err := unix.Statfs(workflowDir(), &fs); err != nil {
+		return false
+	}
+	free := int64(fs.Bavail) * fs.Bsize
+	return free-st.Blocks*512 >= Current().PrewarmMinFreeDisk.Value()
+}
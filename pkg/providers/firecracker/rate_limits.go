@@ -0,0 +1,237 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package firecracker
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/appscodelabs/gh-ci-webhook/pkg/backend"
+
+	sdk "github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+	ops "github.com/firecracker-microvm/firecracker-go-sdk/client/operations"
+	"github.com/pkg/errors"
+	"gomodules.xyz/pointer"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/klog/v2"
+)
+
+// DefaultRateLimit is the rate limit class of VMs that have not picked a
+// job yet, and of jobs without a label with a rate limit class.
+const DefaultRateLimit = "default"
+
+// RateLimit limits the disk and network bandwidth of a VM. Zero values are
+// unlimited.
+type RateLimit struct {
+	// DiskBandwidth is the bytes per second of each drive
+	DiskBandwidth resource.QuantityValue `json:"diskBandwidth,omitempty"`
+	// DiskOps is the operations per second of each drive
+	DiskOps int64 `json:"diskOps,omitempty"`
+	// NetBandwidth is the bytes per second of eth1, in each direction
+	NetBandwidth resource.QuantityValue `json:"netBandwidth,omitempty"`
+}
+
+// tokenBucket returns a bucket refilled with n tokens per second, disabled
+// if n is zero.
+func tokenBucket(n int64) models.TokenBucket {
+	return models.TokenBucket{
+		Size:       pointer.Int64P(n),
+		RefillTime: pointer.Int64P(1000),
+	}
+}
+
+func (r RateLimit) diskLimiter() *models.RateLimiter {
+	return sdk.NewRateLimiter(tokenBucket(r.DiskBandwidth.Value()), tokenBucket(r.DiskOps))
+}
+
+func (r RateLimit) netLimiter() *models.RateLimiter {
+	return sdk.NewRateLimiter(tokenBucket(r.NetBandwidth.Value()), tokenBucket(0))
+}
+
+func (r RateLimit) String() string {
+	var fields []string
+	if !r.DiskBandwidth.IsZero() {
+		fields = append(fields, "disk-bandwidth="+r.DiskBandwidth.String())
+	}
+	if r.DiskOps != 0 {
+		fields = append(fields, "disk-ops="+strconv.FormatInt(r.DiskOps, 10))
+	}
+	if !r.NetBandwidth.IsZero() {
+		fields = append(fields, "net-bandwidth="+r.NetBandwidth.String())
+	}
+	return strings.Join(fields, " ")
+}
+
+// parseRateLimit parses "disk-bandwidth=100Mi disk-ops=2000 net-bandwidth=50Mi".
+func parseRateLimit(s string) (RateLimit, error) {
+	var r RateLimit
+	for _, field := range strings.Fields(s) {
+		key, value, found := strings.Cut(field, "=")
+		if !found {
+			return r, fmt.Errorf("rate limit %q must be key=value", field)
+		}
+		var err error
+		switch key {
+		case "disk-bandwidth":
+			err = r.DiskBandwidth.Set(value)
+		case "disk-ops":
+			r.DiskOps, err = strconv.ParseInt(value, 10, 64)
+		case "net-bandwidth":
+			err = r.NetBandwidth.Set(value)
+		default:
+			return r, fmt.Errorf("unknown rate limit %q, must be disk-bandwidth, disk-ops or net-bandwidth", key)
+		}
+		if err != nil {
+			return r, errors.Wrapf(err, "invalid rate limit %q", field)
+		}
+	}
+	return r, nil
+}
+
+// rateLimitsValue is the flag of the rate limit classes, eg,
+// --firecracker.rate-limits="firecracker-large=disk-bandwidth=400Mi net-bandwidth=200Mi".
+type rateLimitsValue struct {
+	limits *map[string]RateLimit
+}
+
+func (v rateLimitsValue) String() string {
+	names := make([]string, 0, len(*v.limits))
+	for name := range *v.limits {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	out := make([]string, 0, len(names))
+	for _, name := range names {
+		out = append(out, fmt.Sprintf("%s=%s", name, (*v.limits)[name]))
+	}
+	return "[" + strings.Join(out, ",") + "]"
+}
+
+func (v rateLimitsValue) Set(s string) error {
+	name, spec, found := strings.Cut(s, "=")
+	if !found || name == "" {
+		return fmt.Errorf("rate limit class %q must be <label>=<limits>", s)
+	}
+	r, err := parseRateLimit(spec)
+	if err != nil {
+		return err
+	}
+	if *v.limits == nil {
+		*v.limits = map[string]RateLimit{}
+	}
+	(*v.limits)[name] = r
+	return nil
+}
+
+func (v rateLimitsValue) Type() string {
+	return "rateLimits"
+}
+
+// rateLimitClass returns the rate limit class of a job with labels, the
+// first label with a rate limit class or the default class.
+func rateLimitClass(labels []string) string {
+	for _, label := range labels {
+		if _, found := Current().RateLimits[label]; found {
+			return label
+		}
+	}
+	return DefaultRateLimit
+}
+
+// applyRateLimitConfig sets the rate limiters of the default class on the
+// drives and eth1 of a VM about to boot.
+func applyRateLimitConfig(cfg *sdk.Config) {
+	r, found := Current().RateLimits[DefaultRateLimit]
+	if !found {
+		return
+	}
+	for i := range cfg.Drives {
+		cfg.Drives[i].RateLimiter = r.diskLimiter()
+	}
+	for i, nf := range cfg.NetworkInterfaces {
+		if nf.StaticConfiguration != nil && nf.StaticConfiguration.IPConfiguration != nil &&
+			nf.StaticConfiguration.IPConfiguration.IfName == "eth1" {
+			cfg.NetworkInterfaces[i].InRateLimiter = r.netLimiter()
+			cfg.NetworkInterfaces[i].OutRateLimiter = r.netLimiter()
+		}
+	}
+}
+
+// setRateLimit updates the rate limiters of the drives and eth1 of a
+// running VM to the limits of a class, or removes them if the class has no
+// limits.
+func setRateLimit(m *sdk.Machine, class string) error {
+	r := Current().RateLimits[class]
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, drive := range m.Cfg.Drives {
+		limiter := r.diskLimiter()
+		err := m.UpdateGuestDrive(ctx, pointer.String(drive.DriveID), "", func(params *ops.PatchGuestDriveByIDParams) {
+			params.Body.RateLimiter = limiter
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to update rate limiter of drive %s", pointer.String(drive.DriveID))
+		}
+	}
+	if err := m.UpdateGuestNetworkInterfaceRateLimit(ctx, "eth1", sdk.RateLimiterSet{
+		InRateLimiter:  r.netLimiter(),
+		OutRateLimiter: r.netLimiter(),
+	}); err != nil {
+		return errors.Wrap(err, "failed to update rate limiter of eth1")
+	}
+	return nil
+}
+
+// onJob records the repository and applies the rate limit class of the job
+// picked by the VM of a slot.
+func (p impl) onJob(job backend.JobInfo) {
+	id, ok := instanceIDForRunner(job.Runner)
+	if !ok {
+		return
+	}
+	p.ins.SetRepo(id, job.Repo)
+	p.updateRateLimit(id, rateLimitClass(job.Labels), false)
+}
+
+// updateRateLimit applies a rate limit class to the VM of a slot, unless
+// it is applied already.
+func (p impl) updateRateLimit(id int, class string, force bool) {
+	m, cur, ok := p.ins.RateLimit(id)
+	if !ok || (cur == class && !force) {
+		return
+	}
+	if err := setRateLimit(m, class); err != nil {
+		klog.ErrorS(err, "failed to set rate limit", "slot", id, "class", class)
+		return
+	}
+	p.ins.SetRateLimit(id, m, class)
+	klog.InfoS("set rate limit", "slot", id, "class", class, "limits", Current().RateLimits[class].String())
+}
+
+// reloadRateLimits applies the reloaded limits of their class to the
+// running VMs.
+func (p impl) reloadRateLimits() {
+	for id, class := range p.ins.RateLimits() {
+		p.updateRateLimit(id, class, true)
+	}
+}
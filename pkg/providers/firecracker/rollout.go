@@ -0,0 +1,282 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package firecracker
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/appscodelabs/gh-ci-webhook/pkg/notifier"
+
+	"github.com/pkg/errors"
+	"k8s.io/klog/v2"
+)
+
+// RolloutFile stores the state of the canary rollout in ImageDir, so that
+// promotions and rollbacks survive restarts.
+const RolloutFile = "rollout.json"
+
+type RolloutState string
+
+const (
+	RolloutCanary     RolloutState = "canary"
+	RolloutPromoted   RolloutState = "promoted"
+	RolloutRolledBack RolloutState = "rolled-back"
+)
+
+// ImageStats are the job results and boot times of the VMs of an image.
+type ImageStats struct {
+	Jobs         int `json:"jobs"`
+	Failed       int `json:"failed"`
+	BootFailures int `json:"bootFailures"`
+	Boots        int `json:"boots"`
+	// BootTime is the total boot time of Boots VMs
+	BootTime time.Duration `json:"bootTime"`
+}
+
+// FailureRate returns the ratio of failed jobs, counting VMs that failed
+// to boot as failed jobs.
+func (s ImageStats) FailureRate() float64 {
+	if s.Jobs+s.BootFailures == 0 {
+		return 0
+	}
+	return float64(s.Failed+s.BootFailures) / float64(s.Jobs+s.BootFailures)
+}
+
+func (s ImageStats) MeanBootTime() time.Duration {
+	if s.Boots == 0 {
+		return 0
+	}
+	return s.BootTime / time.Duration(s.Boots)
+}
+
+// Rollout is the rollout of a canary image replacing the default OS image.
+type Rollout struct {
+	// OS is the image replaced by the canary
+	OS      string       `json:"os"`
+	Image   string       `json:"image"`
+	Version string       `json:"version"`
+	State   RolloutState `json:"state"`
+	Reason  string       `json:"reason,omitempty"`
+	Updated time.Time    `json:"updated"`
+
+	Baseline ImageStats `json:"baseline"`
+	Canary   ImageStats `json:"canary"`
+}
+
+type rollout struct {
+	mu  sync.Mutex
+	cur *Rollout
+}
+
+func rolloutPath() string {
+	return filepath.Join(Current().ImageDir, RolloutFile)
+}
+
+// loadRollout reads the state of the rollout, if any.
+func loadRollout() (*rollout, error) {
+	r := &rollout{}
+	data, err := os.ReadFile(rolloutPath())
+	if os.IsNotExist(err) {
+		return r, nil
+	} else if err != nil {
+		return nil, err
+	}
+	r.cur = &Rollout{}
+	if err := json.Unmarshal(data, r.cur); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s", rolloutPath())
+	}
+	return r, nil
+}
+
+// Sync starts a rollout when the canary image or its version changes, and
+// stops it when no canary image is configured.
+func (r *rollout) Sync(catalog *imageCatalog) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if Current().CanaryImage == "" {
+		if r.cur != nil {
+			klog.InfoS("stopped rollout", "image", r.cur.Image, "version", r.cur.Version, "state", r.cur.State)
+			r.cur = nil
+			if err := os.Remove(rolloutPath()); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		return nil
+	}
+
+	img, found := catalog.Get(Current().CanaryImage)
+	if !found {
+		return errors.Errorf("canary image %s not found in %s", Current().CanaryImage, Current().ImageDir)
+	}
+	if r.cur != nil && r.cur.OS == Current().OS && r.cur.Image == img.OS && r.cur.Version == img.Version {
+		return nil
+	}
+	r.cur = &Rollout{
+		OS:      Current().OS,
+		Image:   img.OS,
+		Version: img.Version,
+		State:   RolloutCanary,
+		Updated: time.Now(),
+	}
+	klog.InfoS("started rollout", "os", r.cur.OS, "image", r.cur.Image, "version", r.cur.Version, "percent", Current().CanaryPercent, "repos", Current().CanaryRepos)
+	return r.save()
+}
+
+// Status returns the rollout, if any.
+func (r *rollout) Status() *Rollout {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cur == nil {
+		return nil
+	}
+	out := *r.cur
+	return &out
+}
+
+// Image returns the image booted in a slot reserved for role, and whether
+// it is a canary.
+func (r *rollout) Image(role string, id int) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.cur == nil || role != r.cur.OS {
+		return role, false
+	}
+	switch r.cur.State {
+	case RolloutPromoted:
+		return r.cur.Image, false
+	case RolloutCanary:
+		if isCanarySlot(id) {
+			return r.cur.Image, true
+		}
+	}
+	return role, false
+}
+
+// isCanarySlot returns true for the first CanaryPercent of the slots of
+// the default OS image. At least one slot runs the canary if CanaryRepos is
+// set.
+func isCanarySlot(id int) bool {
+	reserved := 0
+	for name, n := range Current().ImageSlots {
+		if name != Current().OS {
+			reserved += n
+		}
+	}
+	slots := Current().NumInstances - reserved
+	canaries := (slots*Current().CanaryPercent + 99) / 100
+	if canaries == 0 && len(Current().CanaryRepos) > 0 {
+		canaries = 1
+	}
+	return id >= reserved && id < reserved+canaries
+}
+
+func (r *rollout) RecordBoot(role string, canary bool, d time.Duration) {
+	r.record(role, canary, func(s *ImageStats) {
+		s.Boots++
+		s.BootTime += d
+	})
+}
+
+func (r *rollout) RecordBootFailure(role string, canary bool) {
+	r.record(role, canary, func(s *ImageStats) {
+		s.BootFailures++
+	})
+}
+
+// RecordJob records the conclusion of a job. Cancelled and skipped jobs are
+// not counted.
+func (r *rollout) RecordJob(role string, canary bool, conclusion string) {
+	switch conclusion {
+	case "success", "failure", "timed_out":
+	default:
+		return
+	}
+	r.record(role, canary, func(s *ImageStats) {
+		s.Jobs++
+		if conclusion != "success" {
+			s.Failed++
+		}
+	})
+}
+
+func (r *rollout) record(role string, canary bool, fn func(s *ImageStats)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.cur == nil || r.cur.State != RolloutCanary || role != r.cur.OS {
+		return
+	}
+	if canary {
+		fn(&r.cur.Canary)
+	} else {
+		fn(&r.cur.Baseline)
+	}
+	r.cur.Updated = time.Now()
+	r.evaluate()
+	if err := r.save(); err != nil {
+		klog.ErrorS(err, "failed to save rollout", "path", rolloutPath())
+	}
+}
+
+// evaluate promotes or rolls back the canary once it ran CanaryMinJobs
+// jobs, comparing its failure rate and mean boot time to the baseline.
+func (r *rollout) evaluate() {
+	c, b := r.cur.Canary, r.cur.Baseline
+	if c.Jobs+c.BootFailures < Current().CanaryMinJobs {
+		return
+	}
+
+	state, et := RolloutPromoted, notifier.EventImagePromoted
+	reason := fmt.Sprintf("failure rate %.1f%% (baseline %.1f%%), mean boot time %s (baseline %s)",
+		100*c.FailureRate(), 100*b.FailureRate(), c.MeanBootTime().Round(time.Second), b.MeanBootTime().Round(time.Second))
+	if 100*(c.FailureRate()-b.FailureRate()) > float64(Current().CanaryMaxFailureRateIncrease) {
+		state, et = RolloutRolledBack, notifier.EventImageRolledBack
+	} else if b.Boots > 0 && c.MeanBootTime() > b.MeanBootTime()*time.Duration(100+Current().CanaryMaxBootTimeIncrease)/100 {
+		state, et = RolloutRolledBack, notifier.EventImageRolledBack
+	}
+	r.cur.State, r.cur.Reason = state, reason
+	klog.InfoS("rollout "+string(state), "os", r.cur.OS, "image", r.cur.Image, "version", r.cur.Version, "reason", reason)
+
+	notifier.Notify(notifier.Event{
+		Type:    et,
+		Message: reason,
+		Details: map[string]string{
+			"Image":    r.cur.Image,
+			"Version":  r.cur.Version,
+			"Replaces": r.cur.OS,
+		},
+	})
+}
+
+func (r *rollout) save() error {
+	data, err := json.MarshalIndent(r.cur, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := rolloutPath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, rolloutPath())
+}
@@ -0,0 +1,347 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package firecracker
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	"gomodules.xyz/go-sh"
+	"k8s.io/klog/v2"
+)
+
+const (
+	RootFSAuto        = "auto"
+	RootFSReflink     = "reflink"
+	RootFSDMSnapshot  = "dm-snapshot"
+	RootFSCopy        = "copy"
+	rootFSSectorBytes = 512
+)
+
+// RootFSProvisioner prepares the writable rootfs of a VM from the read only
+// rootfs of an OS image.
+type RootFSProvisioner interface {
+	Name() string
+	// Provision creates the rootfs of a VM and returns the path of the file
+	// or block device attached as root drive.
+	Provision(base, uid string) (string, error)
+	// Release removes the rootfs of a VM.
+	Release(uid string) error
+}
+
+var (
+	provisioners   = map[string]RootFSProvisioner{}
+	provisionersMu sync.Mutex
+)
+
+func init() {
+	MustRegisterRootFSProvisioner(reflinkProvisioner{})
+	MustRegisterRootFSProvisioner(&dmSnapshotProvisioner{bases: map[string]string{}, snapshots: map[string]string{}})
+	MustRegisterRootFSProvisioner(copyProvisioner{})
+}
+
+func RegisterRootFSProvisioner(p RootFSProvisioner) error {
+	provisionersMu.Lock()
+	defer provisionersMu.Unlock()
+
+	if _, found := provisioners[p.Name()]; found {
+		return fmt.Errorf("rootfs provisioner %q already registered", p.Name())
+	}
+	provisioners[p.Name()] = p
+	return nil
+}
+
+func MustRegisterRootFSProvisioner(p RootFSProvisioner) {
+	if err := RegisterRootFSProvisioner(p); err != nil {
+		panic(err)
+	}
+}
+
+// NewRootFSProvisioner returns the provisioner of a strategy. The auto
+// strategy uses reflinks if the filesystem of the VM rootfs supports them
+// and full copies otherwise.
+func NewRootFSProvisioner(strategy string) (RootFSProvisioner, error) {
+	if strategy == RootFSAuto || strategy == "" {
+		strategy = RootFSCopy
+		if supportsReflink(filepath.Dir(Current().RootFSPath()), workflowDir()) {
+			strategy = RootFSReflink
+		}
+		klog.InfoS("detected rootfs provisioner", "strategy", strategy)
+	}
+
+	provisionersMu.Lock()
+	defer provisionersMu.Unlock()
+	p, found := provisioners[strategy]
+	if !found {
+		return nil, fmt.Errorf("rootfs provisioner %q not registered", strategy)
+	}
+	return p, nil
+}
+
+func workflowDir() string {
+	return filepath.Join(os.TempDir(), "fc")
+}
+
+// supportsReflink checks if files in srcDir can be cloned into dstDir.
+func supportsReflink(srcDir, dstDir string) bool {
+	if err := os.MkdirAll(dstDir, 0o755); err != nil {
+		return false
+	}
+	src, err := os.CreateTemp(srcDir, ".reflink-probe-")
+	if err != nil {
+		return false
+	}
+	defer os.Remove(src.Name()) //nolint:errcheck
+	defer src.Close()
+	if _, err := src.WriteString("probe"); err != nil {
+		return false
+	}
+
+	dst, err := os.CreateTemp(dstDir, ".reflink-probe-")
+	if err != nil {
+		return false
+	}
+	defer os.Remove(dst.Name()) //nolint:errcheck
+	defer dst.Close()
+
+	return unix.IoctlFileClone(int(dst.Fd()), int(src.Fd())) == nil
+}
+
+// reflinkProvisioner clones the base rootfs with FICLONE, which shares all
+// blocks until they are written. Requires XFS with reflink or btrfs.
+type reflinkProvisioner struct{}
+
+func (_ reflinkProvisioner) Name() string {
+	return RootFSReflink
+}
+
+func (_ reflinkProvisioner) Provision(base, uid string) (string, error) {
+	path := WorkflowRunRootFSPath(uid)
+	src, err := os.Open(base)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return "", err
+	}
+	defer dst.Close()
+
+	if err := unix.IoctlFileClone(int(dst.Fd()), int(src.Fd())); err != nil {
+		_ = os.Remove(path)
+		return "", errors.Wrap(err, "FICLONE failed")
+	}
+	return path, nil
+}
+
+func (_ reflinkProvisioner) Release(uid string) error {
+	return removeRootFS(uid)
+}
+
+// copyProvisioner makes a full sparse copy of the base rootfs.
+type copyProvisioner struct{}
+
+func (_ copyProvisioner) Name() string {
+	return RootFSCopy
+}
+
+func (_ copyProvisioner) Provision(base, uid string) (string, error) {
+	path := WorkflowRunRootFSPath(uid)
+	// cp command runs faster than CopyFile
+	if out, err := sh.Command("cp", "--sparse=always", base, path).CombinedOutput(); err != nil {
+		return "", errors.Wrapf(err, "cp failed: %s", out)
+	}
+	return path, nil
+}
+
+func (_ copyProvisioner) Release(uid string) error {
+	return removeRootFS(uid)
+}
+
+// releaseRootFS releases the rootfs provisioned for uid and removes its
+// directory.
+func releaseRootFS(p RootFSProvisioner, uid string) {
+	if err := p.Release(uid); err != nil {
+		klog.ErrorS(err, "failed to release rootfs", "uid", uid, "strategy", p.Name())
+	}
+	// pooled rootfs have their own directory, others share the directory of
+	// their slot
+	if strings.HasPrefix(uid, pooledPrefix) {
+		_ = os.RemoveAll(filepath.Dir(WorkflowRunRootFSPath(uid)))
+	}
+}
+
+func removeRootFS(uid string) error {
+	err := os.Remove(WorkflowRunRootFSPath(uid))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// dmSnapshotProvisioner attaches the base rootfs as a read only loop device
+// shared by all VMs, and gives every VM a device-mapper snapshot of it with
+// a sparse copy-on-write file as writable layer. The loop device of a base
+// is detached once its last snapshot is released, so that the loop devices
+// of replaced image versions do not pile up.
+type dmSnapshotProvisioner struct {
+	mu sync.Mutex
+	// base rootfs path -> read only loop device
+	bases map[string]string
+	// rootfs uid -> base rootfs path
+	snapshots map[string]string
+}
+
+func (_ *dmSnapshotProvisioner) Name() string {
+	return RootFSDMSnapshot
+}
+
+func dmName(uid string) string {
+	return "fc-" + uid
+}
+
+func cowPath(uid string) string {
+	return filepath.Join(filepath.Dir(WorkflowRunRootFSPath(uid)), "vm.cow")
+}
+
+func losetup(args ...string) (string, error) {
+	out, err := sh.Command("losetup", args).CombinedOutput()
+	if err != nil {
+		return "", errors.Wrapf(err, "losetup %s: %s", strings.Join(args, " "), out)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// baseDevice returns the loop device of a base rootfs for the snapshot of
+// uid. A loop device attached before a restart is reused.
+func (p *dmSnapshotProvisioner) baseDevice(base, uid string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	dev, found := p.bases[base]
+	if !found {
+		if out, err := losetup("--associated", base, "--noheadings", "--output", "NAME"); err == nil {
+			if devs := strings.Fields(out); len(devs) > 0 {
+				dev = devs[0]
+			}
+		}
+	}
+	if dev == "" {
+		var err error
+		if dev, err = losetup("--find", "--show", "--read-only", base); err != nil {
+			return "", err
+		}
+	}
+	p.bases[base] = dev
+	p.snapshots[uid] = base
+	return dev, nil
+}
+
+// releaseBaseDevice detaches the loop device of the base rootfs of the
+// snapshot of uid, unless other snapshots use it.
+func (p *dmSnapshotProvisioner) releaseBaseDevice(uid string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	base, found := p.snapshots[uid]
+	if !found {
+		return nil
+	}
+	delete(p.snapshots, uid)
+	for _, b := range p.snapshots {
+		if b == base {
+			return nil
+		}
+	}
+	dev := p.bases[base]
+	delete(p.bases, base)
+	_, err := losetup("--detach", dev)
+	return err
+}
+
+func (p *dmSnapshotProvisioner) Provision(base, uid string) (_ string, err error) {
+	fi, err := os.Stat(base)
+	if err != nil {
+		return "", err
+	}
+	baseDev, err := p.baseDevice(base, uid)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err != nil {
+			_ = p.releaseBaseDevice(uid)
+		}
+	}()
+
+	cow := cowPath(uid)
+	f, err := os.Create(cow)
+	if err != nil {
+		return "", err
+	}
+	err = f.Truncate(fi.Size())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	cowDev, err := losetup("--find", "--show", cow)
+	if err != nil {
+		return "", err
+	}
+
+	// <start> <length> snapshot <origin> <cow> <persistent> <chunksize>
+	table := fmt.Sprintf("0 %d snapshot %s %s N 16", fi.Size()/rootFSSectorBytes, baseDev, cowDev)
+	if out, err := sh.Command("dmsetup", "create", dmName(uid), "--table", table).CombinedOutput(); err != nil {
+		_, _ = losetup("--detach", cowDev)
+		return "", errors.Wrapf(err, "dmsetup create failed: %s", out)
+	}
+	return "/dev/mapper/" + dmName(uid), nil
+}
+
+func (p *dmSnapshotProvisioner) Release(uid string) error {
+	var errs []string
+	if out, err := sh.Command("dmsetup", "remove", "--retry", dmName(uid)).CombinedOutput(); err != nil &&
+		!strings.Contains(string(out), "No such device") {
+		errs = append(errs, fmt.Sprintf("dmsetup remove: %s", out))
+	}
+
+	cow := cowPath(uid)
+	if out, err := losetup("--associated", cow, "--noheadings", "--output", "NAME"); err == nil {
+		for _, dev := range strings.Fields(out) {
+			if _, err := losetup("--detach", dev); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+	}
+	if err := os.Remove(cow); err != nil && !os.IsNotExist(err) {
+		errs = append(errs, err.Error())
+	}
+	if err := p.releaseBaseDevice(uid); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
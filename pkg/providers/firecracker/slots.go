@@ -17,10 +17,15 @@ limitations under the License.
 package firecracker
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
+	"github.com/appscodelabs/gh-ci-webhook/pkg/images"
+
+	sdk "github.com/firecracker-microvm/firecracker-go-sdk"
 	passgen "gomodules.xyz/password-generator"
 )
 
@@ -29,45 +34,134 @@ type Instance struct {
 	UID    string
 	InUse  bool
 	cancel func()
+	// OS and ImageVersion identify the image of the running VM
+	OS           string `json:",omitempty"`
+	ImageVersion string `json:",omitempty"`
+	// Canary is true if the VM boots the canary image under rollout
+	Canary bool `json:",omitempty"`
+	// BootTime is the time from starting the VM until its runner was ready
+	BootTime string `json:",omitempty"`
+	// RootFS describes the rootfs of the running VM
+	RootFS *RootFS `json:",omitempty"`
+	// RateLimit is the rate limit class applied to the running VM
+	RateLimit string `json:",omitempty"`
+	// Repo is the repository of the job picked by the running VM
+	Repo string `json:",omitempty"`
+
+	machine     *sdk.Machine
+	provisioner RootFSProvisioner
+	image       *images.Image
+	// role is the image the slot is reserved for; a canary replaces it
+	role    string
+	started time.Time
+	// sshKeysServed is true once the debug keys were handed to the VM
+	sshKeysServed bool
+}
+
+// setImage records the OS image booted by the VM of a slot.
+func (i *Instance) setImage(img *images.Image, role string, canary bool) {
+	i.image = img
+	i.OS = img.OS
+	i.ImageVersion = img.Version
+	i.role = role
+	i.Canary = canary
+	i.started = time.Now()
+}
+
+// RootFS describes how the rootfs of a VM was provisioned.
+type RootFS struct {
+	Path     string
+	Strategy string
+	Duration string
+	// Prewarmed is true if the rootfs was taken from the prewarmed pool
+	Prewarmed bool `json:",omitempty"`
+
+	// uid identifies the rootfs for its provisioner
+	uid string
+}
+
+// setRootFS records the rootfs provisioned for the VM of a slot.
+func (i *Instance) setRootFS(p RootFSProvisioner, uid, path string, d time.Duration, prewarmed bool) {
+	i.provisioner = p
+	i.RootFS = &RootFS{
+		Path:      path,
+		Strategy:  p.Name(),
+		Duration:  d.String(),
+		Prewarmed: prewarmed,
+		uid:       uid,
+	}
+}
+
+// releaseRootFS releases the rootfs of the VM of a slot.
+func (i *Instance) releaseRootFS() {
+	if i.provisioner != nil {
+		releaseRootFS(i.provisioner, i.RootFS.uid)
+		i.provisioner = nil
+	}
+	i.RootFS = nil
 }
 
 func (i *Instance) Free() {
+	if i.cancel != nil {
+		i.cancel()
+		i.cancel = nil
+	}
+	i.releaseRootFS()
+
 	wfRootFSPath := WorkflowRunRootFSPath(i.UID)
 	wfDir := filepath.Dir(wfRootFSPath)
 	_ = os.RemoveAll(wfDir)
 
 	i.UID = ""
 	i.InUse = false
-	if i.cancel != nil {
-		i.cancel()
-		i.cancel = nil
-	}
+	i.machine = nil
+	i.image = nil
+	i.OS = ""
+	i.ImageVersion = ""
+	i.role = ""
+	i.Canary = false
+	i.BootTime = ""
+	i.RateLimit = ""
+	i.Repo = ""
+	i.started = time.Time{}
+	i.sshKeysServed = false
 }
 
 type Instances struct {
-	slots []Instance
-	mu    sync.Mutex
+	slots []*Instance
+	// size is the number of slots handed out by Next. Slots beyond size
+	// are kept until their VMs are stopped.
+	size int
+	mu   sync.Mutex
 }
 
 func NewInstances(numInstances int) *Instances {
-	out := Instances{
-		slots: make([]Instance, numInstances),
-	}
-	for i := 0; i < numInstances; i++ {
-		out.slots[i].ID = i
-	}
+	out := Instances{}
+	out.Resize(numInstances)
 	return &out
 }
 
+// Resize changes the number of slots. Running VMs are not affected when
+// the number of slots is reduced.
+func (i *Instances) Resize(numInstances int) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for id := len(i.slots); id < numInstances; id++ {
+		i.slots = append(i.slots, &Instance{ID: id})
+	}
+	i.size = numInstances
+}
+
 func (i *Instances) Next() (*Instance, bool) {
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
-	for id, slot := range i.slots {
+	for _, slot := range i.slots[:i.size] {
 		if !slot.InUse {
-			i.slots[id].UID = passgen.GenerateForCharset(6, passgen.AlphaNum)
-			i.slots[id].InUse = true
-			return &i.slots[id], true
+			slot.UID = passgen.GenerateForCharset(6, passgen.AlphaNum)
+			slot.InUse = true
+			return slot, true
 		}
 	}
 	return nil, false
@@ -81,3 +175,124 @@ func (i *Instances) Free(id int) {
 		i.slots[id].Free()
 	}
 }
+
+// Get returns a copy of a slot.
+func (i *Instances) Get(id int) (Instance, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if id < 0 || id >= len(i.slots) {
+		return Instance{}, false
+	}
+	return *i.slots[id], true
+}
+
+// SetBooted records the boot time of the VM of a slot, once its runner is
+// ready. It returns false if the boot time was already recorded.
+func (i *Instances) SetBooted(id int) (Instance, time.Duration, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if id < 0 || id >= len(i.slots) {
+		return Instance{}, 0, false
+	}
+	slot := i.slots[id]
+	if !slot.InUse || slot.started.IsZero() || slot.BootTime != "" {
+		return Instance{}, 0, false
+	}
+	d := time.Since(slot.started)
+	slot.BootTime = d.Round(time.Millisecond).String()
+	return *slot, d, true
+}
+
+// SetMachine records the VM running in a slot.
+func (i *Instances) SetMachine(id int, m *sdk.Machine) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.slots[id].machine = m
+}
+
+// Machine returns the VM running in a slot.
+func (i *Instances) Machine(id int) (*sdk.Machine, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if id < 0 || id >= len(i.slots) || i.slots[id].machine == nil {
+		return nil, false
+	}
+	return i.slots[id].machine, true
+}
+
+// RateLimit returns the VM running in a slot and its rate limit class.
+func (i *Instances) RateLimit(id int) (*sdk.Machine, string, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if id < 0 || id >= len(i.slots) || i.slots[id].machine == nil {
+		return nil, "", false
+	}
+	return i.slots[id].machine, i.slots[id].RateLimit, true
+}
+
+// SetRateLimit records the rate limit class applied to the VM m, if it
+// still runs in the slot.
+func (i *Instances) SetRateLimit(id int, m *sdk.Machine, class string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if id >= 0 && id < len(i.slots) && i.slots[id].machine == m {
+		i.slots[id].RateLimit = class
+	}
+}
+
+// SetRepo records the repository of the job picked by the VM of a slot.
+// Only the first job reported by a VM is recorded, so that a job can not
+// claim another repository afterwards.
+func (i *Instances) SetRepo(id int, repo string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if id >= 0 && id < len(i.slots) && i.slots[id].machine != nil && i.slots[id].Repo == "" {
+		i.slots[id].Repo = repo
+	}
+}
+
+// ServeSSHKeys returns the repository of the job picked by the VM of a
+// slot, the first time it is called for the VM. pending is true if the VM
+// has not reported its job yet.
+func (i *Instances) ServeSSHKeys(id int) (repo string, pending bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if id < 0 || id >= len(i.slots) {
+		return "", false
+	}
+	slot := i.slots[id]
+	switch {
+	case slot.machine == nil || slot.sshKeysServed:
+		return "", false
+	case slot.Repo == "":
+		return "", true
+	}
+	slot.sshKeysServed = true
+	return slot.Repo, false
+}
+
+// RateLimits returns the rate limit classes of the running VMs, by slot.
+func (i *Instances) RateLimits() map[int]string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	out := map[int]string{}
+	for _, slot := range i.slots {
+		if slot.machine != nil {
+			out[slot.ID] = slot.RateLimit
+		}
+	}
+	return out
+}
+
+func (i *Instances) Summary() string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	inUse := 0
+	for _, slot := range i.slots {
+		if slot.InUse {
+			inUse++
+		}
+	}
+	return fmt.Sprintf("%d/%d in use", inUse, i.size)
+}
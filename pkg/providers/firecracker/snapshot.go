@@ -0,0 +1,475 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package firecracker
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/appscodelabs/gh-ci-webhook/pkg/images"
+
+	sdk "github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+	"github.com/pkg/errors"
+	"gomodules.xyz/go-sh"
+	"gomodules.xyz/pointer"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// bakeSlotID is the slot of the VM baked into a snapshot. It runs in its
+	// own network namespace, with the network the IPAM reserves to bake
+	// snapshots; its id is beyond the slots of hostctl.
+	bakeSlotID = 65535
+
+	// snapshotReadyMarker is written to the serial console by the baked VM
+	// once it is ready to be snapshotted.
+	snapshotReadyMarker = "gh-ci-snapshot-ready"
+
+	// snapshotDriveDir holds the drive paths of the baked VM. The drives of a
+	// VM restored from the snapshot are bind mounted at these paths in the
+	// mount namespace of its firecracker process.
+	snapshotDriveDir = "/run/gh-ci/snapshot"
+
+	snapshotInfoFile = "snapshot.json"
+)
+
+// SnapshotInfo describes a snapshot baked from an OS image. VMs are only
+// restored from a snapshot taken from the image version they boot, with the
+// same machine configuration.
+type SnapshotInfo struct {
+	OS string `json:"os"`
+	// Image is the key of the image version the snapshot was baked from
+	Image      string    `json:"image,omitempty"`
+	Created    time.Time `json:"created"`
+	VcpuCount  int64     `json:"vcpuCount"`
+	MemSizeMib int64     `json:"memSizeMib"`
+	CacheDrive bool      `json:"cacheDrive"`
+
+	dir string
+}
+
+func (s *SnapshotInfo) RootFSPath() string {
+	return filepath.Join(s.dir, "vm.rootfs")
+}
+
+func (s *SnapshotInfo) MemPath() string {
+	return filepath.Join(s.dir, "vm.mem")
+}
+
+func (s *SnapshotInfo) StatePath() string {
+	return filepath.Join(s.dir, "vm.state")
+}
+
+// activeImageKey returns the key of the active version of the OS image.
+func activeImageKey() (string, error) {
+	dir, err := filepath.EvalSymlinks(filepath.Join(Current().ImageDir, Current().OS))
+	if err != nil {
+		return "", err
+	}
+	m, err := images.ReadManifest(dir)
+	if os.IsNotExist(err) {
+		return unversionedImage(Current().OS).Key(), nil
+	} else if err != nil {
+		return "", err
+	}
+	return (&images.Image{Manifest: *m}).Key(), nil
+}
+
+// CurrentSnapshot returns the snapshot of the OS image.
+func CurrentSnapshot() (*SnapshotInfo, error) {
+	dir, err := filepath.EvalSymlinks(Current().SnapshotDir())
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, snapshotInfoFile))
+	if err != nil {
+		return nil, err
+	}
+	var info SnapshotInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse snapshot info in %s", dir)
+	}
+	info.dir = dir
+	return &info, nil
+}
+
+// usableSnapshot returns the snapshot VMs booting the image version with
+// key imageKey are restored from, if snapshots are enabled and the snapshot
+// matches the image and the current VM options.
+func usableSnapshot(imageKey string) (*SnapshotInfo, bool) {
+	if !Current().Snapshots {
+		return nil, false
+	}
+	snap, err := CurrentSnapshot()
+	if err != nil {
+		if !os.IsNotExist(err) {
+			klog.ErrorS(err, "failed to read snapshot")
+		}
+		return nil, false
+	}
+	if snap.Image != imageKey {
+		klog.V(2).InfoS("snapshot was baked from another image version", "snapshot", snap.dir, "image", snap.Image, "want", imageKey)
+		return nil, false
+	}
+	if snap.OS != Current().OS ||
+		snap.VcpuCount != Current().VcpuCount ||
+		snap.MemSizeMib != Current().MemSizeMib ||
+		snap.CacheDrive != (Current().CacheVolumeDir != "") {
+		klog.V(2).InfoS("snapshot does not match VM options", "snapshot", snap.dir)
+		return nil, false
+	}
+	return snap, true
+}
+
+// activeBase returns the rootfs new VMs are provisioned from. Symlinks
+// are resolved, so that rootfs provisioned from a previous version of a
+// synced image are not reused.
+func activeBase() string {
+	if key, err := activeImageKey(); err == nil {
+		if snap, ok := usableSnapshot(key); ok {
+			return snap.RootFSPath()
+		}
+	}
+	if path, err := filepath.EvalSymlinks(Current().RootFSPath()); err == nil {
+		return path
+	}
+	return Current().RootFSPath()
+}
+
+func snapshotRootFSPath() string {
+	return filepath.Join(snapshotDriveDir, "rootfs")
+}
+
+func snapshotCachePath() string {
+	return filepath.Join(snapshotDriveDir, "cache")
+}
+
+// ensureSnapshotDrivePaths creates the files the drives of a VM are bind
+// mounted on.
+func ensureSnapshotDrivePaths() error {
+	if err := os.MkdirAll(snapshotDriveDir, 0o755); err != nil {
+		return err
+	}
+	for _, path := range []string{snapshotRootFSPath(), snapshotCachePath()} {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0o644)
+		if err != nil {
+			return err
+		}
+		_ = f.Close()
+	}
+	return nil
+}
+
+// snapshotConfig returns the machine config shared by the baked VM and the
+// VMs restored from its snapshot.
+func snapshotConfig(socketPath, netns string, cacheDrive bool) sdk.Config {
+	cfg := createNewConfig(&Instance{RootFS: &RootFS{Path: snapshotRootFSPath()}}, socketPath)
+	cfg.Drives = cfg.Drives[:1]
+	if cacheDrive {
+		cfg.Drives = append(cfg.Drives, models.Drive{
+			DriveID:      pointer.StringP(CacheDriveID),
+			IsRootDevice: pointer.BoolP(false),
+			IsReadOnly:   pointer.BoolP(false),
+			PathOnHost:   pointer.StringP(snapshotCachePath()),
+		})
+	}
+	cfg.NetNS = netns
+	return cfg
+}
+
+// vmmCommand returns the command that runs firecracker in a new mount
+// namespace, with rootfs and cache bind mounted at the drive paths of the
+// snapshot.
+func vmmCommand(ctx context.Context, socketPath string, stdout io.Writer, rootfs, cache string) *exec.Cmd {
+	script := `set -e
+mount --bind "$1" ` + snapshotRootFSPath() + `
+if [ -n "$2" ]; then mount --bind "$2" ` + snapshotCachePath() + `; fi
+shift 2
+exec "$@"`
+	cmd := exec.CommandContext(ctx, "unshare", "--mount", "--propagation", "slave",
+		"/bin/sh", "-c", script, "vmm", rootfs, cache,
+		Current().FirecrackerBinaryPath, "--api-sock", socketPath)
+	cmd.Stdout = stdout
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// restoreVM starts the VM of a slot from a snapshot. The VM gets its
+// identity from MMDS once it is resumed.
+func (p impl) restoreVM(ctx context.Context, ins *Instance, snap *SnapshotInfo, runnerName, socketPath string) error {
+	egressIface, err := GetEgressInterface()
+	if err != nil {
+		return err
+	}
+	if err := SetupNetNS(ins.ID, egressIface); err != nil {
+		return err
+	}
+	if err := ensureSnapshotDrivePaths(); err != nil {
+		return err
+	}
+
+	cache := ""
+	if snap.CacheDrive {
+		cache = placeholderPath(ins.UID)
+	}
+	socketFile := fmt.Sprintf("%s.restore", socketPath)
+	cfg := snapshotConfig(socketFile, NetNSPath(ins.ID), snap.CacheDrive)
+	cfg.LogPath = fmt.Sprintf("%s.log", socketPath)
+	cfg.LogLevel = "Debug"
+
+	withSnapshot := sdk.WithSnapshot(snap.MemPath(), snap.StatePath(), func(c *sdk.SnapshotConfig) {
+		c.ResumeVM = true
+	})
+	var m *sdk.Machine
+	if Current().Jailer {
+		// the drives are linked into the chroot at the paths of the snapshot
+		cleanupJail(ins.ID)
+		drives := map[string]string{snapshotRootFSPath(): ins.RootFS.Path}
+		if cache != "" {
+			drives[snapshotCachePath()] = cache
+		}
+		if err := jailConfig(&cfg, ins.ID, cfg.LogPath, drives); err != nil {
+			return err
+		}
+		if err := prepareCgroup(ins.ID); err != nil {
+			return err
+		}
+		if m, err = sdk.NewMachine(ctx, cfg, withSnapshot); err != nil {
+			return err
+		}
+		// loading the snapshot replaced the handlers adapted by the jailer
+		if err := cfg.JailerCfg.ChrootStrategy.AdaptHandlers(&m.Handlers); err != nil {
+			return err
+		}
+	} else {
+		cmd := vmmCommand(ctx, socketFile, os.Stdout, ins.RootFS.Path, cache)
+		if slotCgroups() {
+			if err := prepareCgroup(ins.ID); err != nil {
+				return err
+			}
+			done, err := runInCgroup(cmd, ins.ID)
+			if err != nil {
+				return err
+			}
+			defer done()
+		}
+		if m, err = sdk.NewMachine(ctx, cfg, sdk.WithProcessRunner(cmd), withSnapshot); err != nil {
+			return err
+		}
+	}
+
+	start := time.Now()
+	if err := m.Start(ctx); err != nil {
+		return err
+	}
+	if Current().Jailer {
+		// the jailer created the cgroup of the VM
+		if err := setCgroupLimits(slotCgroup(ins.ID)); err != nil {
+			_ = m.StopVMM()
+			return err
+		}
+	}
+	mmds, err := BuildRestoreData(Current().GitHubToken, ins)
+	if err == nil {
+		err = m.SetMetadata(ctx, mmds)
+	}
+	if err != nil {
+		_ = m.StopVMM()
+		return err
+	}
+	klog.InfoS("restored VM from snapshot", "runner", runnerName, "snapshot", snap.dir, "duration", time.Since(start))
+	p.ins.SetMachine(ins.ID, m)
+	// the snapshot has the rate limits of the baked VM
+	p.updateRateLimit(ins.ID, DefaultRateLimit, true)
+
+	go p.waitVM(ctx, m, runnerName)
+
+	return nil
+}
+
+// BakeSnapshot boots a VM from the OS image, provisions it like a cold
+// booted VM without registering a runner, and snapshots it once it is
+// ready. The snapshot replaces the previous snapshot of the OS image; VMs
+// running from the previous snapshot are not affected.
+func BakeSnapshot(ctx context.Context, timeout time.Duration) error {
+	if Current().NumInstances > bakeSlotID {
+		return fmt.Errorf("baking a snapshot uses slot %d, num instances must be at most %d", bakeSlotID, bakeSlotID)
+	}
+
+	imageKey, err := activeImageKey()
+	if err != nil {
+		return errors.Wrap(err, "failed to read the os image")
+	}
+	current := Current().SnapshotDir()
+	info := SnapshotInfo{
+		OS:         Current().OS,
+		Image:      imageKey,
+		Created:    time.Now().UTC(),
+		VcpuCount:  Current().VcpuCount,
+		MemSizeMib: Current().MemSizeMib,
+		CacheDrive: Current().CacheVolumeDir != "",
+		dir:        fmt.Sprintf("%s.%d", current, time.Now().Unix()),
+	}
+	if err := os.MkdirAll(info.dir, 0o755); err != nil {
+		return err
+	}
+	baked := false
+	defer func() {
+		if !baked {
+			_ = os.RemoveAll(info.dir)
+		}
+	}()
+
+	klog.InfoS("copying rootfs", "path", info.RootFSPath())
+	if out, err := sh.Command("cp", "--sparse=always", Current().RootFSPath(), info.RootFSPath()).CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "cp failed: %s", out)
+	}
+	cache := ""
+	if info.CacheDrive {
+		cache = filepath.Join(info.dir, "cache")
+		if err := createSparseFile(cache, placeholderSize); err != nil {
+			return err
+		}
+	}
+
+	if err := allocateBakeNetwork(); err != nil {
+		return err
+	}
+	egressIface, err := GetEgressInterface()
+	if err != nil {
+		return err
+	}
+	if err := SetupNetNS(bakeSlotID, egressIface); err != nil {
+		return err
+	}
+	defer CleanupSlotNetwork(bakeSlotID)
+	if err := ensureSnapshotDrivePaths(); err != nil {
+		return err
+	}
+
+	sn, err := slotNetwork(bakeSlotID)
+	if err != nil {
+		return err
+	}
+	ip0, ip1 := sn.Gateway(), sn.IP()
+	eth0Mac := MacAddr(net.ParseIP(ip0).To4())
+	eth1Mac := MacAddr(net.ParseIP(ip1).To4())
+	nf0, nf1 := networkInterfaces(snapshotTapMMDS, snapshotTap, eth0Mac, eth1Mac, ip0, ip1)
+
+	socketFile := filepath.Join(info.dir, "fc.sock")
+	cfg := snapshotConfig(socketFile, NetNSPath(bakeSlotID), info.CacheDrive)
+	cfg.NetworkInterfaces = sdk.NetworkInterfaces{nf0, nf1}
+	cfg.MmdsAddress = net.ParseIP(MMDS_IP)
+	cfg.MmdsVersion = sdk.MMDSv1
+	cfg.LogPath = filepath.Join(info.dir, "fc.log")
+	cfg.LogLevel = "Debug"
+
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	ready := make(chan struct{})
+	go func() {
+		scanner := bufio.NewScanner(pr)
+		for scanner.Scan() {
+			if strings.Contains(scanner.Text(), snapshotReadyMarker) {
+				close(ready)
+				break
+			}
+		}
+		_, _ = io.Copy(io.Discard, pr)
+	}()
+
+	cmd := vmmCommand(ctx, socketFile, io.MultiWriter(os.Stdout, pw), info.RootFSPath(), cache)
+	m, err := sdk.NewMachine(ctx, cfg, sdk.WithProcessRunner(cmd))
+	if err != nil {
+		return err
+	}
+	m.Handlers.FcInit = m.Handlers.FcInit.Swap(setupKernelArgsHandler(eth0Mac, eth1Mac, sn))
+	m.Handlers.Validation = m.Handlers.Validation.Swap(sdk.Handler{
+		Name: sdk.ValidateNetworkCfgHandlerName,
+		Fn: func(ctx context.Context, m *sdk.Machine) error {
+			return nil
+		},
+	})
+	mmds, err := BuildBakeData()
+	if err != nil {
+		return err
+	}
+	m.Handlers.FcInit = m.Handlers.FcInit.Swappend(sdk.NewSetMetadataHandler(mmds))
+
+	if err := m.Start(ctx); err != nil {
+		return err
+	}
+	defer m.StopVMM() //nolint:errcheck
+
+	klog.InfoS("waiting for the VM to be provisioned", "timeout", timeout)
+	select {
+	case <-ready:
+	case <-time.After(timeout):
+		return fmt.Errorf("VM was not ready within %s", timeout)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if err := m.PauseVM(ctx); err != nil {
+		return errors.Wrap(err, "failed to pause VM")
+	}
+	if err := m.CreateSnapshot(ctx, info.MemPath(), info.StatePath()); err != nil {
+		return errors.Wrap(err, "failed to create snapshot")
+	}
+	_ = m.StopVMM()
+
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(info.dir, snapshotInfoFile), data, 0o644); err != nil {
+		return err
+	}
+	for _, name := range []string{"fc.sock", "fc.log", "cache"} {
+		_ = os.Remove(filepath.Join(info.dir, name))
+	}
+
+	// switch the current snapshot atomically
+	link := current + ".link"
+	_ = os.Remove(link)
+	if err := os.Symlink(filepath.Base(info.dir), link); err != nil {
+		return err
+	}
+	if err := os.Rename(link, current); err != nil {
+		return err
+	}
+	baked = true
+	klog.InfoS("baked snapshot", "dir", info.dir)
+
+	old, _ := filepath.Glob(current + ".*")
+	for _, dir := range old {
+		if dir != info.dir {
+			_ = os.RemoveAll(dir)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package firecracker
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/appscodelabs/gh-ci-webhook/pkg/backend"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+	"k8s.io/klog/v2"
+)
+
+// SubjectSSHKeys is requested by VMs once they reported their job, as
+// gha_ssh_keys.<runner-name>. The reply has the authorized keys of the
+// debug users of the org of the repository of the job, one per line.
+const SubjectSSHKeys = backend.StreamPrefix + "ssh_keys"
+
+// sshKeys caches the public ssh keys of GitHub users, so that VMs are not
+// created with a request to github.com each.
+var sshKeys = &sshKeyCache{
+	keys:   map[string]cachedKeys{},
+	client: &http.Client{Timeout: 10 * time.Second},
+}
+
+type sshKeyCache struct {
+	mu     sync.Mutex
+	keys   map[string]cachedKeys
+	client *http.Client
+}
+
+type cachedKeys struct {
+	keys       []string
+	fetched    time.Time
+	refreshing bool
+}
+
+// Get returns the keys of GitHub users. Keys older than the cache TTL are
+// returned as is and refreshed in the background. Users whose keys can
+// not be fetched are skipped.
+func (c *sshKeyCache) Get(users ...string) []string {
+	var keys []string
+	for _, user := range users {
+		c.mu.Lock()
+		entry, found := c.keys[user]
+		stale := found && !entry.refreshing && time.Since(entry.fetched) > Current().SSHKeysCacheTTL.Duration
+		if stale {
+			entry.refreshing = true
+			c.keys[user] = entry
+		}
+		c.mu.Unlock()
+
+		switch {
+		case !found:
+			userKeys, err := c.fetch(user)
+			if err != nil {
+				klog.ErrorS(err, "failed to fetch ssh keys", "user", user)
+				continue
+			}
+			keys = append(keys, userKeys...)
+		case stale:
+			go func() {
+				if _, err := c.fetch(user); err != nil {
+					klog.ErrorS(err, "failed to refresh ssh keys, using cached keys", "user", user)
+				}
+			}()
+			fallthrough
+		default:
+			keys = append(keys, entry.keys...)
+		}
+	}
+	return keys
+}
+
+// fetch gets the keys of a GitHub user from https://github.com/<user>.keys
+// and caches them. On error, the cached keys are kept.
+func (c *sshKeyCache) fetch(user string) ([]string, error) {
+	keys, err := c.download(user)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		if entry, found := c.keys[user]; found {
+			entry.refreshing = false
+			c.keys[user] = entry
+		}
+		return nil, err
+	}
+	c.keys[user] = cachedKeys{keys: keys, fetched: time.Now()}
+	return keys, nil
+}
+
+func (c *sshKeyCache) download(user string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.client.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("https://github.com/%s.keys", user), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return parseKeys(string(data)), nil
+}
+
+// parseKeys returns the keys in an authorized_keys file, without comments
+// and blank lines.
+func parseKeys(data string) []string {
+	var keys []string
+	sc := bufio.NewScanner(strings.NewReader(data))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keys = append(keys, line)
+	}
+	return keys
+}
+
+// authorizedKeys returns the keys authorized in every VM: the keys in the
+// authorized keys files and of the GitHub users, unless ssh is disabled.
+func authorizedKeys() ([]string, error) {
+	keys := []string{}
+	if Current().DisableSSH {
+		return keys, nil
+	}
+	for _, file := range Current().SSHAuthorizedKeysFiles {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read authorized keys")
+		}
+		keys = append(keys, parseKeys(string(data))...)
+	}
+	return append(keys, sshKeys.Get(Current().SSHGitHubUsers...)...), nil
+}
+
+// debugUsers returns the GitHub users given debug access to the VMs
+// running the jobs of the org of a repository.
+func debugUsers(repo string) []string {
+	org, _, _ := strings.Cut(repo, "/")
+	var users []string
+	for _, entry := range Current().SSHDebugUsers {
+		o, user, _ := strings.Cut(entry, "/")
+		if strings.EqualFold(o, org) {
+			users = append(users, user)
+		}
+	}
+	return users
+}
+
+// warmSSHKeys fetches the keys of all configured GitHub users, so that the
+// first VMs do not wait for them.
+func warmSSHKeys() {
+	if Current().DisableSSH {
+		return
+	}
+	users := append([]string{}, Current().SSHGitHubUsers...)
+	for _, entry := range Current().SSHDebugUsers {
+		_, user, _ := strings.Cut(entry, "/")
+		users = append(users, user)
+	}
+	sshKeys.Get(users...)
+}
+
+// jobReportTimeout is how long a request for debug keys waits for the job
+// report of the VM, which is published right before.
+const jobReportTimeout = 10 * time.Second
+
+// serveSSHKeys replies to VMs of this host with the keys of the debug
+// users of the org of their job. The repository is taken from the job
+// reported for the runner, not from the request, and the keys are handed
+// out once per VM.
+func (p *impl) serveSSHKeys(nc *nats.Conn) error {
+	_, err := nc.Subscribe(SubjectSSHKeys+".>", func(msg *nats.Msg) {
+		runner := strings.TrimPrefix(msg.Subject, SubjectSSHKeys+".")
+		id, ok := instanceIDForRunner(runner)
+		if !ok {
+			return
+		}
+		if Current().DisableSSH {
+			_ = msg.Respond(nil)
+			return
+		}
+		go p.respondSSHKeys(msg, runner, id)
+	})
+	return err
+}
+
+func (p *impl) respondSSHKeys(msg *nats.Msg, runner string, id int) {
+	deadline := time.Now().Add(jobReportTimeout)
+	repo, pending := p.ins.ServeSSHKeys(id)
+	for pending && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+		repo, pending = p.ins.ServeSSHKeys(id)
+	}
+	if repo == "" {
+		klog.InfoS("refused debug access, no job reported or keys already served", "runner", runner)
+		_ = msg.Respond(nil)
+		return
+	}
+	users := debugUsers(repo)
+	keys := sshKeys.Get(users...)
+	if len(keys) > 0 {
+		klog.InfoS("granted debug access", "runner", runner, "repo", repo, "users", users)
+	}
+	_ = msg.Respond([]byte(strings.Join(keys, "\n")))
+}
@@ -26,6 +26,7 @@ type EthernetConfig struct {
 	Match       EthernetMatcher `json:"match"`
 	Addresses   []string        `json:"addresses"`
 	Gateway4    string          `json:"gateway4,omitempty"`
+	Gateway6    string          `json:"gateway6,omitempty"`
 	Nameservers *Nameservers    `json:"nameservers,omitempty"`
 	Routes      []Route         `json:"routes,omitempty"`
 }
@@ -48,21 +49,6 @@ type Metadata struct {
 	LocalHostname string `json:"local-hostname"`
 }
 
-type UserData struct {
-	Users   []User   `json:"users"`
-	Bootcmd []string `json:"bootcmd"`
-}
-
-type User struct {
-	Name              string   `json:"name"`
-	PlainTextPasswd   string   `json:"plain_text_passwd,omitempty"`
-	Gecos             string   `json:"gecos,omitempty"`
-	Shell             string   `json:"shell,omitempty"`
-	Groups            string   `json:"groups,omitempty"`
-	Sudo              string   `json:"sudo,omitempty"`
-	SSHAuthorizedKeys []string `json:"ssh_authorized_keys,omitempty"`
-}
-
 type MMDSConfig struct {
 	Latest LatestConfig `json:"latest"`
 }
@@ -70,4 +56,10 @@ type MMDSConfig struct {
 type LatestConfig struct {
 	MetaData interface{} `json:"meta-data,omitempty"`
 	UserData interface{} `json:"user-data,omitempty"`
+	Identity *Identity   `json:"identity,omitempty"`
+}
+
+// Identity is read by VMs restored from a snapshot.
+type Identity struct {
+	Script string `json:"script"`
 }
@@ -0,0 +1,583 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package firecracker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+	"unicode"
+
+	"github.com/appscodelabs/gh-ci-webhook/pkg/images"
+
+	"github.com/pkg/errors"
+	"sigs.k8s.io/yaml"
+)
+
+// JobHookPath is run by wait-for-job in the VM once it picked a job, if
+// the "job" template is not empty. The job is passed in the GH_CI_JOB_*
+// environment variables.
+const JobHookPath = "/etc/gh-ci/job-hook.sh"
+
+// The user-data of a VM is made of the templates listed in UserDataParts,
+// rendered in order. Parts starting with #cloud-config are cloud-config
+// parts, parts starting with #! are shell scripts and empty parts are
+// skipped. Files in UserDataDir can redefine any of the templates below,
+// eg, {{ define "job" }}...{{ end }}
+const defaultUserDataTemplates = `
+{{- define "cloud-config" }}#cloud-config
+users:{{ template "users" . }}
+ssh_pwauth: false
+{{- if .SSHDisabled }}
+bootcmd:
+  - systemctl mask --now ssh.socket ssh.service
+{{- end }}
+{{- with include "write-files" . }}
+write_files:
+{{ . }}
+{{- end }}
+{{ end }}
+
+{{- define "users" }}
+  - name: default
+    ssh_authorized_keys: {{ toJson .SSHKeys }}
+  - name: root
+    gecos: Root user
+    shell: /bin/bash
+    ssh_authorized_keys: {{ toJson .SSHKeys }}
+  - name: runner
+    gecos: GitHub Action Runner
+    shell: /bin/bash
+    groups: sudo
+    sudo: ALL=(ALL) NOPASSWD:ALL
+    ssh_authorized_keys: {{ toJson .SSHKeys }}
+{{- end }}
+
+{{- define "write-files" }}
+{{- with include "job" . }}
+  - path: {{ $.JobHook }}
+    permissions: "0755"
+    content: {{ toJson . }}
+{{- end }}
+{{- end }}
+
+{{- define "job" }}{{ end }}
+
+{{- define "script" }}#! /bin/bash
+set -x
+
+exec >/root/stackscript.log 2>&1
+# http://redsymbol.net/articles/bash-exit-traps/
+# https://unix.stackexchange.com/a/308209
+function finish {
+    result=$?
+    [ ! -f /root/result.txt ] && echo $result > /root/result.txt
+}
+trap finish EXIT
+{{ if .Snapshot }}
+{{ template "install" . }}
+{{ template "snapshot-agent" . }}
+{{- else }}
+{{ .HostServices }}
+
+{{ .WaitForJob }}
+
+{{ template "install" . }}
+{{ template "runner" . }}
+{{- end }}
+{{ end }}
+
+{{- define "install" }}# https://cloud.linode.com/stackscripts/669224
+apt-get update
+apt upgrade -y
+apt remove docker docker-engine docker.io containerd runc
+apt-get install -y --no-install-recommends apt-transport-https ca-certificates linux-modules-$(uname -r) curl jq gnupg-agent software-properties-common build-essential
+curl -fsSL https://download.docker.com/linux/ubuntu/gpg | sudo apt-key add -
+apt-key fingerprint 0EBFCD88
+add-apt-repository \
+   "deb [arch=amd64] https://download.docker.com/linux/ubuntu \
+   $(lsb_release -cs) \
+   stable"
+apt update
+# https://github.com/docker/setup-qemu-action/issues/67
+apt install docker-ce docker-ce-cli containerd.io docker-buildx-plugin qemu-user-static -y
+cat > /etc/docker/daemon.json <<'EOF'
+{{ .DockerDaemonConfig }}
+EOF
+systemctl restart docker
+
+chmod a+w /usr/local/bin
+
+# bypass docker hub rate limits
+{{ .DockerLogin }}
+
+for IMAGE_NAME in tonistiigi/binfmt:latest moby/buildkit:buildx-stable-1; do
+	until docker pull "$IMAGE_NAME"; do
+	  echo "Docker pull failed, retrying..."
+	  sleep 5 # Wait for 5 seconds before retrying
+	done
+done
+
+# install github cli
+# https://github.com/cli/cli/blob/trunk/docs/install_linux.md
+(type -p wget >/dev/null || (sudo apt update && sudo apt-get install wget -y)) \
+	&& sudo mkdir -p -m 755 /etc/apt/keyrings \
+        && out=$(mktemp) && wget -nv -O$out https://cli.github.com/packages/githubcli-archive-keyring.gpg \
+        && cat $out | sudo tee /etc/apt/keyrings/githubcli-archive-keyring.gpg > /dev/null \
+	&& sudo chmod go+r /etc/apt/keyrings/githubcli-archive-keyring.gpg \
+	&& echo "deb [arch=$(dpkg --print-architecture) signed-by=/etc/apt/keyrings/githubcli-archive-keyring.gpg] https://cli.github.com/packages stable main" | sudo tee /etc/apt/sources.list.d/github-cli.list > /dev/null \
+	&& sudo apt update \
+	&& sudo apt install gh -y
+
+# https://docs.docker.com/engine/install/linux-postinstall/
+sudo usermod -aG docker runner
+{{ end }}
+
+{{- define "runner" }}hostnamectl set-hostname {{ .Runner.Name }}
+echo 127.0.1.1 $HOSTNAME.localdomain {{ .Runner.Name }} >> /etc/hosts
+
+# Prepare GitHun Runner user
+export USER=runner
+newgrp docker
+rsync --archive --chown=$USER:$USER ~/.docker /home/$USER
+
+# Install GitHub Runner
+su $USER
+cd /home/$USER
+
+export TESTRIG={{ .Runner.Testrig }}
+
+export NATS_URL={{ .Runner.NatsURL }}
+export NATS_USERNAME={{ .Runner.NatsUsername }}
+export NATS_PASSWORD={{ .Runner.NatsPassword }}
+
+export RUNNER_CFG_PAT={{ .Runner.Token }}
+export RUNNER_NAME={{ .Runner.Name }}
+
+# https://github.com/actions/runner/blob/main/docs/automate.md
+# ephemeral runner: https://docs.github.com/en/actions/hosting-your-own-runners/autoscaling-with-self-hosted-runners#using-ephemeral-runners-for-autoscaling
+curl -fsSL https://gist.githubusercontent.com/tamalsaha/af2f99c80f84410253bd1e532bdfabc7/raw/27fb0c094182f09b121750bb61ca32ba0ddf7658/start-runner.sh | bash -s -- -n ${RUNNER_NAME} -f
+{{ end }}
+
+{{- define "snapshot-agent" }}sync
+echo {{ .SnapshotReadyMarker }} > /dev/ttyS0
+until curl -sf http://{{ .MMDSAddress }}/latest/identity/script -o /root/restore.sh; do
+	sleep 0.1
+done
+exec /bin/bash /root/restore.sh
+{{ end }}
+
+{{- define "restore" }}#! /bin/bash
+set -x
+exec >/root/restore.log 2>&1
+
+# the clock stopped while the snapshot was stored
+date -s @{{ .Time.Unix }}
+
+ip -4 addr flush dev eth1
+ip -6 addr flush dev eth1 scope global
+ip addr add {{ .Slot.IP }}/{{ .Slot.Subnet }} dev eth1
+ip route replace default via {{ .Slot.Gateway }} dev eth1
+{{- if .Slot.IP6 }}
+ip -6 addr add {{ .Slot.IP6 }}/{{ .Slot.Subnet6 }} dev eth1 nodad
+ip -6 route replace default via {{ .Slot.Gateway6 }} dev eth1
+{{- end }}
+
+{{ .HostServices }}
+
+{{ .WaitForJob }}
+
+cat > /etc/docker/daemon.json <<'EOF'
+{{ .DockerDaemonConfig }}
+EOF
+systemctl restart docker
+
+# bypass docker hub rate limits
+{{ .DockerLogin }}
+
+{{ template "runner" . }}
+{{- end }}`
+
+// UserDataVars are the variables of the user-data templates.
+type UserDataVars struct {
+	// Snapshot is true for the VM baked into a snapshot, which registers
+	// no runner
+	Snapshot bool
+	Time     time.Time
+	Host     HostVars
+	Slot     SlotVars
+	Image    ImageVars
+	Runner   RunnerVars
+	// Job refers to the job picked by the VM. Jobs are picked after boot,
+	// so these are references to the environment of the job hook.
+	Job     JobVars
+	SSHKeys []string
+
+	DockerDaemonConfig string
+	DockerLogin        string
+	// HostServices points the VM to the services on the host
+	HostServices string
+	// WaitForJob makes wait-for-job pick the jobs routed to the VM
+	WaitForJob string
+
+	// SSHDisabled is true if ssh access to VMs is disabled
+	SSHDisabled         bool
+	JobHook             string
+	MMDSAddress         string
+	SnapshotReadyMarker string
+}
+
+type HostVars struct {
+	Name string
+}
+
+type SlotVars struct {
+	ID      int
+	IP      string
+	Gateway string
+	Subnet  int
+	// IP6, Gateway6 and Subnet6 are empty without IPv6
+	IP6      string
+	Gateway6 string
+	Subnet6  int
+}
+
+type ImageVars struct {
+	OS      string
+	Version string
+	Canary  bool
+}
+
+type RunnerVars struct {
+	Name  string
+	Token string
+	// Labels are the runner labels whose jobs the VM picks
+	Labels []string
+	// Repos restricts the jobs picked by a canary VM
+	Repos        []string
+	Testrig      bool
+	NatsURL      string
+	NatsUsername string
+	NatsPassword string
+}
+
+type JobVars struct {
+	ID string
+	// Scope is the repository the runner registers with, as owner/repo
+	Scope    string
+	Workflow string
+	Name     string
+	Label    string
+}
+
+var jobVars = JobVars{
+	ID:       "${GH_CI_JOB_ID}",
+	Scope:    "${GH_CI_JOB_SCOPE}",
+	Workflow: "${GH_CI_JOB_WORKFLOW}",
+	Name:     "${GH_CI_JOB_NAME}",
+	Label:    "${GH_CI_JOB_LABEL}",
+}
+
+// UserDataPart is a part of the MIME multipart user-data of a VM.
+type UserDataPart struct {
+	Name        string
+	ContentType string
+	Content     string
+}
+
+var userData struct {
+	mu  sync.Mutex
+	tpl *template.Template
+}
+
+// LoadUserData parses the user-data templates and validates them by
+// rendering the user-data of a sample runner VM and snapshot VM. The
+// templates in use are only replaced if they are valid.
+func LoadUserData() error {
+	tpl, err := parseUserDataTemplates(Current().UserDataDir)
+	if err != nil {
+		return err
+	}
+	hostname, _ := os.Hostname()
+	samples := map[string]UserDataVars{}
+	for _, kind := range []string{"runner", "snapshot"} {
+		vars, err := sampleUserDataVars(hostname, kind == "snapshot")
+		if err != nil {
+			return err
+		}
+		samples[kind] = vars
+	}
+	for kind, vars := range samples {
+		if _, err := renderUserDataParts(tpl, Current().UserDataParts, vars); err != nil {
+			return errors.Wrapf(err, "invalid user-data of %s VMs", kind)
+		}
+	}
+	if _, err := renderTemplate(tpl, "restore", samples["runner"]); err != nil {
+		return errors.Wrap(err, "invalid restore script")
+	}
+
+	userData.mu.Lock()
+	userData.tpl = tpl
+	userData.mu.Unlock()
+	return nil
+}
+
+func userDataTemplates() (*template.Template, error) {
+	userData.mu.Lock()
+	tpl := userData.tpl
+	userData.mu.Unlock()
+	if tpl != nil {
+		return tpl, nil
+	}
+	if err := LoadUserData(); err != nil {
+		return nil, err
+	}
+	return userDataTemplates()
+}
+
+func parseUserDataTemplates(dir string) (*template.Template, error) {
+	tpl := template.New("user-data").Option("missingkey=error")
+	tpl.Funcs(template.FuncMap{
+		"toJson": func(v any) (string, error) {
+			var buf bytes.Buffer
+			enc := json.NewEncoder(&buf)
+			enc.SetEscapeHTML(false)
+			err := enc.Encode(v)
+			return strings.TrimSuffix(buf.String(), "\n"), err
+		},
+		"join": func(sep string, elems []string) string {
+			return strings.Join(elems, sep)
+		},
+		"indent": func(n int, s string) string {
+			pad := strings.Repeat(" ", n)
+			return pad + strings.ReplaceAll(s, "\n", "\n"+pad)
+		},
+		// include renders a template without its surrounding blank lines,
+		// so that optional templates can be tested with "with"
+		"include": func(name string, data any) (string, error) {
+			s, err := renderTemplate(tpl, name, data)
+			return strings.TrimLeft(strings.TrimRightFunc(s, unicode.IsSpace), "\n"), err
+		},
+	})
+	if _, err := tpl.Parse(defaultUserDataTemplates); err != nil {
+		return nil, err
+	}
+	if dir == "" {
+		return tpl, nil
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.tmpl"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return tpl, nil
+	}
+	if _, err := tpl.ParseFiles(files...); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse user-data templates in %s", dir)
+	}
+	return tpl, nil
+}
+
+func renderTemplate(tpl *template.Template, name string, data any) (string, error) {
+	if tpl.Lookup(name) == nil {
+		return "", fmt.Errorf("template %q not found", name)
+	}
+	var buf bytes.Buffer
+	if err := tpl.ExecuteTemplate(&buf, name, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func renderUserDataParts(tpl *template.Template, names []string, vars UserDataVars) ([]UserDataPart, error) {
+	parts := make([]UserDataPart, 0, len(names))
+	for _, name := range names {
+		content, err := renderTemplate(tpl, name, vars)
+		if err != nil {
+			return nil, err
+		}
+		content = strings.TrimLeftFunc(content, unicode.IsSpace)
+		if content == "" {
+			continue
+		}
+		part := UserDataPart{Name: name, Content: content}
+		switch {
+		case strings.HasPrefix(content, "#cloud-config"):
+			part.ContentType = `text/cloud-config; charset="us-ascii"`
+			var cfg map[string]any
+			if err := yaml.Unmarshal([]byte(content), &cfg); err != nil {
+				return nil, errors.Wrapf(err, "part %s is not valid yaml", name)
+			}
+		case strings.HasPrefix(content, "#!"):
+			part.ContentType = `text/x-shellscript; charset="us-ascii"`
+		default:
+			return nil, fmt.Errorf("part %s must start with #cloud-config or #!", name)
+		}
+		parts = append(parts, part)
+	}
+	return parts, nil
+}
+
+// sampleUserDataVars returns the variables of a sample VM, that has the first
+// network of the pools whether or not it is allocated, so that the templates
+// are validated without the networks of the slots.
+func sampleUserDataVars(hostname string, snapshot bool) (UserDataVars, error) {
+	sn, err := sampleNetwork()
+	if err != nil {
+		return UserDataVars{}, err
+	}
+	vars, err := slotUserDataVars(hostname, 0, sn, snapshot)
+	if err != nil {
+		return vars, err
+	}
+	if !snapshot {
+		osName := Current().OS
+		vars.setInstance(&Instance{ID: 0, OS: osName, role: osName})
+	}
+	vars.SSHKeys = []string{"ssh-ed25519 AAAA sample"}
+	return vars, nil
+}
+
+// newSlotVars returns the addresses of the VM of a slot with network sn.
+func newSlotVars(instanceID int, sn SlotNetwork) SlotVars {
+	vars := SlotVars{
+		ID:      instanceID,
+		IP:      sn.IP(),
+		Gateway: sn.Gateway(),
+		Subnet:  VMS_NETWORK_SUBNET,
+	}
+	if sn.CIDR6 != "" {
+		vars.IP6 = sn.IP6()
+		vars.Gateway6 = sn.Gateway6()
+		vars.Subnet6 = VMS_NETWORK6_SUBNET
+	}
+	return vars
+}
+
+// newUserDataVars returns the variables of the VM of a slot that are known
+// without its image.
+func newUserDataVars(hostname string, instanceID int, snapshot bool) (UserDataVars, error) {
+	sn, err := slotNetwork(instanceID)
+	if err != nil {
+		return UserDataVars{}, err
+	}
+	return slotUserDataVars(hostname, instanceID, sn, snapshot)
+}
+
+// slotUserDataVars returns the variables of the VM of a slot with network
+// sn that are known without its image.
+func slotUserDataVars(hostname string, instanceID int, sn SlotNetwork, snapshot bool) (UserDataVars, error) {
+	opts := Current()
+	daemonCfg, err := dockerDaemonConfig(sn.Gateway())
+	if err != nil {
+		return UserDataVars{}, err
+	}
+	vars := UserDataVars{
+		Snapshot: snapshot,
+		Time:     time.Now(),
+		Host:     HostVars{Name: hostname},
+		Slot:     newSlotVars(instanceID, sn),
+		Runner: RunnerVars{
+			Name:         fmt.Sprintf("%s-%d", hostname, instanceID),
+			Testrig:      opts.Testrig,
+			NatsURL:      opts.NatsURL,
+			NatsUsername: opts.NatsUsername,
+			NatsPassword: opts.NatsPassword,
+		},
+		Job:                 jobVars,
+		SSHDisabled:         opts.DisableSSH,
+		DockerDaemonConfig:  daemonCfg,
+		HostServices:        hostServicesConfig(sn.Gateway()),
+		DockerLogin:         dockerLogin(),
+		JobHook:             JobHookPath,
+		MMDSAddress:         MMDS_IP,
+		SnapshotReadyMarker: snapshotReadyMarker,
+	}
+	if snapshot {
+		vars.Runner.Name = "snapshot-" + opts.OS
+		vars.HostServices = ""
+		vars.DockerLogin = "# docker login is skipped while baking a snapshot"
+	}
+	return vars, nil
+}
+
+// setInstance sets the variables of the image of the VM of a slot and the
+// jobs it picks.
+func (vars *UserDataVars) setInstance(ins *Instance) {
+	vars.Image = ImageVars{
+		OS:      ins.OS,
+		Version: ins.ImageVersion,
+		Canary:  ins.Canary,
+	}
+	vars.Runner.Labels = imageLabels(ins.role)
+	if ins.Canary {
+		vars.Runner.Repos = Current().CanaryRepos
+	}
+	vars.WaitForJob = waitForJobConfig(ins)
+}
+
+// DryRunUserData validates the user-data templates and returns the
+// user-data of the VM of a slot booting an image, or of the VM baked into
+// a snapshot. With restore, it returns the script run by the VM of the slot
+// when it is restored from a snapshot instead. The networks of the slots
+// are read from IPAMStatePath, but not stored.
+func DryRunUserData(ghToken string, instanceID int, image string, canary, snapshot, restore bool) ([]byte, error) {
+	if err := LoadUserData(); err != nil {
+		return nil, err
+	}
+	if snapshot {
+		if err := allocateBakeNetwork(); err != nil {
+			return nil, err
+		}
+		mmds, err := BuildBakeData()
+		if err != nil {
+			return nil, err
+		}
+		return []byte(mmds.Latest.UserData.(string)), nil
+	}
+
+	if err := loadIPAM(max(Current().NumInstances, instanceID+1), true); err != nil {
+		return nil, err
+	}
+	ins := &Instance{ID: instanceID, OS: image, Canary: canary, role: image}
+	if canary {
+		ins.role = Current().OS
+	}
+	if catalog, err := images.LoadCatalog(Current().ImageDir); err == nil {
+		if img, ok := catalog[image]; ok {
+			ins.ImageVersion = img.Version
+		}
+	}
+	if restore {
+		mmds, err := BuildRestoreData(ghToken, ins)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(mmds.Latest.Identity.Script), nil
+	}
+	mmds, err := BuildData(ghToken, ins)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(mmds.Latest.UserData.(string)), nil
+}
@@ -0,0 +1,280 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package firecracker
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/appscodelabs/gh-ci-webhook/pkg/backend"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+	"gomodules.xyz/go-sh"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// CacheDriveID is the drive of a VM that holds its cache volume
+	CacheDriveID = "cache"
+	// SubjectVolume is requested by VMs to attach the cache volume of a
+	// repository, as gha_volume.<runner-name> with the cache key as data.
+	SubjectVolume = backend.StreamPrefix + "volume"
+
+	placeholderSize = 1 << 20
+)
+
+// volumePool keeps an ext4 cache volume per cache key. A volume is attached
+// to one VM at a time; other VMs of the same key get a clone that is
+// discarded when they stop. Unused volumes are removed, least recently used
+// first, when the pool grows over its max size.
+type volumePool struct {
+	mu       sync.Mutex
+	attached map[int]string  // slot id -> attached volume path
+	locked   map[string]bool // base volume path -> in use
+}
+
+func newVolumePool() *volumePool {
+	return &volumePool{
+		attached: map[int]string{},
+		locked:   map[string]bool{},
+	}
+}
+
+func volumeName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// placeholderPath returns the empty drive attached as cache drive when a VM
+// is created, before its job is known.
+func placeholderPath(uid string) string {
+	return filepath.Join(filepath.Dir(WorkflowRunRootFSPath(uid)), "cache.placeholder")
+}
+
+func createPlaceholder(uid string) error {
+	return createSparseFile(placeholderPath(uid), placeholderSize)
+}
+
+func createSparseFile(path string, size int64) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(size); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// acquire returns the volume of key for a slot, creating it if needed.
+func (vp *volumePool) acquire(id int, key string) (string, error) {
+	dir := Current().CacheVolumeDir
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	base := filepath.Join(dir, volumeName(key)+".ext4")
+
+	vp.mu.Lock()
+	defer vp.mu.Unlock()
+
+	if _, found := vp.attached[id]; found {
+		return "", fmt.Errorf("slot %d already has a cache volume", id)
+	}
+
+	if _, err := os.Stat(base); os.IsNotExist(err) {
+		if err := createVolume(base, Current().CacheVolumeSize.Value()); err != nil {
+			return "", err
+		}
+		klog.InfoS("created cache volume", "key", key, "path", base)
+	}
+	now := time.Now()
+	_ = os.Chtimes(base, now, now)
+
+	path := base
+	if vp.locked[base] {
+		path = filepath.Join(dir, fmt.Sprintf("%s-%d.clone", volumeName(key), id))
+		if out, err := sh.Command("cp", "--reflink=auto", "--sparse=always", base, path).CombinedOutput(); err != nil {
+			return "", errors.Wrapf(err, "failed to clone cache volume: %s", out)
+		}
+	} else {
+		vp.locked[base] = true
+	}
+	vp.attached[id] = path
+	return path, nil
+}
+
+func createVolume(path string, size int64) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(size)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if out, err := sh.Command("mkfs.ext4", "-q", "-F", "-L", "gh-ci-cache", tmp).CombinedOutput(); err != nil {
+		_ = os.Remove(tmp)
+		return errors.Wrapf(err, "mkfs.ext4 failed: %s", out)
+	}
+	return os.Rename(tmp, path)
+}
+
+// release unlocks or discards the volume attached to a slot and trims the
+// pool.
+func (vp *volumePool) release(id int) {
+	vp.mu.Lock()
+	defer vp.mu.Unlock()
+
+	path, found := vp.attached[id]
+	if !found {
+		return
+	}
+	delete(vp.attached, id)
+	if strings.HasSuffix(path, ".clone") {
+		if err := os.Remove(path); err != nil {
+			klog.ErrorS(err, "failed to remove cache volume clone", "path", path)
+		}
+	} else {
+		delete(vp.locked, path)
+	}
+	vp.trim()
+}
+
+// trim removes unused volumes, least recently used first, while the
+// allocated size of the pool is over the max size. It must be called with
+// vp.mu held.
+func (vp *volumePool) trim() {
+	files, err := filepath.Glob(filepath.Join(Current().CacheVolumeDir, "*.ext4"))
+	if err != nil {
+		klog.ErrorS(err, "failed to list cache volumes")
+		return
+	}
+
+	type volume struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var (
+		volumes []volume
+		total   int64
+	)
+	for _, path := range files {
+		fi, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		// sparse files only use the allocated blocks
+		size := fi.Size()
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			size = st.Blocks * 512
+		}
+		total += size
+		volumes = append(volumes, volume{path: path, size: size, modTime: fi.ModTime()})
+	}
+	sort.Slice(volumes, func(i, j int) bool {
+		return volumes[i].modTime.Before(volumes[j].modTime)
+	})
+
+	maxSize := Current().CacheVolumesMaxSize.Value()
+	for _, v := range volumes {
+		if total <= maxSize {
+			break
+		}
+		if vp.locked[v.path] {
+			continue
+		}
+		if err := os.Remove(v.path); err != nil {
+			klog.ErrorS(err, "failed to remove cache volume", "path", v.path)
+			continue
+		}
+		total -= v.size
+		klog.InfoS("removed cache volume", "path", v.path, "size", v.size)
+	}
+}
+
+// serveVolumes attaches cache volumes to VMs of this host on request.
+func (p *impl) serveVolumes(nc *nats.Conn) error {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	_, err = nc.Subscribe(SubjectVolume+".>", func(msg *nats.Msg) {
+		runner := strings.TrimPrefix(msg.Subject, SubjectVolume+".")
+		idStr, found := strings.CutPrefix(runner, hostname+"-")
+		if !found {
+			return
+		}
+		id, err := strconv.Atoi(idStr)
+		if err == nil {
+			err = p.attachVolume(id, string(msg.Data))
+		}
+		if err != nil {
+			klog.ErrorS(err, "failed to attach cache volume", "runner", runner)
+			_ = msg.Respond([]byte("error: " + err.Error()))
+			return
+		}
+		_ = msg.Respond([]byte("OK"))
+	})
+	return err
+}
+
+func (p *impl) attachVolume(id int, key string) error {
+	if key == "" {
+		return errors.New("missing cache key")
+	}
+	m, found := p.ins.Machine(id)
+	if !found {
+		return fmt.Errorf("no VM running in slot %d", id)
+	}
+	path, err := p.volumes.acquire(id, key)
+	if err != nil {
+		return err
+	}
+	drive := path
+	if m.Cfg.JailerCfg != nil {
+		if drive, err = jailLink(id, path, jailCacheDrive); err != nil {
+			p.volumes.release(id)
+			return err
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := m.UpdateGuestDrive(ctx, CacheDriveID, drive); err != nil {
+		p.volumes.release(id)
+		return err
+	}
+	klog.InfoS("attached cache volume", "slot", id, "key", key, "path", path)
+	return nil
+}
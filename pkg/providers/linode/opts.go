@@ -19,18 +19,20 @@ package linode
 import (
 	"os"
 
+	"github.com/appscodelabs/gh-ci-webhook/pkg/secrets"
+
 	"github.com/spf13/pflag"
 	passgen "gomodules.xyz/password-generator"
 )
 
 type Options struct {
-	Token         string
-	Region        string
-	MachineType   string
-	Image         string
-	StackScriptID int
-	RootPassword  string
-	GitHubToken   string
+	Token         string `json:"token,omitempty"`
+	Region        string `json:"region,omitempty"`
+	MachineType   string `json:"machineType,omitempty"`
+	Image         string `json:"image,omitempty"`
+	StackScriptID int    `json:"stackScriptID,omitempty"`
+	RootPassword  string `json:"rootPassword,omitempty"`
+	GitHubToken   string `json:"-"`
 }
 
 var DefaultOptions = NewOptions()
@@ -48,10 +50,15 @@ func NewOptions() *Options {
 }
 
 func (opts *Options) AddFlags(fs *pflag.FlagSet) {
-	fs.StringVar(&opts.Token, "linode.token", opts.Token, "Linode api token")
+	secrets.StringVar(fs, &opts.Token, "linode.token", "Linode api token or secret reference")
 	fs.StringVar(&opts.Region, "linode.region", opts.Region, "Linode machine region")
 	fs.StringVar(&opts.MachineType, "linode.machine-type", opts.MachineType, "Linode machine type")
 	fs.StringVar(&opts.Image, "linode.image", opts.Image, "Linode image name")
 	fs.IntVar(&opts.StackScriptID, "linode.stack-script-id", opts.StackScriptID, "Linode StackScript ID")
-	fs.StringVar(&opts.RootPassword, "linode.root-password", opts.RootPassword, "Machine root password")
+	secrets.StringVar(fs, &opts.RootPassword, "linode.root-password", "Machine root password or secret reference")
+}
+
+// ResolveSecrets replaces secret references with their values.
+func (opts *Options) ResolveSecrets() error {
+	return secrets.ResolveAll(&opts.Token, &opts.RootPassword)
 }
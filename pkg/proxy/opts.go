@@ -0,0 +1,91 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+
+	"github.com/appscodelabs/gh-ci-webhook/pkg/netacl"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+type Options struct {
+	// Addr is the listen address of the caching proxy, disabled if empty
+	Addr string `json:"addr,omitempty"`
+	// Dir stores cached responses
+	Dir string `json:"dir,omitempty"`
+	// MaxSize bounds the size of the cache, least recently used responses are evicted first
+	MaxSize     resource.QuantityValue `json:"maxSize,omitempty"`
+	GoProxy     string                 `json:"goProxy,omitempty"`
+	NPMRegistry string                 `json:"npmRegistry,omitempty"`
+	// AllowedNetworks are the client networks allowed to use the proxy,
+	// the networks of the VMs if empty
+	AllowedNetworks []string `json:"allowedNetworks,omitempty"`
+}
+
+func NewOptions() *Options {
+	return &Options{
+		Dir:         "/var/lib/gh-ci/proxy",
+		MaxSize:     resource.QuantityValue{Quantity: resource.MustParse("20Gi")},
+		GoProxy:     "https://proxy.golang.org",
+		NPMRegistry: "https://registry.npmjs.org",
+	}
+}
+
+func (opts *Options) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&opts.Addr, "cache-proxy.addr", opts.Addr, "Listen address of the caching proxy for apt, Go modules and npm used by VMs, eg, :3128 (disabled if empty)")
+	fs.StringVar(&opts.Dir, "cache-proxy.dir", opts.Dir, "PATH to directory where caching proxy stores responses")
+	fs.Var(&opts.MaxSize, "cache-proxy.max-size", "Max size of the caching proxy cache")
+	fs.StringVar(&opts.GoProxy, "cache-proxy.goproxy", opts.GoProxy, "URL of the upstream Go module proxy")
+	fs.StringVar(&opts.NPMRegistry, "cache-proxy.npm-registry", opts.NPMRegistry, "URL of the upstream npm registry")
+	fs.StringSliceVar(&opts.AllowedNetworks, "cache-proxy.allowed-networks", opts.AllowedNetworks, "Client networks allowed to use the caching proxy, defaults to the networks of the VMs")
+}
+
+// Port returns the port the proxy listens on.
+func (opts *Options) Port() (string, error) {
+	_, port, err := net.SplitHostPort(opts.Addr)
+	return port, err
+}
+
+func (opts *Options) Validate() error {
+	if opts.Addr == "" {
+		return nil
+	}
+	if _, err := opts.Port(); err != nil {
+		return fmt.Errorf("invalid caching proxy address %q: %v", opts.Addr, err)
+	}
+	if opts.Dir == "" {
+		return fmt.Errorf("missing caching proxy dir")
+	}
+	if opts.MaxSize.Sign() <= 0 {
+		return fmt.Errorf("caching proxy max size must be positive")
+	}
+	for _, u := range []string{opts.GoProxy, opts.NPMRegistry} {
+		if _, err := url.ParseRequestURI(u); err != nil {
+			return errors.Wrapf(err, "invalid caching proxy upstream %q", u)
+		}
+	}
+	if _, err := netacl.Parse(opts.AllowedNetworks); err != nil {
+		return errors.Wrap(err, "invalid caching proxy allowed networks")
+	}
+	return nil
+}
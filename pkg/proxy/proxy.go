@@ -0,0 +1,388 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/appscodelabs/gh-ci-webhook/pkg/diskcache"
+	"github.com/appscodelabs/gh-ci-webhook/pkg/netacl"
+
+	"github.com/pkg/errors"
+	"k8s.io/klog/v2"
+)
+
+const (
+	KindApt = "apt"
+	KindGo  = "go"
+	KindNPM = "npm"
+
+	// GoProxyPath is the path of the Go module proxy, used as GOPROXY=http://<addr>/gomod
+	GoProxyPath = "/gomod/"
+	// NPMPath is the path of the npm registry, used as npm_config_registry=http://<addr>/npm/
+	NPMPath = "/npm/"
+)
+
+// hopHeaders are removed when requests and responses are forwarded.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Server is a caching proxy for package downloads of VMs. It is a forward
+// http proxy for apt and a reverse proxy for the Go module proxy and the npm
+// registry. Immutable downloads (debs, module zips, npm tarballs) are
+// cached on disk, everything else is passed through.
+type Server struct {
+	opts      *Options
+	acl       netacl.ACL
+	store     *diskcache.Store
+	goproxy   *url.URL
+	npm       *url.URL
+	transport http.RoundTripper
+	client    *http.Client
+
+	mu    sync.Mutex
+	kinds map[string]*KindStats
+}
+
+type KindStats struct {
+	Hits     int64   `json:"hits"`
+	Misses   int64   `json:"misses"`
+	Bypassed int64   `json:"bypassed"`
+	HitRate  float64 `json:"hitRate"`
+}
+
+type Status struct {
+	Store diskcache.Stats      `json:"store"`
+	Kinds map[string]KindStats `json:"kinds"`
+}
+
+func New(opts *Options) (*Server, error) {
+	acl, err := netacl.Parse(opts.AllowedNetworks)
+	if err != nil {
+		return nil, err
+	}
+	goproxy, err := url.Parse(strings.TrimSuffix(opts.GoProxy, "/"))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid Go module proxy")
+	}
+	npm, err := url.Parse(strings.TrimSuffix(opts.NPMRegistry, "/"))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid npm registry")
+	}
+	store, err := diskcache.Open(opts.Dir, opts.MaxSize.Value())
+	if err != nil {
+		return nil, err
+	}
+
+	// never send requests through a proxy configured in the host env
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+
+	return &Server{
+		opts:      opts,
+		acl:       acl,
+		store:     store,
+		goproxy:   goproxy,
+		npm:       npm,
+		transport: t,
+		client:    &http.Client{Transport: t},
+		kinds: map[string]*KindStats{
+			KindApt: {},
+			KindGo:  {},
+			KindNPM: {},
+		},
+	}, nil
+}
+
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	srv := &http.Server{
+		Addr:    s.opts.Addr,
+		Handler: s,
+	}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+	klog.InfoS("starting caching proxy", "addr", s.opts.Addr, "dir", s.opts.Dir, "maxSize", s.opts.MaxSize.String())
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Status returns the cache size and hit rates by kind of download.
+func (s *Server) Status() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := Status{
+		Store: s.store.Stats(),
+		Kinds: map[string]KindStats{},
+	}
+	for kind, ks := range s.kinds {
+		stats := *ks
+		if total := stats.Hits + stats.Misses; total > 0 {
+			stats.HitRate = float64(stats.Hits) / float64(total)
+		}
+		out.Kinds[kind] = stats
+	}
+	return out
+}
+
+func (s *Server) count(kind string, fn func(ks *KindStats)) {
+	s.mu.Lock()
+	fn(s.kinds[kind])
+	s.mu.Unlock()
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.acl.Allowed(r.RemoteAddr) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodConnect:
+		s.tunnel(w, r)
+	case r.URL.IsAbs():
+		if r.URL.Scheme != "http" {
+			http.Error(w, "unsupported scheme "+r.URL.Scheme, http.StatusBadRequest)
+			return
+		}
+		if r.Method == http.MethodGet && aptCacheable(r.URL.Path) {
+			s.serveCached(w, r, KindApt, r.URL)
+		} else {
+			s.forward(w, r, KindApt, r.URL, nil)
+		}
+	case strings.HasPrefix(r.URL.Path, GoProxyPath):
+		target, err := upstreamURL(s.goproxy, r, GoProxyPath)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if r.Method == http.MethodGet && goCacheable(target.Path) {
+			s.serveCached(w, r, KindGo, target)
+		} else {
+			s.forward(w, r, KindGo, target, nil)
+		}
+	case strings.HasPrefix(r.URL.Path, NPMPath):
+		target, err := upstreamURL(s.npm, r, NPMPath)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if r.Method == http.MethodGet && npmCacheable(target.Path) {
+			s.serveCached(w, r, KindNPM, target)
+		} else {
+			// package metadata points tarballs to the upstream registry
+			from := []byte(s.npm.String() + "/")
+			to := []byte("http://" + r.Host + NPMPath)
+			s.forward(w, r, KindNPM, target, func(data []byte) []byte {
+				return bytes.ReplaceAll(data, from, to)
+			})
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func upstreamURL(base *url.URL, r *http.Request, prefix string) (*url.URL, error) {
+	rest := strings.TrimPrefix(r.URL.EscapedPath(), prefix)
+	u, err := url.Parse(base.String() + "/" + rest)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = r.URL.RawQuery
+	return u, nil
+}
+
+func aptCacheable(p string) bool {
+	switch path.Ext(p) {
+	case ".deb", ".udeb", ".ddeb":
+		return true
+	}
+	return strings.Contains(p, "/by-hash/")
+}
+
+func goCacheable(p string) bool {
+	if !strings.Contains(p, "/@v/") {
+		return false
+	}
+	switch path.Ext(p) {
+	case ".info", ".mod", ".zip":
+		return true
+	}
+	return false
+}
+
+func npmCacheable(p string) bool {
+	return strings.Contains(p, "/-/") && strings.HasSuffix(p, ".tgz")
+}
+
+// serveCached serves target from the cache, downloading it on a miss.
+func (s *Server) serveCached(w http.ResponseWriter, r *http.Request, kind string, target *url.URL) {
+	key := target.String()
+	if f, found := s.store.Get(key); found {
+		defer f.Close()
+		s.count(kind, func(ks *KindStats) { ks.Hits++ })
+		w.Header().Set("X-Cache", "HIT")
+		http.ServeContent(w, r, path.Base(target.Path), time.Time{}, f)
+		return
+	}
+	s.count(kind, func(ks *KindStats) { ks.Misses++ })
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, key, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	copyHeader(w.Header(), resp.Header)
+	w.Header().Set("X-Cache", "MISS")
+	w.WriteHeader(resp.StatusCode)
+	if resp.StatusCode != http.StatusOK {
+		_, _ = io.Copy(w, resp.Body)
+		return
+	}
+
+	cw, err := s.store.Create()
+	if err != nil {
+		klog.ErrorS(err, "failed to create cache entry", "url", key)
+		_, _ = io.Copy(w, resp.Body)
+		return
+	}
+	n, err := io.Copy(io.MultiWriter(w, cw), resp.Body)
+	if err != nil || (resp.ContentLength >= 0 && n != resp.ContentLength) {
+		cw.Abort()
+		return
+	}
+	if err := cw.Commit(key); err != nil {
+		klog.ErrorS(err, "failed to cache response", "url", key)
+	}
+}
+
+// forward passes the request through to target. If rewrite is set, it is
+// applied to successful json responses.
+func (s *Server) forward(w http.ResponseWriter, r *http.Request, kind string, target *url.URL, rewrite func([]byte) []byte) {
+	s.count(kind, func(ks *KindStats) { ks.Bypassed++ })
+
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, target.String(), r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	copyHeader(req.Header, r.Header)
+	req.ContentLength = r.ContentLength
+	if rewrite != nil {
+		// let the transport decompress the response
+		req.Header.Del("Accept-Encoding")
+	}
+
+	resp, err := s.transport.RoundTrip(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	copyHeader(w.Header(), resp.Header)
+	if rewrite != nil && resp.StatusCode == http.StatusOK && strings.Contains(resp.Header.Get("Content-Type"), "json") {
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		data = rewrite(data)
+		w.Header().Del("Content-Encoding")
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(resp.StatusCode)
+		_, _ = w.Write(data)
+		return
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, resp.Body)
+}
+
+// tunnel connects https requests of apt and other clients to the target
+// host. These can not be cached.
+func (s *Server) tunnel(w http.ResponseWriter, r *http.Request) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "tunneling not supported", http.StatusInternalServerError)
+		return
+	}
+	dst, err := net.DialTimeout("tcp", r.Host, 10*time.Second)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	src, _, err := hj.Hijack()
+	if err != nil {
+		_ = dst.Close()
+		return
+	}
+	if _, err := src.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		_ = src.Close()
+		_ = dst.Close()
+		return
+	}
+	go func() {
+		defer dst.Close()
+		defer src.Close()
+		_, _ = io.Copy(dst, src)
+	}()
+	go func() {
+		defer dst.Close()
+		defer src.Close()
+		_, _ = io.Copy(src, dst)
+	}()
+}
+
+func copyHeader(dst, src http.Header) {
+	for k, vv := range src {
+		for _, v := range vv {
+			dst.Add(k, v)
+		}
+	}
+	for _, h := range hopHeaders {
+		dst.Del(h)
+	}
+}
@@ -0,0 +1,177 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package secrets
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+)
+
+// Provider looks up secrets by name.
+type Provider interface {
+	Name() string
+	Get(name string) (string, error)
+}
+
+var (
+	providers = map[string]Provider{}
+	mu        sync.Mutex
+)
+
+func init() {
+	MustRegister(fileProvider{})
+	MustRegister(envProvider{})
+	MustRegister(systemdProvider{})
+	MustRegister(execProvider{})
+}
+
+func Register(p Provider) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	_, found := providers[p.Name()]
+	if found {
+		return fmt.Errorf("secret provider for %q already registered", p.Name())
+	}
+	providers[p.Name()] = p
+	return nil
+}
+
+func MustRegister(p Provider) {
+	if err := Register(p); err != nil {
+		panic(err)
+	}
+}
+
+// Resolve returns the value of a secret reference, as <provider>:<name>,
+// eg, file:/etc/gh-ci/github-token, env:GITHUB_TOKEN, systemd:github-token
+// or exec:pass show gh-ci/github-token. Any other value is returned as is.
+// The value is redacted from output.
+func Resolve(ref string) (string, error) {
+	value := ref
+	if name, key, found := strings.Cut(ref, ":"); found {
+		mu.Lock()
+		p, ok := providers[name]
+		mu.Unlock()
+		if ok {
+			var err error
+			value, err = p.Get(key)
+			if err != nil {
+				return "", errors.Wrapf(err, "failed to read %s secret %s", name, key)
+			}
+		}
+	}
+	AddKnown(value)
+	return value, nil
+}
+
+// ResolveAll replaces secret references in place.
+func ResolveAll(refs ...*string) error {
+	for _, ref := range refs {
+		v, err := Resolve(*ref)
+		if err != nil {
+			return err
+		}
+		*ref = v
+	}
+	return nil
+}
+
+type fileProvider struct{}
+
+func (_ fileProvider) Name() string {
+	return "file"
+}
+
+func (_ fileProvider) Get(name string) (string, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+type envProvider struct{}
+
+func (_ envProvider) Name() string {
+	return "env"
+}
+
+func (_ envProvider) Get(name string) (string, error) {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("env var %s is not set", name)
+	}
+	return v, nil
+}
+
+// systemdProvider reads credentials passed via LoadCredential= or
+// SetCredentialEncrypted= in the unit file.
+// ref: https://systemd.io/CREDENTIALS/
+type systemdProvider struct{}
+
+func (_ systemdProvider) Name() string {
+	return "systemd"
+}
+
+func (_ systemdProvider) Get(name string) (string, error) {
+	dir, ok := os.LookupEnv("CREDENTIALS_DIRECTORY")
+	if !ok {
+		return "", errors.New("CREDENTIALS_DIRECTORY is not set, missing LoadCredential= in systemd unit")
+	}
+	if strings.ContainsRune(name, filepath.Separator) {
+		return "", fmt.Errorf("invalid credential name %q", name)
+	}
+	return fileProvider{}.Get(filepath.Join(dir, name))
+}
+
+// execProvider runs a shell command and uses its stdout as the secret, eg,
+// exec:vault kv get -field=token secret/gh-ci
+type execProvider struct{}
+
+func (_ execProvider) Name() string {
+	return "exec"
+}
+
+func (_ execProvider) Get(name string) (string, error) {
+	if strings.TrimSpace(name) == "" {
+		return "", errors.New("missing command")
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("/bin/sh", "-c", name)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", errors.Wrap(err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimRight(stdout.String(), "\r\n"), nil
+}
+
+// StringVar defines a flag for a secret value or reference. The current
+// value is not shown as default in the help output.
+func StringVar(fs *pflag.FlagSet, p *string, name, usage string) {
+	fs.StringVar(p, name, *p, usage)
+	fs.Lookup(name).DefValue = ""
+}
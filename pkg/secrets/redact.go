@@ -0,0 +1,151 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package secrets
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	Mask = "******"
+
+	// values shorter than this are not redacted, to keep output readable
+	minRedactLength = 6
+)
+
+var (
+	known    = map[string]bool{}
+	replacer *strings.Replacer
+	knownMu  sync.RWMutex
+
+	// Stdout is the standard output as it was before RedirectOutput, for
+	// secrets that are printed on purpose.
+	Stdout = os.Stdout
+)
+
+// AddKnown registers secret values that are redacted from output.
+func AddKnown(values ...string) {
+	knownMu.Lock()
+	defer knownMu.Unlock()
+
+	changed := false
+	for _, v := range values {
+		if len(v) >= minRedactLength && !known[v] {
+			known[v] = true
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+
+	// replace longer values first, in case a secret contains another one
+	list := make([]string, 0, len(known))
+	for v := range known {
+		list = append(list, v)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return len(list[i]) > len(list[j])
+	})
+	oldnew := make([]string, 0, 2*len(list))
+	for _, v := range list {
+		oldnew = append(oldnew, v, Mask)
+	}
+	replacer = strings.NewReplacer(oldnew...)
+}
+
+// Redact replaces known secret values in s.
+func Redact(s string) string {
+	knownMu.RLock()
+	r := replacer
+	knownMu.RUnlock()
+
+	if r == nil {
+		return s
+	}
+	return r.Replace(s)
+}
+
+// RedirectOutput redacts known secret values from everything written to
+// os.Stdout and os.Stderr, including klog output. The returned func
+// restores the original files and flushes pending output; it is also
+// called before klog exits the program, eg, on klog.Fatal.
+func RedirectOutput() (restore func(), err error) {
+	stdout, stderr := os.Stdout, os.Stderr
+
+	outDone, outW, err := redactFile(stdout)
+	if err != nil {
+		return nil, err
+	}
+	errDone, errW, err := redactFile(stderr)
+	if err != nil {
+		_ = outW.Close()
+		return nil, err
+	}
+	os.Stdout, os.Stderr = outW, errW
+
+	var once sync.Once
+	exit := klog.OsExit
+	restore = func() {
+		once.Do(func() {
+			klog.OsExit = exit
+			os.Stdout, os.Stderr = stdout, stderr
+			_ = outW.Close()
+			_ = errW.Close()
+			<-outDone
+			<-errDone
+		})
+	}
+	// klog.Fatal exits without returning to the caller of RedirectOutput,
+	// so the output is flushed before, as it has the reason of the exit
+	klog.OsExit = func(code int) {
+		restore()
+		exit(code)
+	}
+	return restore, nil
+}
+
+func redactFile(dst *os.File) (<-chan struct{}, *os.File, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer r.Close() //nolint:errcheck
+
+		br := bufio.NewReader(r)
+		for {
+			line, err := br.ReadString('\n')
+			if len(line) > 0 {
+				_, _ = io.WriteString(dst, Redact(line))
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return done, w, nil
+}